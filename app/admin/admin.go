@@ -0,0 +1,271 @@
+// Package admin serves the Envoy-style admin interface on the admin address,
+// separate from the listeners that carry proxied traffic.
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"seateam/cluster"
+	"seateam/config"
+	"seateam/logger"
+)
+
+var adminLog = logger.Get("admin")
+
+// ListenerStatus describes a running listener.
+type ListenerStatus struct {
+	Name    string
+	Address string
+}
+
+// Runtime is the part of the router the admin server inspects and controls.
+type Runtime interface {
+	Config() config.StaticBootstrap
+	Clusters() []*cluster.Cluster
+	Listeners() []ListenerStatus
+	DrainListeners()
+	// UpdateConfig validates and applies a change to the running config, and
+	// with persist also makes it to the config file.
+	UpdateConfig(mutate func(*config.StaticBootstrap) error, persist bool) error
+}
+
+// Info is the static part of /server_info.
+type Info struct {
+	Version            string
+	ServiceNode        string
+	ServiceCluster     string
+	CommandLineOptions map[string]interface{}
+}
+
+// Server states, as reported by /server_info and /ready.
+const (
+	StatePreInitializing = "PRE_INITIALIZING"
+	StateLive            = "LIVE"
+	StateDraining        = "DRAINING"
+)
+
+type Server struct {
+	runtime           Runtime
+	info              Info
+	started           time.Time
+	live              atomic.Bool
+	draining          atomic.Bool
+	healthCheckFailed atomic.Bool
+	mux               *http.ServeMux
+	help              []helpEntry
+}
+
+type helpEntry struct {
+	path        string
+	description string
+}
+
+func New(runtime Runtime, info Info) *Server {
+	s := &Server{
+		runtime: runtime,
+		info:    info,
+		started: time.Now(),
+		mux:     http.NewServeMux(),
+	}
+
+	s.mux.HandleFunc("/{$}", s.handleHelp)
+	s.Handle("/help", "print out list of admin commands", http.HandlerFunc(s.handleHelp))
+	s.Handle("/clusters", "upstream cluster status", http.HandlerFunc(s.handleClusters))
+	s.Handle("/config_dump", "dump current config, ?format=yaml for YAML", http.HandlerFunc(s.handleConfigDump))
+	s.Handle("/stats", "print server stats, ?filter=regex and ?format=json|prometheus", http.HandlerFunc(s.handleStats))
+	s.Handle("/stats/prometheus", "print server stats in prometheus format", http.HandlerFunc(s.handleStatsPrometheus))
+	s.Handle("/listeners", "print listener info, ?format=json for JSON", http.HandlerFunc(s.handleListeners))
+	s.Handle("/server_info", "print server version/status information", http.HandlerFunc(s.handleServerInfo))
+	s.Handle("/ready", "print server state, return 200 if LIVE, otherwise return 503", http.HandlerFunc(s.handleReady))
+	s.Handle("/healthcheck/fail", "cause the server to fail health checks", postOnly(s.handleHealthCheckFail))
+	s.Handle("/healthcheck/ok", "cause the server to pass health checks", postOnly(s.handleHealthCheckOK))
+	s.Handle("/logging", "query/change logging levels", postOnly(s.handleLogging))
+	s.Handle("/drain_listeners", "drain listeners", postOnly(s.handleDrainListeners))
+	return s
+}
+
+// Handle adds a page to the admin server and lists it on the help page.
+func (s *Server) Handle(pattern, description string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+	s.help = append(s.help, helpEntry{path: pattern, description: description})
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// SetLive marks the server as having applied its first config.
+func (s *Server) SetLive() {
+	s.live.Store(true)
+}
+
+// SetDraining marks the server as shutting down.
+func (s *Server) SetDraining() {
+	s.draining.Store(true)
+}
+
+// HealthCheckFailed reports whether /healthcheck/fail has been called, so the
+// router's own health check can take it out of rotation.
+func (s *Server) HealthCheckFailed() bool {
+	return s.healthCheckFailed.Load()
+}
+
+func (s *Server) State() string {
+	switch {
+	case s.draining.Load() || s.healthCheckFailed.Load():
+		return StateDraining
+	case s.live.Load():
+		return StateLive
+	default:
+		return StatePreInitializing
+	}
+}
+
+func postOnly(handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "This admin endpoint requires POST", http.StatusMethodNotAllowed)
+			return
+		}
+		handler(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		adminLog.Errorf("Failed to write JSON response: %v", err)
+	}
+}
+
+func wantsJSON(r *http.Request) bool {
+	return r.URL.Query().Get("format") == "json"
+}
+
+func (s *Server) handleHelp(w http.ResponseWriter, r *http.Request) {
+	entries := append([]helpEntry(nil), s.help...)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].path < entries[j].path })
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "admin commands are:")
+	for _, entry := range entries {
+		fmt.Fprintf(w, "  %s: %s\n", entry.path, entry.description)
+	}
+}
+
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	state := s.State()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if state != StateLive {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	fmt.Fprintln(w, state)
+}
+
+func (s *Server) handleHealthCheckFail(w http.ResponseWriter, r *http.Request) {
+	s.healthCheckFailed.Store(true)
+	adminLog.Warnf("Health checks set to fail")
+	fmt.Fprintln(w, "OK")
+}
+
+func (s *Server) handleHealthCheckOK(w http.ResponseWriter, r *http.Request) {
+	s.healthCheckFailed.Store(false)
+	adminLog.Infof("Health checks set to pass")
+	fmt.Fprintln(w, "OK")
+}
+
+func (s *Server) handleDrainListeners(w http.ResponseWriter, r *http.Request) {
+	s.SetDraining()
+	s.runtime.DrainListeners()
+	fmt.Fprintln(w, "OK")
+}
+
+func (s *Server) handleServerInfo(w http.ResponseWriter, r *http.Request) {
+	uptime := fmt.Sprintf("%ds", int(time.Since(s.started).Seconds()))
+	writeJSON(w, map[string]interface{}{
+		"version":              s.info.Version,
+		"state":                s.State(),
+		"hot_restart_version":  "disabled",
+		"uptime_current_epoch": uptime,
+		"uptime_all_epochs":    uptime,
+		"command_line_options": s.info.CommandLineOptions,
+		"node": map[string]string{
+			"id":      s.info.ServiceNode,
+			"cluster": s.info.ServiceCluster,
+		},
+	})
+}
+
+func (s *Server) handleListeners(w http.ResponseWriter, r *http.Request) {
+	listeners := s.runtime.Listeners()
+	if wantsJSON(r) {
+		statuses := make([]interface{}, 0, len(listeners))
+		for _, listener := range listeners {
+			statuses = append(statuses, map[string]interface{}{
+				"name":          listener.Name,
+				"local_address": socketAddressJSON(listener.Address),
+			})
+		}
+		writeJSON(w, map[string]interface{}{"listener_statuses": statuses})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, listener := range listeners {
+		fmt.Fprintf(w, "%s::%s\n", listener.Name, listener.Address)
+	}
+}
+
+// handleLogging lists the loggers, or changes levels: ?level=debug changes all
+// of them and ?<logger>=debug changes one.
+func (s *Server) handleLogging(w http.ResponseWriter, r *http.Request) {
+	for name, values := range r.URL.Query() {
+		level, err := logger.ParseLevel(values[0])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if name == "level" {
+			logger.SetLevel(level)
+			continue
+		}
+		found := false
+		for _, l := range logger.Loggers() {
+			if l.Name() == name {
+				l.SetLevel(level)
+				found = true
+			}
+		}
+		if !found {
+			http.Error(w, fmt.Sprintf("unknown logger %q", name), http.StatusNotFound)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "active loggers:")
+	for _, l := range logger.Loggers() {
+		fmt.Fprintf(w, "  %s: %s\n", l.Name(), l.Level())
+	}
+}
+
+func socketAddressJSON(address string) map[string]interface{} {
+	host, port := address, ""
+	if i := strings.LastIndex(address, ":"); i >= 0 {
+		host, port = strings.Trim(address[:i], "[]"), address[i+1:]
+	}
+	var portValue int
+	fmt.Sscan(port, &portValue)
+	return map[string]interface{}{
+		"socket_address": map[string]interface{}{"address": host, "port_value": portValue},
+	}
+}
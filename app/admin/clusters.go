@@ -0,0 +1,143 @@
+package admin
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+
+	"gopkg.in/yaml.v3"
+)
+
+type hostStatus struct {
+	Address      map[string]interface{} `json:"address"`
+	Stats        []hostStat             `json:"stats"`
+	HealthStatus map[string]string      `json:"health_status"`
+	Weight       int                    `json:"weight"`
+}
+
+type hostStat struct {
+	Name  string `json:"name"`
+	Value int    `json:"value"`
+}
+
+type clusterStatus struct {
+	Name         string       `json:"name"`
+	LbPolicy     string       `json:"lb_policy,omitempty"`
+	HostStatuses []hostStatus `json:"host_statuses"`
+}
+
+// handleClusters prints every endpoint of every cluster in Envoy's
+// cluster::host::stat::value format, or as JSON with ?format=json.
+func (s *Server) handleClusters(w http.ResponseWriter, r *http.Request) {
+	var statuses []clusterStatus
+	for _, c := range s.runtime.Clusters() {
+		status := clusterStatus{Name: c.Name, LbPolicy: c.LbPolicy, HostStatuses: []hostStatus{}}
+		activeRequests := c.LoadBalancer.ActiveRequests()
+		for _, endpoint := range c.LoadBalancer.Endpoints() {
+			edsHealthStatus := "HEALTHY"
+			if endpoint.Draining {
+				edsHealthStatus = "DRAINING"
+			}
+			status.HostStatuses = append(status.HostStatuses, hostStatus{
+				Address:      socketAddressJSON(endpoint.Address),
+				Stats:        []hostStat{{Name: "rq_active", Value: activeRequests[endpoint.Address]}},
+				HealthStatus: map[string]string{"eds_health_status": edsHealthStatus},
+				Weight:       endpoint.Weight,
+			})
+		}
+		statuses = append(statuses, status)
+	}
+
+	if wantsJSON(r) {
+		if statuses == nil {
+			statuses = []clusterStatus{}
+		}
+		writeJSON(w, map[string]interface{}{"cluster_statuses": statuses})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, status := range statuses {
+		fmt.Fprintf(w, "%s::observability_name::%s\n", status.Name, status.Name)
+		if status.LbPolicy != "" {
+			fmt.Fprintf(w, "%s::lb_policy::%s\n", status.Name, status.LbPolicy)
+		}
+		for _, host := range status.HostStatuses {
+			address := host.Address["socket_address"].(map[string]interface{})
+			prefix := fmt.Sprintf("%s::%s:%d", status.Name, address["address"], address["port_value"])
+			for _, stat := range host.Stats {
+				fmt.Fprintf(w, "%s::%s::%d\n", prefix, stat.Name, stat.Value)
+			}
+			fmt.Fprintf(w, "%s::health_flags::%s\n", prefix, healthFlags(host.HealthStatus["eds_health_status"]))
+			fmt.Fprintf(w, "%s::weight::%d\n", prefix, host.Weight)
+		}
+	}
+}
+
+func healthFlags(edsHealthStatus string) string {
+	if edsHealthStatus == "HEALTHY" {
+		return "healthy"
+	}
+	return "/failed_eds_health"
+}
+
+// handleConfigDump prints the config the router is running with, after command
+// line overrides, as JSON or with ?format=yaml as YAML. Secrets are redacted.
+func (s *Server) handleConfigDump(w http.ResponseWriter, r *http.Request) {
+	var node yaml.Node
+	if err := node.Encode(s.runtime.Config()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	redactSecrets(&node)
+	if r.URL.Query().Get("format") == "yaml" {
+		data, err := yaml.Marshal(&node)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/yaml")
+		w.Write(data)
+		return
+	}
+
+	// Going through YAML keeps the field names of the config file.
+	var dump interface{}
+	if err := node.Decode(&dump); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, dump)
+}
+
+// redacted replaces secrets in the config dump, as in Envoy's.
+const redacted = "[redacted]"
+
+// secretFields are the fields holding secrets, by the field they are in.
+var secretFields = map[string][]string{
+	"private_key":           {"inline_string"},
+	"consul_cluster_config": {"token"},
+}
+
+// redactSecrets replaces the values of secretFields in node, which the admin
+// interface would otherwise hand to anyone who can reach it.
+func redactSecrets(node *yaml.Node) {
+	for _, child := range node.Content {
+		redactSecrets(child)
+	}
+	if node.Kind != yaml.MappingNode {
+		return
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		fields, ok := secretFields[node.Content[i].Value]
+		value := node.Content[i+1]
+		if !ok || value.Kind != yaml.MappingNode {
+			continue
+		}
+		for j := 0; j+1 < len(value.Content); j += 2 {
+			if slices.Contains(fields, value.Content[j].Value) {
+				value.Content[j+1] = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: redacted}
+			}
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"seateam/config"
+)
+
+// EnableManagementAPI adds the REST routes under /api/v1 that change clusters
+// and endpoints at runtime. Every request must carry token as a bearer token.
+// Changes go through the same validation and apply path as a config reload;
+// with ?persist=true they are also written to the config file.
+func (s *Server) EnableManagementAPI(token string) {
+	handle := func(pattern, description string, handler http.HandlerFunc) {
+		s.Handle(pattern, description, requireToken(token, handler))
+	}
+
+	handle("GET /api/v1/clusters", "list clusters with their endpoints, weights and health status", s.handleListClusters)
+	handle("POST /api/v1/clusters/{cluster}/endpoints", "add an endpoint, body {\"address\", \"port_value\", \"load_balancing_weight\"}", s.handleAddEndpoint)
+	handle("DELETE /api/v1/clusters/{cluster}/endpoints/{endpoint}", "remove an endpoint given as host:port", s.handleRemoveEndpoint)
+	handle("PUT /api/v1/clusters/{cluster}/endpoints/{endpoint}/weight", "set an endpoint's weight, body {\"load_balancing_weight\"}", s.handleSetWeight)
+	handle("POST /api/v1/clusters/{cluster}/endpoints/{endpoint}/drain", "stop sending new requests to an endpoint", s.handleSetHealthStatus("DRAINING"))
+	handle("POST /api/v1/clusters/{cluster}/endpoints/{endpoint}/undrain", "send requests to a drained endpoint again", s.handleSetHealthStatus(""))
+	handle("PUT /api/v1/clusters/{cluster}/lb_policy", "switch a cluster's lb_policy, body {\"lb_policy\"}", s.handleSetLbPolicy)
+}
+
+func requireToken(token string, handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			writeError(w, http.StatusUnauthorized, errors.New("missing or invalid bearer token"))
+			return
+		}
+		handler(w, r)
+	})
+}
+
+type endpointResource struct {
+	Address             string            `json:"address"`
+	PortValue           int               `json:"port_value"`
+	LoadBalancingWeight int               `json:"load_balancing_weight"`
+	HealthStatus        string            `json:"health_status"`
+	RqActive            int               `json:"rq_active"`
+	Metadata            map[string]string `json:"metadata,omitempty"`
+}
+
+type clusterResource struct {
+	Name      string             `json:"name"`
+	LbPolicy  string             `json:"lb_policy"`
+	Endpoints []endpointResource `json:"endpoints"`
+}
+
+func (s *Server) handleListClusters(w http.ResponseWriter, r *http.Request) {
+	clusters := []clusterResource{}
+	for _, c := range s.runtime.Clusters() {
+		resource := clusterResource{Name: c.Name, LbPolicy: c.LbPolicy, Endpoints: []endpointResource{}}
+		if resource.LbPolicy == "" {
+			resource.LbPolicy = "ROUND_ROBIN"
+		}
+		activeRequests := c.LoadBalancer.ActiveRequests()
+		for _, endpoint := range c.LoadBalancer.Endpoints() {
+			address := socketAddressJSON(endpoint.Address)["socket_address"].(map[string]interface{})
+			healthStatus := "HEALTHY"
+			if endpoint.Draining {
+				healthStatus = "DRAINING"
+			}
+			resource.Endpoints = append(resource.Endpoints, endpointResource{
+				Address:             address["address"].(string),
+				PortValue:           address["port_value"].(int),
+				LoadBalancingWeight: endpoint.Weight,
+				HealthStatus:        healthStatus,
+				RqActive:            activeRequests[endpoint.Address],
+				Metadata:            endpoint.Metadata,
+			})
+		}
+		clusters = append(clusters, resource)
+	}
+	writeJSON(w, map[string]interface{}{"clusters": clusters})
+}
+
+func (s *Server) handleAddEndpoint(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Address             string `json:"address"`
+		PortValue           int    `json:"port_value"`
+		LoadBalancingWeight int    `json:"load_balancing_weight"`
+	}
+	if !decodeBody(w, r, &body) {
+		return
+	}
+	var endpoint config.LbEndpoint
+	endpoint.Endpoint.Address.SocketAddress = config.SocketAddress{Address: body.Address, PortValue: body.PortValue}
+	endpoint.LoadBalancingWeight = body.LoadBalancingWeight
+
+	s.updateCluster(w, r, http.StatusCreated, func(c *config.Cluster) error {
+		return c.AddEndpoint(endpoint)
+	})
+}
+
+func (s *Server) handleRemoveEndpoint(w http.ResponseWriter, r *http.Request) {
+	s.updateCluster(w, r, http.StatusOK, func(c *config.Cluster) error {
+		return c.RemoveEndpoint(r.PathValue("endpoint"))
+	})
+}
+
+func (s *Server) handleSetWeight(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		LoadBalancingWeight int `json:"load_balancing_weight"`
+	}
+	if !decodeBody(w, r, &body) {
+		return
+	}
+	s.updateEndpoint(w, r, func(endpoint *config.LbEndpoint) {
+		endpoint.LoadBalancingWeight = body.LoadBalancingWeight
+	})
+}
+
+func (s *Server) handleSetHealthStatus(healthStatus string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.updateEndpoint(w, r, func(endpoint *config.LbEndpoint) {
+			endpoint.HealthStatus = healthStatus
+		})
+	}
+}
+
+func (s *Server) handleSetLbPolicy(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		LbPolicy string `json:"lb_policy"`
+	}
+	if !decodeBody(w, r, &body) {
+		return
+	}
+	s.updateCluster(w, r, http.StatusOK, func(c *config.Cluster) error {
+		c.LbPolicy = body.LbPolicy
+		return nil
+	})
+}
+
+func (s *Server) updateEndpoint(w http.ResponseWriter, r *http.Request, mutate func(*config.LbEndpoint)) {
+	s.updateCluster(w, r, http.StatusOK, func(c *config.Cluster) error {
+		endpoint, err := c.Endpoint(r.PathValue("endpoint"))
+		if err != nil {
+			return err
+		}
+		mutate(endpoint)
+		return nil
+	})
+}
+
+// updateCluster applies mutate to the cluster named in the path and answers
+// with the cluster as it is running afterwards.
+func (s *Server) updateCluster(w http.ResponseWriter, r *http.Request, status int, mutate func(*config.Cluster) error) {
+	name := r.PathValue("cluster")
+	persist := r.URL.Query().Get("persist") == "true"
+	err := s.runtime.UpdateConfig(func(b *config.StaticBootstrap) error {
+		c, err := b.Cluster(name)
+		if err != nil {
+			return err
+		}
+		return mutate(c)
+	}, persist)
+
+	var validationErrors config.ValidationErrors
+	switch {
+	case errors.Is(err, config.ErrNotFound):
+		writeError(w, http.StatusNotFound, err)
+	case errors.Is(err, config.ErrExists):
+		writeError(w, http.StatusConflict, err)
+	case errors.As(err, &validationErrors):
+		writeError(w, http.StatusBadRequest, err)
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err)
+	default:
+		adminLog.Infof("%s %s applied (persist=%t)", r.Method, r.URL.Path, persist)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		s.handleListClusters(w, r)
+	}
+}
+
+func decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %v", err))
+		return false
+	}
+	return true
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,84 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func managementRequest(s *Server, method, target, token, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+	return rr
+}
+
+func TestManagementAPIRequiresToken(t *testing.T) {
+	s, _ := newTestServer(t)
+	if rr := managementRequest(s, "GET", "/api/v1/clusters", "secret", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("expected the management API to be off without a token, got %d", rr.Code)
+	}
+
+	s.EnableManagementAPI("secret")
+	if rr := managementRequest(s, "GET", "/api/v1/clusters", "", ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a token, got %d", rr.Code)
+	}
+	if rr := managementRequest(s, "GET", "/api/v1/clusters", "wrong", ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 with the wrong token, got %d", rr.Code)
+	}
+	if rr := managementRequest(s, "GET", "/api/v1/clusters", "secret", ""); rr.Code != http.StatusOK {
+		t.Errorf("expected 200 with the token, got %d", rr.Code)
+	}
+}
+
+func TestManagementAPIUpdatesEndpoints(t *testing.T) {
+	s, runtime := newTestServer(t)
+	s.EnableManagementAPI("secret")
+	lb := runtime.Clusters()[0].LoadBalancer
+
+	steps := []struct {
+		method, target, body string
+		code                 int
+	}{
+		{"POST", "/api/v1/clusters/some_service/endpoints", `{"address": "127.0.0.1", "port_value": 1235, "load_balancing_weight": 3}`, http.StatusCreated},
+		{"POST", "/api/v1/clusters/some_service/endpoints", `{"address": "127.0.0.1", "port_value": 1235}`, http.StatusConflict},
+		{"PUT", "/api/v1/clusters/some_service/endpoints/127.0.0.1:1234/weight", `{"load_balancing_weight": 2}`, http.StatusOK},
+		{"PUT", "/api/v1/clusters/some_service/endpoints/127.0.0.1:1234/weight", `{"load_balancing_weight": -1}`, http.StatusBadRequest},
+		{"POST", "/api/v1/clusters/some_service/endpoints/127.0.0.1:1234/drain", "", http.StatusOK},
+		{"POST", "/api/v1/clusters/other_service/endpoints/127.0.0.1:1234/drain", "", http.StatusNotFound},
+	}
+	for _, step := range steps {
+		if rr := managementRequest(s, step.method, step.target, "secret", step.body); rr.Code != step.code {
+			t.Fatalf("%s %s: expected %d, got %d: %s", step.method, step.target, step.code, rr.Code, rr.Body.String())
+		}
+	}
+
+	var list struct {
+		Clusters []clusterResource `json:"clusters"`
+	}
+	if err := json.Unmarshal(managementRequest(s, "GET", "/api/v1/clusters", "secret", "").Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	endpoints := list.Clusters[0].Endpoints
+	if len(endpoints) != 2 || endpoints[0].LoadBalancingWeight != 2 || endpoints[0].HealthStatus != "DRAINING" || endpoints[1].LoadBalancingWeight != 3 {
+		t.Errorf("unexpected endpoints: %+v", endpoints)
+	}
+	if runtime.Clusters()[0].LoadBalancer != lb {
+		t.Errorf("expected endpoint changes to keep the cluster's load balancer")
+	}
+	if endpoint := lb.NextEndpoint(); endpoint != "127.0.0.1:1235" {
+		t.Errorf("expected the draining endpoint to be skipped, got %s", endpoint)
+	}
+
+	if rr := managementRequest(s, "PUT", "/api/v1/clusters/some_service/lb_policy", "secret", `{"lb_policy": "LEAST_CONNECTIONS"}`); rr.Code != http.StatusOK {
+		t.Fatalf("expected lb_policy change to succeed, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if c := runtime.Clusters()[0]; c.LbPolicy != "LEAST_CONNECTIONS" || c.LoadBalancer == lb {
+		t.Errorf("expected a new least connections load balancer, got %s", c.LbPolicy)
+	}
+}
@@ -0,0 +1,84 @@
+package admin
+
+import (
+	"fmt"
+	"net/http"
+
+	"seateam/discovery"
+)
+
+// EnableRegistrationAPI adds the routes under /api/v1/registrations that
+// backends of REGISTRY clusters use to register themselves in registry and
+// keep their registration alive. Every request must carry token as a bearer
+// token, which is separate from the management API's so backends cannot
+// change anything else. With ?persist=true a registration survives a restart.
+func (s *Server) EnableRegistrationAPI(token string, registry *discovery.Registry) {
+	handle := func(pattern, description string, handler http.HandlerFunc) {
+		s.Handle(pattern, description, requireToken(token, handler))
+	}
+
+	handle("GET /api/v1/registrations", "list the registered backends", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{"registrations": registry.Registrations()})
+	})
+	handle("POST /api/v1/registrations", "register a backend, body {\"cluster\", \"address\", \"port\", \"weight\", \"metadata\", \"ttl\"}", func(w http.ResponseWriter, r *http.Request) {
+		s.handleRegister(w, r, registry)
+	})
+	handle("PUT /api/v1/registrations/{id}/heartbeat", "keep a registration for another TTL", func(w http.ResponseWriter, r *http.Request) {
+		registration, err := registry.Heartbeat(r.PathValue("id"))
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeJSON(w, registration)
+	})
+	handle("DELETE /api/v1/registrations/{id}", "deregister a backend", func(w http.ResponseWriter, r *http.Request) {
+		if err := registry.Deregister(r.PathValue("id")); err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request, registry *discovery.Registry) {
+	var body struct {
+		Cluster  string             `json:"cluster"`
+		Address  string             `json:"address"`
+		Port     int                `json:"port"`
+		Weight   int                `json:"weight"`
+		Metadata map[string]string  `json:"metadata"`
+		TTL      discovery.Duration `json:"ttl"`
+	}
+	if !decodeBody(w, r, &body) {
+		return
+	}
+
+	// Registering for a cluster that is not there, or whose endpoints come
+	// from elsewhere, would silently do nothing.
+	found := false
+	for _, c := range s.runtime.Clusters() {
+		found = found || (c.Name == body.Cluster && c.Type == "REGISTRY")
+	}
+	if !found {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no REGISTRY cluster %q", body.Cluster))
+		return
+	}
+
+	registration, err := registry.Register(discovery.Registration{
+		Cluster:  body.Cluster,
+		Address:  body.Address,
+		Port:     body.Port,
+		Weight:   body.Weight,
+		Metadata: body.Metadata,
+		TTL:      body.TTL,
+		Persist:  r.URL.Query().Get("persist") == "true",
+	})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	adminLog.Infof("Registered %s in cluster %q as %s", registration.Endpoint(), registration.Cluster, registration.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, registration)
+}
@@ -0,0 +1,52 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"seateam/config"
+	"seateam/discovery"
+)
+
+func TestRegistrationAPI(t *testing.T) {
+	s, runtime := newTestServer(t)
+	registryCluster := config.Cluster{Name: "adhoc", Type: "REGISTRY"}
+	if err := runtime.clusters.Apply(append(runtime.config.StaticResources.Clusters, registryCluster)); err != nil {
+		t.Fatal(err)
+	}
+	s.EnableRegistrationAPI("backend-secret", discovery.DefaultRegistry)
+
+	if rr := managementRequest(s, "POST", "/api/v1/registrations", "", `{}`); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a token, got %d", rr.Code)
+	}
+	if rr := managementRequest(s, "POST", "/api/v1/registrations", "backend-secret", `{"cluster": "some_service", "address": "10.0.0.1", "port": 8080}`); rr.Code != http.StatusNotFound {
+		t.Errorf("expected registering in a STATIC cluster to fail with 404, got %d", rr.Code)
+	}
+	if rr := managementRequest(s, "POST", "/api/v1/registrations", "backend-secret", `{"cluster": "adhoc", "address": "10.0.0.1", "port": 0}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected an invalid port to fail with 400, got %d", rr.Code)
+	}
+
+	rr := managementRequest(s, "POST", "/api/v1/registrations", "backend-secret", `{"cluster": "adhoc", "address": "10.0.0.1", "port": 8080, "weight": 2, "ttl": "1m"}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body)
+	}
+	var registration discovery.Registration
+	if err := json.NewDecoder(rr.Body).Decode(&registration); err != nil {
+		t.Fatal(err)
+	}
+	if registration.ID == "" || registration.TTL != discovery.Duration(time.Minute) {
+		t.Errorf("expected an ID and the requested TTL, got %+v", registration)
+	}
+
+	if rr := managementRequest(s, "PUT", "/api/v1/registrations/"+registration.ID+"/heartbeat", "backend-secret", ""); rr.Code != http.StatusOK {
+		t.Errorf("expected the heartbeat to succeed, got %d", rr.Code)
+	}
+	if rr := managementRequest(s, "DELETE", "/api/v1/registrations/"+registration.ID, "backend-secret", ""); rr.Code != http.StatusNoContent {
+		t.Errorf("expected deregistering to succeed, got %d", rr.Code)
+	}
+	if rr := managementRequest(s, "PUT", "/api/v1/registrations/"+registration.ID+"/heartbeat", "backend-secret", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("expected a heartbeat for a removed registration to fail with 404, got %d", rr.Code)
+	}
+}
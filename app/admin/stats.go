@@ -0,0 +1,41 @@
+package admin
+
+import (
+	"net/http"
+	"regexp"
+
+	"seateam/stats"
+)
+
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("format") == "prometheus" {
+		s.handleStatsPrometheus(w, r)
+		return
+	}
+
+	var filter *regexp.Regexp
+	if pattern := r.URL.Query().Get("filter"); pattern != "" {
+		var err error
+		if filter, err = regexp.Compile(pattern); err != nil {
+			http.Error(w, "Invalid regex: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	values, err := stats.Values(filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		stats.WriteJSON(w, values)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	stats.WriteText(w, values)
+}
+
+func (s *Server) handleStatsPrometheus(w http.ResponseWriter, r *http.Request) {
+	stats.PrometheusHandler().ServeHTTP(w, r)
+}
@@ -9,9 +9,27 @@ import (
 
 // HealthCheckHandler handles health check requests.
 func HealthCheckHandler(w http.ResponseWriter, r *http.Request) {
-    // Need to fill in more check logic once the router is more coded
+    writeHealth(w, false)
+}
+
+// NewHealthCheckHandler returns a health check handler that reports unhealthy
+// while failed returns true, so the router can be taken out of rotation before
+// it is shut down.
+func NewHealthCheckHandler(failed func() bool) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        writeHealth(w, failed())
+    }
+}
+
+func writeHealth(w http.ResponseWriter, failed bool) {
     healthStatus := "healthy"
     message := "The proxy/router is operating normally"
+    statusCode := http.StatusOK
+    if failed {
+        healthStatus = "unhealthy"
+        message = "The proxy/router has been set to fail health checks"
+        statusCode = http.StatusServiceUnavailable
+    }
 
     // Create a response JSON
     response := struct {
@@ -31,7 +49,7 @@ func HealthCheckHandler(w http.ResponseWriter, r *http.Request) {
 
     // Set the Content-Type header and write the response
     w.Header().Set("Content-Type", "application/json")
-    w.WriteHeader(http.StatusOK)
+    w.WriteHeader(statusCode)
     w.Write(responseJSON)
 }
 
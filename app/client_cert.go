@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"seateam/config"
+)
+
+// forwardedClientCertHeader carries the details of client certificates to
+// upstreams, as Envoy's x-forwarded-client-cert.
+const forwardedClientCertHeader = "X-Forwarded-Client-Cert"
+
+// setForwardedClientCert applies forward_client_cert_details to the request:
+// it keeps, extends, replaces or removes the x-forwarded-client-cert header,
+// depending on the mode and whether the client presented a certificate.
+func (sr *Router) setForwardedClientCert(r *http.Request) {
+	mtls := r.TLS != nil && len(r.TLS.PeerCertificates) > 0
+	switch {
+	case sr.ForwardClientCertDetails == config.AlwaysForwardOnly:
+	case sr.ForwardClientCertDetails == config.ForwardOnly && mtls:
+	case sr.ForwardClientCertDetails == config.AppendForward && mtls:
+		element := clientCertElement(r.TLS.PeerCertificates, sr.SetCurrentClientCertDetails)
+		if forwarded := r.Header.Values(forwardedClientCertHeader); len(forwarded) > 0 {
+			element = strings.Join(forwarded, ",") + "," + element
+		}
+		r.Header.Set(forwardedClientCertHeader, element)
+	case sr.ForwardClientCertDetails == config.SanitizeSet && mtls:
+		r.Header.Set(forwardedClientCertHeader, clientCertElement(r.TLS.PeerCertificates, sr.SetCurrentClientCertDetails))
+	default:
+		r.Header.Del(forwardedClientCertHeader)
+	}
+}
+
+// clientCertElement describes the client's certificate chain as one element
+// of x-forwarded-client-cert: the hash of the leaf and the fields details
+// asks for, separated by semicolons.
+func clientCertElement(chain []*x509.Certificate, details config.SetCurrentClientCertDetails) string {
+	leaf := chain[0]
+	hash := sha256.Sum256(leaf.Raw)
+	fields := []string{"Hash=" + hex.EncodeToString(hash[:])}
+	if details.Cert {
+		fields = append(fields, `Cert="`+url.QueryEscape(string(encodePEM(leaf)))+`"`)
+	}
+	if details.Chain {
+		var pems []byte
+		for _, certificate := range chain {
+			pems = append(pems, encodePEM(certificate)...)
+		}
+		fields = append(fields, `Chain="`+url.QueryEscape(string(pems))+`"`)
+	}
+	if details.Subject {
+		fields = append(fields, `Subject="`+strings.ReplaceAll(leaf.Subject.String(), `"`, `\"`)+`"`)
+	}
+	if details.URI {
+		for _, uri := range leaf.URIs {
+			fields = append(fields, "URI="+uri.String())
+		}
+	}
+	if details.DNS {
+		for _, name := range leaf.DNSNames {
+			fields = append(fields, "DNS="+name)
+		}
+	}
+	return strings.Join(fields, ";")
+}
+
+func encodePEM(certificate *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw})
+}
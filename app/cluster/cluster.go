@@ -0,0 +1,292 @@
+// Package cluster turns cluster definitions from the config into upstream
+// clusters, each with its own load balancer and HTTP client.
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"seateam/config"
+	"seateam/discovery"
+	"seateam/loadbalancer"
+	"seateam/transport"
+)
+
+// defaultConnectTimeout matches Envoy's default when connect_timeout is left out.
+const defaultConnectTimeout = 5 * time.Second
+
+type Cluster struct {
+	Name           string
+	Type           string
+	ConnectTimeout time.Duration
+	LbPolicy       string
+	LoadBalancer   loadbalancer.LoadBalancer
+	Client         *http.Client
+	Stats          *Stats
+
+	config   config.Cluster
+	locality config.Locality
+	dialer   *net.Dialer
+	// tls starts TLS on connections to the endpoints when the cluster has a
+	// transport socket.
+	tls *transport.ClientConfig
+	// http2 holds the connections of a cluster whose requests go over
+	// HTTP/2.
+	http2 *http2ConnPool
+	// stopDiscovery stops the service discovery of a cluster whose endpoints
+	// are discovered.
+	stopDiscovery context.CancelFunc
+}
+
+// New builds cluster c for a router running in locality.
+func New(c config.Cluster, locality config.Locality) (*Cluster, error) {
+	connectTimeout := defaultConnectTimeout
+	if c.ConnectTimeout != "" {
+		var err error
+		if connectTimeout, err = time.ParseDuration(c.ConnectTimeout); err != nil {
+			return nil, fmt.Errorf("cluster %q: invalid connect_timeout %q", c.Name, c.ConnectTimeout)
+		}
+	}
+
+	// Discovered endpoints only go to the load balancer once they are found.
+	serviceDiscovery, err := discovery.New(c, locality)
+	if err != nil {
+		return nil, err
+	}
+	var endpoints []loadbalancer.Endpoint
+	if serviceDiscovery == nil {
+		endpoints = lbEndpoints(c)
+	}
+
+	var tlsConfig *transport.ClientConfig
+	if c.TransportSocket != nil {
+		tlsContext := c.TransportSocket.TypedConfig
+		if c.Http2ProtocolOptions != nil && len(tlsContext.CommonTlsContext.AlpnProtocols) == 0 {
+			tlsContext.CommonTlsContext.AlpnProtocols = []string{config.AlpnHTTP2}
+		}
+		if tlsConfig, err = transport.NewClientConfig(c.Name, tlsContext); err != nil {
+			return nil, fmt.Errorf("cluster %q: transport_socket: %v", c.Name, err)
+		}
+	}
+
+	cluster := &Cluster{
+		Name:           c.Name,
+		Type:           c.Type,
+		ConnectTimeout: connectTimeout,
+		LbPolicy:       c.LbPolicy,
+		LoadBalancer:   newLoadBalancer(c.LbPolicy, endpoints),
+		Stats:          newStats(c.Name),
+		config:         c,
+		locality:       locality,
+		dialer:         &net.Dialer{Timeout: connectTimeout},
+		tls:            tlsConfig,
+	}
+	httpTransport := http.DefaultTransport.(*http.Transport).Clone()
+	httpTransport.DialContext = cluster.dialer.DialContext
+	if tlsConfig != nil {
+		httpTransport.DialTLSContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			return cluster.Dial(ctx, address)
+		}
+	}
+	cluster.Client = &http.Client{Transport: httpTransport}
+	if c.Http2ProtocolOptions != nil {
+		var http2Transport http.RoundTripper
+		http2Transport, cluster.http2 = newHTTP2Transport(cluster, c.Http2ProtocolOptions)
+		cluster.Client = &http.Client{Transport: http2Transport}
+	}
+	if serviceDiscovery != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		cluster.stopDiscovery = cancel
+		go serviceDiscovery.Run(ctx, cluster.LoadBalancer.UpdateEndpoints)
+	}
+	return cluster, nil
+}
+
+// Dial connects to the endpoint at address, within the connect timeout, and
+// starts TLS on the connection if the cluster has a transport socket.
+func (c *Cluster) Dial(ctx context.Context, address string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.ConnectTimeout)
+	defer cancel()
+	conn, err := c.dialer.DialContext(ctx, "tcp", address)
+	if err != nil || c.tls == nil {
+		return conn, err
+	}
+	return c.tls.Client(ctx, conn)
+}
+
+// Scheme is the scheme of the URLs requests to the cluster are sent to.
+func (c *Cluster) Scheme() string {
+	if c.tls != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// Endpoints lists the "host:port" address of every endpoint the load balancer
+// knows, which is what the ?endpoint=N debug parameter indexes.
+func (c *Cluster) Endpoints() []string {
+	return addresses(c.LoadBalancer.Endpoints())
+}
+
+func newLoadBalancer(lbPolicy string, endpoints []loadbalancer.Endpoint) loadbalancer.LoadBalancer {
+	var lb loadbalancer.LoadBalancer
+	switch lbPolicy {
+	case "LEAST_CONNECTIONS":
+		lb = loadbalancer.NewLeastConnectionsLoadBalancer(addresses(endpoints))
+	default:
+		// Default to Round Robin if lbPolicy is not set
+		lb = loadbalancer.NewRoundRobinLoadBalancer(addresses(endpoints))
+	}
+	lb.UpdateEndpoints(endpoints)
+	return lb
+}
+
+// lbEndpoints lists the cluster's endpoints in config order with their
+// weights and drain state.
+func lbEndpoints(c config.Cluster) []loadbalancer.Endpoint {
+	var endpoints []loadbalancer.Endpoint
+	for _, locality := range c.LoadAssignment.Endpoints {
+		for _, lbEndpoint := range locality.LbEndpoints {
+			endpoints = append(endpoints, loadbalancer.Endpoint{
+				Address:  lbEndpoint.Address(),
+				Weight:   lbEndpoint.LoadBalancingWeight,
+				Draining: lbEndpoint.HealthStatus == "DRAINING",
+			})
+		}
+	}
+	return endpoints
+}
+
+func addresses(endpoints []loadbalancer.Endpoint) []string {
+	servers := make([]string, len(endpoints))
+	for i, endpoint := range endpoints {
+		servers[i] = endpoint.Address
+	}
+	return servers
+}
+
+// withEndpoints returns a copy of c for updated, which differs from c's config
+// only in its load_assignment. The copy shares c's load balancer, client and
+// stats, so requests in flight are still counted; the load balancer moves to
+// the new endpoints once the copy is applied.
+func (c *Cluster) withEndpoints(updated config.Cluster) *Cluster {
+	copied := *c
+	copied.config = updated
+	return &copied
+}
+
+// sameExceptEndpoints reports whether a and b differ at most in their
+// endpoints. For DNS clusters those are hostnames that have to be resolved
+// again, so they never qualify.
+func sameExceptEndpoints(a, b config.Cluster) bool {
+	if a.IsDNS() || b.IsDNS() {
+		return false
+	}
+	a.LoadAssignment, b.LoadAssignment = config.ClusterLoadAssignment{}, config.ClusterLoadAssignment{}
+	return reflect.DeepEqual(a, b)
+}
+
+// Close stops service discovery and releases idle upstream connections once a
+// cluster has been replaced.
+func (c *Cluster) Close() {
+	if c.stopDiscovery != nil {
+		c.stopDiscovery()
+	}
+	c.Client.CloseIdleConnections()
+	if c.http2 != nil {
+		c.http2.close()
+	}
+	if c.tls != nil {
+		c.tls.Close()
+	}
+}
+
+// Manager holds the current set of clusters. Apply swaps in a whole new set at
+// once, so a request never sees a mix of old and new clusters.
+type Manager struct {
+	mu       sync.Mutex
+	clusters atomic.Pointer[map[string]*Cluster]
+	locality config.Locality
+}
+
+func NewManager() *Manager {
+	m := &Manager{}
+	m.clusters.Store(&map[string]*Cluster{})
+	return m
+}
+
+// SetLocality sets where the router runs. Clusters are rebuilt for it on the
+// next Apply.
+func (m *Manager) SetLocality(locality config.Locality) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.locality = locality
+}
+
+// Apply replaces the cluster set with configs. Clusters whose config did not
+// change are kept as they are, and clusters where only the endpoints changed
+// keep their load balancer, so load balancer state survives a reload. If any
+// cluster cannot be built, nothing is applied.
+func (m *Manager) Apply(configs []config.Cluster) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	current := *m.clusters.Load()
+	updated := make(map[string]*Cluster, len(configs))
+	var built, reassigned []*Cluster
+	for _, c := range configs {
+		existing, ok := current[c.Name]
+		ok = ok && existing.locality == m.locality
+		if ok && reflect.DeepEqual(existing.config, c) {
+			updated[c.Name] = existing
+			continue
+		} else if ok && sameExceptEndpoints(existing.config, c) {
+			updated[c.Name] = existing.withEndpoints(c)
+			reassigned = append(reassigned, updated[c.Name])
+			continue
+		}
+		cluster, err := New(c, m.locality)
+		if err != nil {
+			for _, cluster := range built {
+				cluster.Close()
+			}
+			return err
+		}
+		built = append(built, cluster)
+		updated[c.Name] = cluster
+	}
+	for _, cluster := range reassigned {
+		cluster.LoadBalancer.UpdateEndpoints(lbEndpoints(cluster.config))
+	}
+	m.clusters.Store(&updated)
+
+	for name, cluster := range current {
+		if replacement := updated[name]; replacement == nil || replacement.Client != cluster.Client {
+			cluster.Close()
+		}
+	}
+	return nil
+}
+
+// Get returns the named cluster, or nil if there is no such cluster.
+func (m *Manager) Get(name string) *Cluster {
+	return (*m.clusters.Load())[name]
+}
+
+// All returns every cluster sorted by name.
+func (m *Manager) All() []*Cluster {
+	clusters := *m.clusters.Load()
+	all := make([]*Cluster, 0, len(clusters))
+	for _, cluster := range clusters {
+		all = append(all, cluster)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Name < all[j].Name })
+	return all
+}
@@ -0,0 +1,45 @@
+package cluster
+
+import (
+	"reflect"
+	"testing"
+
+	"seateam/config"
+)
+
+func testCluster(name string, port int) config.Cluster {
+	var lbEndpoint config.LbEndpoint
+	lbEndpoint.Endpoint.Address.SocketAddress = config.SocketAddress{Address: "127.0.0.1", PortValue: port}
+	c := config.Cluster{Name: name}
+	c.LoadAssignment.Endpoints = []config.LocalityLbEndpoints{{LbEndpoints: []config.LbEndpoint{lbEndpoint}}}
+	return c
+}
+
+// TestManagerApplyIsAtomic checks that an update with a cluster that cannot
+// be built changes nothing, not even the endpoints of the other clusters.
+func TestManagerApplyIsAtomic(t *testing.T) {
+	m := NewManager()
+	if err := m.Apply([]config.Cluster{testCluster("a", 1000)}); err != nil {
+		t.Fatal(err)
+	}
+	a := m.Get("a")
+
+	broken := testCluster("c", 1002)
+	broken.ConnectTimeout = "soon"
+	if err := m.Apply([]config.Cluster{testCluster("a", 1001), testCluster("b", 1001), broken}); err == nil {
+		t.Fatal("expected an error for the broken cluster")
+	}
+	if m.Get("a") != a || m.Get("b") != nil {
+		t.Error("expected the cluster set to be left as it was")
+	}
+	if endpoints := a.Endpoints(); !reflect.DeepEqual(endpoints, []string{"127.0.0.1:1000"}) {
+		t.Errorf("expected the endpoints to be left as they were, got %v", endpoints)
+	}
+
+	if err := m.Apply([]config.Cluster{testCluster("a", 1001)}); err != nil {
+		t.Fatal(err)
+	}
+	if m.Get("a").LoadBalancer != a.LoadBalancer || !reflect.DeepEqual(a.Endpoints(), []string{"127.0.0.1:1001"}) {
+		t.Errorf("expected the endpoints to change on the same load balancer, got %v", m.Get("a").Endpoints())
+	}
+}
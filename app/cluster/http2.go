@@ -0,0 +1,128 @@
+package cluster
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"golang.org/x/net/http2"
+
+	"seateam/config"
+)
+
+// newHTTP2Transport sends the cluster's requests over HTTP/2: with TLS and
+// ALPN when the cluster has a transport socket, and as h2c with prior
+// knowledge otherwise.
+func newHTTP2Transport(c *Cluster, options *config.Http2ProtocolOptions) (*http2.Transport, *http2ConnPool) {
+	t := &http2.Transport{AllowHTTP: true}
+	pool := &http2ConnPool{
+		cluster:    c,
+		transport:  t,
+		maxStreams: options.MaxConcurrentStreams,
+		conns:      make(map[string][]*http2.ClientConn),
+	}
+	t.ConnPool = pool
+	return t, pool
+}
+
+// http2ConnPool keeps the HTTP/2 connections to each endpoint of a cluster.
+// A request goes on the first connection with a stream to spare under
+// max_concurrent_streams, or on a new connection if none has one.
+type http2ConnPool struct {
+	cluster   *Cluster
+	transport *http2.Transport
+	// maxStreams is the cluster's max_concurrent_streams, zero for no limit
+	// but the endpoint's.
+	maxStreams int
+
+	mu    sync.Mutex
+	conns map[string][]*http2.ClientConn
+}
+
+// GetClientConn returns a connection to addr with a stream reserved for req.
+func (p *http2ConnPool) GetClientConn(req *http.Request, addr string) (*http2.ClientConn, error) {
+	if cc := p.reserve(addr); cc != nil {
+		return cc, nil
+	}
+	// Dial without the lock, so a slow endpoint holds up no one else.
+	cc, err := p.dial(req.Context(), addr)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.conns[addr] = append(p.conns[addr], cc)
+	cc.ReserveNewRequest()
+	return cc, nil
+}
+
+// reserve returns an open connection to addr with a stream reserved on it,
+// or nil if every connection is at max_concurrent_streams.
+func (p *http2ConnPool) reserve(addr string) *http2.ClientConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	open := p.conns[addr][:0]
+	for _, cc := range p.conns[addr] {
+		if state := cc.State(); !state.Closed && !state.Closing {
+			open = append(open, cc)
+		}
+	}
+	p.conns[addr] = open
+	for _, cc := range open {
+		state := cc.State()
+		streams := state.StreamsActive + state.StreamsReserved + state.StreamsPending
+		if (p.maxStreams == 0 || streams < p.maxStreams) && cc.ReserveNewRequest() {
+			return cc
+		}
+	}
+	return nil
+}
+
+// dial opens a connection to addr and starts HTTP/2 on it.
+func (p *http2ConnPool) dial(ctx context.Context, addr string) (*http2.ClientConn, error) {
+	conn, err := p.cluster.Dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok && tlsConn.ConnectionState().NegotiatedProtocol != config.AlpnHTTP2 {
+		conn.Close()
+		return nil, fmt.Errorf("endpoint %s did not negotiate HTTP/2", addr)
+	}
+	cc, err := p.transport.NewClientConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	p.cluster.Stats.UpstreamCxHttp2Total.Inc()
+	return cc, nil
+}
+
+// MarkDead drops a connection the transport found broken.
+func (p *http2ConnPool) MarkDead(dead *http2.ClientConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for addr, conns := range p.conns {
+		for i, cc := range conns {
+			if cc == dead {
+				p.conns[addr] = append(conns[:i:i], conns[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// close closes every connection once the requests on it have finished, for a
+// cluster that has been replaced.
+func (p *http2ConnPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for addr, conns := range p.conns {
+		for _, cc := range conns {
+			go cc.Shutdown(context.Background())
+		}
+		delete(p.conns, addr)
+	}
+}
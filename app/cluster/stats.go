@@ -0,0 +1,51 @@
+package cluster
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"seateam/stats"
+)
+
+var (
+	upstreamRqTotal       = stats.NewCounterVec("cluster", "upstream_rq_total", "Total requests sent upstream.", "envoy_cluster_name")
+	upstreamRqCompleted   = stats.NewCounterVec("cluster", "upstream_rq_{}xx", "Upstream responses by status code class.", "envoy_cluster_name", "envoy_response_code_class")
+	upstreamRqActive      = stats.NewGaugeVec("cluster", "upstream_rq_active", "Requests currently in flight upstream.", "envoy_cluster_name")
+	upstreamRqTimeout     = stats.NewCounterVec("cluster", "upstream_rq_timeout", "Upstream requests that timed out.", "envoy_cluster_name")
+	upstreamCxConnectFail = stats.NewCounterVec("cluster", "upstream_cx_connect_fail", "Upstream connections that could not be established.", "envoy_cluster_name")
+	upstreamCxTotal       = stats.NewCounterVec("cluster", "upstream_cx_total", "Total upstream connections opened by the TCP proxy.", "envoy_cluster_name")
+	upstreamCxActive      = stats.NewGaugeVec("cluster", "upstream_cx_active", "Upstream connections of the TCP proxy currently open.", "envoy_cluster_name")
+	upstreamCxHttp2Total  = stats.NewCounterVec("cluster", "upstream_cx_http2_total", "Total HTTP/2 connections opened to upstream endpoints.", "envoy_cluster_name")
+)
+
+// Stats are the per-cluster stats, reported as cluster.<name>.<stat>.
+type Stats struct {
+	UpstreamRqTotal       prometheus.Counter
+	UpstreamRqActive      prometheus.Gauge
+	UpstreamRqTimeout     prometheus.Counter
+	UpstreamCxConnectFail prometheus.Counter
+	UpstreamCxTotal       prometheus.Counter
+	UpstreamCxActive      prometheus.Gauge
+	UpstreamCxHttp2Total  prometheus.Counter
+	upstreamRqCompleted   *prometheus.CounterVec
+}
+
+func newStats(name string) *Stats {
+	labels := prometheus.Labels{"envoy_cluster_name": name}
+	return &Stats{
+		UpstreamRqTotal:       upstreamRqTotal.With(labels),
+		UpstreamRqActive:      upstreamRqActive.With(labels),
+		UpstreamRqTimeout:     upstreamRqTimeout.With(labels),
+		UpstreamCxConnectFail: upstreamCxConnectFail.With(labels),
+		UpstreamCxTotal:       upstreamCxTotal.With(labels),
+		UpstreamCxActive:      upstreamCxActive.With(labels),
+		UpstreamCxHttp2Total:  upstreamCxHttp2Total.With(labels),
+		upstreamRqCompleted:   upstreamRqCompleted.MustCurryWith(labels),
+	}
+}
+
+// UpstreamRqCompleted counts a response under its status code class.
+func (s *Stats) UpstreamRqCompleted(statusCode int) {
+	s.upstreamRqCompleted.WithLabelValues(fmt.Sprint(statusCode / 100)).Inc()
+}
@@ -0,0 +1,105 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Acme has the certificates of a filter chain obtained and renewed from an
+// ACME CA, such as Let's Encrypt, in place of tls_certificates. They are
+// obtained on the first handshake for each domain, kept in StorageDir and
+// renewed RenewBefore they expire.
+//
+// The CA validates a domain with TLS-ALPN-01, answered by the filter chain
+// itself, so the listener must be reachable on port 443. With Http01, HTTP-01
+// is tried when that fails, answered on port 80 by the router of any HTTP
+// listener.
+type Acme struct {
+	DirectoryURL string `yaml:"directory_url,omitempty"`
+	Email        string `yaml:"email,omitempty"`
+	StorageDir   string `yaml:"storage_dir,omitempty"`
+	// RenewBefore defaults to 720h, 30 days.
+	RenewBefore string `yaml:"renew_before,omitempty"`
+	Http01      bool   `yaml:"http_01,omitempty"`
+	// Domains default to the domains of the filter chain's virtual hosts,
+	// leaving out wildcards, which ACME can only validate through DNS.
+	Domains []string `yaml:"domains,omitempty"`
+	// TrustedCa verifies the ACME server in place of the system roots, as
+	// for a local Pebble.
+	TrustedCa *DataSource `yaml:"trusted_ca,omitempty"`
+}
+
+// DefaultAcmeRenewBefore is how long before expiry ACME certificates are
+// renewed when renew_before is not set.
+const DefaultAcmeRenewBefore = 30 * 24 * time.Hour
+
+// DownstreamTlsContext returns the TLS context of the filter chain, with the
+// domains of its ACME certificates filled in if they come from its virtual
+// hosts. With ACME and no alpn_protocols, the chain offers what its
+// connection manager serves: TLS-ALPN-01 adds acme-tls/1, and clients
+// offering only other protocols would otherwise fail their handshake.
+func (c FilterChain) DownstreamTlsContext() DownstreamTlsContext {
+	tlsContext := c.TransportSocket.TypedConfig
+	if tlsContext.Acme != nil && len(tlsContext.CommonTlsContext.AlpnProtocols) == 0 {
+		for _, filter := range c.Filters {
+			if filter.Name != HttpConnectionManagerFilter {
+				continue
+			}
+			var alpnProtocols []string
+			if filter.TypedConfig.AcceptsHTTP2() {
+				alpnProtocols = append(alpnProtocols, AlpnHTTP2)
+			}
+			if filter.TypedConfig.AcceptsHTTP1() {
+				alpnProtocols = append(alpnProtocols, AlpnHTTP1)
+			}
+			tlsContext.CommonTlsContext.AlpnProtocols = alpnProtocols
+		}
+	}
+	if tlsContext.Acme != nil && len(tlsContext.Acme.Domains) == 0 {
+		acme := *tlsContext.Acme
+		for _, filter := range c.Filters {
+			if filter.Name != HttpConnectionManagerFilter {
+				continue
+			}
+			for _, virtualHost := range filter.TypedConfig.RouteConfig.VirtualHosts {
+				for _, domain := range virtualHost.Domains {
+					if !strings.Contains(domain, "*") {
+						acme.Domains = append(acme.Domains, domain)
+					}
+				}
+			}
+		}
+		tlsContext.Acme = &acme
+	}
+	return tlsContext
+}
+
+func (v *validator) checkAcme(path string, filterChain FilterChain) {
+	acme := filterChain.DownstreamTlsContext().Acme
+	if u, err := url.Parse(acme.DirectoryURL); err != nil || u.Scheme != "https" || u.Host == "" {
+		v.errorf(path+".directory_url", "directory_url must be an https URL")
+	}
+	if acme.StorageDir == "" {
+		v.errorf(path+".storage_dir", "storage_dir is required")
+	}
+	if acme.RenewBefore != "" {
+		if renewBefore, err := time.ParseDuration(acme.RenewBefore); err != nil || renewBefore <= 0 {
+			v.errorf(path+".renew_before", "invalid duration %q", acme.RenewBefore)
+		}
+	}
+	if len(acme.Domains) == 0 {
+		v.errorf(path+".domains", "no domains to obtain certificates for: the virtual hosts have only wildcard domains")
+	}
+	for i, domain := range acme.Domains {
+		if strings.Contains(domain, "*") || strings.Contains(domain, ":") {
+			v.errorf(fmt.Sprintf("%s.domains[%d]", path, i), "ACME certificates cannot be obtained for %q", domain)
+		}
+	}
+	if acme.TrustedCa != nil {
+		if _, err := (CertificateValidationContext{TrustedCa: *acme.TrustedCa}).LoadTrustedCa(); err != nil {
+			v.errorf(path+".trusted_ca", "cannot load trusted_ca: %v", err)
+		}
+	}
+}
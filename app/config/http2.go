@@ -0,0 +1,107 @@
+package config
+
+import (
+	"fmt"
+	"math"
+	"slices"
+)
+
+// Codec types of the HTTP connection manager. AUTO, the default, takes
+// HTTP/2 from clients that negotiate it with ALPN or, over plaintext, open
+// with the HTTP/2 preface or upgrade to h2c, and HTTP/1.1 from the rest.
+const (
+	CodecAuto  = "AUTO"
+	CodecHTTP1 = "HTTP1"
+	CodecHTTP2 = "HTTP2"
+)
+
+// ALPN protocol names of the HTTP versions.
+const (
+	AlpnHTTP1 = "http/1.1"
+	AlpnHTTP2 = "h2"
+)
+
+// Http2ProtocolOptions tunes HTTP/2 connections. Left out, a setting keeps
+// the default of Go's HTTP/2 implementation. On a cluster, the options also
+// make its endpoints be talked to over HTTP/2, with h2c when the cluster has
+// no TLS; the flow control windows of those connections cannot be set.
+type Http2ProtocolOptions struct {
+	// MaxConcurrentStreams is how many requests may be in flight on one
+	// connection. Clusters open another connection to an endpoint rather
+	// than exceed it, or the endpoint's own limit.
+	MaxConcurrentStreams int `yaml:"max_concurrent_streams,omitempty"`
+	// InitialStreamWindowSize and InitialConnectionWindowSize are how many
+	// bytes of request body a client may send ahead, on each stream and on
+	// the connection as a whole.
+	InitialStreamWindowSize     int `yaml:"initial_stream_window_size,omitempty"`
+	InitialConnectionWindowSize int `yaml:"initial_connection_window_size,omitempty"`
+}
+
+// minHttp2InitialWindowSize is the smallest flow control window HTTP/2
+// allows.
+const minHttp2InitialWindowSize = 65535
+
+// AcceptsHTTP1 reports whether the connection manager serves HTTP/1.1.
+func (hcm HttpConnectionManager) AcceptsHTTP1() bool {
+	return hcm.CodecType != CodecHTTP2 && hcm.CodecType != CodecHTTP3
+}
+
+// AcceptsHTTP2 reports whether the connection manager serves HTTP/2.
+func (hcm HttpConnectionManager) AcceptsHTTP2() bool {
+	return hcm.CodecType != CodecHTTP1 && hcm.CodecType != CodecHTTP3
+}
+
+var supportedCodecTypes = map[string]bool{
+	"":         true,
+	CodecAuto:  true,
+	CodecHTTP1: true,
+	CodecHTTP2: true,
+	CodecHTTP3: true,
+}
+
+// checkCodec checks the codec_type of the connection manager at path and that
+// the filter chain's ALPN protocols only offer what it serves.
+func (v *validator) checkCodec(path string, hcm HttpConnectionManager, filterChainPath string, filterChain FilterChain) {
+	if !supportedCodecTypes[hcm.CodecType] {
+		v.errorf(path+".codec_type", "unsupported codec_type %q", hcm.CodecType)
+		return
+	}
+	if hcm.Http2ProtocolOptions != nil {
+		v.checkHttp2ProtocolOptions(path+".http2_protocol_options", *hcm.Http2ProtocolOptions)
+	}
+	if filterChain.TransportSocket == nil {
+		return
+	}
+	alpnProtocols := filterChain.TransportSocket.TypedConfig.CommonTlsContext.AlpnProtocols
+	if slices.Contains(alpnProtocols, AlpnHTTP2) && !hcm.AcceptsHTTP2() || slices.Contains(alpnProtocols, AlpnHTTP1) && !hcm.AcceptsHTTP1() {
+		v.errorf(filterChainPath+".transport_socket.typed_config.common_tls_context.alpn_protocols", "alpn_protocols %v offer a protocol codec_type %s does not serve", alpnProtocols, hcm.CodecType)
+	}
+}
+
+func (v *validator) checkHttp2ProtocolOptions(path string, options Http2ProtocolOptions) {
+	if options.MaxConcurrentStreams < 0 || options.MaxConcurrentStreams > math.MaxInt32 {
+		v.errorf(path+".max_concurrent_streams", "max_concurrent_streams must be between 1 and %d, got %d", math.MaxInt32, options.MaxConcurrentStreams)
+	}
+	for _, window := range []struct {
+		name string
+		size int
+	}{
+		{"initial_stream_window_size", options.InitialStreamWindowSize},
+		{"initial_connection_window_size", options.InitialConnectionWindowSize},
+	} {
+		if window.size != 0 && (window.size < minHttp2InitialWindowSize || window.size > math.MaxInt32) {
+			v.errorf(fmt.Sprintf("%s.%s", path, window.name), "%s must be between %d and %d, got %d", window.name, minHttp2InitialWindowSize, math.MaxInt32, window.size)
+		}
+	}
+}
+
+// checkUpstreamHttp2ProtocolOptions reports the options a cluster cannot
+// apply to its connections.
+func (v *validator) checkUpstreamHttp2ProtocolOptions(path string, options Http2ProtocolOptions) {
+	if options.InitialStreamWindowSize != 0 {
+		v.errorf(path+".initial_stream_window_size", "initial_stream_window_size cannot be set on a cluster")
+	}
+	if options.InitialConnectionWindowSize != 0 {
+		v.errorf(path+".initial_connection_window_size", "initial_connection_window_size cannot be set on a cluster")
+	}
+}
@@ -0,0 +1,243 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// TLSInspectorFilter is the listener filter that reads the ClientHello of TLS
+// connections, so filter chains can match on the server name in it.
+const TLSInspectorFilter = "envoy.filters.listener.tls_inspector"
+
+// Transport protocols a filter chain can match on. The TLS inspector tells
+// them apart.
+const (
+	TLSTransportProtocol       = "tls"
+	RawBufferTransportProtocol = "raw_buffer"
+)
+
+// UdpProxyFilter is the listener filter that makes a UDP listener forward
+// datagrams to a cluster.
+const UdpProxyFilter = "envoy.filters.udp_listener.udp_proxy"
+
+// ListenerFilter is a listener filter. Like a network filter, its
+// typed_config is read into the field for its name; TypedConfig holds it for
+// filters without settings of their own.
+type ListenerFilter struct {
+	Name        string `yaml:"name,omitempty"`
+	TypedConfig struct {
+		Type string `yaml:"@type,omitempty"`
+	} `yaml:"typed_config,omitempty"`
+	UdpProxy *UdpProxy `yaml:"-"`
+}
+
+func (f *ListenerFilter) UnmarshalYAML(node *yaml.Node) error {
+	*f = ListenerFilter{}
+	name, err := decodeNamed(node, func(name string) interface{} {
+		if name == UdpProxyFilter {
+			f.UdpProxy = new(UdpProxy)
+			return f.UdpProxy
+		}
+		return &f.TypedConfig
+	})
+	f.Name = name
+	return err
+}
+
+func (f ListenerFilter) MarshalYAML() (interface{}, error) {
+	var typedConfig interface{} = f.TypedConfig
+	if f.UdpProxy != nil {
+		typedConfig = f.UdpProxy
+	}
+	return named{f.Name, typedConfig}, nil
+}
+
+// UdpProxy forwards the datagrams of each client to an endpoint of Cluster,
+// and the replies back, over a session that lasts while datagrams flow.
+type UdpProxy struct {
+	Type       string `yaml:"@type,omitempty"`
+	StatPrefix string `yaml:"stat_prefix,omitempty"`
+	Cluster    string `yaml:"cluster,omitempty"`
+	// IdleTimeout ends sessions without datagrams either way for that long,
+	// by default a minute.
+	IdleTimeout string `yaml:"idle_timeout,omitempty"`
+	// HashPolicies keep a client on the same endpoint while the endpoints
+	// stay the same, instead of asking the load balancer for each session.
+	HashPolicies []UdpHashPolicy `yaml:"hash_policies,omitempty"`
+}
+
+type UdpHashPolicy struct {
+	SourceIP bool `yaml:"source_ip,omitempty"`
+}
+
+// IsUDP reports whether the listener receives datagrams rather than
+// connections.
+func (l Listener) IsUDP() bool {
+	return l.Address.SocketAddress.Protocol == "UDP"
+}
+
+// UdpProxy returns the listener's udp_proxy config, or nil if it has none.
+func (l Listener) UdpProxy() *UdpProxy {
+	for _, listenerFilter := range l.ListenerFilters {
+		if listenerFilter.UdpProxy != nil {
+			return listenerFilter.UdpProxy
+		}
+	}
+	return nil
+}
+
+// FilterChainMatch picks the filter chain for a connection. An empty match
+// is the default chain, used when no other chain matches.
+type FilterChainMatch struct {
+	// ServerNames are the SNI names the chain is for, either exact or with a
+	// leading "*." wildcard.
+	ServerNames       []string `yaml:"server_names,omitempty"`
+	TransportProtocol string   `yaml:"transport_protocol,omitempty"`
+}
+
+func (m FilterChainMatch) IsZero() bool {
+	return len(m.ServerNames) == 0 && m.TransportProtocol == ""
+}
+
+// HasListenerFilter reports whether the listener runs the named listener
+// filter.
+func (l Listener) HasListenerFilter(name string) bool {
+	for _, listenerFilter := range l.ListenerFilters {
+		if listenerFilter.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkListenerFilters checks the listener filters: a UDP listener has just
+// udp_proxy and no filter chains, a TCP listener may have the TLS inspector
+// and a QUIC listener has none, only filter chains.
+func (v *validator) checkListenerFilters(path string, listener Listener, clusterNames map[string]bool) {
+	switch protocol := listener.Address.SocketAddress.Protocol; protocol {
+	case "", "TCP", "UDP":
+	default:
+		v.errorf(path+".address.socket_address.protocol", "unsupported protocol %q", protocol)
+	}
+
+	for i, listenerFilter := range listener.ListenerFilters {
+		filterPath := fmt.Sprintf("%s.listener_filters[%d]", path, i)
+		switch {
+		case listenerFilter.Name == UdpProxyFilter && listener.IsUDP() && !listener.IsQUIC():
+			if listenerFilter.UdpProxy == nil {
+				v.errorf(filterPath+".typed_config", "%s needs a typed_config", UdpProxyFilter)
+			} else {
+				v.checkUdpProxy(filterPath+".typed_config", listenerFilter.UdpProxy, clusterNames)
+			}
+		case listenerFilter.Name == TLSInspectorFilter && !listener.IsUDP():
+		case listenerFilter.Name == UdpProxyFilter || listenerFilter.Name == TLSInspectorFilter:
+			v.errorf(filterPath+".name", "%s cannot be used on a %s listener", listenerFilter.Name, listener.protocol())
+		default:
+			v.errorf(filterPath+".name", "unsupported listener filter %q", listenerFilter.Name)
+		}
+	}
+
+	if !listener.IsUDP() || listener.IsQUIC() {
+		if len(listener.FilterChains) == 0 {
+			v.errorf(path+".filter_chains", "listener %q has no filter chains", listener.Name)
+		}
+		return
+	}
+	if len(listener.FilterChains) > 0 {
+		v.errorf(path+".filter_chains", "UDP listener %q cannot have filter chains", listener.Name)
+	}
+	if len(listener.ListenerFilters) != 1 || listener.UdpProxy() == nil {
+		v.errorf(path+".listener_filters", "UDP listener %q needs exactly one listener filter, %s", listener.Name, UdpProxyFilter)
+	}
+}
+
+func (l Listener) protocol() string {
+	if l.IsQUIC() {
+		return "QUIC"
+	}
+	if l.IsUDP() {
+		return "UDP"
+	}
+	return "TCP"
+}
+
+func (v *validator) checkUdpProxy(path string, udpProxy *UdpProxy, clusterNames map[string]bool) {
+	if udpProxy.StatPrefix == "" {
+		v.errorf(path+".stat_prefix", "stat_prefix is required")
+	}
+	if udpProxy.Cluster == "" {
+		v.errorf(path+".cluster", "udp_proxy has no cluster")
+	} else if !clusterNames[udpProxy.Cluster] {
+		v.errorf(path+".cluster", "udp_proxy points at unknown cluster %q", udpProxy.Cluster)
+	}
+	if udpProxy.IdleTimeout != "" {
+		if idleTimeout, err := time.ParseDuration(udpProxy.IdleTimeout); err != nil || idleTimeout <= 0 {
+			v.errorf(path+".idle_timeout", "invalid duration %q", udpProxy.IdleTimeout)
+		}
+	}
+	for i, hashPolicy := range udpProxy.HashPolicies {
+		if !hashPolicy.SourceIP {
+			v.errorf(fmt.Sprintf("%s.hash_policies[%d]", path, i), "only source_ip hash policies are supported")
+		}
+	}
+}
+
+// checkFilterChainMatches checks that no two filter chains of a listener
+// match the same connections.
+func (v *validator) checkFilterChainMatches(path string, listener Listener) {
+	if listener.ListenerFiltersTimeout != "" {
+		if timeout, err := time.ParseDuration(listener.ListenerFiltersTimeout); err != nil || timeout < 0 {
+			v.errorf(path+".listener_filters_timeout", "invalid duration %q", listener.ListenerFiltersTimeout)
+		}
+	}
+
+	inspector := listener.HasListenerFilter(TLSInspectorFilter)
+	seen := make(map[string]int)
+	for i, filterChain := range listener.FilterChains {
+		matchPath := fmt.Sprintf("%s.filter_chains[%d].filter_chain_match", path, i)
+		match := filterChain.FilterChainMatch
+		switch match.TransportProtocol {
+		case "", TLSTransportProtocol, RawBufferTransportProtocol:
+		default:
+			v.errorf(matchPath+".transport_protocol", "unsupported transport_protocol %q", match.TransportProtocol)
+		}
+		if !inspector && (len(match.ServerNames) > 0 || match.TransportProtocol != "") {
+			v.errorf(matchPath, "matching on server_names or transport_protocol needs the %s listener filter", TLSInspectorFilter)
+		}
+
+		serverNames := match.ServerNames
+		if len(serverNames) == 0 {
+			serverNames = []string{""}
+		}
+		for j, serverName := range serverNames {
+			if serverName != "" && !validServerName(serverName) {
+				v.errorf(fmt.Sprintf("%s.server_names[%d]", matchPath, j), "invalid server name %q", serverName)
+				continue
+			}
+			key := strings.ToLower(serverName) + "/" + match.TransportProtocol
+			if other, ok := seen[key]; ok {
+				v.errorf(matchPath, "filter chain matches the same connections as filter chain %d", other)
+				break
+			}
+			seen[key] = i
+		}
+	}
+}
+
+// validServerName accepts host names, optionally starting with a "*."
+// wildcard.
+func validServerName(name string) bool {
+	name = strings.TrimPrefix(name, "*.")
+	if name == "" || strings.ContainsAny(name, "*/: ") {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,165 @@
+package config
+
+import (
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// StringMatcher matches a string in exactly one of its ways. IgnoreCase
+// applies to all but SafeRegex.
+type StringMatcher struct {
+	Exact      string     `yaml:"exact,omitempty"`
+	Prefix     string     `yaml:"prefix,omitempty"`
+	Suffix     string     `yaml:"suffix,omitempty"`
+	Contains   string     `yaml:"contains,omitempty"`
+	SafeRegex  *SafeRegex `yaml:"safe_regex,omitempty"`
+	IgnoreCase bool       `yaml:"ignore_case,omitempty"`
+}
+
+// SafeRegex is an RE2 regular expression, which must match the whole string.
+type SafeRegex struct {
+	Regex string `yaml:"regex,omitempty"`
+}
+
+// regexes caches compiled safe_regex expressions, as matchers are checked
+// for every request or handshake.
+var regexes sync.Map
+
+// Matches reports whether s matches. Validation has already checked the
+// regular expression; one that does not compile matches nothing.
+func (m StringMatcher) Matches(s string) bool {
+	if m.SafeRegex != nil {
+		cached, ok := regexes.Load(m.SafeRegex.Regex)
+		if !ok {
+			re, err := regexp.Compile("^(?:" + m.SafeRegex.Regex + ")$")
+			if err != nil {
+				return false
+			}
+			cached, _ = regexes.LoadOrStore(m.SafeRegex.Regex, re)
+		}
+		return cached.(*regexp.Regexp).MatchString(s)
+	}
+	pattern := ""
+	match := func(s, pattern string) bool { return s == pattern }
+	switch {
+	case m.Exact != "":
+		pattern = m.Exact
+	case m.Prefix != "":
+		pattern, match = m.Prefix, strings.HasPrefix
+	case m.Suffix != "":
+		pattern, match = m.Suffix, strings.HasSuffix
+	case m.Contains != "":
+		pattern, match = m.Contains, strings.Contains
+	}
+	if m.IgnoreCase {
+		s, pattern = strings.ToLower(s), strings.ToLower(pattern)
+	}
+	return match(s, pattern)
+}
+
+// Check reports what is wrong with m. Matchers in the typed_config of a
+// filter are checked by the filter, with this, rather than by Validate.
+func (m StringMatcher) Check() error {
+	v := &validator{}
+	v.checkStringMatcher("", m)
+	if len(v.errs) > 0 {
+		return errors.New(v.errs[0].Message)
+	}
+	return nil
+}
+
+func (v *validator) checkStringMatcher(path string, m StringMatcher) {
+	set := 0
+	for _, matcher := range []bool{m.Exact != "", m.Prefix != "", m.Suffix != "", m.Contains != "", m.SafeRegex != nil} {
+		if matcher {
+			set++
+		}
+	}
+	if set != 1 {
+		v.errorf(path, "exactly one of exact, prefix, suffix, contains and safe_regex is required")
+	}
+	if m.SafeRegex != nil {
+		if _, err := regexp.Compile(m.SafeRegex.Regex); err != nil {
+			v.errorf(path+".safe_regex.regex", "invalid regex: %v", err)
+		}
+	}
+}
+
+// SubjectAltNameMatcher matches the subject alternative names of one type in
+// a certificate.
+type SubjectAltNameMatcher struct {
+	// SanType is DNS, URI, EMAIL or IP_ADDRESS.
+	SanType string        `yaml:"san_type,omitempty"`
+	Matcher StringMatcher `yaml:"matcher,omitempty"`
+}
+
+func (v *validator) checkSubjectAltNameMatcher(path string, m SubjectAltNameMatcher) {
+	switch m.SanType {
+	case "DNS", "URI", "EMAIL", "IP_ADDRESS":
+	default:
+		v.errorf(path+".san_type", "unsupported san_type %q", m.SanType)
+	}
+	v.checkStringMatcher(path+".matcher", m.Matcher)
+}
+
+// HeaderMatcher matches a request header: its value against StringMatch, or
+// that it is there at all with PresentMatch. InvertMatch turns the result
+// around.
+type HeaderMatcher struct {
+	Name         string         `yaml:"name,omitempty"`
+	StringMatch  *StringMatcher `yaml:"string_match,omitempty"`
+	PresentMatch bool           `yaml:"present_match,omitempty"`
+	InvertMatch  bool           `yaml:"invert_match,omitempty"`
+}
+
+func (v *validator) checkHeaderMatcher(path string, m HeaderMatcher) {
+	if m.Name == "" {
+		v.errorf(path+".name", "header name is required")
+	}
+	if (m.StringMatch != nil) == m.PresentMatch {
+		v.errorf(path, "exactly one of string_match and present_match is required")
+	}
+	if m.StringMatch != nil {
+		v.checkStringMatcher(path+".string_match", *m.StringMatch)
+	}
+}
+
+// Matches reports whether the header matches. Several values of the header
+// are matched as one, joined by commas.
+func (m HeaderMatcher) Matches(header http.Header) bool {
+	values, matched := header[http.CanonicalHeaderKey(m.Name)]
+	if matched && m.StringMatch != nil {
+		matched = m.StringMatch.Matches(strings.Join(values, ","))
+	}
+	return matched != m.InvertMatch
+}
+
+// Matches reports whether one of the certificate's subject alternative names
+// of the matcher's type matches.
+func (m SubjectAltNameMatcher) Matches(certificate *x509.Certificate) bool {
+	var names []string
+	switch m.SanType {
+	case "DNS":
+		names = certificate.DNSNames
+	case "URI":
+		for _, uri := range certificate.URIs {
+			names = append(names, uri.String())
+		}
+	case "EMAIL":
+		names = certificate.EmailAddresses
+	case "IP_ADDRESS":
+		for _, ip := range certificate.IPAddresses {
+			names = append(names, ip.String())
+		}
+	}
+	for _, name := range names {
+		if m.Matcher.Matches(name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ErrNotFound is returned when a cluster or endpoint being changed does not exist.
+var ErrNotFound = errors.New("not found")
+
+// ErrExists is returned when adding an endpoint a cluster already has.
+var ErrExists = errors.New("already exists")
+
+// Clone returns a deep copy of b, so a change can be made and validated without
+// touching the config that is running.
+func (b StaticBootstrap) Clone() (StaticBootstrap, error) {
+	var clone StaticBootstrap
+	data, err := yaml.Marshal(b)
+	if err != nil {
+		return clone, err
+	}
+	err = yaml.Unmarshal(data, &clone)
+	return clone, err
+}
+
+// Cluster returns the named cluster so it can be changed in place.
+func (b *StaticBootstrap) Cluster(name string) (*Cluster, error) {
+	for i := range b.StaticResources.Clusters {
+		if b.StaticResources.Clusters[i].Name == name {
+			return &b.StaticResources.Clusters[i], nil
+		}
+	}
+	return nil, fmt.Errorf("cluster %q: %w", name, ErrNotFound)
+}
+
+// Address returns the endpoint's "host:port" address.
+func (e LbEndpoint) Address() string {
+	socketAddress := e.Endpoint.Address.SocketAddress
+	return net.JoinHostPort(socketAddress.Address, strconv.Itoa(socketAddress.PortValue))
+}
+
+// Endpoint returns the endpoint with the given "host:port" address so it can be
+// changed in place.
+func (c *Cluster) Endpoint(address string) (*LbEndpoint, error) {
+	for i := range c.LoadAssignment.Endpoints {
+		locality := &c.LoadAssignment.Endpoints[i]
+		for j := range locality.LbEndpoints {
+			if locality.LbEndpoints[j].Address() == address {
+				return &locality.LbEndpoints[j], nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("cluster %q: endpoint %s: %w", c.Name, address, ErrNotFound)
+}
+
+// AddEndpoint appends an endpoint to the cluster's first locality.
+func (c *Cluster) AddEndpoint(endpoint LbEndpoint) error {
+	if _, err := c.Endpoint(endpoint.Address()); err == nil {
+		return fmt.Errorf("cluster %q: endpoint %s: %w", c.Name, endpoint.Address(), ErrExists)
+	}
+	if len(c.LoadAssignment.Endpoints) == 0 {
+		c.LoadAssignment.Endpoints = []LocalityLbEndpoints{{}}
+	}
+	locality := &c.LoadAssignment.Endpoints[0]
+	locality.LbEndpoints = append(locality.LbEndpoints, endpoint)
+	return nil
+}
+
+// RemoveEndpoint removes the endpoint with the given "host:port" address.
+func (c *Cluster) RemoveEndpoint(address string) error {
+	for i := range c.LoadAssignment.Endpoints {
+		locality := &c.LoadAssignment.Endpoints[i]
+		for j := range locality.LbEndpoints {
+			if locality.LbEndpoints[j].Address() == address {
+				locality.LbEndpoints = append(locality.LbEndpoints[:j], locality.LbEndpoints[j+1:]...)
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("cluster %q: endpoint %s: %w", c.Name, address, ErrNotFound)
+}
@@ -0,0 +1,458 @@
+package config
+
+import (
+	"fmt"
+	"net/netip"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Network filters other than the HTTP connection manager. tcp_proxy ends a
+// filter chain as http_connection_manager does; the others come before either
+// and act on each new connection.
+const (
+	TcpProxyFilter        = "envoy.filters.network.tcp_proxy"
+	ConnectionLimitFilter = "envoy.filters.network.connection_limit"
+	RBACFilter            = "envoy.filters.network.rbac"
+)
+
+// TcpProxy forwards the bytes of each connection to an endpoint of Cluster.
+type TcpProxy struct {
+	Type       string `yaml:"@type,omitempty"`
+	StatPrefix string `yaml:"stat_prefix,omitempty"`
+	Cluster    string `yaml:"cluster,omitempty"`
+	// IdleTimeout closes connections that have sent nothing either way for
+	// that long, by default an hour. "0s" turns it off.
+	IdleTimeout string `yaml:"idle_timeout,omitempty"`
+	// MaxConnectAttempts is how many endpoints are tried before giving up,
+	// by default one.
+	MaxConnectAttempts int         `yaml:"max_connect_attempts,omitempty"`
+	AccessLog          []AccessLog `yaml:"access_log,omitempty"`
+}
+
+// AccessLog writes a line per connection to a file or the standard streams.
+type AccessLog struct {
+	Name        string `yaml:"name,omitempty"`
+	TypedConfig struct {
+		Type string `yaml:"@type,omitempty"`
+		// Path is the file of envoy.access_loggers.file.
+		Path      string `yaml:"path,omitempty"`
+		LogFormat struct {
+			TextFormatSource struct {
+				InlineString string `yaml:"inline_string,omitempty"`
+			} `yaml:"text_format_source,omitempty"`
+		} `yaml:"log_format,omitempty"`
+	} `yaml:"typed_config,omitempty"`
+}
+
+// Access loggers that can be named in access_log.
+const (
+	FileAccessLog   = "envoy.access_loggers.file"
+	StdoutAccessLog = "envoy.access_loggers.stdout"
+	StderrAccessLog = "envoy.access_loggers.stderr"
+)
+
+// ConnectionLimit caps the connections a filter chain has open at once.
+type ConnectionLimit struct {
+	Type           string `yaml:"@type,omitempty"`
+	StatPrefix     string `yaml:"stat_prefix,omitempty"`
+	MaxConnections int    `yaml:"max_connections,omitempty"`
+	// Delay is how long a connection over the limit is held before it is
+	// closed, to slow down clients that reconnect straight away.
+	Delay string `yaml:"delay,omitempty"`
+}
+
+// RBAC allows or denies connections by the policies that match them.
+type RBAC struct {
+	Type       string     `yaml:"@type,omitempty"`
+	StatPrefix string     `yaml:"stat_prefix,omitempty"`
+	Rules      *RBACRules `yaml:"rules,omitempty"`
+}
+
+type RBACRules struct {
+	// Action is ALLOW, the default, to let through only connections some
+	// policy matches, or DENY to turn them away.
+	Action   string                `yaml:"action,omitempty"`
+	Policies map[string]RBACPolicy `yaml:"policies,omitempty"`
+}
+
+// RBACPolicy matches a connection when one of its permissions and one of its
+// principals do.
+type RBACPolicy struct {
+	Permissions []RBACPermission `yaml:"permissions,omitempty"`
+	Principals  []RBACPrincipal  `yaml:"principals,omitempty"`
+}
+
+type RBACPermission struct {
+	Any             bool `yaml:"any,omitempty"`
+	DestinationPort int  `yaml:"destination_port,omitempty"`
+}
+
+type RBACPrincipal struct {
+	Any bool `yaml:"any,omitempty"`
+	// DirectRemoteIP matches the address the connection came from.
+	// RemoteIP matches it too, as there is no proxy protocol to say
+	// otherwise.
+	DirectRemoteIP *CidrRange `yaml:"direct_remote_ip,omitempty"`
+	RemoteIP       *CidrRange `yaml:"remote_ip,omitempty"`
+	// Authenticated matches TLS connections whose client certificate was
+	// verified and, with a principal_name, names that principal.
+	Authenticated *RBACAuthenticated `yaml:"authenticated,omitempty"`
+}
+
+// RBACAuthenticated matches the principal name of a client certificate: its
+// first URI SAN, else its first DNS SAN, else its subject, as in Envoy.
+type RBACAuthenticated struct {
+	PrincipalName *StringMatcher `yaml:"principal_name,omitempty"`
+}
+
+type CidrRange struct {
+	AddressPrefix string `yaml:"address_prefix,omitempty"`
+	PrefixLen     *int   `yaml:"prefix_len,omitempty"`
+}
+
+// UnmarshalYAML reads typed_config into the field for the filter's name.
+func (f *Filter) UnmarshalYAML(node *yaml.Node) error {
+	*f = Filter{}
+	name, err := decodeNamed(node, func(name string) interface{} {
+		switch name {
+		case TcpProxyFilter:
+			f.TcpProxy = new(TcpProxy)
+			return f.TcpProxy
+		case ConnectionLimitFilter:
+			f.ConnectionLimit = new(ConnectionLimit)
+			return f.ConnectionLimit
+		case RBACFilter:
+			f.RBAC = new(RBAC)
+			return f.RBAC
+		}
+		return &f.TypedConfig
+	})
+	f.Name = name
+	return err
+}
+
+func (f Filter) MarshalYAML() (interface{}, error) {
+	var typedConfig interface{} = f.TypedConfig
+	switch {
+	case f.TcpProxy != nil:
+		typedConfig = f.TcpProxy
+	case f.ConnectionLimit != nil:
+		typedConfig = f.ConnectionLimit
+	case f.RBAC != nil:
+		typedConfig = f.RBAC
+	}
+	return named{f.Name, typedConfig}, nil
+}
+
+// named is a filter as it is written out: its name and typed_config.
+type named struct {
+	Name        string      `yaml:"name,omitempty"`
+	TypedConfig interface{} `yaml:"typed_config,omitempty"`
+}
+
+// decodeNamed decodes a filter's name and returns it, with typed_config
+// decoded into what typedConfig returns for the name. It rejects unknown
+// fields itself, as the decoder's check does not reach into custom
+// unmarshalers.
+func decodeNamed(node *yaml.Node, typedConfig func(name string) interface{}) (string, error) {
+	var raw struct {
+		Name        string    `yaml:"name"`
+		TypedConfig yaml.Node `yaml:"typed_config"`
+	}
+	if err := checkKnownFields(node, reflect.TypeOf(raw)); err != nil {
+		return "", err
+	}
+	if err := node.Decode(&raw); err != nil {
+		return "", err
+	}
+
+	target := typedConfig(raw.Name)
+	if raw.TypedConfig.Kind == 0 {
+		return raw.Name, nil
+	}
+	if err := checkKnownFields(&raw.TypedConfig, reflect.TypeOf(target).Elem()); err != nil {
+		return raw.Name, err
+	}
+	return raw.Name, raw.TypedConfig.Decode(target)
+}
+
+// checkNetworkFilters checks that a filter chain is any number of
+// connection filters followed by one terminal filter, and the configs of the
+// filters other than the HTTP connection manager.
+func (v *validator) checkNetworkFilters(path string, filterChain FilterChain, clusterNames map[string]bool) {
+	if len(filterChain.Filters) == 0 {
+		v.errorf(path+".filters", "filter chain has no filters")
+		return
+	}
+	for i, filter := range filterChain.Filters {
+		filterPath := fmt.Sprintf("%s.filters[%d]", path, i)
+		terminal := filter.Name == HttpConnectionManagerFilter || filter.Name == TcpProxyFilter
+		switch {
+		case filter.Name == "":
+			v.errorf(filterPath+".name", "network filter name is required")
+			continue
+		case filter.Name != HttpConnectionManagerFilter && filter.Name != TcpProxyFilter &&
+			filter.Name != ConnectionLimitFilter && filter.Name != RBACFilter:
+			v.errorf(filterPath+".name", "unsupported network filter %q", filter.Name)
+			continue
+		case terminal && i != len(filterChain.Filters)-1:
+			v.errorf(filterPath+".name", "%s must be the last network filter", filter.Name)
+		case !terminal && i == len(filterChain.Filters)-1:
+			v.errorf(filterPath+".name", "the last network filter must be %s or %s", HttpConnectionManagerFilter, TcpProxyFilter)
+		}
+
+		typedConfigPath := filterPath + ".typed_config"
+		switch {
+		case filter.TcpProxy != nil:
+			v.checkTcpProxy(typedConfigPath, filter.TcpProxy, clusterNames)
+		case filter.ConnectionLimit != nil:
+			if filter.ConnectionLimit.MaxConnections <= 0 {
+				v.errorf(typedConfigPath+".max_connections", "max_connections must be greater than zero")
+			}
+			if filter.ConnectionLimit.Delay != "" {
+				if delay, err := time.ParseDuration(filter.ConnectionLimit.Delay); err != nil || delay < 0 {
+					v.errorf(typedConfigPath+".delay", "invalid duration %q", filter.ConnectionLimit.Delay)
+				}
+			}
+		case filter.RBAC != nil:
+			v.checkRBAC(typedConfigPath, filter.RBAC)
+		case filter.Name == TcpProxyFilter:
+			v.errorf(typedConfigPath, "%s needs a typed_config", TcpProxyFilter)
+		case filter.Name == ConnectionLimitFilter:
+			v.errorf(typedConfigPath, "%s needs a typed_config", ConnectionLimitFilter)
+		}
+	}
+}
+
+func (v *validator) checkTcpProxy(path string, tcpProxy *TcpProxy, clusterNames map[string]bool) {
+	if tcpProxy.StatPrefix == "" {
+		v.errorf(path+".stat_prefix", "stat_prefix is required")
+	}
+	if tcpProxy.Cluster == "" {
+		v.errorf(path+".cluster", "tcp_proxy has no cluster")
+	} else if !clusterNames[tcpProxy.Cluster] {
+		v.errorf(path+".cluster", "tcp_proxy points at unknown cluster %q", tcpProxy.Cluster)
+	}
+	if tcpProxy.IdleTimeout != "" {
+		if idleTimeout, err := time.ParseDuration(tcpProxy.IdleTimeout); err != nil || idleTimeout < 0 {
+			v.errorf(path+".idle_timeout", "invalid duration %q", tcpProxy.IdleTimeout)
+		}
+	}
+	if tcpProxy.MaxConnectAttempts < 0 {
+		v.errorf(path+".max_connect_attempts", "max_connect_attempts must not be negative")
+	}
+	for i, accessLog := range tcpProxy.AccessLog {
+		accessLogPath := fmt.Sprintf("%s.access_log[%d]", path, i)
+		switch accessLog.Name {
+		case FileAccessLog:
+			if accessLog.TypedConfig.Path == "" {
+				v.errorf(accessLogPath+".typed_config.path", "%s needs a path", FileAccessLog)
+			}
+		case StdoutAccessLog, StderrAccessLog:
+		default:
+			v.errorf(accessLogPath+".name", "unsupported access logger %q", accessLog.Name)
+		}
+		for _, match := range AccessLogCommandPattern.FindAllStringSubmatch(accessLog.Format(), -1) {
+			if !accessLogCommands[match[1]] {
+				v.errorf(accessLogPath+".typed_config.log_format.text_format_source.inline_string", "unsupported command %q", match[0])
+			}
+		}
+	}
+}
+
+// DefaultTcpAccessLogFormat is used by access loggers without a format.
+const DefaultTcpAccessLogFormat = "[%START_TIME%] %DOWNSTREAM_REMOTE_ADDRESS% %UPSTREAM_CLUSTER% %UPSTREAM_HOST% %RESPONSE_FLAGS% %BYTES_RECEIVED% %BYTES_SENT% %DURATION%\n"
+
+// AccessLogCommandPattern matches the %COMMAND% placeholders of a log format.
+var AccessLogCommandPattern = regexp.MustCompile(`%([A-Z_]+)%`)
+
+var accessLogCommands = map[string]bool{
+	"START_TIME":                true,
+	"DOWNSTREAM_REMOTE_ADDRESS": true,
+	"DOWNSTREAM_LOCAL_ADDRESS":  true,
+	"UPSTREAM_HOST":             true,
+	"UPSTREAM_CLUSTER":          true,
+	"BYTES_RECEIVED":            true,
+	"BYTES_SENT":                true,
+	"DURATION":                  true,
+	"RESPONSE_FLAGS":            true,
+}
+
+// Format returns the log format, or DefaultTcpAccessLogFormat if none is set.
+func (a AccessLog) Format() string {
+	if format := a.TypedConfig.LogFormat.TextFormatSource.InlineString; format != "" {
+		return format
+	}
+	return DefaultTcpAccessLogFormat
+}
+
+func (v *validator) checkRBAC(path string, rbac *RBAC) {
+	if rbac.StatPrefix == "" {
+		v.errorf(path+".stat_prefix", "stat_prefix is required")
+	}
+	if rbac.Rules == nil {
+		return
+	}
+	rulesPath := path + ".rules"
+	if action := rbac.Rules.Action; action != "" && action != "ALLOW" && action != "DENY" {
+		v.errorf(rulesPath+".action", "unsupported action %q", action)
+	}
+	for _, name := range rbac.Rules.PolicyNames() {
+		policy := rbac.Rules.Policies[name]
+		policyPath := fmt.Sprintf("%s.policies.%s", rulesPath, name)
+		if len(policy.Permissions) == 0 {
+			v.errorf(policyPath+".permissions", "policy %q has no permissions", name)
+		}
+		if len(policy.Principals) == 0 {
+			v.errorf(policyPath+".principals", "policy %q has no principals", name)
+		}
+		for i, permission := range policy.Permissions {
+			permissionPath := fmt.Sprintf("%s.permissions[%d]", policyPath, i)
+			switch {
+			case permission.Any == (permission.DestinationPort != 0):
+				v.errorf(permissionPath, "exactly one of any and destination_port is required")
+			case permission.DestinationPort != 0:
+				v.checkPort(permissionPath+".destination_port", permission.DestinationPort, false)
+			}
+		}
+		for i, principal := range policy.Principals {
+			principalPath := fmt.Sprintf("%s.principals[%d]", policyPath, i)
+			set := 0
+			for _, matcher := range []bool{principal.Any, principal.DirectRemoteIP != nil, principal.RemoteIP != nil, principal.Authenticated != nil} {
+				if matcher {
+					set++
+				}
+			}
+			if set != 1 {
+				v.errorf(principalPath, "exactly one of any, direct_remote_ip, remote_ip and authenticated is required")
+			}
+			if principal.Authenticated != nil && principal.Authenticated.PrincipalName != nil {
+				v.checkStringMatcher(principalPath+".authenticated.principal_name", *principal.Authenticated.PrincipalName)
+			}
+			if principal.DirectRemoteIP != nil {
+				v.checkCidrRange(principalPath+".direct_remote_ip", principal.DirectRemoteIP)
+			}
+			if principal.RemoteIP != nil {
+				v.checkCidrRange(principalPath+".remote_ip", principal.RemoteIP)
+			}
+		}
+	}
+}
+
+// PolicyNames returns the names of the policies in sorted order, the order
+// they are checked in.
+func (r RBACRules) PolicyNames() []string {
+	names := make([]string, 0, len(r.Policies))
+	for name := range r.Policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (v *validator) checkCidrRange(path string, cidrRange *CidrRange) {
+	if _, err := cidrRange.Prefix(); err != nil {
+		v.errorf(path, "%v", err)
+	}
+}
+
+// Prefix returns the range as a netip.Prefix. A missing prefix_len matches
+// the address alone.
+func (c CidrRange) Prefix() (netip.Prefix, error) {
+	addr, err := netip.ParseAddr(c.AddressPrefix)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid address_prefix %q", c.AddressPrefix)
+	}
+	bits := addr.BitLen()
+	if c.PrefixLen != nil {
+		bits = *c.PrefixLen
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid prefix_len %d for %s", bits, addr)
+	}
+	return prefix, nil
+}
+
+var (
+	nodeType        = reflect.TypeOf(yaml.Node{})
+	unmarshalerType = reflect.TypeOf((*yaml.Unmarshaler)(nil)).Elem()
+)
+
+// checkKnownFields reports the keys in node that t has no field for, in the
+// form the decoder's own check uses.
+func checkKnownFields(node *yaml.Node, t reflect.Type) error {
+	var messages []string
+	collectUnknownFields(node, t, &messages)
+	if len(messages) > 0 {
+		return &yaml.TypeError{Errors: messages}
+	}
+	return nil
+}
+
+func collectUnknownFields(node *yaml.Node, t reflect.Type, messages *[]string) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if t == nodeType || reflect.PointerTo(t).Implements(unmarshalerType) {
+		return
+	}
+
+	switch {
+	case t.Kind() == reflect.Struct && node.Kind == yaml.MappingNode:
+		fields := yamlFields(t)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			fieldType, ok := fields[key.Value]
+			if !ok {
+				*messages = append(*messages, fmt.Sprintf("line %d: field %s not found in type %s", key.Line, key.Value, t))
+				continue
+			}
+			collectUnknownFields(value, fieldType, messages)
+		}
+	case (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) && node.Kind == yaml.SequenceNode:
+		for _, item := range node.Content {
+			collectUnknownFields(item, t.Elem(), messages)
+		}
+	case t.Kind() == reflect.Map && node.Kind == yaml.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			collectUnknownFields(node.Content[i], t.Elem(), messages)
+		}
+	}
+}
+
+// yamlFields maps the keys a struct is decoded from to their field types,
+// including those of inlined structs.
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		tag := field.Tag.Get("yaml")
+		name, options, _ := strings.Cut(tag, ",")
+		switch {
+		case name == "-":
+			continue
+		case strings.Contains(options, "inline"):
+			for key, fieldType := range yamlFields(field.Type) {
+				fields[key] = fieldType
+			}
+			continue
+		case name == "":
+			name = strings.ToLower(field.Name)
+		}
+		fields[name] = field.Type
+	}
+	return fields
+}
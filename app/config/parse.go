@@ -1,84 +1,263 @@
 package config
 
 import (
-	"fmt"
+	"bytes"
+	"errors"
 	"os"
 
 	"gopkg.in/yaml.v3"
 )
 
+// DefaultPath is where the bootstrap config is read from when no other path is given.
+const DefaultPath = "config/static.yaml"
+
+type SocketAddress struct {
+	// Protocol is TCP, the default, or UDP. Only listeners use it.
+	Protocol  string `yaml:"protocol,omitempty"`
+	Address   string `yaml:"address,omitempty"`
+	PortValue int    `yaml:"port_value,omitempty"`
+}
+
+type Address struct {
+	SocketAddress SocketAddress `yaml:"socket_address,omitempty"`
+}
+
+type Admin struct {
+	Address Address `yaml:"address,omitempty"`
+}
+
 type StaticBootstrap struct {
-	Admin struct {
-		Address struct {
-			SocketAddress struct {
-				Address   string `yaml:"address"`
-				PortValue int    `yaml:"port_value"`
-			} `yaml:"socket_address"`
-		} `yaml:"address"`
-	} `yaml:"admin"`
-	StaticResources struct {
-		Listeners []struct {
-			Name    string `yaml:"name"`
-			Address struct {
-				SocketAddress struct {
-					Address   string `yaml:"address"`
-					PortValue int    `yaml:"port_value"`
-				} `yaml:"socket_address"`
-			} `yaml:"address"`
-			FilterChains []struct {
-				Filters []struct {
-					Name        string `yaml:"name"`
-					TypedConfig struct {
-						Type        string `yaml:"@type"`
-						StatPrefix  string `yaml:"stat_prefix"`
-						CodecType   string `yaml:"codec_type"`
-						RouteConfig struct {
-							Name         string `yaml:"name"`
-							VirtualHosts []struct {
-								Name    string   `yaml:"name"`
-								Domains []string `yaml:"domains"`
-								Routes  []struct {
-									Match struct {
-										Prefix string `yaml:"prefix"`
-									} `yaml:"match"`
-									Route struct {
-										Cluster string `yaml:"cluster"`
-									} `yaml:"route"`
-								} `yaml:"routes"`
-							} `yaml:"virtual_hosts"`
-						} `yaml:"route_config"`
-						HTTPFilters []struct {
-							Name        string `yaml:"name"`
-							TypedConfig struct {
-								Type string `yaml:"@type"`
-							} `yaml:"typed_config"`
-						} `yaml:"http_filters"`
-					} `yaml:"typed_config"`
-				} `yaml:"filters"`
-			} `yaml:"filter_chains"`
-		} `yaml:"listeners"`
-		Clusters []struct {
-			Name           string `yaml:"name"`
-			ConnectTimeout string `yaml:"connect_timeout"`
-			Type           string `yaml:"type"`
-			LbPolicy       string `yaml:"lb_policy"`
-			LoadAssignment struct {
-				ClusterName string `yaml:"cluster_name"`
-				Endpoints   []struct {
-					LbEndpoints []struct {
-						Endpoint struct {
-							Address struct {
-								SocketAddress struct {
-									Address   string `yaml:"address"`
-									PortValue int    `yaml:"port_value"`
-								} `yaml:"socket_address"`
-							} `yaml:"address"`
-						} `yaml:"endpoint"`
-					} `yaml:"lb_endpoints"`
-				} `yaml:"endpoints"`
-			} `yaml:"load_assignment"`
-		} `yaml:"clusters"`
-	} `yaml:"static_resources"`
+	Node             Node             `yaml:"node,omitempty"`
+	Admin            Admin            `yaml:"admin,omitempty"`
+	StaticResources  StaticResources  `yaml:"static_resources,omitempty"`
+	DynamicResources DynamicResources `yaml:"dynamic_resources,omitempty"`
+}
+
+// Node identifies this router to a management server.
+type Node struct {
+	ID      string `yaml:"id,omitempty"`
+	Cluster string `yaml:"cluster,omitempty"`
+	// Locality is where the router runs. KUBERNETES clusters prefer the
+	// endpoints hinted for its zone.
+	Locality Locality `yaml:"locality,omitempty"`
+}
+
+type Locality struct {
+	Region  string `yaml:"region,omitempty"`
+	Zone    string `yaml:"zone,omitempty"`
+	SubZone string `yaml:"sub_zone,omitempty"`
+}
+
+// DynamicResources says where listeners and clusters beyond the static ones
+// come from. It is read once at startup.
+type DynamicResources struct {
+	AdsConfig *ApiConfigSource `yaml:"ads_config,omitempty"`
+	CdsConfig *ConfigSource    `yaml:"cds_config,omitempty"`
+	LdsConfig *ConfigSource    `yaml:"lds_config,omitempty"`
+}
+
+// ApiConfigSource points at a management server through one of the static
+// clusters.
+type ApiConfigSource struct {
+	ApiType             string        `yaml:"api_type,omitempty"`
+	TransportApiVersion string        `yaml:"transport_api_version,omitempty"`
+	GrpcServices        []GrpcService `yaml:"grpc_services,omitempty"`
+}
+
+type GrpcService struct {
+	EnvoyGrpc struct {
+		ClusterName string `yaml:"cluster_name,omitempty"`
+	} `yaml:"envoy_grpc,omitempty"`
+}
+
+// ConfigSource says how a kind of resource is discovered: over the aggregated
+// stream from ads_config, or from a file holding a DiscoveryResponse.
+type ConfigSource struct {
+	Ads                *struct{}         `yaml:"ads,omitempty"`
+	PathConfigSource   *PathConfigSource `yaml:"path_config_source,omitempty"`
+	ResourceApiVersion string            `yaml:"resource_api_version,omitempty"`
+}
+
+type PathConfigSource struct {
+	Path string `yaml:"path,omitempty"`
+}
+
+type StaticResources struct {
+	Listeners []Listener `yaml:"listeners,omitempty"`
+	Clusters  []Cluster  `yaml:"clusters,omitempty"`
+}
+
+type Listener struct {
+	Name            string           `yaml:"name,omitempty"`
+	Address         Address          `yaml:"address,omitempty"`
+	ListenerFilters []ListenerFilter `yaml:"listener_filters,omitempty"`
+	// ListenerFiltersTimeout is how long the listener filters may take to
+	// inspect a new connection before it is closed, by default 15s. "0s"
+	// turns the timeout off.
+	ListenerFiltersTimeout string             `yaml:"listener_filters_timeout,omitempty"`
+	FilterChains           []FilterChain      `yaml:"filter_chains,omitempty"`
+	UdpListenerConfig      *UdpListenerConfig `yaml:"udp_listener_config,omitempty"`
+}
+
+type FilterChain struct {
+	FilterChainMatch FilterChainMatch           `yaml:"filter_chain_match,omitempty"`
+	TransportSocket  *DownstreamTransportSocket `yaml:"transport_socket,omitempty"`
+	Filters          []Filter                   `yaml:"filters,omitempty"`
+}
+
+// HttpConnectionManagerFilter is the network filter that routes HTTP traffic.
+const HttpConnectionManagerFilter = "envoy.filters.network.http_connection_manager"
+
+// Filter is a network filter. Its typed_config is read into the field for
+// its name: TypedConfig for the HTTP connection manager and the field of the
+// same name for the others.
+type Filter struct {
+	Name            string                `yaml:"name,omitempty"`
+	TypedConfig     HttpConnectionManager `yaml:"typed_config,omitempty"`
+	TcpProxy        *TcpProxy             `yaml:"-"`
+	ConnectionLimit *ConnectionLimit      `yaml:"-"`
+	RBAC            *RBAC                 `yaml:"-"`
+}
+
+type HttpConnectionManager struct {
+	Type        string             `yaml:"@type,omitempty"`
+	StatPrefix  string             `yaml:"stat_prefix,omitempty"`
+	CodecType   string             `yaml:"codec_type,omitempty"`
+	RouteConfig RouteConfiguration `yaml:"route_config,omitempty"`
+	HTTPFilters []HttpFilter       `yaml:"http_filters,omitempty"`
+	// ForwardClientCertDetails says what becomes of the
+	// x-forwarded-client-cert header, and SetCurrentClientCertDetails what
+	// goes into it about the client certificate when one is added.
+	ForwardClientCertDetails    string                      `yaml:"forward_client_cert_details,omitempty"`
+	SetCurrentClientCertDetails SetCurrentClientCertDetails `yaml:"set_current_client_cert_details,omitempty"`
+	// Http2ProtocolOptions tunes the HTTP/2 connections of clients.
+	Http2ProtocolOptions *Http2ProtocolOptions `yaml:"http2_protocol_options,omitempty"`
+}
+
+type RouteConfiguration struct {
+	Name         string        `yaml:"name,omitempty"`
+	VirtualHosts []VirtualHost `yaml:"virtual_hosts,omitempty"`
+}
+
+type VirtualHost struct {
+	Name    string   `yaml:"name,omitempty"`
+	Domains []string `yaml:"domains,omitempty"`
+	Routes  []Route  `yaml:"routes,omitempty"`
+	// TypedPerFilterConfig overrides the config of HTTP filters, by filter
+	// name, for the virtual host's routes.
+	TypedPerFilterConfig map[string]TypedConfig `yaml:"typed_per_filter_config,omitempty"`
+}
+
+type Route struct {
+	Match struct {
+		Prefix string `yaml:"prefix,omitempty"`
+		// Headers must all match too.
+		Headers []HeaderMatcher `yaml:"headers,omitempty"`
+	} `yaml:"match,omitempty"`
+	Route struct {
+		Cluster string `yaml:"cluster,omitempty"`
+		// UpgradeConfigs lets requests that ask to switch protocols, such
+		// as WebSockets, through to the cluster. Other upgrade requests are
+		// refused.
+		UpgradeConfigs []UpgradeConfig `yaml:"upgrade_configs,omitempty"`
+		// IdleTimeout closes upgraded connections that carry nothing for
+		// this long, five minutes by default.
+		IdleTimeout string `yaml:"idle_timeout,omitempty"`
+	} `yaml:"route,omitempty"`
+	// TypedPerFilterConfig overrides the config of HTTP filters, by filter
+	// name, for this route. It takes precedence over the virtual host's.
+	TypedPerFilterConfig map[string]TypedConfig `yaml:"typed_per_filter_config,omitempty"`
+}
+
+type HttpFilter struct {
+	Name        string      `yaml:"name,omitempty"`
+	TypedConfig TypedConfig `yaml:"typed_config,omitempty"`
+}
+
+type Cluster struct {
+	Name           string                `yaml:"name,omitempty"`
+	ConnectTimeout string                `yaml:"connect_timeout,omitempty"`
+	Type           string                `yaml:"type,omitempty"`
+	LbPolicy       string                `yaml:"lb_policy,omitempty"`
+	LoadAssignment ClusterLoadAssignment `yaml:"load_assignment,omitempty"`
+	// DnsRefreshRate, RespectDnsTtl and DnsLookupFamily control how the
+	// endpoint hostnames of STRICT_DNS and LOGICAL_DNS clusters are resolved.
+	DnsRefreshRate  string `yaml:"dns_refresh_rate,omitempty"`
+	RespectDnsTtl   bool   `yaml:"respect_dns_ttl,omitempty"`
+	DnsLookupFamily string `yaml:"dns_lookup_family,omitempty"`
+	// EdsClusterConfig says where the endpoints of an EDS cluster come from.
+	// Its load_assignment is filled in as they are discovered.
+	EdsClusterConfig *EdsClusterConfig `yaml:"eds_cluster_config,omitempty"`
+	// ConsulClusterConfig names the Consul service a CONSUL cluster's
+	// endpoints come from.
+	ConsulClusterConfig *ConsulClusterConfig `yaml:"consul_cluster_config,omitempty"`
+	// KubernetesClusterConfig names the Kubernetes Service whose
+	// EndpointSlices a KUBERNETES cluster's endpoints come from.
+	KubernetesClusterConfig *KubernetesClusterConfig `yaml:"kubernetes_cluster_config,omitempty"`
+	// TransportSocket starts TLS on the connections to the cluster's
+	// endpoints.
+	TransportSocket *UpstreamTransportSocket `yaml:"transport_socket,omitempty"`
+	// Http2ProtocolOptions makes requests to the endpoints go over HTTP/2.
+	Http2ProtocolOptions *Http2ProtocolOptions `yaml:"http2_protocol_options,omitempty"`
+}
+
+type EdsClusterConfig struct {
+	EdsConfig   ConfigSource `yaml:"eds_config,omitempty"`
+	ServiceName string       `yaml:"service_name,omitempty"`
+}
+
+type ConsulClusterConfig struct {
+	// Address is the base URL of the Consul HTTP API, by default
+	// http://127.0.0.1:8500.
+	Address     string `yaml:"address,omitempty"`
+	ServiceName string `yaml:"service_name,omitempty"`
+	// Tags keeps only the instances that have every one of them.
+	Tags       []string `yaml:"tags,omitempty"`
+	Datacenter string   `yaml:"datacenter,omitempty"`
+	Token      string   `yaml:"token,omitempty"`
+	// WaitTime is how long a blocking query waits for a change, by default
+	// five minutes.
+	WaitTime string `yaml:"wait_time,omitempty"`
+}
+
+type KubernetesClusterConfig struct {
+	ServiceName string `yaml:"service_name,omitempty"`
+	// Namespace defaults to the router's own namespace when it runs in the
+	// cluster, and to the kubeconfig context's namespace otherwise.
+	Namespace string `yaml:"namespace,omitempty"`
+	// PortName picks the Service port by name. Without it the first port is
+	// used.
+	PortName string `yaml:"port_name,omitempty"`
+	// Kubeconfig is the path of a kubeconfig file. Without it the in-cluster
+	// service account is used.
+	Kubeconfig string `yaml:"kubeconfig,omitempty"`
+}
+
+// EdsServiceName is the name the cluster's endpoints are requested under.
+func (c Cluster) EdsServiceName() string {
+	if c.EdsClusterConfig != nil && c.EdsClusterConfig.ServiceName != "" {
+		return c.EdsClusterConfig.ServiceName
+	}
+	return c.Name
+}
+
+type ClusterLoadAssignment struct {
+	ClusterName string                `yaml:"cluster_name,omitempty"`
+	Endpoints   []LocalityLbEndpoints `yaml:"endpoints,omitempty"`
+}
+
+type LocalityLbEndpoints struct {
+	LbEndpoints []LbEndpoint `yaml:"lb_endpoints,omitempty"`
+}
+
+type LbEndpoint struct {
+	Endpoint struct {
+		Address Address `yaml:"address,omitempty"`
+	} `yaml:"endpoint,omitempty"`
+	// HealthStatus is one of Envoy's EDS health statuses. DRAINING endpoints
+	// keep their connections but get no new requests.
+	HealthStatus        string `yaml:"health_status,omitempty"`
+	LoadBalancingWeight int    `yaml:"load_balancing_weight,omitempty"`
 }
 
 type BackendServer struct {
@@ -86,32 +265,67 @@ type BackendServer struct {
 	Port    int
 }
 
-func GetYAMLdata() (StaticBootstrap, []BackendServer) {
-	var staticBootstrap StaticBootstrap
-	var backendServers []BackendServer
-
-	staticData, err := os.ReadFile("config/static.yaml")
+// Load reads and validates the bootstrap config at path. Any problems found are
+// returned together as ValidationErrors so they can all be fixed in one go.
+func Load(path string) (StaticBootstrap, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
-		fmt.Println("Error reading 'static.yaml'")
-	} else {
-		err = yaml.Unmarshal(staticData, &staticBootstrap)
-		if err != nil {
-			fmt.Println("Error unmarshaling 'listeners.yaml'")
+		return StaticBootstrap{}, err
+	}
+	staticBootstrap, err := Parse(data)
+	var validationErrors ValidationErrors
+	if errors.As(err, &validationErrors) {
+		for i := range validationErrors {
+			validationErrors[i].File = path
 		}
+		return staticBootstrap, validationErrors
+	}
+	return staticBootstrap, err
+}
+
+// Parse decodes a bootstrap document, rejecting unknown fields, and runs the
+// semantic checks in Validate on the result.
+func Parse(data []byte) (StaticBootstrap, error) {
+	var staticBootstrap StaticBootstrap
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return staticBootstrap, yamlErrors(err)
+	}
 
-		// Extract backend server information from the configuration
-		for _, cluster := range staticBootstrap.StaticResources.Clusters {
-			for _, endpoint := range cluster.LoadAssignment.Endpoints {
-				for _, lbEndpoint := range endpoint.LbEndpoints {
-					server := BackendServer{
-						Address: lbEndpoint.Endpoint.Address.SocketAddress.Address,
-						Port:    int(lbEndpoint.Endpoint.Address.SocketAddress.PortValue),
-					}
-					backendServers = append(backendServers, server)
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&staticBootstrap); err != nil {
+		return staticBootstrap, yamlErrors(err)
+	}
+
+	if errs := validate(&staticBootstrap, newPositions(&root)); len(errs) > 0 {
+		return staticBootstrap, errs
+	}
+	return staticBootstrap, nil
+}
+
+// BackendServers flattens the endpoints of every cluster into a single list.
+func (b StaticBootstrap) BackendServers() []BackendServer {
+	var backendServers []BackendServer
+	for _, cluster := range b.StaticResources.Clusters {
+		for _, endpoint := range cluster.LoadAssignment.Endpoints {
+			for _, lbEndpoint := range endpoint.LbEndpoints {
+				server := BackendServer{
+					Address: lbEndpoint.Endpoint.Address.SocketAddress.Address,
+					Port:    lbEndpoint.Endpoint.Address.SocketAddress.PortValue,
 				}
+				backendServers = append(backendServers, server)
 			}
 		}
 	}
+	return backendServers
+}
 
-	return staticBootstrap, backendServers
+func GetYAMLdata(path string) (StaticBootstrap, []BackendServer, error) {
+	staticBootstrap, err := Load(path)
+	if err != nil {
+		return staticBootstrap, nil, err
+	}
+	return staticBootstrap, staticBootstrap.BackendServers(), nil
 }
@@ -0,0 +1,819 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const validConfig = `
+admin:
+  address:
+    socket_address: { address: 127.0.0.1, port_value: 9901 }
+static_resources:
+  listeners:
+  - name: listener_0
+    address:
+      socket_address: { address: 127.0.0.1, port_value: 10000 }
+    filter_chains:
+    - filters:
+      - name: envoy.filters.network.http_connection_manager
+        typed_config:
+          route_config:
+            virtual_hosts:
+            - name: local_service
+              domains: ["*"]
+              routes:
+              - match: { prefix: "/" }
+                route: { cluster: some_service }
+  clusters:
+  - name: some_service
+    connect_timeout: 0.25s
+    lb_policy: ROUND_ROBIN
+    load_assignment:
+      endpoints:
+      - lb_endpoints:
+        - endpoint:
+            address:
+              socket_address: { address: 127.0.0.1, port_value: 1234 }
+`
+
+func TestParseValidConfig(t *testing.T) {
+	staticBootstrap, err := Parse([]byte(validConfig))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	servers := staticBootstrap.BackendServers()
+	if len(servers) != 1 || servers[0].Address != "127.0.0.1" || servers[0].Port != 1234 {
+		t.Errorf("unexpected backend servers: %v", servers)
+	}
+}
+
+func TestParseReportsLineNumbers(t *testing.T) {
+	tests := []struct {
+		name    string
+		old     string
+		new     string
+		line    int
+		message string
+	}{
+		{"unknown field", "lb_policy: ROUND_ROBIN", "lb_polcy: ROUND_ROBIN", 24, "field lb_polcy not found"},
+		{"bad duration", "connect_timeout: 0.25s", "connect_timeout: quarter", 23, `invalid duration "quarter"`},
+		{"bad port", "port_value: 1234", "port_value: 123456", 30, "port 123456 is out of range"},
+		{"missing cluster", "cluster: some_service", "cluster: other_service", 20, `unknown cluster "other_service"`},
+		{"wrong type", "port_value: 1234", "port_value: high", 30, "cannot unmarshal"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(strings.Replace(validConfig, tt.old, tt.new, 1)))
+
+			var errs ValidationErrors
+			if !errors.As(err, &errs) || len(errs) != 1 {
+				t.Fatalf("expected a single validation error, got %v", err)
+			}
+			if errs[0].Line != tt.line {
+				t.Errorf("expected error on line %d, got %d (%v)", tt.line, errs[0].Line, errs[0])
+			}
+			if !strings.Contains(errs[0].Message, tt.message) {
+				t.Errorf("expected message to contain %q, got %q", tt.message, errs[0].Message)
+			}
+		})
+	}
+}
+
+func TestParseDuplicateAndEmptyClusters(t *testing.T) {
+	duplicate := validConfig + `
+  - name: some_service
+    load_assignment: {}
+`
+	_, err := Parse([]byte(duplicate))
+
+	var errs ValidationErrors
+	if !errors.As(err, &errs) || len(errs) != 2 {
+		t.Fatalf("expected two validation errors, got %v", err)
+	}
+	if !strings.Contains(errs[0].Message, `duplicate cluster name "some_service"`) || errs[0].Line != 32 {
+		t.Errorf("unexpected first error: %v", errs[0])
+	}
+	if !strings.Contains(errs[1].Message, "has no endpoints") || errs[1].Line != 33 {
+		t.Errorf("unexpected second error: %v", errs[1])
+	}
+}
+
+func TestParseDynamicResources(t *testing.T) {
+	dynamic := validConfig + `
+  - name: eds_service
+    type: EDS
+    eds_cluster_config:
+      eds_config: { ads: {}, resource_api_version: V3 }
+dynamic_resources:
+  ads_config:
+    api_type: GRPC
+    transport_api_version: V3
+    grpc_services:
+    - envoy_grpc: { cluster_name: some_service }
+  cds_config: { ads: {} }
+  lds_config: { ads: {} }
+`
+	staticBootstrap, err := Parse([]byte(dynamic))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if staticBootstrap.DynamicResources.CdsConfig == nil || staticBootstrap.DynamicResources.CdsConfig.Ads == nil {
+		t.Errorf("expected cds_config to use ads, got %+v", staticBootstrap.DynamicResources)
+	}
+
+	_, err = Parse([]byte(strings.Replace(dynamic, "cluster_name: some_service", "cluster_name: xds_cluster", 1)))
+	if err == nil || !strings.Contains(err.Error(), `unknown cluster "xds_cluster"`) {
+		t.Errorf("expected an unknown ads cluster to be rejected, got %v", err)
+	}
+
+	withoutAds := dynamic[:strings.Index(dynamic, "dynamic_resources:")]
+	_, err = Parse([]byte(withoutAds))
+	if err == nil || !strings.Contains(err.Error(), "without dynamic_resources.ads_config") {
+		t.Errorf("expected an EDS cluster without ads_config to be rejected, got %v", err)
+	}
+
+	fileBased := strings.Replace(withoutAds, "eds_config: { ads: {}, resource_api_version: V3 }", "eds_config: { path_config_source: { path: /etc/envoyrouter/eds_service.yaml } }", 1) + `
+dynamic_resources:
+  cds_config: { path_config_source: { path: /etc/envoyrouter/cds.yaml } }
+`
+	if _, err := Parse([]byte(fileBased)); err != nil {
+		t.Errorf("expected file based config sources to need no ads_config, got %v", err)
+	}
+}
+
+func TestParseDNSClusters(t *testing.T) {
+	dns := validConfig + `
+  - name: dns_service
+    type: STRICT_DNS
+    dns_refresh_rate: 10s
+    respect_dns_ttl: true
+    dns_lookup_family: V4_ONLY
+    load_assignment:
+      endpoints:
+      - lb_endpoints:
+        - endpoint:
+            address:
+              socket_address: { address: backend.example.com, port_value: 80 }
+        - endpoint:
+            address:
+              socket_address: { address: _http._tcp.example.com, port_value: 0 }
+`
+	if _, err := Parse([]byte(dns)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err := Parse([]byte(strings.Replace(dns, "STRICT_DNS", "LOGICAL_DNS", 1)))
+	if err == nil || !strings.Contains(err.Error(), "must have exactly one endpoint") {
+		t.Errorf("expected a LOGICAL_DNS cluster with two endpoints to be rejected, got %v", err)
+	}
+
+	_, err = Parse([]byte(strings.Replace(dns, "dns_refresh_rate: 10s", "dns_refresh_rate: soon", 1)))
+	if err == nil || !strings.Contains(err.Error(), `invalid duration "soon"`) {
+		t.Errorf("expected an invalid dns_refresh_rate to be rejected, got %v", err)
+	}
+}
+
+func TestParseConsulClusters(t *testing.T) {
+	consul := validConfig + `
+  - name: web
+    type: CONSUL
+    consul_cluster_config:
+      address: http://consul.service:8500
+      service_name: web
+      tags: [primary]
+      wait_time: 1m
+`
+	if _, err := Parse([]byte(consul)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err := Parse([]byte(strings.Replace(consul, "service_name: web", "datacenter: dc1", 1)))
+	if err == nil || !strings.Contains(err.Error(), "service_name is required") {
+		t.Errorf("expected a CONSUL cluster without service_name to be rejected, got %v", err)
+	}
+
+	_, err = Parse([]byte(strings.Replace(consul, "http://consul.service:8500", "consul.service:8500", 1)))
+	if err == nil || !strings.Contains(err.Error(), "must be an http or https URL") {
+		t.Errorf("expected an address without a scheme to be rejected, got %v", err)
+	}
+}
+
+func TestParseKubernetesClusters(t *testing.T) {
+	kubernetes := validConfig + `
+  - name: web
+    type: KUBERNETES
+    kubernetes_cluster_config: { service_name: web, namespace: shop, port_name: http }
+node:
+  locality: { zone: zone-a }
+`
+	if _, err := Parse([]byte(kubernetes)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err := Parse([]byte(strings.Replace(kubernetes, "service_name: web, ", "", 1)))
+	if err == nil || !strings.Contains(err.Error(), "service_name is required") {
+		t.Errorf("expected a KUBERNETES cluster without service_name to be rejected, got %v", err)
+	}
+}
+
+func TestParseHTTPFilters(t *testing.T) {
+	withFilters := strings.Replace(validConfig, `          route_config:`, `          http_filters:
+          - name: envoy.filters.http.router
+            typed_config:
+              "@type": type.googleapis.com/envoy.extensions.filters.http.router.v3.Router
+          route_config:`, 1)
+	staticBootstrap, err := Parse([]byte(withFilters))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	httpFilter := staticBootstrap.StaticResources.Listeners[0].FilterChains[0].Filters[0].TypedConfig.HTTPFilters[0]
+	if httpFilter.TypedConfig.Type != "type.googleapis.com/envoy.extensions.filters.http.router.v3.Router" {
+		t.Errorf("expected the filter's @type to be kept, got %+v", httpFilter.TypedConfig)
+	}
+
+	unknown := strings.Replace(withFilters, `          - name: envoy.filters.http.router`, `          - name: envoy.filters.http.unknown
+          - name: envoy.filters.http.router`, 1)
+	_, err = Parse([]byte(unknown))
+	var errs ValidationErrors
+	if !errors.As(err, &errs) || len(errs) != 1 || errs[0].Line != 15 || !strings.Contains(errs[0].Message, `unknown http filter "envoy.filters.http.unknown"`) {
+		t.Errorf("expected an unknown http filter to be rejected on line 15, got %v", err)
+	}
+
+	routerFirst := strings.Replace(withFilters, `          route_config:`, `          - name: envoy.filters.http.router
+          route_config:`, 1)
+	_, err = Parse([]byte(routerFirst))
+	if err == nil || !strings.Contains(err.Error(), "must be the last http filter") {
+		t.Errorf("expected a router before another filter to be rejected, got %v", err)
+	}
+}
+
+func TestTypedConfigDecode(t *testing.T) {
+	var typedConfig TypedConfig
+	if err := yaml.Unmarshal([]byte(`{"@type": type.googleapis.com/envoy.extensions.filters.http.buffer.v3.Buffer, max_request_bytes: 1024}`), &typedConfig); err != nil {
+		t.Fatal(err)
+	}
+	var buffer struct {
+		MaxRequestBytes int `yaml:"max_request_bytes"`
+	}
+	if err := typedConfig.Decode(&buffer); err != nil || buffer.MaxRequestBytes != 1024 {
+		t.Errorf("expected max_request_bytes 1024, got %d (%v)", buffer.MaxRequestBytes, err)
+	}
+	var other struct {
+		MaxBytes int `yaml:"max_bytes"`
+	}
+	if err := typedConfig.Decode(&other); err == nil || !strings.Contains(err.Error(), "field max_request_bytes not found") {
+		t.Errorf("expected unknown fields to be rejected, got %v", err)
+	}
+
+	data, err := yaml.Marshal(typedConfig)
+	if err != nil || !strings.Contains(string(data), "'@type': type.googleapis.com/envoy.extensions.filters.http.buffer.v3.Buffer") {
+		t.Errorf("expected @type to be written back, got %s (%v)", data, err)
+	}
+}
+
+func TestParseNetworkFilters(t *testing.T) {
+	tcpProxy := strings.Replace(validConfig, `      - name: envoy.filters.network.http_connection_manager
+        typed_config:
+          route_config:
+            virtual_hosts:
+            - name: local_service
+              domains: ["*"]
+              routes:
+              - match: { prefix: "/" }
+                route: { cluster: some_service }
+`, `      - name: envoy.filters.network.rbac
+        typed_config:
+          stat_prefix: postgres
+          rules:
+            action: ALLOW
+            policies:
+              internal:
+                permissions: [{ any: true }]
+                principals: [{ remote_ip: { address_prefix: 10.0.0.0, prefix_len: 8 } }]
+      - name: envoy.filters.network.connection_limit
+        typed_config: { stat_prefix: postgres, max_connections: 100, delay: 1s }
+      - name: envoy.filters.network.tcp_proxy
+        typed_config:
+          stat_prefix: postgres
+          cluster: some_service
+          idle_timeout: 10m
+          access_log:
+          - name: envoy.access_loggers.stdout
+`, 1)
+	staticBootstrap, err := Parse([]byte(tcpProxy))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	filters := staticBootstrap.StaticResources.Listeners[0].FilterChains[0].Filters
+	if len(filters) != 3 || filters[0].RBAC == nil || filters[1].ConnectionLimit == nil || filters[2].TcpProxy == nil {
+		t.Fatalf("expected rbac, connection_limit and tcp_proxy configs, got %+v", filters)
+	}
+	if filters[2].TcpProxy.Cluster != "some_service" || filters[1].ConnectionLimit.MaxConnections != 100 {
+		t.Errorf("unexpected filter configs %+v and %+v", filters[2].TcpProxy, filters[1].ConnectionLimit)
+	}
+
+	for _, test := range []struct {
+		name, old, new, message string
+		line                    int
+	}{
+		{"unknown field", "idle_timeout: 10m", "idle_time: 10m", "field idle_time not found", 27},
+		{"unknown cluster", "cluster: some_service", "cluster: other_service", `unknown cluster "other_service"`, 26},
+		{"bad prefix", "prefix_len: 8", "prefix_len: 40", "invalid prefix_len 40", 20},
+		{"terminal filter not last", "      - name: envoy.filters.network.connection_limit", "      - name: envoy.filters.network.tcp_proxy\n        typed_config: { stat_prefix: other, cluster: some_service }\n      - name: envoy.filters.network.connection_limit", "must be the last network filter", 21},
+		{"bad log format", "      - name: envoy.access_loggers.stdout", "      - name: envoy.access_loggers.stdout\n            typed_config: { log_format: { text_format_source: { inline_string: \"%PROTOCOL%\" } } }", `unsupported command "%PROTOCOL%"`, 30},
+	} {
+		_, err := Parse([]byte(strings.Replace(tcpProxy, test.old, test.new, 1)))
+		if err == nil || !strings.Contains(err.Error(), test.message) || !strings.HasPrefix(err.Error(), fmt.Sprintf("%d:", test.line)) {
+			t.Errorf("%s: expected an error on line %d containing %q, got %v", test.name, test.line, test.message, err)
+		}
+	}
+}
+
+func TestParseDownstreamMtls(t *testing.T) {
+	certificateChain, privateKey := writeKeyPair(t, t.TempDir())
+	mtlsConfig := strings.Replace(validConfig, `    filter_chains:
+    - filters:
+      - name: envoy.filters.network.http_connection_manager
+        typed_config:
+          route_config:`, fmt.Sprintf(`    filter_chains:
+    - transport_socket:
+        name: envoy.transport_sockets.tls
+        typed_config:
+          require_client_certificate: true
+          common_tls_context:
+            tls_certificates:
+            - certificate_chain: { filename: %s }
+              private_key: { filename: %s }
+            validation_context:
+              trusted_ca: { filename: %s }
+              match_typed_subject_alt_names:
+              - san_type: URI
+                matcher: { prefix: "spiffe://example.com/" }
+              - san_type: DNS
+                matcher: { safe_regex: { regex: "[a-z]+\\.example\\.com" } }
+      filters:
+      - name: envoy.filters.network.http_connection_manager
+        typed_config:
+          forward_client_cert_details: SANITIZE_SET
+          set_current_client_cert_details: { subject: true, uri: true }
+          route_config:`, certificateChain, privateKey, certificateChain), 1)
+	mtlsConfig = strings.Replace(mtlsConfig, `              - match: { prefix: "/" }`, `              - match:
+                  prefix: "/"
+                  headers:
+                  - name: x-tenant
+                    string_match: { exact: blue, ignore_case: true }`, 1)
+	staticBootstrap, err := Parse([]byte(mtlsConfig))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	filterChain := staticBootstrap.StaticResources.Listeners[0].FilterChains[0]
+	if validationContext := filterChain.TransportSocket.TypedConfig.CommonTlsContext.ValidationContext; validationContext == nil || len(validationContext.MatchTypedSubjectAltNames) != 2 {
+		t.Errorf("expected a validation context with two SAN matchers, got %+v", validationContext)
+	}
+	hcm := filterChain.Filters[0].TypedConfig
+	if hcm.ForwardClientCertDetails != SanitizeSet || !hcm.SetCurrentClientCertDetails.Subject || !hcm.SetCurrentClientCertDetails.URI {
+		t.Errorf("unexpected client cert details %q %+v", hcm.ForwardClientCertDetails, hcm.SetCurrentClientCertDetails)
+	}
+	if headers := hcm.RouteConfig.VirtualHosts[0].Routes[0].Match.Headers; len(headers) != 1 || !headers[0].Matches(http.Header{"X-Tenant": {"Blue"}}) {
+		t.Errorf("expected a header matcher for x-tenant: blue, got %+v", headers)
+	}
+
+	for _, test := range []struct {
+		name, old, new, message string
+	}{
+		{"unknown san type", "san_type: URI", "san_type: OTHER_NAME", `unsupported san_type "OTHER_NAME"`},
+		{"two string matchers", `{ prefix: "spiffe://example.com/" }`, `{ prefix: "spiffe://", suffix: "/web" }`, "exactly one of exact, prefix, suffix, contains and safe_regex is required"},
+		{"bad regex", `[a-z]+`, `[a-z+`, "invalid regex"},
+		{"missing ca", "trusted_ca: { filename: " + certificateChain, "trusted_ca: { filename: " + certificateChain + ".missing", "cannot load trusted_ca"},
+		{"unknown forward mode", "SANITIZE_SET", "FORWARD_ALL", `unsupported forward_client_cert_details "FORWARD_ALL"`},
+		{"header without match", "string_match: { exact: blue, ignore_case: true }", "invert_match: true", "exactly one of string_match and present_match is required"},
+	} {
+		_, err := Parse([]byte(strings.Replace(mtlsConfig, test.old, test.new, 1)))
+		if err == nil || !strings.Contains(err.Error(), test.message) {
+			t.Errorf("%s: expected an error containing %q, got %v", test.name, test.message, err)
+		}
+	}
+
+	// A client certificate can only be required if there is a CA to verify
+	// it with.
+	start := strings.Index(mtlsConfig, "            validation_context:")
+	end := strings.Index(mtlsConfig, "      filters:")
+	_, err = Parse([]byte(mtlsConfig[:start] + mtlsConfig[end:]))
+	if message := "require_client_certificate needs a validation_context"; err == nil || !strings.Contains(err.Error(), message) {
+		t.Errorf("expected an error containing %q, got %v", message, err)
+	}
+}
+
+func TestParseUpstreamTls(t *testing.T) {
+	certificateChain, privateKey := writeKeyPair(t, t.TempDir())
+	tlsConfig := strings.Replace(validConfig, "    lb_policy: ROUND_ROBIN\n", fmt.Sprintf(`    lb_policy: ROUND_ROBIN
+    transport_socket:
+      name: envoy.transport_sockets.tls
+      typed_config:
+        "@type": type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.UpstreamTlsContext
+        sni: backend.example.com
+        common_tls_context:
+          tls_certificates:
+          - certificate_chain: { filename: %s }
+            private_key: { filename: %s }
+          validation_context:
+            trusted_ca: { filename: %s }
+            match_typed_subject_alt_names:
+            - san_type: DNS
+              matcher: { exact: backend.example.com }
+`, certificateChain, privateKey, certificateChain), 1)
+	staticBootstrap, err := Parse([]byte(tlsConfig))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	upstreamTls := staticBootstrap.StaticResources.Clusters[0].TransportSocket.TypedConfig
+	if upstreamTls.Sni != "backend.example.com" || len(upstreamTls.CommonTlsContext.TlsCertificates) != 1 || upstreamTls.CommonTlsContext.ValidationContext == nil {
+		t.Errorf("unexpected upstream TLS context %+v", upstreamTls)
+	}
+
+	for _, test := range []struct {
+		name, old, new, message string
+	}{
+		{"unknown socket", "name: envoy.transport_sockets.tls", "name: envoy.transport_sockets.alts", `unsupported transport socket "envoy.transport_sockets.alts"`},
+		{"two certificates", "          validation_context:", fmt.Sprintf("          - certificate_chain: { filename: %s }\n            private_key: { filename: %s }\n          validation_context:", certificateChain, privateKey), "at most one client certificate"},
+		{"missing ca", "trusted_ca: { filename: " + certificateChain, "trusted_ca: { filename: " + certificateChain + ".missing", "cannot load trusted_ca"},
+		{"unknown field", "sni:", "auto_host_sni: true\n        sni:", "field auto_host_sni not found"},
+	} {
+		_, err := Parse([]byte(strings.Replace(tlsConfig, test.old, test.new, 1)))
+		if err == nil || !strings.Contains(err.Error(), test.message) {
+			t.Errorf("%s: expected an error containing %q, got %v", test.name, test.message, err)
+		}
+	}
+}
+
+func TestParseAcme(t *testing.T) {
+	acmeConfig := strings.Replace(validConfig, `    filter_chains:
+    - filters:`, `    filter_chains:
+    - transport_socket:
+        name: envoy.transport_sockets.tls
+        typed_config:
+          acme:
+            directory_url: https://acme.example.com/directory
+            email: ops@example.com
+            storage_dir: /var/lib/seateam/acme
+            renew_before: 240h
+            http_01: true
+      filters:`, 1)
+	acmeConfig = strings.Replace(acmeConfig, `domains: ["*"]`, `domains: ["www.example.com", "*.example.com", "example.com"]`, 1)
+	staticBootstrap, err := Parse([]byte(acmeConfig))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	filterChain := staticBootstrap.StaticResources.Listeners[0].FilterChains[0]
+	if domains := filterChain.DownstreamTlsContext().Acme.Domains; !reflect.DeepEqual(domains, []string{"www.example.com", "example.com"}) {
+		t.Errorf("expected the virtual host domains without wildcards, got %v", domains)
+	}
+	if alpnProtocols := filterChain.DownstreamTlsContext().CommonTlsContext.AlpnProtocols; !reflect.DeepEqual(alpnProtocols, []string{AlpnHTTP2, AlpnHTTP1}) {
+		t.Errorf("expected the protocols the connection manager serves to be offered, got %v", alpnProtocols)
+	}
+	if filterChain.TransportSocket.TypedConfig.Acme.Domains != nil {
+		t.Error("expected the parsed config to be left as it was")
+	}
+
+	for _, test := range []struct {
+		name, old, new, message string
+	}{
+		{"plain http directory", "https://acme.example.com", "http://acme.example.com", "directory_url must be an https URL"},
+		{"no storage", "            storage_dir: /var/lib/seateam/acme\n", "", "storage_dir is required"},
+		{"bad renew_before", "240h", "ten days", `invalid duration "ten days"`},
+		{"only wildcards", `["www.example.com", "*.example.com", "example.com"]`, `["*"]`, "no domains to obtain certificates for"},
+		{"wildcard domain", "http_01: true", "domains: [\"*.example.com\"]", `ACME certificates cannot be obtained for "*.example.com"`},
+		{"with certificates", "          acme:", "          common_tls_context: { tls_certificates: [{ certificate_chain: { inline_string: x }, private_key: { inline_string: y } }] }\n          acme:", "tls_certificates and acme cannot both be set"},
+	} {
+		_, err := Parse([]byte(strings.Replace(acmeConfig, test.old, test.new, 1)))
+		if err == nil || !strings.Contains(err.Error(), test.message) {
+			t.Errorf("%s: expected an error containing %q, got %v", test.name, test.message, err)
+		}
+	}
+}
+
+func TestParseUpgradeConfigs(t *testing.T) {
+	upgradeConfig := strings.Replace(validConfig, `route: { cluster: some_service }`, `route:
+                  cluster: some_service
+                  idle_timeout: 30s
+                  upgrade_configs:
+                  - upgrade_type: WebSocket
+                  - upgrade_type: h2c
+                    enabled: false`, 1)
+	staticBootstrap, err := Parse([]byte(upgradeConfig))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	route := staticBootstrap.StaticResources.Listeners[0].FilterChains[0].Filters[0].TypedConfig.RouteConfig.VirtualHosts[0].Routes[0]
+	if !route.AllowsUpgrade("websocket") || route.AllowsUpgrade("h2c") || route.AllowsUpgrade("connect-udp") {
+		t.Errorf("expected only websocket upgrades to be allowed, got %+v", route.Route.UpgradeConfigs)
+	}
+	if route.UpgradeIdleTimeout() != 30*time.Second {
+		t.Errorf("expected a 30s idle timeout, got %v", route.UpgradeIdleTimeout())
+	}
+
+	for _, test := range []struct {
+		name, old, new, message string
+	}{
+		{"no type", "upgrade_type: h2c\n                    ", "", "upgrade_type is required"},
+		{"duplicate", "upgrade_type: h2c", "upgrade_type: websocket", `duplicate upgrade_type "websocket"`},
+		{"bad idle_timeout", "30s", "soon", `invalid duration "soon"`},
+	} {
+		_, err := Parse([]byte(strings.Replace(upgradeConfig, test.old, test.new, 1)))
+		if err == nil || !strings.Contains(err.Error(), test.message) {
+			t.Errorf("%s: expected an error containing %q, got %v", test.name, test.message, err)
+		}
+	}
+}
+
+func TestParseHttp2ProtocolOptions(t *testing.T) {
+	http2Config := strings.Replace(validConfig, `        typed_config:
+          route_config:`, `        typed_config:
+          codec_type: AUTO
+          http2_protocol_options:
+            max_concurrent_streams: 100
+            initial_stream_window_size: 65536
+            initial_connection_window_size: 1048576
+          route_config:`, 1)
+	http2Config = strings.Replace(http2Config, `    lb_policy: ROUND_ROBIN`, `    lb_policy: ROUND_ROBIN
+    http2_protocol_options: { max_concurrent_streams: 10 }`, 1)
+	staticBootstrap, err := Parse([]byte(http2Config))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	hcm := staticBootstrap.StaticResources.Listeners[0].FilterChains[0].Filters[0].TypedConfig
+	if options := hcm.Http2ProtocolOptions; options == nil || *options != (Http2ProtocolOptions{MaxConcurrentStreams: 100, InitialStreamWindowSize: 65536, InitialConnectionWindowSize: 1048576}) {
+		t.Errorf("unexpected connection manager options: %+v", options)
+	}
+	if !hcm.AcceptsHTTP1() || !hcm.AcceptsHTTP2() {
+		t.Error("expected AUTO to accept both HTTP versions")
+	}
+	if options := staticBootstrap.StaticResources.Clusters[0].Http2ProtocolOptions; options == nil || options.MaxConcurrentStreams != 10 {
+		t.Errorf("unexpected cluster options: %+v", options)
+	}
+
+	tlsConfig := strings.Replace(http2Config, `    filter_chains:
+    - filters:`, `    filter_chains:
+    - transport_socket:
+        name: envoy.transport_sockets.tls
+        typed_config:
+          common_tls_context:
+            tls_certificates: [{ certificate_chain: { filename: cert.pem }, private_key: { filename: key.pem } }]
+            alpn_protocols: [h2, http/1.1]
+      filters:`, 1)
+	for _, test := range []struct {
+		name, config, old, new, message string
+	}{
+		{"unknown codec", http2Config, "codec_type: AUTO", "codec_type: SPDY", `unsupported codec_type "SPDY"`},
+		{"small window", http2Config, "initial_stream_window_size: 65536", "initial_stream_window_size: 1024", "initial_stream_window_size must be between 65535 and 2147483647, got 1024"},
+		{"negative streams", http2Config, "max_concurrent_streams: 100", "max_concurrent_streams: -1", "max_concurrent_streams must be between 1 and 2147483647, got -1"},
+		{"cluster window", http2Config, "{ max_concurrent_streams: 10 }", "{ initial_stream_window_size: 65536 }", "initial_stream_window_size cannot be set on a cluster"},
+		{"h2 over HTTP1", tlsConfig, "codec_type: AUTO", "codec_type: HTTP1", "alpn_protocols [h2 http/1.1] offer a protocol codec_type HTTP1 does not serve"},
+		{"http/1.1 over HTTP2", tlsConfig, "codec_type: AUTO", "codec_type: HTTP2", "alpn_protocols [h2 http/1.1] offer a protocol codec_type HTTP2 does not serve"},
+	} {
+		_, err := Parse([]byte(strings.Replace(test.config, test.old, test.new, 1)))
+		if err == nil || !strings.Contains(err.Error(), test.message) {
+			t.Errorf("%s: expected an error containing %q, got %v", test.name, test.message, err)
+		}
+	}
+}
+
+func TestParseFilterChainMatch(t *testing.T) {
+	passthrough := strings.Replace(validConfig, `    filter_chains:
+    - filters:`, `    listener_filters:
+    - name: envoy.filters.listener.tls_inspector
+    filter_chains:
+    - filter_chain_match:
+        server_names: [db.example.com, "*.db.example.com"]
+      filters:
+      - name: envoy.filters.network.tcp_proxy
+        typed_config: { stat_prefix: db, cluster: some_service }
+    - filters:`, 1)
+	staticBootstrap, err := Parse([]byte(passthrough))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if serverNames := staticBootstrap.StaticResources.Listeners[0].FilterChains[0].FilterChainMatch.ServerNames; len(serverNames) != 2 {
+		t.Errorf("expected two server names, got %v", serverNames)
+	}
+
+	for _, test := range []struct {
+		name, old, new, message string
+	}{
+		{"no inspector", "    - name: envoy.filters.listener.tls_inspector\n", "", "needs the envoy.filters.listener.tls_inspector listener filter"},
+		{"bad server name", `"*.db.example.com"`, `"db.*.com"`, `invalid server name "db.*.com"`},
+		{"same match", "server_names: [db.example.com, \"*.db.example.com\"]", "server_names: []", "matches the same connections as filter chain 0"},
+		{"unknown listener filter", "envoy.filters.listener.tls_inspector", "envoy.filters.listener.http_inspector", "unsupported listener filter"},
+	} {
+		_, err := Parse([]byte(strings.Replace(passthrough, test.old, test.new, 1)))
+		if err == nil || !strings.Contains(err.Error(), test.message) {
+			t.Errorf("%s: expected an error containing %q, got %v", test.name, test.message, err)
+		}
+	}
+}
+
+func TestParseUdpProxy(t *testing.T) {
+	udp := strings.Replace(validConfig, `  clusters:`, `  - name: dns
+    address:
+      socket_address: { protocol: UDP, address: 127.0.0.1, port_value: 10053 }
+    listener_filters:
+    - name: envoy.filters.udp_listener.udp_proxy
+      typed_config:
+        stat_prefix: dns
+        cluster: some_service
+        idle_timeout: 30s
+        hash_policies:
+        - source_ip: true
+  clusters:`, 1)
+	staticBootstrap, err := Parse([]byte(udp))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	listener := staticBootstrap.StaticResources.Listeners[1]
+	if !listener.IsUDP() || listener.UdpProxy() == nil || listener.UdpProxy().Cluster != "some_service" {
+		t.Errorf("expected a UDP listener proxying to some_service, got %+v", listener)
+	}
+
+	for _, test := range []struct {
+		name, old, new, message string
+	}{
+		{"unknown cluster", "cluster: some_service\n        idle", "cluster: other\n        idle", `udp_proxy points at unknown cluster "other"`},
+		{"bad idle timeout", "idle_timeout: 30s", "idle_timeout: soon", `invalid duration "soon"`},
+		{"key hash policy", "- source_ip: true", "- source_ip: false", "only source_ip hash policies are supported"},
+		{"on TCP", "protocol: UDP, ", "", "envoy.filters.udp_listener.udp_proxy cannot be used on a TCP listener"},
+		{"bad protocol", "protocol: UDP", "protocol: SCTP", `unsupported protocol "SCTP"`},
+		{"no proxy", "udp_listener.udp_proxy\n      typed_config:\n        stat_prefix: dns\n        cluster: some_service\n        idle_timeout: 30s\n        hash_policies:\n        - source_ip: true\n", "listener.tls_inspector\n", "cannot be used on a UDP listener"},
+		{"filter chains", "    listener_filters:", "    filter_chains:\n    - filters:\n      - name: envoy.filters.network.tcp_proxy\n        typed_config: { stat_prefix: dns, cluster: some_service }\n    listener_filters:", `UDP listener "dns" cannot have filter chains`},
+		{"unknown field", "stat_prefix: dns", "stat_prefix: dns\n        matcher: {}", "field matcher not found"},
+	} {
+		_, err := Parse([]byte(strings.Replace(udp, test.old, test.new, 1)))
+		if err == nil || !strings.Contains(err.Error(), test.message) {
+			t.Errorf("%s: expected an error containing %q, got %v", test.name, test.message, err)
+		}
+	}
+}
+
+// writeKeyPair writes a self-signed certificate and its key to dir and
+// returns their paths.
+func writeKeyPair(t *testing.T, dir string) (certificateChain, privateKey string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), DNSNames: []string{"example.com"}, NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificateChain, privateKey = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certificateChain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644)
+	os.WriteFile(privateKey, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return certificateChain, privateKey
+}
+
+func TestParseDownstreamTls(t *testing.T) {
+	certificateChain, privateKey := writeKeyPair(t, t.TempDir())
+	tlsConfig := strings.Replace(validConfig, `    filter_chains:
+    - filters:`, fmt.Sprintf(`    filter_chains:
+    - transport_socket:
+        name: envoy.transport_sockets.tls
+        typed_config:
+          "@type": type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.DownstreamTlsContext
+          common_tls_context:
+            tls_params:
+              tls_minimum_protocol_version: TLSv1_2
+              tls_maximum_protocol_version: TLSv1_3
+              cipher_suites: [ECDHE-ECDSA-AES128-GCM-SHA256, TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256]
+            tls_certificates:
+            - certificate_chain: { filename: %s }
+              private_key: { filename: %s }
+            alpn_protocols: [h2, http/1.1]
+      filters:`, certificateChain, privateKey), 1)
+	staticBootstrap, err := Parse([]byte(tlsConfig))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	common := staticBootstrap.StaticResources.Listeners[0].FilterChains[0].TransportSocket.TypedConfig.CommonTlsContext
+	if len(common.TlsCertificates) != 1 || len(common.AlpnProtocols) != 2 {
+		t.Errorf("expected a certificate and two ALPN protocols, got %+v", common)
+	}
+
+	for _, test := range []struct {
+		name, old, new, message string
+	}{
+		{"unknown socket", "name: envoy.transport_sockets.tls", "name: envoy.transport_sockets.alts", `unsupported transport socket "envoy.transport_sockets.alts"`},
+		{"unknown version", "TLSv1_3", "TLSv1_4", `unsupported TLS version "TLSv1_4"`},
+		{"min above max", "TLSv1_3", "TLSv1_1", "tls_minimum_protocol_version is above tls_maximum_protocol_version"},
+		{"unknown cipher", "ECDHE-ECDSA-AES128-GCM-SHA256", "RC4-MD5", `unsupported cipher suite "RC4-MD5"`},
+		{"missing file", privateKey, privateKey + ".missing", "cannot load certificate: private_key: open"},
+		{"no certificates", fmt.Sprintf("            tls_certificates:\n            - certificate_chain: { filename: %s }\n              private_key: { filename: %s }\n", certificateChain, privateKey), "", "a downstream TLS context needs a certificate"},
+		{"unknown field", "alpn_protocols:", "key_log: {}\n            alpn_protocols:", "field key_log not found"},
+	} {
+		_, err := Parse([]byte(strings.Replace(tlsConfig, test.old, test.new, 1)))
+		if err == nil || !strings.Contains(err.Error(), test.message) {
+			t.Errorf("%s: expected an error containing %q, got %v", test.name, test.message, err)
+		}
+	}
+}
+
+func TestParseQuicListener(t *testing.T) {
+	certificateChain, privateKey := writeKeyPair(t, t.TempDir())
+	quic := strings.Replace(validConfig, `  clusters:`, fmt.Sprintf(`  - name: listener_quic
+    address:
+      socket_address: { protocol: UDP, address: 127.0.0.1, port_value: 10000 }
+    udp_listener_config:
+      quic_options:
+        quic_protocol_options: { max_concurrent_streams: 50 }
+        idle_timeout: 30s
+    filter_chains:
+    - transport_socket:
+        name: envoy.transport_sockets.quic
+        typed_config:
+          "@type": type.googleapis.com/envoy.extensions.transport_sockets.quic.v3.QuicDownstreamTransport
+          downstream_tls_context:
+            common_tls_context:
+              tls_certificates:
+              - certificate_chain: { filename: %s }
+                private_key: { filename: %s }
+      filters:
+      - name: envoy.filters.network.http_connection_manager
+        typed_config:
+          codec_type: HTTP3
+          route_config:
+            virtual_hosts:
+            - name: local_service
+              domains: ["*"]
+              routes:
+              - match: { prefix: "/" }
+                route: { cluster: some_service }
+  clusters:`, certificateChain, privateKey), 1)
+	staticBootstrap, err := Parse([]byte(quic))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	listener := staticBootstrap.StaticResources.Listeners[1]
+	if !listener.IsQUIC() || listener.UdpListenerConfig.QuicOptions.QuicProtocolOptions.MaxConcurrentStreams != 50 || listener.UdpListenerConfig.QuicOptions.IdleTimeout != "30s" {
+		t.Errorf("expected a QUIC listener with its options, got %+v", listener)
+	}
+	transportSocket := listener.FilterChains[0].TransportSocket
+	if len(transportSocket.TypedConfig.CommonTlsContext.TlsCertificates) != 1 {
+		t.Errorf("expected the TLS context of the QUIC transport socket, got %+v", transportSocket.TypedConfig)
+	}
+	marshalled, err := yaml.Marshal(transportSocket)
+	if err != nil || !strings.Contains(string(marshalled), "downstream_tls_context:") {
+		t.Errorf("expected the QUIC transport socket to be written as it was read, got %s (%v)", marshalled, err)
+	}
+
+	for _, test := range []struct {
+		name, old, new, message string
+	}{
+		{"HTTP2 codec", "codec_type: HTTP3", "codec_type: HTTP2", `the connection manager of QUIC listener "listener_quic" needs codec_type HTTP3`},
+		{"HTTP3 on TCP", "        typed_config:\n          route_config:", "        typed_config:\n          codec_type: HTTP3\n          route_config:", "codec_type HTTP3 can only be used on QUIC listeners"},
+		{"TLS 1.2", "            common_tls_context:\n", "            common_tls_context:\n              tls_params: { tls_maximum_protocol_version: TLSv1_2 }\n", "QUIC needs TLSv1_3"},
+		{"bad idle timeout", "idle_timeout: 30s", "idle_timeout: never", `invalid duration "never"`},
+		{"on TCP", "protocol: UDP, ", "", `TCP listener "listener_quic" cannot have a udp_listener_config`},
+		{"udp_proxy", "    udp_listener_config:", "    listener_filters:\n    - name: envoy.filters.udp_listener.udp_proxy\n      typed_config: { stat_prefix: dns, cluster: some_service }\n    udp_listener_config:", "envoy.filters.udp_listener.udp_proxy cannot be used on a QUIC listener"},
+		{"unknown field", "downstream_tls_context:", "enable_early_data: true\n          downstream_tls_context:", "field enable_early_data not found"},
+	} {
+		_, err := Parse([]byte(strings.Replace(quic, test.old, test.new, 1)))
+		if err == nil || !strings.Contains(err.Error(), test.message) {
+			t.Errorf("%s: expected an error containing %q, got %v", test.name, test.message, err)
+		}
+	}
+	tlsSocket := strings.NewReplacer(
+		"name: envoy.transport_sockets.quic", "name: envoy.transport_sockets.tls",
+		`"@type": type.googleapis.com/envoy.extensions.transport_sockets.quic.v3.QuicDownstreamTransport`, `"@type": type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.DownstreamTlsContext`,
+		"          downstream_tls_context:\n", "",
+		"            common_tls_context:", "          common_tls_context:",
+		"              tls_certificates:", "            tls_certificates:",
+		"              - certificate_chain", "            - certificate_chain",
+		"                private_key", "              private_key",
+	).Replace(quic)
+	message := `filter chains of QUIC listener "listener_quic" need a envoy.transport_sockets.quic transport socket`
+	if _, err := Parse([]byte(tlsSocket)); err == nil || !strings.Contains(err.Error(), message) {
+		t.Errorf("TLS socket: expected an error containing %q, got %v", message, err)
+	}
+}
@@ -0,0 +1,140 @@
+package config
+
+import (
+	"crypto/tls"
+	"fmt"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// QuicTransportSocket is the transport socket of the filter chains of QUIC
+// listeners, which serve HTTP/3.
+const QuicTransportSocket = "envoy.transport_sockets.quic"
+
+// CodecHTTP3 is the codec type of the connection managers of QUIC listeners,
+// the only one they take.
+const CodecHTTP3 = "HTTP3"
+
+// AlpnHTTP3 is the ALPN protocol name of HTTP/3.
+const AlpnHTTP3 = "h3"
+
+// UdpListenerConfig is how a UDP listener reads its datagrams. With
+// quic_options the listener is a QUIC listener: instead of a udp_proxy it has
+// filter chains, with a QUIC transport socket and an HTTP/3 connection
+// manager, and serves HTTP/3.
+type UdpListenerConfig struct {
+	QuicOptions *QuicListenerOptions `yaml:"quic_options,omitempty"`
+}
+
+// QuicListenerOptions tunes the connections of a QUIC listener. Left out, a
+// setting keeps the default of the QUIC implementation.
+type QuicListenerOptions struct {
+	QuicProtocolOptions QuicProtocolOptions `yaml:"quic_protocol_options,omitempty"`
+	// IdleTimeout closes connections without traffic for that long.
+	IdleTimeout string `yaml:"idle_timeout,omitempty"`
+}
+
+type QuicProtocolOptions struct {
+	// MaxConcurrentStreams is how many requests may be in flight on one
+	// connection.
+	MaxConcurrentStreams int `yaml:"max_concurrent_streams,omitempty"`
+}
+
+// IsQUIC reports whether the listener serves HTTP/3 over QUIC.
+func (l Listener) IsQUIC() bool {
+	return l.IsUDP() && l.UdpListenerConfig != nil && l.UdpListenerConfig.QuicOptions != nil
+}
+
+// AcceptsHTTP3 reports whether the connection manager serves HTTP/3.
+func (hcm HttpConnectionManager) AcceptsHTTP3() bool {
+	return hcm.CodecType == CodecHTTP3
+}
+
+// quicDownstreamTransport is the typed_config of a QUIC transport socket,
+// which wraps the TLS context its connections are set up with.
+type quicDownstreamTransport struct {
+	Type                 string               `yaml:"@type,omitempty"`
+	DownstreamTlsContext DownstreamTlsContext `yaml:"downstream_tls_context,omitempty"`
+}
+
+// UnmarshalYAML reads the typed_config of a QUIC transport socket into
+// TypedConfig as if it were a TLS one, keeping its own @type there.
+func (s *DownstreamTransportSocket) UnmarshalYAML(node *yaml.Node) error {
+	*s = DownstreamTransportSocket{}
+	var quic quicDownstreamTransport
+	name, err := decodeNamed(node, func(name string) interface{} {
+		if name == QuicTransportSocket {
+			return &quic
+		}
+		return &s.TypedConfig
+	})
+	s.Name = name
+	if name == QuicTransportSocket {
+		s.TypedConfig = quic.DownstreamTlsContext
+		s.TypedConfig.Type = quic.Type
+	}
+	return err
+}
+
+func (s DownstreamTransportSocket) MarshalYAML() (interface{}, error) {
+	if s.Name != QuicTransportSocket {
+		return named{s.Name, s.TypedConfig}, nil
+	}
+	quic := quicDownstreamTransport{Type: s.TypedConfig.Type, DownstreamTlsContext: s.TypedConfig}
+	quic.DownstreamTlsContext.Type = ""
+	return named{s.Name, quic}, nil
+}
+
+// checkQuic checks that a QUIC listener's filter chains are fit for HTTP/3,
+// and that other listeners use none of what only QUIC listeners take.
+func (v *validator) checkQuic(path string, listener Listener) {
+	if listener.UdpListenerConfig != nil && !listener.IsUDP() {
+		v.errorf(path+".udp_listener_config", "TCP listener %q cannot have a udp_listener_config", listener.Name)
+	}
+	quic := listener.IsQUIC()
+	if quic {
+		options := listener.UdpListenerConfig.QuicOptions
+		optionsPath := path + ".udp_listener_config.quic_options"
+		if streams := options.QuicProtocolOptions.MaxConcurrentStreams; streams < 0 {
+			v.errorf(optionsPath+".quic_protocol_options.max_concurrent_streams", "max_concurrent_streams cannot be negative, got %d", streams)
+		}
+		if options.IdleTimeout != "" {
+			if idleTimeout, err := time.ParseDuration(options.IdleTimeout); err != nil || idleTimeout <= 0 {
+				v.errorf(optionsPath+".idle_timeout", "invalid duration %q", options.IdleTimeout)
+			}
+		}
+	}
+
+	for i, filterChain := range listener.FilterChains {
+		filterChainPath := fmt.Sprintf("%s.filter_chains[%d]", path, i)
+		transportSocket := filterChain.TransportSocket
+		switch {
+		case quic && (transportSocket == nil || transportSocket.Name != QuicTransportSocket):
+			v.errorf(filterChainPath+".transport_socket", "filter chains of QUIC listener %q need a %s transport socket", listener.Name, QuicTransportSocket)
+		case !quic && transportSocket != nil && transportSocket.Name == QuicTransportSocket:
+			v.errorf(filterChainPath+".transport_socket.name", "%s can only be used on QUIC listeners", QuicTransportSocket)
+		case quic && !allowsTLS13(transportSocket.TypedConfig.CommonTlsContext.TlsParams):
+			v.errorf(filterChainPath+".transport_socket.typed_config.downstream_tls_context.common_tls_context.tls_params.tls_maximum_protocol_version", "QUIC needs TLSv1_3")
+		}
+
+		for j, filter := range filterChain.Filters {
+			filterPath := fmt.Sprintf("%s.filters[%d]", filterChainPath, j)
+			switch {
+			case quic && filter.Name != HttpConnectionManagerFilter:
+				v.errorf(filterPath+".name", "QUIC listener %q only takes the %s network filter", listener.Name, HttpConnectionManagerFilter)
+			case quic && !filter.TypedConfig.AcceptsHTTP3():
+				v.errorf(filterPath+".typed_config.codec_type", "the connection manager of QUIC listener %q needs codec_type %s", listener.Name, CodecHTTP3)
+			case !quic && filter.Name == HttpConnectionManagerFilter && filter.TypedConfig.AcceptsHTTP3():
+				v.errorf(filterPath+".typed_config.codec_type", "codec_type %s can only be used on QUIC listeners", CodecHTTP3)
+			}
+		}
+	}
+}
+
+// allowsTLS13 reports whether params leave TLS 1.3, which QUIC is built on,
+// enabled.
+func allowsTLS13(params TlsParams) bool {
+	maxVersion := TLSVersions[params.TlsMaximumProtocolVersion]
+	return maxVersion == 0 || maxVersion >= tls.VersionTLS13
+}
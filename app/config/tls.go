@@ -0,0 +1,287 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// TLSTransportSocket is the transport socket that speaks TLS.
+const TLSTransportSocket = "envoy.transport_sockets.tls"
+
+// DownstreamTransportSocket is the transport socket of a filter chain, which
+// terminates TLS before the connection reaches the network filters.
+type DownstreamTransportSocket struct {
+	Name        string               `yaml:"name,omitempty"`
+	TypedConfig DownstreamTlsContext `yaml:"typed_config,omitempty"`
+}
+
+// UpstreamTransportSocket is the transport socket of a cluster, which starts
+// TLS on the connections to its endpoints.
+type UpstreamTransportSocket struct {
+	Name        string             `yaml:"name,omitempty"`
+	TypedConfig UpstreamTlsContext `yaml:"typed_config,omitempty"`
+}
+
+// UpstreamTlsContext is how a cluster's endpoints are talked to over TLS. Its
+// certificate, if any, is the client certificate for mTLS. The endpoints'
+// certificates are only verified with a validation_context, as in Envoy.
+type UpstreamTlsContext struct {
+	Type             string           `yaml:"@type,omitempty"`
+	CommonTlsContext CommonTlsContext `yaml:"common_tls_context,omitempty"`
+	// Sni is the server name sent to the endpoints, which get none without
+	// it.
+	Sni string `yaml:"sni,omitempty"`
+}
+
+type DownstreamTlsContext struct {
+	Type             string           `yaml:"@type,omitempty"`
+	CommonTlsContext CommonTlsContext `yaml:"common_tls_context,omitempty"`
+	// RequireClientCertificate turns away clients without a certificate.
+	// Without it, a certificate is still verified if the client sends one.
+	RequireClientCertificate bool `yaml:"require_client_certificate,omitempty"`
+	// Acme obtains the certificates from an ACME CA.
+	Acme *Acme `yaml:"acme,omitempty"`
+}
+
+// CommonTlsContext is the part of a TLS context shared by both ends of a
+// connection. With several certificates, the one whose names cover the
+// server name the client asks for is used, and the first otherwise.
+type CommonTlsContext struct {
+	TlsParams         TlsParams                     `yaml:"tls_params,omitempty"`
+	TlsCertificates   []TlsCertificate              `yaml:"tls_certificates,omitempty"`
+	ValidationContext *CertificateValidationContext `yaml:"validation_context,omitempty"`
+	AlpnProtocols     []string                      `yaml:"alpn_protocols,omitempty"`
+}
+
+// CertificateValidationContext says which certificates the other end may
+// present: ones issued by TrustedCa and, if there are SAN matchers, with a
+// subject alternative name that one of them matches.
+type CertificateValidationContext struct {
+	TrustedCa                 DataSource              `yaml:"trusted_ca,omitempty"`
+	MatchTypedSubjectAltNames []SubjectAltNameMatcher `yaml:"match_typed_subject_alt_names,omitempty"`
+}
+
+// LoadTrustedCa reads the CA bundle into a pool.
+func (c CertificateValidationContext) LoadTrustedCa() (*x509.CertPool, error) {
+	bundle, err := c.TrustedCa.Read()
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bundle) {
+		return nil, errors.New("no certificates found")
+	}
+	return pool, nil
+}
+
+// TlsParams limits the protocol versions and, for TLS 1.2 and below, the
+// cipher suites. Cipher suites may be given by their OpenSSL names, as in
+// Envoy, or their IANA names.
+type TlsParams struct {
+	TlsMinimumProtocolVersion string   `yaml:"tls_minimum_protocol_version,omitempty"`
+	TlsMaximumProtocolVersion string   `yaml:"tls_maximum_protocol_version,omitempty"`
+	CipherSuites              []string `yaml:"cipher_suites,omitempty"`
+}
+
+type TlsCertificate struct {
+	CertificateChain DataSource `yaml:"certificate_chain,omitempty"`
+	PrivateKey       DataSource `yaml:"private_key,omitempty"`
+}
+
+// DataSource is a file or an inline string.
+type DataSource struct {
+	Filename     string `yaml:"filename,omitempty"`
+	InlineString string `yaml:"inline_string,omitempty"`
+}
+
+// Read returns the data, reading the file if it is one.
+func (d DataSource) Read() ([]byte, error) {
+	switch {
+	case d.Filename != "" && d.InlineString != "":
+		return nil, errors.New("only one of filename and inline_string may be set")
+	case d.Filename != "":
+		return os.ReadFile(d.Filename)
+	case d.InlineString != "":
+		return []byte(d.InlineString), nil
+	}
+	return nil, errors.New("no filename or inline_string")
+}
+
+// LoadKeyPair reads and parses the certificate chain and private key, with
+// the leaf certificate parsed too.
+func (c TlsCertificate) LoadKeyPair() (tls.Certificate, error) {
+	certificateChain, err := c.CertificateChain.Read()
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("certificate_chain: %v", err)
+	}
+	privateKey, err := c.PrivateKey.Read()
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("private_key: %v", err)
+	}
+	keyPair, err := tls.X509KeyPair(certificateChain, privateKey)
+	if err != nil {
+		return keyPair, err
+	}
+	if keyPair.Leaf == nil {
+		keyPair.Leaf, err = x509.ParseCertificate(keyPair.Certificate[0])
+	}
+	return keyPair, err
+}
+
+// TLSVersions maps Envoy's protocol version names to crypto/tls versions.
+// TLS_AUTO is 0, which leaves the choice to crypto/tls.
+var TLSVersions = map[string]uint16{
+	"TLS_AUTO": 0,
+	"TLSv1_0":  tls.VersionTLS10,
+	"TLSv1_1":  tls.VersionTLS11,
+	"TLSv1_2":  tls.VersionTLS12,
+	"TLSv1_3":  tls.VersionTLS13,
+}
+
+// openSSLCipherSuites maps the OpenSSL names Envoy uses to the IANA names of
+// crypto/tls.
+var openSSLCipherSuites = map[string]string{
+	"ECDHE-ECDSA-AES128-GCM-SHA256": "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+	"ECDHE-RSA-AES128-GCM-SHA256":   "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+	"ECDHE-ECDSA-AES256-GCM-SHA384": "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+	"ECDHE-RSA-AES256-GCM-SHA384":   "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+	"ECDHE-ECDSA-CHACHA20-POLY1305": "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256",
+	"ECDHE-RSA-CHACHA20-POLY1305":   "TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256",
+	"ECDHE-ECDSA-AES128-SHA":        "TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA",
+	"ECDHE-RSA-AES128-SHA":          "TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA",
+	"ECDHE-ECDSA-AES256-SHA":        "TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA",
+	"ECDHE-RSA-AES256-SHA":          "TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA",
+	"AES128-GCM-SHA256":             "TLS_RSA_WITH_AES_128_GCM_SHA256",
+	"AES256-GCM-SHA384":             "TLS_RSA_WITH_AES_256_GCM_SHA384",
+	"AES128-SHA":                    "TLS_RSA_WITH_AES_128_CBC_SHA",
+	"AES256-SHA":                    "TLS_RSA_WITH_AES_256_CBC_SHA",
+}
+
+// CipherSuiteIDs returns the crypto/tls IDs of the cipher suites, or an error
+// naming the first one that is not known.
+func (p TlsParams) CipherSuiteIDs() ([]uint16, error) {
+	ids := make(map[string]uint16)
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		ids[suite.Name] = suite.ID
+	}
+	var suites []uint16
+	for _, name := range p.CipherSuites {
+		ianaName := name
+		if mapped, ok := openSSLCipherSuites[name]; ok {
+			ianaName = mapped
+		}
+		id, ok := ids[ianaName]
+		if !ok {
+			return nil, fmt.Errorf("unsupported cipher suite %q", name)
+		}
+		suites = append(suites, id)
+	}
+	return suites, nil
+}
+
+func (v *validator) checkDownstreamTransportSocket(path string, transportSocket *DownstreamTransportSocket) {
+	if transportSocket.Name != TLSTransportSocket && transportSocket.Name != QuicTransportSocket {
+		v.errorf(path+".name", "unsupported transport socket %q", transportSocket.Name)
+		return
+	}
+	common := transportSocket.TypedConfig.CommonTlsContext
+	commonPath := path + ".typed_config.common_tls_context"
+	switch acme := transportSocket.TypedConfig.Acme != nil; {
+	case len(common.TlsCertificates) == 0 && !acme:
+		v.errorf(commonPath+".tls_certificates", "a downstream TLS context needs a certificate")
+	case len(common.TlsCertificates) > 0 && acme:
+		v.errorf(commonPath+".tls_certificates", "tls_certificates and acme cannot both be set")
+	}
+	for i, certificate := range common.TlsCertificates {
+		if _, err := certificate.LoadKeyPair(); err != nil {
+			v.errorf(fmt.Sprintf("%s.tls_certificates[%d]", commonPath, i), "cannot load certificate: %v", err)
+		}
+	}
+	v.checkTlsParams(commonPath+".tls_params", common.TlsParams)
+	if common.ValidationContext != nil {
+		v.checkValidationContext(commonPath+".validation_context", *common.ValidationContext)
+	} else if transportSocket.TypedConfig.RequireClientCertificate {
+		v.errorf(path+".typed_config.require_client_certificate", "require_client_certificate needs a validation_context to verify certificates with")
+	}
+}
+
+func (v *validator) checkUpstreamTransportSocket(path string, transportSocket *UpstreamTransportSocket) {
+	if transportSocket.Name != TLSTransportSocket && transportSocket.Name != QuicTransportSocket {
+		v.errorf(path+".name", "unsupported transport socket %q", transportSocket.Name)
+		return
+	}
+	common := transportSocket.TypedConfig.CommonTlsContext
+	commonPath := path + ".typed_config.common_tls_context"
+	if len(common.TlsCertificates) > 1 {
+		v.errorf(commonPath+".tls_certificates", "an upstream TLS context takes at most one client certificate")
+	}
+	for i, certificate := range common.TlsCertificates {
+		if _, err := certificate.LoadKeyPair(); err != nil {
+			v.errorf(fmt.Sprintf("%s.tls_certificates[%d]", commonPath, i), "cannot load certificate: %v", err)
+		}
+	}
+	v.checkTlsParams(commonPath+".tls_params", common.TlsParams)
+	if common.ValidationContext != nil {
+		v.checkValidationContext(commonPath+".validation_context", *common.ValidationContext)
+	}
+}
+
+func (v *validator) checkValidationContext(path string, validationContext CertificateValidationContext) {
+	if _, err := validationContext.LoadTrustedCa(); err != nil {
+		v.errorf(path+".trusted_ca", "cannot load trusted_ca: %v", err)
+	}
+	for i, matcher := range validationContext.MatchTypedSubjectAltNames {
+		v.checkSubjectAltNameMatcher(fmt.Sprintf("%s.match_typed_subject_alt_names[%d]", path, i), matcher)
+	}
+}
+
+func (v *validator) checkTlsParams(path string, params TlsParams) {
+	minVersion, minOK := TLSVersions[params.TlsMinimumProtocolVersion]
+	if params.TlsMinimumProtocolVersion != "" && !minOK {
+		v.errorf(path+".tls_minimum_protocol_version", "unsupported TLS version %q", params.TlsMinimumProtocolVersion)
+	}
+	maxVersion, maxOK := TLSVersions[params.TlsMaximumProtocolVersion]
+	if params.TlsMaximumProtocolVersion != "" && !maxOK {
+		v.errorf(path+".tls_maximum_protocol_version", "unsupported TLS version %q", params.TlsMaximumProtocolVersion)
+	}
+	if minVersion != 0 && maxVersion != 0 && minVersion > maxVersion {
+		v.errorf(path, "tls_minimum_protocol_version is above tls_maximum_protocol_version")
+	}
+	if _, err := params.CipherSuiteIDs(); err != nil {
+		v.errorf(path+".cipher_suites", "%v", err)
+	}
+}
+
+// Modes of forward_client_cert_details. SANITIZE, the default, removes the
+// x-forwarded-client-cert header. The others keep it from mTLS clients:
+// FORWARD_ONLY as it is, APPEND_FORWARD with the client's certificate added
+// and SANITIZE_SET replaced by it. ALWAYS_FORWARD_ONLY keeps it from any
+// client.
+const (
+	Sanitize          = "SANITIZE"
+	ForwardOnly       = "FORWARD_ONLY"
+	AppendForward     = "APPEND_FORWARD"
+	SanitizeSet       = "SANITIZE_SET"
+	AlwaysForwardOnly = "ALWAYS_FORWARD_ONLY"
+)
+
+// SetCurrentClientCertDetails picks the fields of the client certificate put
+// in the x-forwarded-client-cert header besides its hash.
+type SetCurrentClientCertDetails struct {
+	Subject bool `yaml:"subject,omitempty"`
+	Cert    bool `yaml:"cert,omitempty"`
+	Chain   bool `yaml:"chain,omitempty"`
+	DNS     bool `yaml:"dns,omitempty"`
+	URI     bool `yaml:"uri,omitempty"`
+}
+
+func (v *validator) checkForwardClientCertDetails(path string, hcm HttpConnectionManager) {
+	switch hcm.ForwardClientCertDetails {
+	case "", Sanitize, ForwardOnly, AppendForward, SanitizeSet, AlwaysForwardOnly:
+	default:
+		v.errorf(path+".forward_client_cert_details", "unsupported forward_client_cert_details %q", hcm.ForwardClientCertDetails)
+	}
+}
@@ -0,0 +1,191 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// RouterFilter is the HTTP filter that forwards requests upstream. It ends
+// every http_filters list.
+const RouterFilter = "envoy.filters.http.router"
+
+// FilterConfigType wraps a typed_per_filter_config entry to turn the filter
+// off for a route, or to mark the filter optional.
+const FilterConfigType = "type.googleapis.com/envoy.config.route.v3.FilterConfig"
+
+// TypedConfig is the typed_config of an HTTP filter: its "@type" and the
+// fields of that type, kept as written for the filter to decode.
+type TypedConfig struct {
+	Type   string
+	fields map[string]interface{}
+}
+
+func (t *TypedConfig) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: typed_config must be a mapping", node.Line)
+	}
+	t.Type, t.fields = "", nil
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		if key.Value == "@type" {
+			t.Type = value.Value
+			continue
+		}
+		var field interface{}
+		if err := value.Decode(&field); err != nil {
+			return err
+		}
+		if t.fields == nil {
+			t.fields = make(map[string]interface{})
+		}
+		t.fields[key.Value] = field
+	}
+	return nil
+}
+
+func (t TypedConfig) MarshalYAML() (interface{}, error) {
+	document := make(map[string]interface{}, len(t.fields)+1)
+	for key, value := range t.fields {
+		document[key] = value
+	}
+	if t.Type != "" {
+		document["@type"] = t.Type
+	}
+	return document, nil
+}
+
+// IsZero lets omitempty leave out a typed_config with nothing in it.
+func (t TypedConfig) IsZero() bool {
+	return t.Type == "" && len(t.fields) == 0
+}
+
+// Decode decodes the fields other than "@type" into v, rejecting any that v
+// does not have.
+func (t TypedConfig) Decode(v interface{}) error {
+	if len(t.fields) == 0 {
+		return nil
+	}
+	data, err := yaml.Marshal(t.fields)
+	if err != nil {
+		return err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(v); err != nil && err != io.EOF {
+		// Line numbers would point into the re-encoded fields rather than
+		// the config file, so only the messages are kept.
+		var messages []string
+		for _, validationError := range yamlErrors(err) {
+			messages = append(messages, validationError.Message)
+		}
+		return fmt.Errorf("%s", strings.Join(messages, "; "))
+	}
+	return nil
+}
+
+// RouteFilterConfig is a typed_per_filter_config entry with Envoy's
+// FilterConfig wrapper taken off. Disabled turns the filter off for the route.
+type RouteFilterConfig struct {
+	Config     TypedConfig `yaml:"config,omitempty"`
+	Disabled   bool        `yaml:"disabled,omitempty"`
+	IsOptional bool        `yaml:"is_optional,omitempty"`
+}
+
+// RouteFilterConfig unwraps a typed_per_filter_config entry. Entries that are
+// not a FilterConfig are returned as its Config.
+func (t TypedConfig) RouteFilterConfig() (RouteFilterConfig, error) {
+	if t.Type != FilterConfigType {
+		return RouteFilterConfig{Config: t}, nil
+	}
+	var wrapped RouteFilterConfig
+	err := t.Decode(&wrapped)
+	return wrapped, err
+}
+
+// HTTPFilterCheck validates the config of a registered HTTP filter.
+type HTTPFilterCheck struct {
+	// Config checks an http_filters entry's typed_config.
+	Config func(TypedConfig) error
+	// RouteConfig checks a typed_per_filter_config entry for the filter.
+	RouteConfig func(TypedConfig) error
+}
+
+var httpFilterChecks = map[string]HTTPFilterCheck{}
+
+// RegisterHTTPFilter makes name a known HTTP filter, whose configs are
+// checked by check when a config is validated. The filters package registers
+// each filter it implements.
+func RegisterHTTPFilter(name string, check HTTPFilterCheck) {
+	httpFilterChecks[name] = check
+}
+
+// checkHTTPFilters validates an HTTP connection manager's http_filters and
+// the typed_per_filter_config of its routes.
+func (v *validator) checkHTTPFilters(path string, hcm HttpConnectionManager) {
+	for i, httpFilter := range hcm.HTTPFilters {
+		filterPath := fmt.Sprintf("%s.http_filters[%d]", path, i)
+		check, known := httpFilterChecks[httpFilter.Name]
+		switch {
+		case httpFilter.Name == "":
+			v.errorf(filterPath+".name", "http filter name is required")
+			continue
+		case httpFilter.Name == RouterFilter:
+			if i != len(hcm.HTTPFilters)-1 {
+				v.errorf(filterPath+".name", "%s must be the last http filter", RouterFilter)
+			}
+			continue
+		case !known:
+			v.errorf(filterPath+".name", "unknown http filter %q", httpFilter.Name)
+			continue
+		case i == len(hcm.HTTPFilters)-1:
+			v.errorf(filterPath+".name", "the last http filter must be %s", RouterFilter)
+		}
+		if check.Config != nil {
+			if err := check.Config(httpFilter.TypedConfig); err != nil {
+				v.errorf(filterPath+".typed_config", "http filter %q: %v", httpFilter.Name, err)
+			}
+		}
+	}
+
+	routeConfigPath := path + ".route_config"
+	for i, virtualHost := range hcm.RouteConfig.VirtualHosts {
+		virtualHostPath := fmt.Sprintf("%s.virtual_hosts[%d]", routeConfigPath, i)
+		v.checkRouteFilterConfigs(virtualHostPath+".typed_per_filter_config", virtualHost.TypedPerFilterConfig)
+		for j, route := range virtualHost.Routes {
+			v.checkRouteFilterConfigs(fmt.Sprintf("%s.routes[%d].typed_per_filter_config", virtualHostPath, j), route.TypedPerFilterConfig)
+		}
+	}
+}
+
+func (v *validator) checkRouteFilterConfigs(path string, configs map[string]TypedConfig) {
+	names := make([]string, 0, len(configs))
+	for name := range configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		typedConfig := configs[name]
+		filterPath := path + "." + name
+		check, known := httpFilterChecks[name]
+		if !known {
+			v.errorf(filterPath, "unknown http filter %q", name)
+			continue
+		}
+		routeFilterConfig, err := typedConfig.RouteFilterConfig()
+		if err != nil {
+			v.errorf(filterPath, "http filter %q: %v", name, err)
+			continue
+		}
+		if routeFilterConfig.Disabled || check.RouteConfig == nil {
+			continue
+		}
+		if err := check.RouteConfig(routeFilterConfig.Config); err != nil {
+			v.errorf(filterPath, "http filter %q: %v", name, err)
+		}
+	}
+}
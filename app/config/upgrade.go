@@ -0,0 +1,60 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// UpgradeConfig allows one protocol, such as websocket, to be switched to on
+// a route.
+type UpgradeConfig struct {
+	UpgradeType string `yaml:"upgrade_type,omitempty"`
+	// Enabled defaults to true.
+	Enabled *bool `yaml:"enabled,omitempty"`
+}
+
+// DefaultUpgradeIdleTimeout is how long upgraded connections may carry
+// nothing when the route sets no idle_timeout, Envoy's default stream idle
+// timeout.
+const DefaultUpgradeIdleTimeout = 5 * time.Minute
+
+// AllowsUpgrade reports whether requests to switch to upgradeType may go
+// through on the route. Upgrade types are compared without case, as the
+// Upgrade header is.
+func (r Route) AllowsUpgrade(upgradeType string) bool {
+	for _, upgrade := range r.Route.UpgradeConfigs {
+		if strings.EqualFold(upgrade.UpgradeType, upgradeType) {
+			return upgrade.Enabled == nil || *upgrade.Enabled
+		}
+	}
+	return false
+}
+
+// UpgradeIdleTimeout returns the idle timeout of the route's upgraded
+// connections.
+func (r Route) UpgradeIdleTimeout() time.Duration {
+	if idleTimeout, err := time.ParseDuration(r.Route.IdleTimeout); err == nil {
+		return idleTimeout
+	}
+	return DefaultUpgradeIdleTimeout
+}
+
+func (v *validator) checkUpgradeConfigs(path string, route Route) {
+	seen := make(map[string]bool)
+	for i, upgrade := range route.Route.UpgradeConfigs {
+		upgradeType := strings.ToLower(upgrade.UpgradeType)
+		switch {
+		case upgradeType == "":
+			v.errorf(fmt.Sprintf("%s.upgrade_configs[%d].upgrade_type", path, i), "upgrade_type is required")
+		case seen[upgradeType]:
+			v.errorf(fmt.Sprintf("%s.upgrade_configs[%d].upgrade_type", path, i), "duplicate upgrade_type %q", upgrade.UpgradeType)
+		}
+		seen[upgradeType] = true
+	}
+	if route.Route.IdleTimeout != "" {
+		if idleTimeout, err := time.ParseDuration(route.Route.IdleTimeout); err != nil || idleTimeout <= 0 {
+			v.errorf(path+".idle_timeout", "invalid duration %q", route.Route.IdleTimeout)
+		}
+	}
+}
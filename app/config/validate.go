@@ -0,0 +1,450 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ValidationError is a single problem found in a config file. Line and Column
+// are 1-based and zero when the position is not known.
+type ValidationError struct {
+	File    string
+	Line    int
+	Column  int
+	Path    string
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	var location []string
+	if e.File != "" {
+		location = append(location, e.File)
+	}
+	if e.Line > 0 {
+		location = append(location, strconv.Itoa(e.Line))
+		if e.Column > 0 {
+			location = append(location, strconv.Itoa(e.Column))
+		}
+	}
+
+	message := e.Message
+	if e.Path != "" {
+		message = e.Path + ": " + message
+	}
+	if len(location) == 0 {
+		return message
+	}
+	return strings.Join(location, ":") + ": " + message
+}
+
+// ValidationErrors collects every problem found while loading a config file.
+type ValidationErrors []ValidationError
+
+func (errs ValidationErrors) Error() string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+var yamlLineMessage = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// yamlErrors converts the errors reported by the yaml decoder, which carry
+// their line number inside the message text, into ValidationErrors.
+func yamlErrors(err error) ValidationErrors {
+	var messages []string
+	var typeError *yaml.TypeError
+	if errors.As(err, &typeError) {
+		messages = typeError.Errors
+	} else {
+		messages = []string{err.Error()}
+	}
+
+	var errs ValidationErrors
+	for _, message := range messages {
+		validationError := ValidationError{Message: strings.TrimPrefix(message, "yaml: ")}
+		if match := yamlLineMessage.FindStringSubmatch(message); match != nil {
+			validationError.Line, _ = strconv.Atoi(match[1])
+			validationError.Message = match[2]
+		}
+		errs = append(errs, validationError)
+	}
+	return errs
+}
+
+type position struct {
+	line   int
+	column int
+}
+
+// positions maps the dotted path of every node in a document, for example
+// "static_resources.clusters[0].name", to where it appears in the file.
+type positions map[string]position
+
+func newPositions(root *yaml.Node) positions {
+	p := positions{}
+	if root.Kind == yaml.DocumentNode && len(root.Content) > 0 {
+		p.walk("", root.Content[0])
+	}
+	return p
+}
+
+func (p positions) walk(path string, node *yaml.Node) {
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			childPath := key.Value
+			if path != "" {
+				childPath = path + "." + key.Value
+			}
+			p[childPath] = position{key.Line, key.Column}
+			p.walk(childPath, value)
+		}
+	case yaml.SequenceNode:
+		for i, item := range node.Content {
+			childPath := fmt.Sprintf("%s[%d]", path, i)
+			p[childPath] = position{item.Line, item.Column}
+			p.walk(childPath, item)
+		}
+	}
+}
+
+// lookup returns the position of path, or of its closest ancestor when the
+// field itself was left out of the file.
+func (p positions) lookup(path string) position {
+	for path != "" {
+		if pos, ok := p[path]; ok {
+			return pos
+		}
+		cut := strings.LastIndexAny(path, ".[")
+		if cut < 0 {
+			break
+		}
+		path = path[:cut]
+	}
+	return position{}
+}
+
+type validator struct {
+	positions positions
+	errs      ValidationErrors
+}
+
+func (v *validator) errorf(path string, format string, args ...interface{}) {
+	pos := v.positions.lookup(path)
+	v.errs = append(v.errs, ValidationError{
+		Line:    pos.line,
+		Column:  pos.column,
+		Path:    path,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// checkPort reports ports outside the valid range. Port 0 asks the kernel for a
+// free port, which only makes sense for addresses we bind to.
+func (v *validator) checkPort(path string, port int, allowZero bool) {
+	if port == 0 && allowZero {
+		return
+	}
+	if port < 1 || port > 65535 {
+		v.errorf(path, "port %d is out of range 1-65535", port)
+	}
+}
+
+var supportedLbPolicies = map[string]bool{
+	"":                  true,
+	"ROUND_ROBIN":       true,
+	"LEAST_CONNECTIONS": true,
+}
+
+var supportedClusterTypes = map[string]bool{
+	"":            true,
+	"STATIC":      true,
+	"STRICT_DNS":  true,
+	"LOGICAL_DNS": true,
+	"EDS":         true,
+	"CONSUL":      true,
+	"KUBERNETES":  true,
+	"REGISTRY":    true,
+}
+
+var supportedDnsLookupFamilies = map[string]bool{
+	"":             true,
+	"AUTO":         true,
+	"V4_ONLY":      true,
+	"V6_ONLY":      true,
+	"V4_PREFERRED": true,
+	"ALL":          true,
+}
+
+// IsDNS reports whether the cluster's endpoints are hostnames to resolve.
+func (c Cluster) IsDNS() bool {
+	return c.Type == "STRICT_DNS" || c.Type == "LOGICAL_DNS"
+}
+
+// IsSRV reports whether address is a DNS SRV name such as
+// _http._tcp.example.com, which supplies ports as well as hosts.
+func IsSRV(address string) bool {
+	return strings.HasPrefix(address, "_")
+}
+
+func (v *validator) checkConsulClusterConfig(path string, consul *ConsulClusterConfig) {
+	if consul == nil {
+		v.errorf(path, "consul_cluster_config is required for CONSUL clusters")
+		return
+	}
+	if consul.ServiceName == "" {
+		v.errorf(path+".service_name", "service_name is required")
+	}
+	if consul.Address != "" {
+		if u, err := url.Parse(consul.Address); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			v.errorf(path+".address", "address must be an http or https URL, got %q", consul.Address)
+		}
+	}
+	if consul.WaitTime != "" {
+		if waitTime, err := time.ParseDuration(consul.WaitTime); err != nil || waitTime <= 0 {
+			v.errorf(path+".wait_time", "invalid duration %q", consul.WaitTime)
+		}
+	}
+}
+
+func (v *validator) checkKubernetesClusterConfig(path string, kubernetes *KubernetesClusterConfig) {
+	if kubernetes == nil {
+		v.errorf(path, "kubernetes_cluster_config is required for KUBERNETES clusters")
+		return
+	}
+	if kubernetes.ServiceName == "" {
+		v.errorf(path+".service_name", "service_name is required")
+	}
+}
+
+func edsConfig(c Cluster) *ConfigSource {
+	if c.EdsClusterConfig == nil {
+		return nil
+	}
+	return &c.EdsClusterConfig.EdsConfig
+}
+
+// checkConfigSource checks that a resource discovered at path comes either
+// from the aggregated discovery stream, which needs an ads_config, or from a
+// file.
+func (v *validator) checkConfigSource(b *StaticBootstrap, path string, source *ConfigSource) {
+	switch {
+	case source == nil || (source.Ads == nil && source.PathConfigSource == nil):
+		v.errorf(path, "only ads and path_config_source config sources are supported")
+	case source.Ads != nil && source.PathConfigSource != nil:
+		v.errorf(path, "only one of ads and path_config_source may be set")
+	case source.PathConfigSource != nil && source.PathConfigSource.Path == "":
+		v.errorf(path+".path_config_source.path", "path is required")
+	case source.Ads != nil && b.DynamicResources.AdsConfig == nil:
+		v.errorf(path, "ads config source used without dynamic_resources.ads_config")
+	case source.ResourceApiVersion != "" && source.ResourceApiVersion != "V3":
+		v.errorf(path+".resource_api_version", "unsupported resource_api_version %q", source.ResourceApiVersion)
+	}
+}
+
+func (v *validator) checkDynamicResources(b *StaticBootstrap, clusterNames map[string]bool) {
+	dynamicResources := b.DynamicResources
+	if dynamicResources.CdsConfig != nil {
+		v.checkConfigSource(b, "dynamic_resources.cds_config", dynamicResources.CdsConfig)
+	}
+	if dynamicResources.LdsConfig != nil {
+		v.checkConfigSource(b, "dynamic_resources.lds_config", dynamicResources.LdsConfig)
+	}
+
+	adsConfig := dynamicResources.AdsConfig
+	if adsConfig == nil {
+		return
+	}
+	if adsConfig.ApiType != "GRPC" {
+		v.errorf("dynamic_resources.ads_config.api_type", "unsupported api_type %q, only GRPC is supported", adsConfig.ApiType)
+	}
+	if adsConfig.TransportApiVersion != "" && adsConfig.TransportApiVersion != "V3" {
+		v.errorf("dynamic_resources.ads_config.transport_api_version", "unsupported transport_api_version %q", adsConfig.TransportApiVersion)
+	}
+	if len(adsConfig.GrpcServices) != 1 {
+		v.errorf("dynamic_resources.ads_config.grpc_services", "exactly one grpc service is required, got %d", len(adsConfig.GrpcServices))
+		return
+	}
+	clusterName := adsConfig.GrpcServices[0].EnvoyGrpc.ClusterName
+	if !clusterNames[clusterName] {
+		v.errorf("dynamic_resources.ads_config.grpc_services[0].envoy_grpc.cluster_name", "unknown cluster %q", clusterName)
+	}
+}
+
+// supportedHealthStatuses are the EDS health statuses an endpoint can be given
+// in the config. The router has no health checking of its own yet, so only
+// DRAINING changes how an endpoint is treated.
+var supportedHealthStatuses = map[string]bool{
+	"":         true,
+	"UNKNOWN":  true,
+	"HEALTHY":  true,
+	"DRAINING": true,
+}
+
+// Validate runs the semantic checks on an already decoded bootstrap. Errors
+// carry the path of the offending field but no line numbers.
+func Validate(b *StaticBootstrap) error {
+	if errs := validate(b, positions{}); len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func validate(b *StaticBootstrap, p positions) ValidationErrors {
+	v := &validator{positions: p}
+
+	v.checkPort("admin.address.socket_address.port_value", b.Admin.Address.SocketAddress.PortValue, true)
+
+	clusterNames := make(map[string]bool)
+	for i, cluster := range b.StaticResources.Clusters {
+		path := fmt.Sprintf("static_resources.clusters[%d]", i)
+		switch {
+		case cluster.Name == "":
+			v.errorf(path+".name", "cluster name is required")
+		case clusterNames[cluster.Name]:
+			v.errorf(path+".name", "duplicate cluster name %q", cluster.Name)
+		}
+		clusterNames[cluster.Name] = true
+
+		if cluster.ConnectTimeout != "" {
+			if _, err := time.ParseDuration(cluster.ConnectTimeout); err != nil {
+				v.errorf(path+".connect_timeout", "invalid duration %q", cluster.ConnectTimeout)
+			}
+		}
+		if !supportedClusterTypes[cluster.Type] {
+			v.errorf(path+".type", "unsupported cluster type %q", cluster.Type)
+		}
+		if !supportedLbPolicies[cluster.LbPolicy] {
+			v.errorf(path+".lb_policy", "unsupported lb_policy %q", cluster.LbPolicy)
+		}
+		if cluster.DnsRefreshRate != "" {
+			if refreshRate, err := time.ParseDuration(cluster.DnsRefreshRate); err != nil || refreshRate <= 0 {
+				v.errorf(path+".dns_refresh_rate", "invalid duration %q", cluster.DnsRefreshRate)
+			}
+		}
+		if !supportedDnsLookupFamilies[cluster.DnsLookupFamily] {
+			v.errorf(path+".dns_lookup_family", "unsupported dns_lookup_family %q", cluster.DnsLookupFamily)
+		}
+		if cluster.TransportSocket != nil {
+			v.checkUpstreamTransportSocket(path+".transport_socket", cluster.TransportSocket)
+		}
+		if cluster.Http2ProtocolOptions != nil {
+			v.checkHttp2ProtocolOptions(path+".http2_protocol_options", *cluster.Http2ProtocolOptions)
+			v.checkUpstreamHttp2ProtocolOptions(path+".http2_protocol_options", *cluster.Http2ProtocolOptions)
+		}
+
+		endpointCount := 0
+		for j, locality := range cluster.LoadAssignment.Endpoints {
+			for k, lbEndpoint := range locality.LbEndpoints {
+				endpointPath := fmt.Sprintf("%s.load_assignment.endpoints[%d].lb_endpoints[%d].endpoint.address.socket_address", path, j, k)
+				socketAddress := lbEndpoint.Endpoint.Address.SocketAddress
+				if socketAddress.Address == "" {
+					v.errorf(endpointPath+".address", "endpoint address is required")
+				}
+				// SRV records carry the port.
+				v.checkPort(endpointPath+".port_value", socketAddress.PortValue, cluster.IsDNS() && IsSRV(socketAddress.Address))
+				lbEndpointPath := fmt.Sprintf("%s.load_assignment.endpoints[%d].lb_endpoints[%d]", path, j, k)
+				if lbEndpoint.LoadBalancingWeight < 0 {
+					v.errorf(lbEndpointPath+".load_balancing_weight", "load_balancing_weight must not be negative, got %d", lbEndpoint.LoadBalancingWeight)
+				}
+				if !supportedHealthStatuses[lbEndpoint.HealthStatus] {
+					v.errorf(lbEndpointPath+".health_status", "unsupported health_status %q", lbEndpoint.HealthStatus)
+				}
+				endpointCount++
+			}
+		}
+		if cluster.Type == "LOGICAL_DNS" && endpointCount > 1 {
+			v.errorf(path+".load_assignment", "LOGICAL_DNS cluster %q must have exactly one endpoint, got %d", cluster.Name, endpointCount)
+		}
+		switch {
+		case cluster.Type == "EDS":
+			// Endpoints arrive over EDS, possibly none at first.
+			v.checkConfigSource(b, path+".eds_cluster_config.eds_config", edsConfig(cluster))
+		case cluster.Type == "CONSUL" || cluster.Type == "KUBERNETES" || cluster.Type == "REGISTRY":
+			switch cluster.Type {
+			case "CONSUL":
+				v.checkConsulClusterConfig(path+".consul_cluster_config", cluster.ConsulClusterConfig)
+			case "KUBERNETES":
+				v.checkKubernetesClusterConfig(path+".kubernetes_cluster_config", cluster.KubernetesClusterConfig)
+			}
+			// REGISTRY clusters start empty and fill up as backends register.
+			if endpointCount > 0 {
+				v.errorf(path+".load_assignment", "%s cluster %q discovers its endpoints and cannot list any", cluster.Type, cluster.Name)
+			}
+		case endpointCount == 0:
+			v.errorf(path+".load_assignment", "cluster %q has no endpoints", cluster.Name)
+		}
+	}
+
+	v.checkDynamicResources(b, clusterNames)
+
+	listenerNames := make(map[string]bool)
+	listenerAddresses := make(map[SocketAddress]string)
+	for i, listener := range b.StaticResources.Listeners {
+		path := fmt.Sprintf("static_resources.listeners[%d]", i)
+		switch {
+		case listener.Name == "":
+			v.errorf(path+".name", "listener name is required")
+		case listenerNames[listener.Name]:
+			v.errorf(path+".name", "duplicate listener name %q", listener.Name)
+		}
+		listenerNames[listener.Name] = true
+
+		socketAddress := listener.Address.SocketAddress
+		v.checkPort(path+".address.socket_address.port_value", socketAddress.PortValue, true)
+		if other, ok := listenerAddresses[socketAddress]; ok && socketAddress.PortValue != 0 {
+			v.errorf(path+".address", "listener %q uses the same address as listener %q", listener.Name, other)
+		}
+		listenerAddresses[socketAddress] = listener.Name
+
+		v.checkListenerFilters(path, listener, clusterNames)
+		v.checkFilterChainMatches(path, listener)
+		v.checkQuic(path, listener)
+		for j, filterChain := range listener.FilterChains {
+			filterChainPath := fmt.Sprintf("%s.filter_chains[%d]", path, j)
+			v.checkNetworkFilters(filterChainPath, filterChain, clusterNames)
+			if filterChain.TransportSocket != nil {
+				v.checkDownstreamTransportSocket(filterChainPath+".transport_socket", filterChain.TransportSocket)
+				if filterChain.TransportSocket.TypedConfig.Acme != nil {
+					v.checkAcme(filterChainPath+".transport_socket.typed_config.acme", filterChain)
+				}
+			}
+			for k, filter := range filterChain.Filters {
+				if filter.Name != HttpConnectionManagerFilter {
+					continue
+				}
+				hcmPath := fmt.Sprintf("%s.filter_chains[%d].filters[%d].typed_config", path, j, k)
+				v.checkHTTPFilters(hcmPath, filter.TypedConfig)
+				v.checkForwardClientCertDetails(hcmPath, filter.TypedConfig)
+				v.checkCodec(hcmPath, filter.TypedConfig, filterChainPath, filterChain)
+				filterPath := hcmPath + ".route_config"
+				for l, virtualHost := range filter.TypedConfig.RouteConfig.VirtualHosts {
+					for m, route := range virtualHost.Routes {
+						for n, header := range route.Match.Headers {
+							v.checkHeaderMatcher(fmt.Sprintf("%s.virtual_hosts[%d].routes[%d].match.headers[%d]", filterPath, l, m, n), header)
+						}
+						v.checkUpgradeConfigs(fmt.Sprintf("%s.virtual_hosts[%d].routes[%d].route", filterPath, l, m), route)
+						routePath := fmt.Sprintf("%s.virtual_hosts[%d].routes[%d].route.cluster", filterPath, l, m)
+						if route.Route.Cluster == "" {
+							v.errorf(routePath, "route has no cluster")
+						} else if !clusterNames[route.Route.Cluster] {
+							v.errorf(routePath, "route points at unknown cluster %q", route.Route.Cluster)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	return v.errs
+}
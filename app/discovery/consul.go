@@ -0,0 +1,219 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"seateam/config"
+	"seateam/loadbalancer"
+)
+
+const (
+	defaultConsulAddress  = "http://127.0.0.1:8500"
+	defaultConsulWaitTime = 5 * time.Minute
+
+	initialBackoff = time.Second
+	maxBackoff     = 30 * time.Second
+)
+
+// Consul watches the instances of a service in the Consul catalog with
+// blocking queries on the health API. Only instances with every configured tag
+// whose checks all pass become endpoints. An instance's weight is its "weight"
+// service meta, or its passing weight, and all of its service meta is kept as
+// endpoint metadata.
+type Consul struct {
+	cluster  string
+	config   config.ConsulClusterConfig
+	address  string
+	waitTime time.Duration
+	client   *http.Client
+}
+
+// NewConsul returns the discovery for cluster c, which must be a CONSUL
+// cluster.
+func NewConsul(c config.Cluster) (*Consul, error) {
+	if c.ConsulClusterConfig == nil {
+		return nil, fmt.Errorf("cluster %q: consul_cluster_config is required", c.Name)
+	}
+	d := &Consul{
+		cluster:  c.Name,
+		config:   *c.ConsulClusterConfig,
+		address:  strings.TrimSuffix(c.ConsulClusterConfig.Address, "/"),
+		waitTime: defaultConsulWaitTime,
+		client:   &http.Client{},
+	}
+	if d.address == "" {
+		d.address = defaultConsulAddress
+	}
+	if d.config.WaitTime != "" {
+		waitTime, err := time.ParseDuration(d.config.WaitTime)
+		if err != nil || waitTime <= 0 {
+			return nil, fmt.Errorf("cluster %q: invalid wait_time %q", c.Name, d.config.WaitTime)
+		}
+		d.waitTime = waitTime
+	}
+	return d, nil
+}
+
+// consulServiceEntry is the part of a /v1/health/service entry that is used.
+type consulServiceEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    int
+		Tags    []string
+		Meta    map[string]string
+		Weights struct {
+			Passing int
+		}
+	}
+	Checks []struct {
+		Status string
+	}
+}
+
+// Run keeps a blocking query open and reports the endpoints each time Consul
+// answers with something new. While Consul cannot be reached the last
+// endpoints stay in place and the query is retried with backoff.
+func (d *Consul) Run(ctx context.Context, update func([]loadbalancer.Endpoint)) {
+	var index uint64
+	var last []loadbalancer.Endpoint
+	updated := false
+	backoff := initialBackoff
+	for {
+		entries, newIndex, err := d.query(ctx, index)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			discoveryLog.Warnf("Cluster %q: Consul query for service %q failed, keeping the last %d endpoints and retrying in %s: %v", d.cluster, d.config.ServiceName, len(last), backoff, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(2*backoff, maxBackoff)
+			continue
+		}
+		backoff = initialBackoff
+
+		// An index that goes backwards means Consul's state was reset, so the
+		// next query must not block on the old index.
+		if newIndex < index {
+			index = 0
+		} else {
+			index = newIndex
+		}
+
+		endpoints := d.endpoints(entries)
+		if !updated || !reflect.DeepEqual(endpoints, last) {
+			discoveryLog.Infof("Cluster %q: Consul service %q has %d passing endpoints", d.cluster, d.config.ServiceName, len(endpoints))
+			update(endpoints)
+			last, updated = endpoints, true
+		}
+	}
+}
+
+// query asks for the passing instances of the service, blocking until the
+// result differs from index or the wait time is over.
+func (d *Consul) query(ctx context.Context, index uint64) ([]consulServiceEntry, uint64, error) {
+	params := url.Values{}
+	params.Set("passing", "true")
+	for _, tag := range d.config.Tags {
+		params.Add("tag", tag)
+	}
+	if d.config.Datacenter != "" {
+		params.Set("dc", d.config.Datacenter)
+	}
+	if index > 0 {
+		params.Set("index", strconv.FormatUint(index, 10))
+		params.Set("wait", fmt.Sprintf("%dms", d.waitTime.Milliseconds()))
+	}
+	// Consul adds up to wait/16 of jitter to the wait time.
+	ctx, cancel := context.WithTimeout(ctx, d.waitTime+d.waitTime/16+10*time.Second)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, d.address+"/v1/health/service/"+url.PathEscape(d.config.ServiceName)+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if d.config.Token != "" {
+		request.Header.Set("X-Consul-Token", d.config.Token)
+	}
+	response, err := d.client.Do(request)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+		return nil, 0, fmt.Errorf("%s: %s", response.Status, strings.TrimSpace(string(body)))
+	}
+
+	var entries []consulServiceEntry
+	if err := json.NewDecoder(response.Body).Decode(&entries); err != nil {
+		return nil, 0, err
+	}
+	newIndex, err := strconv.ParseUint(response.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid X-Consul-Index %q", response.Header.Get("X-Consul-Index"))
+	}
+	return entries, newIndex, nil
+}
+
+// endpoints turns the entries into endpoints, checking the tags and health
+// again in case the query parameters were ignored.
+func (d *Consul) endpoints(entries []consulServiceEntry) []loadbalancer.Endpoint {
+	var endpoints []loadbalancer.Endpoint
+	for _, entry := range entries {
+		if !passing(entry) || !hasTags(entry.Service.Tags, d.config.Tags) {
+			continue
+		}
+		host := entry.Service.Address
+		if host == "" {
+			host = entry.Node.Address
+		}
+		weight := entry.Service.Weights.Passing
+		if metaWeight, err := strconv.Atoi(entry.Service.Meta["weight"]); err == nil && metaWeight > 0 {
+			weight = metaWeight
+		}
+		endpoints = append(endpoints, loadbalancer.Endpoint{
+			Address:  net.JoinHostPort(host, strconv.Itoa(entry.Service.Port)),
+			Weight:   weight,
+			Metadata: entry.Service.Meta,
+		})
+	}
+	sort.Slice(endpoints, func(i, j int) bool { return endpoints[i].Address < endpoints[j].Address })
+	return endpoints
+}
+
+func passing(entry consulServiceEntry) bool {
+	for _, check := range entry.Checks {
+		if check.Status != "passing" {
+			return false
+		}
+	}
+	return true
+}
+
+func hasTags(tags, wanted []string) bool {
+	for _, tag := range wanted {
+		if !slices.Contains(tags, tag) {
+			return false
+		}
+	}
+	return true
+}
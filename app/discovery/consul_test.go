@@ -0,0 +1,155 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"seateam/config"
+	"seateam/loadbalancer"
+)
+
+// fakeConsul serves /v1/health/service/web with blocking queries: a request
+// with an index waits until the entries change.
+type fakeConsul struct {
+	mu      sync.Mutex
+	index   uint64
+	entries []map[string]interface{}
+	changed chan struct{}
+	queries []string
+}
+
+func newFakeConsul(t *testing.T) (*fakeConsul, string) {
+	f := &fakeConsul{index: 1, entries: []map[string]interface{}{}, changed: make(chan struct{})}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/health/service/web" || r.Header.Get("X-Consul-Token") != "secret" {
+			http.Error(w, "Permission denied", http.StatusForbidden)
+			return
+		}
+		f.mu.Lock()
+		f.queries = append(f.queries, r.URL.RawQuery)
+		changed := f.changed
+		index := f.index
+		f.mu.Unlock()
+
+		if r.URL.Query().Get("index") == strconv.FormatUint(index, 10) {
+			select {
+			case <-changed:
+			case <-time.After(time.Second):
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+		json.NewEncoder(w).Encode(f.entries)
+	}))
+	t.Cleanup(server.Close)
+	return f, server.URL
+}
+
+func (f *fakeConsul) set(entries ...map[string]interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.index++
+	f.entries = entries
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func consulEntry(address string, port int, tags []string, meta map[string]string, status string) map[string]interface{} {
+	return map[string]interface{}{
+		"Node": map[string]interface{}{"Address": "10.0.0.100"},
+		"Service": map[string]interface{}{
+			"Address": address,
+			"Port":    port,
+			"Tags":    tags,
+			"Meta":    meta,
+			"Weights": map[string]interface{}{"Passing": 1, "Warning": 1},
+		},
+		"Checks": []map[string]interface{}{{"Status": "passing"}, {"Status": status}},
+	}
+}
+
+func TestConsulWatchesService(t *testing.T) {
+	consul, address := newFakeConsul(t)
+	c := config.Cluster{Name: "web", Type: "CONSUL", ConsulClusterConfig: &config.ConsulClusterConfig{
+		Address:     address,
+		ServiceName: "web",
+		Tags:        []string{"primary"},
+		Token:       "secret",
+	}}
+	d, err := NewConsul(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updates := make(chan []loadbalancer.Endpoint, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx, func(endpoints []loadbalancer.Endpoint) { updates <- endpoints })
+
+	if got := next(t, updates); len(got) != 0 {
+		t.Fatalf("expected no endpoints yet, got %v", got)
+	}
+
+	consul.set(
+		consulEntry("10.0.0.2", 8080, []string{"primary"}, map[string]string{"weight": "5", "version": "v2"}, "passing"),
+		consulEntry("", 8080, []string{"primary", "canary"}, nil, "passing"),
+		consulEntry("10.0.0.3", 8080, []string{"secondary"}, nil, "passing"),
+		consulEntry("10.0.0.4", 8080, []string{"primary"}, nil, "critical"),
+	)
+	var endpoints []loadbalancer.Endpoint
+	select {
+	case endpoints = <-updates:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for endpoints")
+	}
+	if len(endpoints) != 2 {
+		t.Fatalf("expected the two passing primary instances, got %+v", endpoints)
+	}
+	if endpoints[0].Address != "10.0.0.100:8080" || endpoints[0].Weight != 1 {
+		t.Errorf("expected the node address with the passing weight, got %+v", endpoints[0])
+	}
+	if endpoints[1].Address != "10.0.0.2:8080" || endpoints[1].Weight != 5 || endpoints[1].Metadata["version"] != "v2" {
+		t.Errorf("expected the weight and metadata from service meta, got %+v", endpoints[1])
+	}
+
+	consul.mu.Lock()
+	defer consul.mu.Unlock()
+	if query := consul.queries[0]; query != "passing=true&tag=primary" {
+		t.Errorf("expected a query for passing primary instances, got %q", query)
+	}
+	if query := consul.queries[1]; query != "index=1&passing=true&tag=primary&wait=300000ms" {
+		t.Errorf("expected the next query to block on the index, got %q", query)
+	}
+}
+
+func TestConsulKeepsEndpointsWhenUnreachable(t *testing.T) {
+	consul, address := newFakeConsul(t)
+	consul.set(consulEntry("10.0.0.2", 8080, nil, nil, "passing"))
+	d, err := NewConsul(config.Cluster{Name: "web", Type: "CONSUL", ConsulClusterConfig: &config.ConsulClusterConfig{
+		Address:     address,
+		ServiceName: "web",
+		Token:       "wrong",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	updates := make(chan []loadbalancer.Endpoint, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx, func(endpoints []loadbalancer.Endpoint) { updates <- endpoints })
+
+	select {
+	case got := <-updates:
+		t.Fatalf("expected no update while queries fail, got %v", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
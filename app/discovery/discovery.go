@@ -0,0 +1,68 @@
+// Package discovery finds the endpoints of clusters whose members are not
+// listed in the config, such as STRICT_DNS and LOGICAL_DNS clusters, and keeps
+// them current while the cluster is in use: STRICT_DNS and LOGICAL_DNS
+// clusters resolve hostnames, CONSUL clusters watch the Consul catalog,
+// KUBERNETES clusters watch the EndpointSlices of a Service and REGISTRY
+// clusters take the backends that registered themselves with the router.
+package discovery
+
+import (
+	"context"
+	"time"
+
+	"seateam/config"
+	"seateam/loadbalancer"
+	"seateam/logger"
+)
+
+var discoveryLog = logger.Get("upstream")
+
+// ServiceDiscovery keeps the endpoints of one cluster up to date.
+type ServiceDiscovery interface {
+	// Run calls update with the cluster's endpoints whenever they change, until
+	// ctx is cancelled. When a lookup fails the last endpoints stay in place.
+	Run(ctx context.Context, update func([]loadbalancer.Endpoint))
+}
+
+// New returns the discovery for cluster c of a router running in locality, or
+// nil when its endpoints are the ones listed in its load_assignment.
+func New(c config.Cluster, locality config.Locality) (ServiceDiscovery, error) {
+	switch {
+	case c.IsDNS():
+		return NewDNS(c, DefaultResolver)
+	case c.Type == "CONSUL":
+		return NewConsul(c)
+	case c.Type == "KUBERNETES":
+		return NewKubernetes(c, locality)
+	case c.Type == "REGISTRY":
+		return DefaultRegistry.Discovery(c.Name), nil
+	}
+	return nil, nil
+}
+
+// Address is an IP address along with how long it may be cached.
+type Address struct {
+	IP  string
+	TTL time.Duration
+}
+
+// Service is a target of a DNS SRV record.
+type Service struct {
+	Target string
+	Port   int
+	Weight int
+	TTL    time.Duration
+}
+
+// Resolver looks up DNS records. A TTL of zero means the record did not say
+// how long it may be cached.
+type Resolver interface {
+	// LookupIP returns the addresses of host for network "ip4" or "ip6".
+	LookupIP(ctx context.Context, network, host string) ([]Address, error)
+	// LookupSRV returns the targets of an SRV name such as
+	// _http._tcp.example.com.
+	LookupSRV(ctx context.Context, name string) ([]Service, error)
+}
+
+// DefaultResolver is the resolver DNS clusters use.
+var DefaultResolver Resolver = NewSystemResolver()
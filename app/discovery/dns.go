@@ -0,0 +1,234 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	"seateam/config"
+	"seateam/loadbalancer"
+)
+
+// defaultDnsRefreshRate matches Envoy's default when dns_refresh_rate is left
+// out.
+const defaultDnsRefreshRate = 5 * time.Second
+
+// DNS resolves the endpoint hostnames of a STRICT_DNS or LOGICAL_DNS cluster.
+//
+// A STRICT_DNS cluster has an endpoint for every address of every host. A
+// LOGICAL_DNS cluster has a single host and only uses the first address it
+// resolves to, as Envoy does for large web services that return a different
+// subset of addresses each time. Hosts starting with an underscore are SRV
+// names that supply the ports and weights as well.
+type DNS struct {
+	cluster     string
+	logical     bool
+	family      string
+	refreshRate time.Duration
+	respectTTL  bool
+	hosts       []dnsHost
+	resolver    Resolver
+}
+
+type dnsHost struct {
+	name     string
+	port     int
+	weight   int
+	draining bool
+}
+
+// NewDNS returns the discovery for cluster c, which must be a STRICT_DNS or
+// LOGICAL_DNS cluster, looking names up with resolver.
+func NewDNS(c config.Cluster, resolver Resolver) (*DNS, error) {
+	if !c.IsDNS() {
+		return nil, fmt.Errorf("cluster %q: %s is not a DNS cluster type", c.Name, c.Type)
+	}
+	d := &DNS{
+		cluster:     c.Name,
+		logical:     c.Type == "LOGICAL_DNS",
+		family:      c.DnsLookupFamily,
+		refreshRate: defaultDnsRefreshRate,
+		respectTTL:  c.RespectDnsTtl,
+		resolver:    resolver,
+	}
+	if c.DnsRefreshRate != "" {
+		refreshRate, err := time.ParseDuration(c.DnsRefreshRate)
+		if err != nil || refreshRate <= 0 {
+			return nil, fmt.Errorf("cluster %q: invalid dns_refresh_rate %q", c.Name, c.DnsRefreshRate)
+		}
+		d.refreshRate = refreshRate
+	}
+	for _, locality := range c.LoadAssignment.Endpoints {
+		for _, lbEndpoint := range locality.LbEndpoints {
+			socketAddress := lbEndpoint.Endpoint.Address.SocketAddress
+			d.hosts = append(d.hosts, dnsHost{
+				name:     socketAddress.Address,
+				port:     socketAddress.PortValue,
+				weight:   lbEndpoint.LoadBalancingWeight,
+				draining: lbEndpoint.HealthStatus == "DRAINING",
+			})
+		}
+	}
+	return d, nil
+}
+
+// Run resolves every host each refresh interval, or when the shortest TTL
+// runs out if respect_dns_ttl is set. A host that fails to resolve keeps the
+// addresses it had.
+func (d *DNS) Run(ctx context.Context, update func([]loadbalancer.Endpoint)) {
+	previous := make([][]loadbalancer.Endpoint, len(d.hosts))
+	var last []loadbalancer.Endpoint
+	updated := false
+	for {
+		var endpoints []loadbalancer.Endpoint
+		var shortestTTL time.Duration
+		for i, host := range d.hosts {
+			resolved, ttl, err := d.resolve(ctx, host)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				discoveryLog.Warnf("Cluster %q: cannot resolve %s, keeping its last %d addresses: %v", d.cluster, host.name, len(previous[i]), err)
+			} else {
+				previous[i] = resolved
+				if ttl > 0 && (shortestTTL == 0 || ttl < shortestTTL) {
+					shortestTTL = ttl
+				}
+			}
+			for _, endpoint := range previous[i] {
+				if !slices.ContainsFunc(endpoints, func(e loadbalancer.Endpoint) bool { return e.Address == endpoint.Address }) {
+					endpoints = append(endpoints, endpoint)
+				}
+			}
+		}
+
+		if !updated || !reflect.DeepEqual(endpoints, last) {
+			discoveryLog.Infof("Cluster %q resolved to %d endpoints", d.cluster, len(endpoints))
+			update(endpoints)
+			last, updated = endpoints, true
+		}
+
+		wait := d.refreshRate
+		if d.respectTTL && shortestTTL > 0 {
+			wait = shortestTTL
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// resolve returns the endpoints of one configured host and the shortest TTL
+// of the records they came from.
+func (d *DNS) resolve(ctx context.Context, host dnsHost) ([]loadbalancer.Endpoint, time.Duration, error) {
+	type target struct {
+		name   string
+		port   int
+		weight int
+	}
+	targets := []target{{name: host.name, port: host.port, weight: host.weight}}
+	var ttl time.Duration
+	if config.IsSRV(host.name) {
+		services, err := d.resolver.LookupSRV(ctx, host.name)
+		if err != nil {
+			return nil, 0, err
+		}
+		targets = targets[:0]
+		for _, service := range services {
+			weight := host.weight
+			if service.Weight > 0 {
+				weight = service.Weight
+			}
+			targets = append(targets, target{name: service.Target, port: service.Port, weight: weight})
+			ttl = shorter(ttl, service.TTL)
+		}
+	}
+
+	var endpoints []loadbalancer.Endpoint
+	var errs []error
+	for _, t := range targets {
+		addresses, err := d.lookupHost(ctx, t.name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, address := range addresses {
+			endpoints = append(endpoints, loadbalancer.Endpoint{
+				Address:  net.JoinHostPort(address.IP, strconv.Itoa(t.port)),
+				Weight:   t.weight,
+				Draining: host.draining,
+			})
+			ttl = shorter(ttl, address.TTL)
+		}
+	}
+	if len(endpoints) == 0 {
+		if err := errors.Join(errs...); err != nil {
+			return nil, 0, err
+		}
+		return nil, 0, fmt.Errorf("no addresses for %s", host.name)
+	}
+
+	if d.logical {
+		return endpoints[:1], ttl, nil
+	}
+	// Servers often rotate the order of their records, which should not count
+	// as a change.
+	sort.Slice(endpoints, func(i, j int) bool { return endpoints[i].Address < endpoints[j].Address })
+	return endpoints, ttl, nil
+}
+
+// lookupHost returns the addresses of name in the cluster's dns_lookup_family.
+// AUTO prefers IPv6 and V4_PREFERRED IPv4, each falling back to the other
+// family when the preferred one has no addresses.
+func (d *DNS) lookupHost(ctx context.Context, name string) ([]Address, error) {
+	var networks []string
+	fallback := true
+	switch d.family {
+	case "V4_ONLY":
+		networks = []string{"ip4"}
+	case "V6_ONLY":
+		networks = []string{"ip6"}
+	case "V4_PREFERRED":
+		networks = []string{"ip4", "ip6"}
+	case "ALL":
+		networks, fallback = []string{"ip4", "ip6"}, false
+	default:
+		networks = []string{"ip6", "ip4"}
+	}
+
+	var addresses []Address
+	var errs []error
+	for _, network := range networks {
+		found, err := d.resolver.LookupIP(ctx, network, name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		addresses = append(addresses, found...)
+		if fallback && len(addresses) > 0 {
+			break
+		}
+	}
+	if len(addresses) == 0 {
+		if err := errors.Join(errs...); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("no addresses for %s", name)
+	}
+	return addresses, nil
+}
+
+func shorter(a, b time.Duration) time.Duration {
+	if a == 0 || (b > 0 && b < a) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,137 @@
+package discovery
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"seateam/config"
+	"seateam/loadbalancer"
+)
+
+func dnsCluster(clusterType string, hosts ...config.SocketAddress) config.Cluster {
+	c := config.Cluster{Name: "dns_service", Type: clusterType, DnsRefreshRate: "10ms"}
+	for _, host := range hosts {
+		var lbEndpoint config.LbEndpoint
+		lbEndpoint.Endpoint.Address.SocketAddress = host
+		c.AddEndpoint(lbEndpoint)
+	}
+	return c
+}
+
+// run starts discovery for c and returns the endpoints it reports.
+func run(t *testing.T, c config.Cluster, resolver Resolver) <-chan []loadbalancer.Endpoint {
+	t.Helper()
+	d, err := NewDNS(c, resolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updates := make(chan []loadbalancer.Endpoint, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go d.Run(ctx, func(endpoints []loadbalancer.Endpoint) { updates <- endpoints })
+	return updates
+}
+
+func next(t *testing.T, updates <-chan []loadbalancer.Endpoint) []string {
+	t.Helper()
+	select {
+	case endpoints := <-updates:
+		addresses := make([]string, len(endpoints))
+		for i, endpoint := range endpoints {
+			addresses[i] = endpoint.Address
+		}
+		return addresses
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for endpoints")
+		return nil
+	}
+}
+
+func TestStrictDNSFollowsChanges(t *testing.T) {
+	resolver := NewFakeResolver()
+	resolver.SetHost("backend.example.com", 0, "10.0.0.2", "10.0.0.1", "fd00::1")
+	c := dnsCluster("STRICT_DNS", config.SocketAddress{Address: "backend.example.com", PortValue: 80})
+	c.DnsLookupFamily = "V4_ONLY"
+	updates := run(t, c, resolver)
+
+	if got := next(t, updates); len(got) != 2 || got[0] != "10.0.0.1:80" || got[1] != "10.0.0.2:80" {
+		t.Fatalf("expected both IPv4 addresses, got %v", got)
+	}
+
+	resolver.SetHost("backend.example.com", 0, "10.0.0.3")
+	if got := next(t, updates); len(got) != 1 || got[0] != "10.0.0.3:80" {
+		t.Fatalf("expected the new address, got %v", got)
+	}
+
+	// A failed lookup keeps the last addresses rather than emptying the cluster.
+	resolver.SetHost("backend.example.com", 0)
+	select {
+	case got := <-updates:
+		t.Fatalf("expected the last addresses to be kept, got %v", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestLogicalDNSUsesFirstAddress(t *testing.T) {
+	resolver := NewFakeResolver()
+	resolver.SetHost("backend.example.com", 0, "10.0.0.2", "10.0.0.1")
+	c := dnsCluster("LOGICAL_DNS", config.SocketAddress{Address: "backend.example.com", PortValue: 80})
+	c.DnsLookupFamily = "V4_PREFERRED"
+
+	if got := next(t, run(t, c, resolver)); len(got) != 1 || got[0] != "10.0.0.2:80" {
+		t.Fatalf("expected only the first address, got %v", got)
+	}
+}
+
+func TestDNSLookupFamilyAutoPrefersIPv6(t *testing.T) {
+	resolver := NewFakeResolver()
+	resolver.SetHost("dual.example.com", 0, "10.0.0.1", "fd00::1")
+	resolver.SetHost("v4.example.com", 0, "10.0.0.2")
+	c := dnsCluster("STRICT_DNS",
+		config.SocketAddress{Address: "dual.example.com", PortValue: 80},
+		config.SocketAddress{Address: "v4.example.com", PortValue: 80})
+
+	if got := next(t, run(t, c, resolver)); len(got) != 2 || got[0] != "[fd00::1]:80" || got[1] != "10.0.0.2:80" {
+		t.Fatalf("expected IPv6 with a fallback to IPv4, got %v", got)
+	}
+}
+
+func TestSRVSuppliesPortsAndWeights(t *testing.T) {
+	resolver := NewFakeResolver()
+	resolver.SetSRV("_http._tcp.example.com",
+		Service{Target: "a.example.com", Port: 8080, Weight: 3},
+		Service{Target: "b.example.com", Port: 8081})
+	resolver.SetHost("a.example.com", 0, "10.0.0.1")
+	resolver.SetHost("b.example.com", 0, "10.0.0.2")
+	c := dnsCluster("STRICT_DNS", config.SocketAddress{Address: "_http._tcp.example.com"})
+	c.LoadAssignment.Endpoints[0].LbEndpoints[0].LoadBalancingWeight = 2
+
+	d, err := NewDNS(c, resolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoints, _, err := d.resolve(context.Background(), d.hosts[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []loadbalancer.Endpoint{{Address: "10.0.0.1:8080", Weight: 3}, {Address: "10.0.0.2:8081", Weight: 2}}
+	if !reflect.DeepEqual(endpoints, want) {
+		t.Errorf("expected %v, got %v", want, endpoints)
+	}
+}
+
+func TestRespectDNSTTL(t *testing.T) {
+	resolver := NewFakeResolver()
+	resolver.SetHost("backend.example.com", time.Hour, "10.0.0.1")
+	c := dnsCluster("STRICT_DNS", config.SocketAddress{Address: "backend.example.com", PortValue: 80})
+	c.RespectDnsTtl = true
+	next(t, run(t, c, resolver))
+
+	// The one hour TTL replaces the 10ms refresh rate.
+	time.Sleep(100 * time.Millisecond)
+	if lookups := resolver.Lookups("backend.example.com"); lookups > 2 {
+		t.Errorf("expected the TTL to hold off lookups, got %d", lookups)
+	}
+}
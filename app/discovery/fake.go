@@ -0,0 +1,86 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// FakeResolver is an in-memory Resolver for tests. Hosts and SRV names that
+// were not set are not found.
+type FakeResolver struct {
+	mu       sync.Mutex
+	hosts    map[string][]Address
+	services map[string][]Service
+	lookups  map[string]int
+}
+
+func NewFakeResolver() *FakeResolver {
+	return &FakeResolver{
+		hosts:    make(map[string][]Address),
+		services: make(map[string][]Service),
+		lookups:  make(map[string]int),
+	}
+}
+
+// SetHost makes host resolve to ips, each with ttl. No ips removes the host.
+func (f *FakeResolver) SetHost(host string, ttl time.Duration, ips ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(ips) == 0 {
+		delete(f.hosts, host)
+		return
+	}
+	addresses := make([]Address, len(ips))
+	for i, ip := range ips {
+		addresses[i] = Address{IP: ip, TTL: ttl}
+	}
+	f.hosts[host] = addresses
+}
+
+// SetSRV makes the SRV name resolve to services. No services removes it.
+func (f *FakeResolver) SetSRV(name string, services ...Service) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(services) == 0 {
+		delete(f.services, name)
+		return
+	}
+	f.services[name] = services
+}
+
+// Lookups returns how many times host or SRV name has been looked up.
+func (f *FakeResolver) Lookups(name string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.lookups[name]
+}
+
+func (f *FakeResolver) LookupIP(_ context.Context, network, host string) ([]Address, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lookups[host]++
+	addresses, ok := f.hosts[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	var matching []Address
+	for _, address := range addresses {
+		if ip := net.ParseIP(address.IP); ip != nil && (ip.To4() != nil) == (network == "ip4") {
+			matching = append(matching, address)
+		}
+	}
+	return matching, nil
+}
+
+func (f *FakeResolver) LookupSRV(_ context.Context, name string) ([]Service, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lookups[name]++
+	services, ok := f.services[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return append([]Service(nil), services...), nil
+}
@@ -0,0 +1,215 @@
+package discovery
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// serviceAccountDir holds the credentials Kubernetes mounts into every pod.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubeClient makes requests to the Kubernetes API server.
+type kubeClient struct {
+	server string
+	client *http.Client
+	token  string
+	// tokenFile is read again for every request, as service account tokens
+	// are rotated.
+	tokenFile string
+	// namespace is the one the credentials default to.
+	namespace string
+}
+
+func (k *kubeClient) get(ctx context.Context, path string) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, k.server+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Accept", "application/json")
+	token := k.token
+	if k.tokenFile != "" {
+		data, err := os.ReadFile(k.tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	return k.client.Do(request)
+}
+
+// inClusterClient uses the service account of the pod the router runs in.
+func inClusterClient() (*kubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a Kubernetes cluster and no kubeconfig given")
+	}
+	ca, err := os.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := tlsClientConfig(ca, nil, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	namespace, _ := os.ReadFile(filepath.Join(serviceAccountDir, "namespace"))
+	return &kubeClient{
+		server:    "https://" + net.JoinHostPort(host, port),
+		client:    newKubeHTTPClient(tlsConfig),
+		tokenFile: filepath.Join(serviceAccountDir, "token"),
+		namespace: strings.TrimSpace(string(namespace)),
+	}, nil
+}
+
+// kubeconfig is the part of a kubeconfig file that is used.
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Contexts       []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster   string `yaml:"cluster"`
+			User      string `yaml:"user"`
+			Namespace string `yaml:"namespace"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+	Clusters []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server                   string `yaml:"server"`
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			Token                 string `yaml:"token"`
+			TokenFile             string `yaml:"tokenFile"`
+			ClientCertificate     string `yaml:"client-certificate"`
+			ClientCertificateData string `yaml:"client-certificate-data"`
+			ClientKey             string `yaml:"client-key"`
+			ClientKeyData         string `yaml:"client-key-data"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+}
+
+// kubeconfigClient uses the current context of the kubeconfig file at path.
+func kubeconfigClient(path string) (*kubeClient, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file kubeconfig
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	k := &kubeClient{}
+	var clusterName, userName string
+	found := false
+	for _, c := range file.Contexts {
+		if c.Name == file.CurrentContext {
+			clusterName, userName, k.namespace = c.Context.Cluster, c.Context.User, c.Context.Namespace
+			found = true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("%s: current context %q not found", path, file.CurrentContext)
+	}
+
+	// Relative paths in a kubeconfig are relative to the file.
+	dir := filepath.Dir(path)
+	read := func(data, file string) ([]byte, error) {
+		switch {
+		case data != "":
+			return base64.StdEncoding.DecodeString(data)
+		case file != "":
+			if !filepath.IsAbs(file) {
+				file = filepath.Join(dir, file)
+			}
+			return os.ReadFile(file)
+		}
+		return nil, nil
+	}
+
+	var ca, cert, key []byte
+	insecure := false
+	found = false
+	for _, c := range file.Clusters {
+		if c.Name != clusterName {
+			continue
+		}
+		k.server = strings.TrimSuffix(c.Cluster.Server, "/")
+		insecure = c.Cluster.InsecureSkipTLSVerify
+		if ca, err = read(c.Cluster.CertificateAuthorityData, c.Cluster.CertificateAuthority); err != nil {
+			return nil, fmt.Errorf("%s: cluster %q: %v", path, clusterName, err)
+		}
+		found = true
+	}
+	if !found {
+		return nil, fmt.Errorf("%s: cluster %q not found", path, clusterName)
+	}
+	for _, u := range file.Users {
+		if u.Name != userName {
+			continue
+		}
+		k.token = u.User.Token
+		if u.User.TokenFile != "" {
+			k.tokenFile = u.User.TokenFile
+			if !filepath.IsAbs(k.tokenFile) {
+				k.tokenFile = filepath.Join(dir, k.tokenFile)
+			}
+		}
+		if cert, err = read(u.User.ClientCertificateData, u.User.ClientCertificate); err != nil {
+			return nil, fmt.Errorf("%s: user %q: %v", path, userName, err)
+		}
+		if key, err = read(u.User.ClientKeyData, u.User.ClientKey); err != nil {
+			return nil, fmt.Errorf("%s: user %q: %v", path, userName, err)
+		}
+	}
+
+	tlsConfig, err := tlsClientConfig(ca, cert, key, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	k.client = newKubeHTTPClient(tlsConfig)
+	return k, nil
+}
+
+func tlsClientConfig(ca, cert, key []byte, insecure bool) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecure}
+	if len(ca) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates in the certificate authority")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if len(cert) > 0 || len(key) > 0 {
+		certificate, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return tlsConfig, nil
+}
+
+func newKubeHTTPClient(tlsConfig *tls.Config) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport}
+}
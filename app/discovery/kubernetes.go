@@ -0,0 +1,360 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"seateam/config"
+	"seateam/loadbalancer"
+)
+
+// watchTimeout is how long one watch request runs before it is renewed.
+const watchTimeout = 5 * time.Minute
+
+// errResourceVersionGone is returned when the API server no longer has the
+// history a watch would resume from, so the slices must be listed again.
+var errResourceVersionGone = errors.New("resource version too old")
+
+// Kubernetes watches the EndpointSlices of a Service.
+//
+// Ready endpoints receive requests. Endpoints that are terminating but still
+// serving drain: they get no new requests while those in flight finish. Any
+// other endpoint is left out. When every ready endpoint carries topology hints
+// and some are hinted for the router's zone, only those are used, as
+// kube-proxy does for topology aware routing.
+type Kubernetes struct {
+	cluster  string
+	config   config.KubernetesClusterConfig
+	locality config.Locality
+	client   *kubeClient
+}
+
+// NewKubernetes returns the discovery for cluster c, which must be a
+// KUBERNETES cluster, for a router running in locality.
+func NewKubernetes(c config.Cluster, locality config.Locality) (*Kubernetes, error) {
+	if c.KubernetesClusterConfig == nil {
+		return nil, fmt.Errorf("cluster %q: kubernetes_cluster_config is required", c.Name)
+	}
+	d := &Kubernetes{cluster: c.Name, config: *c.KubernetesClusterConfig, locality: locality}
+
+	var err error
+	if d.config.Kubeconfig != "" {
+		d.client, err = kubeconfigClient(d.config.Kubeconfig)
+	} else {
+		d.client, err = inClusterClient()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cluster %q: %v", c.Name, err)
+	}
+	if d.config.Namespace == "" {
+		d.config.Namespace = d.client.namespace
+	}
+	if d.config.Namespace == "" {
+		d.config.Namespace = "default"
+	}
+	return d, nil
+}
+
+type endpointSlice struct {
+	Metadata struct {
+		Name            string `json:"name"`
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	AddressType string `json:"addressType"`
+	Endpoints   []struct {
+		Addresses  []string `json:"addresses"`
+		Conditions struct {
+			Ready       *bool `json:"ready"`
+			Serving     *bool `json:"serving"`
+			Terminating *bool `json:"terminating"`
+		} `json:"conditions"`
+		NodeName string `json:"nodeName"`
+		Zone     string `json:"zone"`
+		Hints    *struct {
+			ForZones []struct {
+				Name string `json:"name"`
+			} `json:"forZones"`
+		} `json:"hints"`
+	} `json:"endpoints"`
+	Ports []endpointPort `json:"ports"`
+}
+
+type endpointPort struct {
+	Name *string `json:"name"`
+	Port *int    `json:"port"`
+}
+
+type endpointSliceList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []endpointSlice `json:"items"`
+}
+
+type watchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// status is the object of an ERROR watch event.
+type status struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// Run lists the Service's EndpointSlices and then watches them, listing again
+// whenever the watch cannot resume. While the API server cannot be reached the
+// last endpoints stay in place and it is retried with backoff.
+func (d *Kubernetes) Run(ctx context.Context, update func([]loadbalancer.Endpoint)) {
+	var last []loadbalancer.Endpoint
+	updated := false
+	publish := func(known map[string]endpointSlice) {
+		endpoints := d.endpoints(known)
+		if !updated || !reflect.DeepEqual(endpoints, last) {
+			discoveryLog.Infof("Cluster %q: Service %s/%s has %d endpoints", d.cluster, d.config.Namespace, d.config.ServiceName, len(endpoints))
+			update(endpoints)
+			last, updated = endpoints, true
+		}
+	}
+
+	backoff := initialBackoff
+	for {
+		received, err := d.listAndWatch(ctx, publish)
+		if ctx.Err() != nil {
+			return
+		}
+		if received {
+			backoff = initialBackoff
+		}
+		if errors.Is(err, errResourceVersionGone) {
+			continue
+		}
+		discoveryLog.Warnf("Cluster %q: watching EndpointSlices of %s/%s failed, keeping the last %d endpoints and retrying in %s: %v", d.cluster, d.config.Namespace, d.config.ServiceName, len(last), backoff, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxBackoff)
+	}
+}
+
+func (d *Kubernetes) slicesPath(params url.Values) string {
+	params.Set("labelSelector", "kubernetes.io/service-name="+d.config.ServiceName)
+	return "/apis/discovery.k8s.io/v1/namespaces/" + url.PathEscape(d.config.Namespace) + "/endpointslices?" + params.Encode()
+}
+
+// listAndWatch lists the slices, then renews the watch on them until it
+// fails. It reports whether anything was received.
+func (d *Kubernetes) listAndWatch(ctx context.Context, publish func(map[string]endpointSlice)) (bool, error) {
+	var list endpointSliceList
+	if err := d.getJSON(ctx, d.slicesPath(url.Values{}), &list); err != nil {
+		return false, err
+	}
+	known := make(map[string]endpointSlice, len(list.Items))
+	for _, slice := range list.Items {
+		known[slice.Metadata.Name] = slice
+	}
+	publish(known)
+
+	resourceVersion := list.Metadata.ResourceVersion
+	for {
+		params := url.Values{}
+		params.Set("watch", "true")
+		params.Set("allowWatchBookmarks", "true")
+		params.Set("resourceVersion", resourceVersion)
+		params.Set("timeoutSeconds", strconv.Itoa(int(watchTimeout.Seconds())))
+		var err error
+		resourceVersion, err = d.watch(ctx, d.slicesPath(params), resourceVersion, known, publish)
+		if err != nil {
+			return true, err
+		}
+	}
+}
+
+// watch applies the events of one watch request to known and returns the
+// resource version to resume from once the server ends it.
+func (d *Kubernetes) watch(ctx context.Context, path, resourceVersion string, known map[string]endpointSlice, publish func(map[string]endpointSlice)) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, watchTimeout+time.Minute)
+	defer cancel()
+	response, err := d.client.get(ctx, path)
+	if err != nil {
+		return resourceVersion, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusGone {
+		return resourceVersion, errResourceVersionGone
+	}
+	if response.StatusCode != http.StatusOK {
+		return resourceVersion, responseError(response)
+	}
+
+	decoder := json.NewDecoder(response.Body)
+	for {
+		var event watchEvent
+		if err := decoder.Decode(&event); err == io.EOF {
+			return resourceVersion, nil
+		} else if err != nil {
+			return resourceVersion, err
+		}
+
+		if event.Type == "ERROR" {
+			var s status
+			json.Unmarshal(event.Object, &s)
+			if s.Code == http.StatusGone {
+				return resourceVersion, errResourceVersionGone
+			}
+			return resourceVersion, fmt.Errorf("watch error %d: %s", s.Code, s.Message)
+		}
+		var slice endpointSlice
+		if err := json.Unmarshal(event.Object, &slice); err != nil {
+			return resourceVersion, err
+		}
+		resourceVersion = slice.Metadata.ResourceVersion
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			known[slice.Metadata.Name] = slice
+		case "DELETED":
+			delete(known, slice.Metadata.Name)
+		default:
+			// BOOKMARK only moves the resource version on.
+			continue
+		}
+		publish(known)
+	}
+}
+
+func (d *Kubernetes) getJSON(ctx context.Context, path string, v interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	response, err := d.client.get(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return responseError(response)
+	}
+	return json.NewDecoder(response.Body).Decode(v)
+}
+
+func responseError(response *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+	var s status
+	if json.Unmarshal(body, &s) == nil && s.Message != "" {
+		return fmt.Errorf("%s: %s", response.Status, s.Message)
+	}
+	return fmt.Errorf("%s: %s", response.Status, strings.TrimSpace(string(body)))
+}
+
+// endpoints turns the slices into endpoints. An address in more than one
+// slice, as happens while they are being rebalanced, counts once and is
+// ready if any slice says so.
+func (d *Kubernetes) endpoints(known map[string]endpointSlice) []loadbalancer.Endpoint {
+	type candidate struct {
+		endpoint loadbalancer.Endpoint
+		hinted   bool
+		forZone  bool
+	}
+	byAddress := make(map[string]candidate)
+	for _, slice := range known {
+		if slice.AddressType != "IPv4" && slice.AddressType != "IPv6" {
+			continue
+		}
+		port, ok := d.port(slice)
+		if !ok {
+			continue
+		}
+		for _, e := range slice.Endpoints {
+			if len(e.Addresses) == 0 {
+				continue
+			}
+			// Conditions left out mean ready, serving as ready says, and not
+			// terminating.
+			ready := e.Conditions.Ready == nil || *e.Conditions.Ready
+			serving := ready
+			if e.Conditions.Serving != nil {
+				serving = *e.Conditions.Serving
+			}
+			terminating := e.Conditions.Terminating != nil && *e.Conditions.Terminating
+
+			var c candidate
+			switch {
+			case ready && !terminating:
+			case serving && terminating:
+				c.endpoint.Draining = true
+			default:
+				continue
+			}
+			// Only the first address is used, as the API asks of consumers.
+			c.endpoint.Address = net.JoinHostPort(e.Addresses[0], strconv.Itoa(port))
+			c.endpoint.Weight = 1
+			if e.Zone != "" || e.NodeName != "" {
+				c.endpoint.Metadata = make(map[string]string)
+				if e.Zone != "" {
+					c.endpoint.Metadata["zone"] = e.Zone
+				}
+				if e.NodeName != "" {
+					c.endpoint.Metadata["node_name"] = e.NodeName
+				}
+			}
+			if e.Hints != nil {
+				c.hinted = true
+				for _, zone := range e.Hints.ForZones {
+					c.forZone = c.forZone || (zone.Name == d.locality.Zone && zone.Name != "")
+				}
+			}
+			if existing, ok := byAddress[c.endpoint.Address]; ok && !existing.endpoint.Draining {
+				continue
+			}
+			byAddress[c.endpoint.Address] = c
+		}
+	}
+
+	useHints := d.locality.Zone != ""
+	anyForZone := false
+	for _, c := range byAddress {
+		if !c.endpoint.Draining {
+			useHints = useHints && c.hinted
+			anyForZone = anyForZone || c.forZone
+		}
+	}
+	useHints = useHints && anyForZone
+
+	var endpoints []loadbalancer.Endpoint
+	for _, c := range byAddress {
+		if useHints && !c.endpoint.Draining && !c.forZone {
+			continue
+		}
+		endpoints = append(endpoints, c.endpoint)
+	}
+	sort.Slice(endpoints, func(i, j int) bool { return endpoints[i].Address < endpoints[j].Address })
+	return endpoints
+}
+
+// port returns the slice's port for the configured port name, or its first
+// port when no name is configured.
+func (d *Kubernetes) port(slice endpointSlice) (int, bool) {
+	index := 0
+	if d.config.PortName != "" {
+		index = slices.IndexFunc(slice.Ports, func(p endpointPort) bool {
+			return p.Name != nil && *p.Name == d.config.PortName
+		})
+	}
+	if index < 0 || index >= len(slice.Ports) || slice.Ports[index].Port == nil {
+		return 0, false
+	}
+	return *slice.Ports[index].Port, true
+}
@@ -0,0 +1,199 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"seateam/config"
+	"seateam/loadbalancer"
+)
+
+// fakeAPIServer serves the EndpointSlices of the "web" Service in namespace
+// "shop": a list of the initial slices, then watches streaming what is sent on
+// events.
+type fakeAPIServer struct {
+	slices []map[string]interface{}
+	events chan map[string]interface{}
+}
+
+func newFakeAPIServer(t *testing.T, slices ...map[string]interface{}) (*fakeAPIServer, string) {
+	f := &fakeAPIServer{slices: slices, events: make(chan map[string]interface{}, 10)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, `{"kind":"Status","code":401,"message":"Unauthorized"}`, http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/apis/discovery.k8s.io/v1/namespaces/shop/endpointslices" || r.URL.Query().Get("labelSelector") != "kubernetes.io/service-name=web" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Query().Get("watch") != "true" {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"metadata": map[string]interface{}{"resourceVersion": "1"},
+				"items":    f.slices,
+			})
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case event := <-f.events:
+				json.NewEncoder(w).Encode(event)
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(server.CloseClientConnections)
+	return f, server.URL
+}
+
+type sliceEndpoint struct {
+	address                     string
+	ready, serving, terminating bool
+	zone                        string
+	hints                       []string
+}
+
+func testSlice(name, resourceVersion string, endpoints ...sliceEndpoint) map[string]interface{} {
+	var items []map[string]interface{}
+	for _, e := range endpoints {
+		item := map[string]interface{}{
+			"addresses": []string{e.address},
+			"conditions": map[string]interface{}{
+				"ready":       e.ready,
+				"serving":     e.serving,
+				"terminating": e.terminating,
+			},
+			"zone": e.zone,
+		}
+		if e.hints != nil {
+			var forZones []map[string]string
+			for _, zone := range e.hints {
+				forZones = append(forZones, map[string]string{"name": zone})
+			}
+			item["hints"] = map[string]interface{}{"forZones": forZones}
+		}
+		items = append(items, item)
+	}
+	return map[string]interface{}{
+		"metadata":    map[string]interface{}{"name": name, "resourceVersion": resourceVersion},
+		"addressType": "IPv4",
+		"endpoints":   items,
+		"ports": []map[string]interface{}{
+			{"name": "metrics", "port": 9090},
+			{"name": "http", "port": 8080},
+		},
+	}
+}
+
+func writeKubeconfig(t *testing.T, server string) string {
+	path := filepath.Join(t.TempDir(), "kubeconfig")
+	kubeconfig := fmt.Sprintf(`apiVersion: v1
+kind: Config
+current-context: test
+contexts:
+- name: test
+  context: { cluster: test, user: test, namespace: shop }
+clusters:
+- name: test
+  cluster: { server: %q }
+users:
+- name: test
+  user: { token: secret }
+`, server)
+	if err := os.WriteFile(path, []byte(kubeconfig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func kubernetesCluster(kubeconfig string) config.Cluster {
+	return config.Cluster{Name: "web", Type: "KUBERNETES", KubernetesClusterConfig: &config.KubernetesClusterConfig{
+		ServiceName: "web",
+		PortName:    "http",
+		Kubeconfig:  kubeconfig,
+	}}
+}
+
+func TestKubernetesWatchesEndpointSlices(t *testing.T) {
+	apiServer, address := newFakeAPIServer(t, testSlice("web-abc", "1",
+		sliceEndpoint{address: "10.1.0.1", ready: true, serving: true},
+		sliceEndpoint{address: "10.1.0.2", serving: true, terminating: true},
+		sliceEndpoint{address: "10.1.0.3"},
+	))
+	d, err := NewKubernetes(kubernetesCluster(writeKubeconfig(t, address)), config.Locality{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	updates := make(chan []loadbalancer.Endpoint, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx, func(endpoints []loadbalancer.Endpoint) { updates <- endpoints })
+
+	endpoints := <-updates
+	if len(endpoints) != 2 || endpoints[0].Address != "10.1.0.1:8080" || endpoints[0].Draining ||
+		endpoints[1].Address != "10.1.0.2:8080" || !endpoints[1].Draining {
+		t.Fatalf("expected the ready endpoint and the draining one on the http port, got %+v", endpoints)
+	}
+
+	apiServer.events <- map[string]interface{}{"type": "MODIFIED", "object": testSlice("web-abc", "2",
+		sliceEndpoint{address: "10.1.0.1", ready: true, serving: true},
+		sliceEndpoint{address: "10.1.0.3", ready: true, serving: true},
+	)}
+	if got := next(t, updates); len(got) != 2 || got[0] != "10.1.0.1:8080" || got[1] != "10.1.0.3:8080" {
+		t.Fatalf("expected the terminated endpoint to be removed and the new one added, got %v", got)
+	}
+
+	apiServer.events <- map[string]interface{}{"type": "DELETED", "object": testSlice("web-abc", "3")}
+	if got := next(t, updates); len(got) != 0 {
+		t.Fatalf("expected no endpoints once the slice is deleted, got %v", got)
+	}
+}
+
+func TestKubernetesTopologyHints(t *testing.T) {
+	d := &Kubernetes{config: config.KubernetesClusterConfig{PortName: "http"}, locality: config.Locality{Zone: "zone-a"}}
+	hinted := map[string]endpointSlice{}
+	decode := func(slice map[string]interface{}) endpointSlice {
+		data, _ := json.Marshal(slice)
+		var decoded endpointSlice
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		return decoded
+	}
+
+	hinted["web-abc"] = decode(testSlice("web-abc", "1",
+		sliceEndpoint{address: "10.1.0.1", ready: true, serving: true, zone: "zone-a", hints: []string{"zone-a"}},
+		sliceEndpoint{address: "10.1.0.2", ready: true, serving: true, zone: "zone-b", hints: []string{"zone-b"}},
+	))
+	endpoints := d.endpoints(hinted)
+	if len(endpoints) != 1 || endpoints[0].Address != "10.1.0.1:8080" || endpoints[0].Metadata["zone"] != "zone-a" {
+		t.Errorf("expected only the endpoint hinted for zone-a, got %+v", endpoints)
+	}
+
+	// Hints only count when every endpoint has them.
+	hinted["web-def"] = decode(testSlice("web-def", "1",
+		sliceEndpoint{address: "10.1.0.3", ready: true, serving: true, zone: "zone-b"},
+	))
+	if endpoints := d.endpoints(hinted); len(endpoints) != 3 {
+		t.Errorf("expected every endpoint when one has no hints, got %+v", endpoints)
+	}
+}
+
+func TestKubernetesKubeconfigErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kubeconfig")
+	os.WriteFile(path, []byte("current-context: missing\n"), 0o600)
+	if _, err := NewKubernetes(kubernetesCluster(path), config.Locality{}); err == nil {
+		t.Error("expected a kubeconfig without its current context to be rejected")
+	}
+}
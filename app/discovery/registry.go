@@ -0,0 +1,349 @@
+package discovery
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"seateam/loadbalancer"
+)
+
+// DefaultRegistrationTTL is how long a registration lasts without a heartbeat
+// when it does not ask for a TTL of its own.
+const DefaultRegistrationTTL = 30 * time.Second
+
+// ErrUnknownRegistration is returned for a registration ID that does not exist
+// or has expired.
+var ErrUnknownRegistration = errors.New("unknown registration")
+
+// Registration is a backend that registered itself with the router.
+type Registration struct {
+	ID       string            `json:"id"`
+	Cluster  string            `json:"cluster"`
+	Address  string            `json:"address"`
+	Port     int               `json:"port"`
+	Weight   int               `json:"weight,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	TTL      Duration          `json:"ttl"`
+	// Persist keeps the registration in the registry's file so it survives a
+	// restart.
+	Persist bool `json:"persist,omitempty"`
+	// ExpiresAt is when the registration is dropped unless a heartbeat
+	// arrives first.
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Duration is a time.Duration written as a string such as "30s" in JSON.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Endpoint is the address backends of the registration are reached at.
+func (r Registration) Endpoint() string {
+	return net.JoinHostPort(r.Address, strconv.Itoa(r.Port))
+}
+
+// Registry holds the backends of REGISTRY clusters, which register themselves
+// and then send heartbeats. A registration that misses its TTL is removed.
+// Once the registry has a file to persist to, registrations that ask for it
+// are kept there, so they survive a restart; each gets a full TTL again when
+// it is loaded.
+type Registry struct {
+	mu            sync.Mutex
+	registrations map[string]*Registration
+	expiry        map[string]*time.Timer
+	watchers      map[string]map[chan struct{}]bool
+	path          string
+}
+
+// DefaultRegistry is the registry REGISTRY clusters get their endpoints from.
+var DefaultRegistry = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{
+		registrations: make(map[string]*Registration),
+		expiry:        make(map[string]*time.Timer),
+		watchers:      make(map[string]map[chan struct{}]bool),
+	}
+}
+
+// Persist loads the registrations saved at path, if there are any, and saves
+// the persistent registrations there from now on.
+func (r *Registry) Persist(path string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	r.path = path
+	if len(data) == 0 {
+		return nil
+	}
+	var saved []Registration
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	for _, registration := range saved {
+		registration := registration
+		r.put(&registration)
+	}
+	discoveryLog.Infof("Loaded %d registrations from %s", len(saved), path)
+	return nil
+}
+
+// Register adds a backend, or refreshes it when the same address and port is
+// already registered for the cluster, keeping its ID.
+func (r *Registry) Register(registration Registration) (Registration, error) {
+	switch {
+	case registration.Cluster == "":
+		return registration, errors.New("cluster is required")
+	case registration.Address == "":
+		return registration, errors.New("address is required")
+	case registration.Port <= 0 || registration.Port > 65535:
+		return registration, fmt.Errorf("port must be between 1 and 65535, got %d", registration.Port)
+	case registration.Weight < 0:
+		return registration, fmt.Errorf("weight must not be negative, got %d", registration.Weight)
+	case registration.TTL < 0:
+		return registration, fmt.Errorf("ttl must not be negative, got %s", time.Duration(registration.TTL))
+	}
+	if registration.TTL == 0 {
+		registration.TTL = Duration(DefaultRegistrationTTL)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if registration.Persist && r.path == "" {
+		return registration, errors.New("registrations cannot be persisted without a registry file")
+	}
+	registration.ID = ""
+	for id, existing := range r.registrations {
+		if existing.Cluster == registration.Cluster && existing.Endpoint() == registration.Endpoint() {
+			registration.ID = id
+		}
+	}
+	if registration.ID == "" {
+		registration.ID = newRegistrationID()
+	}
+	r.put(&registration)
+	r.save()
+	return registration, nil
+}
+
+// Heartbeat restarts the TTL of a registration.
+func (r *Registry) Heartbeat(id string) (Registration, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	registration, ok := r.registrations[id]
+	if !ok {
+		return Registration{}, ErrUnknownRegistration
+	}
+	registration.ExpiresAt = time.Now().Add(time.Duration(registration.TTL))
+	r.expiry[id].Reset(time.Duration(registration.TTL))
+	return *registration, nil
+}
+
+// Deregister removes a registration.
+func (r *Registry) Deregister(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.registrations[id]; !ok {
+		return ErrUnknownRegistration
+	}
+	r.remove(id)
+	r.save()
+	return nil
+}
+
+// Registrations returns every registration sorted by cluster and endpoint.
+func (r *Registry) Registrations() []Registration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	all := make([]Registration, 0, len(r.registrations))
+	for _, registration := range r.registrations {
+		all = append(all, *registration)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Cluster != all[j].Cluster {
+			return all[i].Cluster < all[j].Cluster
+		}
+		return all[i].Endpoint() < all[j].Endpoint()
+	})
+	return all
+}
+
+// put stores registration with a fresh TTL. It is called with mu held.
+func (r *Registry) put(registration *Registration) {
+	id := registration.ID
+	if previous, ok := r.registrations[id]; ok && previous.Cluster != registration.Cluster {
+		r.notify(previous.Cluster)
+	}
+	if timer, ok := r.expiry[id]; ok {
+		timer.Stop()
+	}
+	ttl := time.Duration(registration.TTL)
+	registration.ExpiresAt = time.Now().Add(ttl)
+	r.registrations[id] = registration
+	r.expiry[id] = time.AfterFunc(ttl, func() { r.expire(id, registration) })
+	r.notify(registration.Cluster)
+}
+
+func (r *Registry) expire(id string, registration *Registration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// A heartbeat may have come in while the timer fired.
+	if r.registrations[id] != registration || time.Now().Before(registration.ExpiresAt) {
+		return
+	}
+	discoveryLog.Warnf("Registration %s of %s in cluster %q missed its %s TTL, removing it", id, registration.Endpoint(), registration.Cluster, time.Duration(registration.TTL))
+	r.remove(id)
+	r.save()
+}
+
+// remove is called with mu held.
+func (r *Registry) remove(id string) {
+	registration := r.registrations[id]
+	r.expiry[id].Stop()
+	delete(r.registrations, id)
+	delete(r.expiry, id)
+	r.notify(registration.Cluster)
+}
+
+// notify wakes the discoveries of cluster. It is called with mu held.
+func (r *Registry) notify(cluster string) {
+	for changed := range r.watchers[cluster] {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// save writes the registrations to the persistence file, if there is one. A
+// failure is only logged, as the registrations still work until a restart.
+// It is called with mu held.
+func (r *Registry) save() {
+	if r.path == "" {
+		return
+	}
+	saved := []Registration{}
+	for _, registration := range r.registrations {
+		if registration.Persist {
+			saved = append(saved, *registration)
+		}
+	}
+	sort.Slice(saved, func(i, j int) bool { return saved[i].ID < saved[j].ID })
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(r.path, data)
+	}
+	if err != nil {
+		discoveryLog.Errorf("Cannot save registrations to %s: %v", r.path, err)
+	}
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func newRegistrationID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Discovery returns the discovery of a REGISTRY cluster, whose endpoints are
+// the backends registered for it.
+func (r *Registry) Discovery(cluster string) ServiceDiscovery {
+	return &registryDiscovery{registry: r, cluster: cluster}
+}
+
+type registryDiscovery struct {
+	registry *Registry
+	cluster  string
+}
+
+func (d *registryDiscovery) Run(ctx context.Context, update func([]loadbalancer.Endpoint)) {
+	r := d.registry
+	changed := make(chan struct{}, 1)
+	r.mu.Lock()
+	if r.watchers[d.cluster] == nil {
+		r.watchers[d.cluster] = make(map[chan struct{}]bool)
+	}
+	r.watchers[d.cluster][changed] = true
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		delete(r.watchers[d.cluster], changed)
+	}()
+
+	var last []loadbalancer.Endpoint
+	updated := false
+	for {
+		endpoints := d.endpoints()
+		if !updated || !reflect.DeepEqual(endpoints, last) {
+			discoveryLog.Infof("Cluster %q has %d registered endpoints", d.cluster, len(endpoints))
+			update(endpoints)
+			last, updated = endpoints, true
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+		}
+	}
+}
+
+func (d *registryDiscovery) endpoints() []loadbalancer.Endpoint {
+	var endpoints []loadbalancer.Endpoint
+	for _, registration := range d.registry.Registrations() {
+		if registration.Cluster == d.cluster {
+			endpoints = append(endpoints, loadbalancer.Endpoint{
+				Address:  registration.Endpoint(),
+				Weight:   registration.Weight,
+				Metadata: registration.Metadata,
+			})
+		}
+	}
+	return endpoints
+}
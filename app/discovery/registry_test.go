@@ -0,0 +1,93 @@
+package discovery
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"seateam/loadbalancer"
+)
+
+func TestRegistryHeartbeatsAndExpiry(t *testing.T) {
+	registry := NewRegistry()
+	updates := make(chan []loadbalancer.Endpoint, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go registry.Discovery("web").Run(ctx, func(endpoints []loadbalancer.Endpoint) { updates <- endpoints })
+	if got := next(t, updates); len(got) != 0 {
+		t.Fatalf("expected no endpoints before anything registers, got %v", got)
+	}
+
+	ttl := Duration(200 * time.Millisecond)
+	first, err := registry.Register(Registration{Cluster: "web", Address: "10.0.0.1", Port: 8080, TTL: ttl})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := registry.Register(Registration{Cluster: "other", Address: "10.0.0.9", Port: 8080}); err != nil {
+		t.Fatal(err)
+	}
+	if got := next(t, updates); len(got) != 1 || got[0] != "10.0.0.1:8080" {
+		t.Fatalf("expected the registered endpoint, got %v", got)
+	}
+
+	// Registering the same endpoint again refreshes it under the same ID.
+	again, err := registry.Register(Registration{Cluster: "web", Address: "10.0.0.1", Port: 8080, Weight: 3, TTL: ttl})
+	if err != nil || again.ID != first.ID {
+		t.Fatalf("expected the registration to be refreshed as %s, got %+v (%v)", first.ID, again, err)
+	}
+	<-updates
+
+	// Heartbeats keep it past its TTL.
+	for i := 0; i < 4; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if _, err := registry.Heartbeat(first.ID); err != nil {
+			t.Fatalf("heartbeat %d: %v", i, err)
+		}
+	}
+
+	// Without them it is removed.
+	if got := next(t, updates); len(got) != 0 {
+		t.Fatalf("expected the endpoint to expire, got %v", got)
+	}
+	if _, err := registry.Heartbeat(first.ID); err != ErrUnknownRegistration {
+		t.Errorf("expected a heartbeat after expiry to fail, got %v", err)
+	}
+}
+
+func TestRegistryPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registrations.json")
+	registry := NewRegistry()
+	if _, err := registry.Register(Registration{Cluster: "web", Address: "10.0.0.1", Port: 8080, Persist: true}); err == nil {
+		t.Error("expected persisting without a registry file to fail")
+	}
+	if err := registry.Persist(path); err != nil {
+		t.Fatal(err)
+	}
+	persistent, err := registry.Register(Registration{Cluster: "web", Address: "10.0.0.1", Port: 8080, Persist: true, Metadata: map[string]string{"version": "v1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := registry.Register(Registration{Cluster: "web", Address: "10.0.0.2", Port: 8080}); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := NewRegistry()
+	if err := restarted.Persist(path); err != nil {
+		t.Fatal(err)
+	}
+	registrations := restarted.Registrations()
+	if len(registrations) != 1 || registrations[0].ID != persistent.ID || registrations[0].Metadata["version"] != "v1" {
+		t.Fatalf("expected only the persistent registration after a restart, got %+v", registrations)
+	}
+	if !registrations[0].ExpiresAt.After(time.Now().Add(DefaultRegistrationTTL - time.Second)) {
+		t.Errorf("expected a loaded registration to get a full TTL, expires at %s", registrations[0].ExpiresAt)
+	}
+
+	if err := restarted.Deregister(persistent.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewRegistry().Persist(path); err != nil {
+		t.Fatal(err)
+	}
+}
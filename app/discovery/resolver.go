@@ -0,0 +1,167 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const resolvConf = "/etc/resolv.conf"
+
+// systemResolver asks the name servers in /etc/resolv.conf directly, since
+// net.Resolver does not return TTLs. Names the servers do not know, such as
+// those in /etc/hosts, fall back to net.DefaultResolver without a TTL.
+type systemResolver struct {
+	once   sync.Once
+	config *dns.ClientConfig
+}
+
+// NewSystemResolver returns a Resolver using the host's DNS configuration.
+func NewSystemResolver() Resolver {
+	return &systemResolver{}
+}
+
+func (r *systemResolver) clientConfig() *dns.ClientConfig {
+	r.once.Do(func() {
+		config, err := dns.ClientConfigFromFile(resolvConf)
+		if err != nil {
+			discoveryLog.Warnf("Cannot read %s, DNS TTLs will not be known: %v", resolvConf, err)
+			return
+		}
+		r.config = config
+	})
+	return r.config
+}
+
+func (r *systemResolver) LookupIP(ctx context.Context, network, host string) ([]Address, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		if (ip.To4() != nil) != (network == "ip4") {
+			return nil, nil
+		}
+		return []Address{{IP: ip.String()}}, nil
+	}
+
+	qtype := dns.TypeA
+	if network == "ip6" {
+		qtype = dns.TypeAAAA
+	}
+	answer, err := r.query(ctx, host, qtype)
+	if err != nil {
+		ips, fallbackErr := net.DefaultResolver.LookupIP(ctx, network, host)
+		if fallbackErr != nil {
+			return nil, err
+		}
+		addresses := make([]Address, len(ips))
+		for i, ip := range ips {
+			addresses[i] = Address{IP: ip.String()}
+		}
+		return addresses, nil
+	}
+
+	ttl := minTTL(answer)
+	var addresses []Address
+	for _, rr := range answer {
+		switch record := rr.(type) {
+		case *dns.A:
+			addresses = append(addresses, Address{IP: record.A.String(), TTL: ttl})
+		case *dns.AAAA:
+			addresses = append(addresses, Address{IP: record.AAAA.String(), TTL: ttl})
+		}
+	}
+	return addresses, nil
+}
+
+func (r *systemResolver) LookupSRV(ctx context.Context, name string) ([]Service, error) {
+	answer, err := r.query(ctx, name, dns.TypeSRV)
+	if err != nil {
+		_, records, fallbackErr := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+		if fallbackErr != nil {
+			return nil, err
+		}
+		services := make([]Service, len(records))
+		for i, record := range records {
+			services[i] = Service{Target: strings.TrimSuffix(record.Target, "."), Port: int(record.Port), Weight: int(record.Weight)}
+		}
+		return services, nil
+	}
+
+	ttl := minTTL(answer)
+	var services []Service
+	for _, rr := range answer {
+		if record, ok := rr.(*dns.SRV); ok {
+			services = append(services, Service{
+				Target: strings.TrimSuffix(record.Target, "."),
+				Port:   int(record.Port),
+				Weight: int(record.Weight),
+				TTL:    ttl,
+			})
+		}
+	}
+	return services, nil
+}
+
+// query returns the answer to the first name in the search list that has
+// records of qtype.
+func (r *systemResolver) query(ctx context.Context, name string, qtype uint16) ([]dns.RR, error) {
+	config := r.clientConfig()
+	if config == nil {
+		return nil, fmt.Errorf("no name servers for %s", name)
+	}
+	client := &dns.Client{Timeout: time.Duration(config.Timeout) * time.Second}
+
+	var lastErr error
+	for _, candidate := range config.NameList(name) {
+		for _, server := range config.Servers {
+			msg := new(dns.Msg)
+			msg.SetQuestion(candidate, qtype)
+			address := net.JoinHostPort(server, config.Port)
+			response, _, err := client.ExchangeContext(ctx, msg, address)
+			if err == nil && response.Truncated {
+				tcp := *client
+				tcp.Net = "tcp"
+				response, _, err = tcp.ExchangeContext(ctx, msg, address)
+			}
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			if response.Rcode == dns.RcodeSuccess && hasType(response.Answer, qtype) {
+				return response.Answer, nil
+			}
+			// The server answered that there is nothing there, so asking the
+			// others would not help.
+			break
+		}
+	}
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func hasType(answer []dns.RR, qtype uint16) bool {
+	for _, rr := range answer {
+		if rr.Header().Rrtype == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+// minTTL returns the shortest TTL in the answer, which includes every CNAME
+// on the way to the records.
+func minTTL(answer []dns.RR) time.Duration {
+	var ttl time.Duration
+	for i, rr := range answer {
+		recordTTL := time.Duration(rr.Header().Ttl) * time.Second
+		if i == 0 || recordTTL < ttl {
+			ttl = recordTTL
+		}
+	}
+	return ttl
+}
@@ -0,0 +1,114 @@
+package filters
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"seateam/config"
+)
+
+// BufferFilter reads the whole request body before it goes upstream, so the
+// upstream gets a Content-Length and is not held up by slow clients.
+const BufferFilter = "envoy.filters.http.buffer"
+
+type bufferConfig struct {
+	// MaxRequestBytes is the largest body buffered. Larger requests get a
+	// 413.
+	MaxRequestBytes int64 `yaml:"max_request_bytes"`
+}
+
+type bufferPerRoute struct {
+	Disabled bool          `yaml:"disabled,omitempty"`
+	Buffer   *bufferConfig `yaml:"buffer,omitempty"`
+}
+
+type bufferFactory struct{}
+
+func (bufferFactory) NewFilterFactory(typedConfig config.TypedConfig) (func() StreamFilter, error) {
+	var c bufferConfig
+	if err := typedConfig.Decode(&c); err != nil {
+		return nil, err
+	}
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	return func() StreamFilter { return &bufferFilter{config: c} }, nil
+}
+
+func (bufferFactory) ParseRouteConfig(typedConfig config.TypedConfig) (interface{}, error) {
+	var perRoute bufferPerRoute
+	if err := typedConfig.Decode(&perRoute); err != nil {
+		return nil, err
+	}
+	switch {
+	case perRoute.Disabled == (perRoute.Buffer != nil):
+		return nil, errors.New("exactly one of disabled and buffer is required")
+	case perRoute.Buffer != nil:
+		if err := perRoute.Buffer.check(); err != nil {
+			return nil, err
+		}
+	}
+	return perRoute, nil
+}
+
+func (c bufferConfig) check() error {
+	if c.MaxRequestBytes <= 0 {
+		return errors.New("max_request_bytes must be greater than zero")
+	}
+	return nil
+}
+
+type bufferFilter struct {
+	PassThroughFilter
+	config   bufferConfig
+	request  *http.Request
+	buffered int64
+}
+
+func (f *bufferFilter) DecodeHeaders(r *http.Request, endStream bool) Status {
+	if perRoute, ok := f.Callbacks.PerRouteConfig().(bufferPerRoute); ok {
+		if perRoute.Disabled {
+			return Continue
+		}
+		f.config = *perRoute.Buffer
+	}
+	if endStream {
+		return Continue
+	}
+	if r.ContentLength > f.config.MaxRequestBytes {
+		f.Callbacks.SendLocalReply(http.StatusRequestEntityTooLarge, "Payload Too Large", nil)
+		return StopIteration
+	}
+	f.request = r
+	return StopIteration
+}
+
+func (f *bufferFilter) DecodeData(data *bytes.Buffer, endStream bool) Status {
+	if f.request == nil {
+		return Continue
+	}
+	f.buffered += int64(data.Len())
+	if f.buffered > f.config.MaxRequestBytes {
+		f.Callbacks.SendLocalReply(http.StatusRequestEntityTooLarge, "Payload Too Large", nil)
+		return StopIterationNoBuffer
+	}
+	if !endStream {
+		return StopIteration
+	}
+	f.setContentLength()
+	return Continue
+}
+
+func (f *bufferFilter) DecodeTrailers(trailers http.Header) Status {
+	if f.request != nil {
+		f.setContentLength()
+	}
+	return Continue
+}
+
+func (f *bufferFilter) setContentLength() {
+	f.request.ContentLength = f.buffered
+	f.request.Header.Set("Content-Length", strconv.FormatInt(f.buffered, 10))
+}
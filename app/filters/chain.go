@@ -0,0 +1,122 @@
+package filters
+
+import (
+	"fmt"
+	"net/http"
+
+	"seateam/config"
+)
+
+// Chain is the http_filters of one HTTP connection manager, ready to filter
+// requests for its route config.
+type Chain struct {
+	filters []chainFilter
+	// routeConfigs holds the parsed typed_per_filter_config of each route
+	// and virtual host, keyed by their address in the route config the
+	// chain was built for.
+	routeConfigs map[interface{}]map[string]routeFilterConfig
+}
+
+type chainFilter struct {
+	name      string
+	newFilter func() StreamFilter
+}
+
+type routeFilterConfig struct {
+	disabled bool
+	config   interface{}
+}
+
+// NewChain builds the chain for httpFilters. routeConfig must be the route
+// config the requests are matched against, as the per-route configs are
+// looked up by the address of the matched route. An empty httpFilters is
+// taken as the router filter alone.
+func NewChain(httpFilters []config.HttpFilter, routeConfig *config.RouteConfiguration) (*Chain, error) {
+	c := &Chain{routeConfigs: make(map[interface{}]map[string]routeFilterConfig)}
+	for i, httpFilter := range httpFilters {
+		if httpFilter.Name == config.RouterFilter {
+			if i != len(httpFilters)-1 {
+				return nil, fmt.Errorf("%s must be the last http filter", config.RouterFilter)
+			}
+			break
+		}
+		if i == len(httpFilters)-1 {
+			return nil, fmt.Errorf("the last http filter must be %s", config.RouterFilter)
+		}
+		factory, err := lookup(httpFilter.Name)
+		if err != nil {
+			return nil, err
+		}
+		newFilter, err := factory.NewFilterFactory(httpFilter.TypedConfig)
+		if err != nil {
+			return nil, fmt.Errorf("http filter %q: %v", httpFilter.Name, err)
+		}
+		c.filters = append(c.filters, chainFilter{name: httpFilter.Name, newFilter: newFilter})
+	}
+
+	for i := range routeConfig.VirtualHosts {
+		virtualHost := &routeConfig.VirtualHosts[i]
+		if err := c.addRouteConfigs(virtualHost, virtualHost.TypedPerFilterConfig); err != nil {
+			return nil, fmt.Errorf("virtual host %q: %v", virtualHost.Name, err)
+		}
+		for j := range virtualHost.Routes {
+			route := &virtualHost.Routes[j]
+			if err := c.addRouteConfigs(route, route.TypedPerFilterConfig); err != nil {
+				return nil, fmt.Errorf("virtual host %q route %d: %v", virtualHost.Name, j, err)
+			}
+		}
+	}
+	return c, nil
+}
+
+func (c *Chain) addRouteConfigs(key interface{}, typedConfigs map[string]config.TypedConfig) error {
+	for name, typedConfig := range typedConfigs {
+		factory, err := lookup(name)
+		if err != nil {
+			return err
+		}
+		unwrapped, err := typedConfig.RouteFilterConfig()
+		if err != nil {
+			return fmt.Errorf("http filter %q: %v", name, err)
+		}
+		parsed := routeFilterConfig{disabled: unwrapped.Disabled}
+		if !parsed.disabled {
+			if parsed.config, err = factory.ParseRouteConfig(unwrapped.Config); err != nil {
+				return fmt.Errorf("http filter %q: %v", name, err)
+			}
+		}
+		if c.routeConfigs[key] == nil {
+			c.routeConfigs[key] = make(map[string]routeFilterConfig)
+		}
+		c.routeConfigs[key][name] = parsed
+	}
+	return nil
+}
+
+// routeConfig returns the filter's config for route, falling back to the one
+// for virtualHost.
+func (c *Chain) routeConfig(virtualHost *config.VirtualHost, route *config.Route, name string) (routeFilterConfig, bool) {
+	if route != nil {
+		if routeConfig, ok := c.routeConfigs[route][name]; ok {
+			return routeConfig, true
+		}
+	}
+	if virtualHost != nil {
+		if routeConfig, ok := c.routeConfigs[virtualHost][name]; ok {
+			return routeConfig, true
+		}
+	}
+	return routeFilterConfig{}, false
+}
+
+// Serve passes the request matched to virtualHost and route, either of which
+// may be nil, through the chain. Once every filter has let the request
+// headers through they are handed to terminal, the router, whose response is
+// passed back through the chain to w.
+func (c *Chain) Serve(w http.ResponseWriter, r *http.Request, virtualHost *config.VirtualHost, route *config.Route, terminal http.Handler) {
+	if c == nil || len(c.filters) == 0 {
+		terminal.ServeHTTP(w, r)
+		return
+	}
+	newStream(c, w, r, virtualHost, route, terminal).run()
+}
@@ -0,0 +1,478 @@
+package filters
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"seateam/config"
+	"seateam/grpc"
+)
+
+// recordingFilter notes every callback in a log shared by the chain, and
+// stops or replies where a test tells it to.
+type recordingFilter struct {
+	PassThroughFilter
+	name string
+	log  *[]string
+	mu   *sync.Mutex
+	// stopHeaders holds the request headers until the body has been read.
+	stopHeaders bool
+	// reply answers every request with a 403.
+	reply bool
+	// async continues the request from another goroutine.
+	async bool
+}
+
+func (f *recordingFilter) record(event string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	*f.log = append(*f.log, f.name+":"+event)
+}
+
+func (f *recordingFilter) DecodeHeaders(r *http.Request, endStream bool) Status {
+	f.record("decodeHeaders")
+	r.Header.Add("X-Filters", f.name)
+	switch {
+	case f.reply:
+		f.Callbacks.SendLocalReply(http.StatusForbidden, "denied by "+f.name, nil)
+		return StopIteration
+	case f.async:
+		go f.Callbacks.ContinueDecoding()
+		return StopIteration
+	case f.stopHeaders:
+		return StopIteration
+	}
+	return Continue
+}
+
+func (f *recordingFilter) DecodeData(data *bytes.Buffer, endStream bool) Status {
+	f.record("decodeData")
+	if f.stopHeaders && !endStream {
+		return StopIteration
+	}
+	return Continue
+}
+
+func (f *recordingFilter) EncodeHeaders(h *ResponseHeaders, endStream bool) Status {
+	f.record("encodeHeaders")
+	h.Header.Add("X-Filters", f.name)
+	return Continue
+}
+
+func (f *recordingFilter) EncodeData(data *bytes.Buffer, endStream bool) Status {
+	if data.Len() > 0 {
+		f.record("encodeData")
+		data.WriteString("+" + f.name)
+	}
+	return Continue
+}
+
+func (f *recordingFilter) EncodeTrailers(trailers http.Header) Status {
+	f.record("encodeTrailers")
+	return Continue
+}
+
+// testFactory creates recordingFilters configured from typed_config fields of
+// the same names.
+type testFactory struct {
+	log *[]string
+	mu  *sync.Mutex
+}
+
+type testFilterConfig struct {
+	Name        string `yaml:"name"`
+	StopHeaders bool   `yaml:"stop_headers"`
+	Reply       bool   `yaml:"reply"`
+	Async       bool   `yaml:"async"`
+}
+
+func (f testFactory) NewFilterFactory(typedConfig config.TypedConfig) (func() StreamFilter, error) {
+	var c testFilterConfig
+	if err := typedConfig.Decode(&c); err != nil {
+		return nil, err
+	}
+	return func() StreamFilter {
+		return &recordingFilter{name: c.Name, log: f.log, mu: f.mu, stopHeaders: c.StopHeaders, reply: c.Reply, async: c.Async}
+	}, nil
+}
+
+func (f testFactory) ParseRouteConfig(typedConfig config.TypedConfig) (interface{}, error) {
+	return nil, errNoRouteConfig
+}
+
+func typedConfig(t *testing.T, document string) config.TypedConfig {
+	t.Helper()
+	var typedConfig config.TypedConfig
+	if err := yaml.Unmarshal([]byte(document), &typedConfig); err != nil {
+		t.Fatal(err)
+	}
+	return typedConfig
+}
+
+// newTestChain registers a test filter for the test and builds a chain of one
+// per document followed by the router. It returns the filter name and the
+// callbacks seen so far.
+func newTestChain(t *testing.T, routeConfig *config.RouteConfiguration, documents ...string) (*Chain, string, func() []string) {
+	t.Helper()
+	var (
+		log []string
+		mu  sync.Mutex
+	)
+	name := "test.filters." + t.Name()
+	Register(name, testFactory{log: &log, mu: &mu})
+
+	var httpFilters []config.HttpFilter
+	for _, document := range documents {
+		httpFilters = append(httpFilters, config.HttpFilter{Name: name, TypedConfig: typedConfig(t, document)})
+	}
+	httpFilters = append(httpFilters, config.HttpFilter{Name: config.RouterFilter})
+	if routeConfig == nil {
+		routeConfig = &config.RouteConfiguration{}
+	}
+	chain, err := NewChain(httpFilters, routeConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chain, name, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), log...)
+	}
+}
+
+// echo is the terminal handler: it answers with the request's body and the
+// filters it passed through.
+var echo = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	w.Header().Set("X-Request-Filters", strings.Join(r.Header.Values("X-Filters"), ","))
+	w.Header().Set("X-Request-Length", r.Header.Get("Content-Length"))
+	w.Header().Set("Trailer", "X-Checksum")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+	w.Header().Set("X-Checksum", "abc")
+})
+
+func serve(chain *Chain, body string, route *config.Route) *httptest.ResponseRecorder {
+	var r *http.Request
+	if body == "" {
+		r = httptest.NewRequest("POST", "/", nil)
+	} else {
+		r = httptest.NewRequest("POST", "/", strings.NewReader(body))
+	}
+	rr := httptest.NewRecorder()
+	chain.Serve(rr, r, nil, route, echo)
+	return rr
+}
+
+func TestChainRunsFiltersInOrder(t *testing.T) {
+	chain, _, log := newTestChain(t, nil, "name: a", "name: b")
+
+	rr := serve(chain, "hello", nil)
+	if rr.Code != http.StatusOK || rr.Body.String() != "hello+b+a" {
+		t.Fatalf("expected the body encoded by b then a, got %d %q", rr.Code, rr.Body.String())
+	}
+	if got := rr.Header().Get("X-Request-Filters"); got != "a,b" {
+		t.Errorf("expected the request to pass a then b, got %q", got)
+	}
+	if got := rr.Header().Values("X-Filters"); strings.Join(got, ",") != "b,a" {
+		t.Errorf("expected the response to pass b then a, got %q", got)
+	}
+	if got := rr.Result().Trailer.Get("X-Checksum"); got != "abc" {
+		t.Errorf("expected the trailer to reach downstream, got %q", got)
+	}
+
+	expected := []string{
+		"a:decodeHeaders", "b:decodeHeaders", "a:decodeData", "b:decodeData",
+		// The end of the body comes as an empty last piece.
+		"a:decodeData", "b:decodeData",
+		"b:encodeHeaders", "a:encodeHeaders", "b:encodeData", "a:encodeData",
+		"b:encodeTrailers", "a:encodeTrailers",
+	}
+	if got := log(); strings.Join(got, " ") != strings.Join(expected, " ") {
+		t.Errorf("unexpected callbacks:\n got %v\nwant %v", got, expected)
+	}
+}
+
+func TestChainStopIterationHoldsTheRequest(t *testing.T) {
+	chain, _, log := newTestChain(t, nil, "name: a\nstop_headers: true", "name: b")
+
+	rr := serve(chain, "hello", nil)
+	if rr.Code != http.StatusOK || rr.Body.String() != "hello+b+a" {
+		t.Fatalf("unexpected response %d %q", rr.Code, rr.Body.String())
+	}
+	// b sees nothing until a has read the whole body.
+	got := strings.Join(log(), " ")
+	if !strings.HasPrefix(got, "a:decodeHeaders a:decodeData a:decodeData b:decodeHeaders b:decodeData ") {
+		t.Errorf("expected b to see the request once a continued, got %v", got)
+	}
+}
+
+func TestChainAsyncContinue(t *testing.T) {
+	chain, _, _ := newTestChain(t, nil, "name: a\nasync: true", "name: b")
+
+	for i := 0; i < 20; i++ {
+		if rr := serve(chain, "", nil); rr.Code != http.StatusOK || rr.Header().Get("X-Request-Filters") != "a,b" {
+			t.Fatalf("expected the request to be continued, got %d %q", rr.Code, rr.Header().Get("X-Request-Filters"))
+		}
+	}
+}
+
+func TestChainLocalReply(t *testing.T) {
+	chain, _, log := newTestChain(t, nil, "name: a", "name: b\nreply: true", "name: c")
+
+	rr := serve(chain, "hello", nil)
+	if rr.Code != http.StatusForbidden || rr.Body.String() != "denied by b+a" {
+		t.Fatalf("expected b's local reply encoded by a, got %d %q", rr.Code, rr.Body.String())
+	}
+	for _, event := range log() {
+		if strings.HasPrefix(event, "c:") || event == "b:encodeHeaders" {
+			t.Errorf("expected only a to see the local reply, got %v", log())
+		}
+	}
+}
+
+func TestChainGrpcLocalReply(t *testing.T) {
+	chain, _, _ := newTestChain(t, nil, "name: b\nreply: true")
+
+	r := httptest.NewRequest("POST", "/", strings.NewReader("hello"))
+	r.Header.Set("Content-Type", "application/grpc")
+	rr := httptest.NewRecorder()
+	chain.Serve(rr, r, nil, nil, echo)
+	if rr.Code != http.StatusOK || rr.Body.Len() != 0 {
+		t.Fatalf("expected a trailers-only gRPC reply, got %d %q", rr.Code, rr.Body.String())
+	}
+	if status, message := rr.Header().Get("Grpc-Status"), rr.Header().Get("Grpc-Message"); status != "7" || message != "denied by b" {
+		t.Errorf("expected PERMISSION_DENIED with the reply's body, got %q %q", status, message)
+	}
+}
+
+func TestChainPerRouteDisabled(t *testing.T) {
+	var routeConfig config.RouteConfiguration
+	routeConfig.VirtualHosts = []config.VirtualHost{{Name: "local", Routes: make([]config.Route, 2)}}
+	disabled := &routeConfig.VirtualHosts[0].Routes[1]
+	disabled.TypedPerFilterConfig = map[string]config.TypedConfig{
+		"test.filters." + t.Name(): typedConfig(t, "{'@type': "+config.FilterConfigType+", disabled: true}"),
+	}
+	chain, _, _ := newTestChain(t, &routeConfig, "name: a\nreply: true")
+
+	if rr := serve(chain, "", &routeConfig.VirtualHosts[0].Routes[0]); rr.Code != http.StatusForbidden {
+		t.Errorf("expected the filter to reply on the first route, got %d", rr.Code)
+	}
+	if rr := serve(chain, "", disabled); rr.Code != http.StatusOK {
+		t.Errorf("expected the filter to be disabled on the second route, got %d", rr.Code)
+	}
+}
+
+func TestNewChainRequiresRouterLast(t *testing.T) {
+	if _, err := NewChain([]config.HttpFilter{{Name: config.RouterFilter}, {Name: BufferFilter}}, &config.RouteConfiguration{}); err == nil {
+		t.Errorf("expected a filter after the router to be rejected")
+	}
+	if _, err := NewChain([]config.HttpFilter{{Name: "envoy.filters.http.unknown"}, {Name: config.RouterFilter}}, &config.RouteConfiguration{}); err == nil {
+		t.Errorf("expected an unknown filter to be rejected")
+	}
+}
+
+func TestBufferFilter(t *testing.T) {
+	var routeConfig config.RouteConfiguration
+	routeConfig.VirtualHosts = []config.VirtualHost{{Name: "local", Routes: make([]config.Route, 2)}}
+	routeConfig.VirtualHosts[0].Routes[1].TypedPerFilterConfig = map[string]config.TypedConfig{
+		BufferFilter: typedConfig(t, "buffer: { max_request_bytes: 100 }"),
+	}
+	chain, err := NewChain([]config.HttpFilter{
+		{Name: BufferFilter, TypedConfig: typedConfig(t, "max_request_bytes: 8")},
+		{Name: config.RouterFilter},
+	}, &routeConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	small, large := &routeConfig.VirtualHosts[0].Routes[0], &routeConfig.VirtualHosts[0].Routes[1]
+
+	// The body is streamed in pieces, so it has no Content-Length until the
+	// filter has buffered it.
+	r := httptest.NewRequest("POST", "/", io.MultiReader(strings.NewReader("hel"), strings.NewReader("lo")))
+	r.ContentLength = -1
+	rr := httptest.NewRecorder()
+	chain.Serve(rr, r, nil, small, echo)
+	if rr.Code != http.StatusOK || rr.Body.String() != "hello" || rr.Header().Get("X-Request-Length") != "5" {
+		t.Errorf("expected the buffered body with its length, got %d %q %q", rr.Code, rr.Body.String(), rr.Header().Get("X-Request-Length"))
+	}
+
+	if rr := serve(chain, "too long for the limit", small); rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413 over max_request_bytes, got %d", rr.Code)
+	}
+	if rr := serve(chain, "too long for the limit", large); rr.Code != http.StatusOK {
+		t.Errorf("expected the route's larger limit to apply, got %d", rr.Code)
+	}
+
+	if _, err := (bufferFactory{}).NewFilterFactory(typedConfig(t, "max_request_bytes: 0")); err == nil {
+		t.Errorf("expected max_request_bytes 0 to be rejected")
+	}
+	if _, err := (bufferFactory{}).NewFilterFactory(typedConfig(t, "max_request_byte: 10")); err == nil {
+		t.Errorf("expected an unknown field to be rejected")
+	}
+}
+
+func TestChainStopsWhenClientGoesAway(t *testing.T) {
+	chain, _, _ := newTestChain(t, nil, "name: a\nstop_headers: true")
+
+	pr, pw := io.Pipe()
+	r := httptest.NewRequest("POST", "/", pr)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		chain.Serve(httptest.NewRecorder(), r, nil, nil, echo)
+	}()
+	pw.Write([]byte("partial"))
+	pw.CloseWithError(io.ErrUnexpectedEOF)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Serve to return once the request body failed")
+	}
+}
+
+// grpcEcho is a terminal handler answering like a gRPC server: it sends the
+// request's frames back and ends with trailers.
+var grpcEcho = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	if !grpc.IsGrpc(r.Header) || r.Header.Get("Te") != "trailers" {
+		http.Error(w, "not gRPC: "+r.Header.Get("Content-Type"), http.StatusBadRequest)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	w.Header().Set("Content-Type", "application/grpc+proto")
+	w.Write(body)
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+	w.Header().Set(http.TrailerPrefix+"Grpc-Message", "ok")
+})
+
+func TestGrpcWebFilter(t *testing.T) {
+	chain, err := NewChain([]config.HttpFilter{
+		{Name: GrpcWebFilter},
+		{Name: config.RouterFilter},
+	}, &config.RouteConfiguration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, second := grpc.AppendFrame(nil, 0, []byte("one")), grpc.AppendFrame(nil, 0, []byte("second"))
+	messages := append(append([]byte(nil), first...), second...)
+	expected := grpc.AppendTrailerFrame(append([]byte(nil), messages...), http.Header{"Grpc-Status": {"0"}, "Grpc-Message": {"ok"}})
+
+	r := httptest.NewRequest("POST", "/echo.Echo/Say", bytes.NewReader(messages))
+	r.Header.Set("Content-Type", "application/grpc-web+proto")
+	rr := httptest.NewRecorder()
+	chain.Serve(rr, r, nil, nil, grpcEcho)
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "application/grpc-web+proto" || !bytes.Equal(rr.Body.Bytes(), expected) {
+		t.Errorf("binary: expected the messages and the trailer frame, got %d %q %q", rr.Code, rr.Header().Get("Content-Type"), rr.Body.Bytes())
+	}
+	if trailer := rr.Result().Trailer; len(trailer) != 0 {
+		t.Errorf("binary: expected the trailers only in the body, got %v", trailer)
+	}
+
+	// Clients encode each message on its own, so padding can come midway,
+	// and the body may arrive cut anywhere.
+	encoded := base64.StdEncoding.EncodeToString(first) + base64.StdEncoding.EncodeToString(second)
+	r = httptest.NewRequest("POST", "/echo.Echo/Say", io.MultiReader(strings.NewReader(encoded[:5]), strings.NewReader(encoded[5:])))
+	r.Header.Set("Content-Type", "application/grpc-web-text")
+	rr = httptest.NewRecorder()
+	chain.Serve(rr, r, nil, nil, grpcEcho)
+	decoded, err := decodeBase64Segments(rr.Body.Bytes())
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "application/grpc-web-text+proto" || err != nil || !bytes.Equal(decoded, expected) {
+		t.Errorf("text: expected the messages and the trailer frame in base64, got %d %q %q (%v)", rr.Code, rr.Header().Get("Content-Type"), rr.Body.String(), err)
+	}
+
+	r = httptest.NewRequest("POST", "/echo.Echo/Say", strings.NewReader("AAA"))
+	r.Header.Set("Content-Type", "application/grpc-web-text")
+	rr = httptest.NewRecorder()
+	chain.Serve(rr, r, nil, nil, grpcEcho)
+	if rr.Header().Get("Grpc-Status") != "13" {
+		t.Errorf("expected a truncated text body to fail the call, got %d %v", rr.Code, rr.Header())
+	}
+
+	if _, err := (grpcWebFactory{}).NewFilterFactory(typedConfig(t, "mode: text")); err == nil {
+		t.Errorf("expected an unknown field to be rejected")
+	}
+}
+
+func TestCorsFilter(t *testing.T) {
+	var routeConfig config.RouteConfiguration
+	routeConfig.VirtualHosts = []config.VirtualHost{{Name: "local", Routes: make([]config.Route, 1)}}
+	routeConfig.VirtualHosts[0].TypedPerFilterConfig = map[string]config.TypedConfig{
+		CorsFilter: typedConfig(t, `
+allow_origin_string_match: [{ suffix: ".example.com" }]
+allow_methods: "POST, GET"
+allow_headers: "content-type,x-grpc-web,x-user-agent"
+expose_headers: "grpc-status,grpc-message"
+max_age: "600"
+`),
+	}
+	chain, err := NewChain([]config.HttpFilter{
+		{Name: GrpcWebFilter},
+		{Name: CorsFilter},
+		{Name: config.RouterFilter},
+	}, &routeConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	route := &routeConfig.VirtualHosts[0].Routes[0]
+	serveFrom := func(method, origin string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/echo.Echo/Say", nil)
+		r.Header.Set("Origin", origin)
+		if method == http.MethodOptions {
+			r.Header.Set("Access-Control-Request-Method", "POST")
+			r.Header.Set("Access-Control-Request-Headers", "content-type,x-grpc-web")
+		}
+		rr := httptest.NewRecorder()
+		chain.Serve(rr, r, &routeConfig.VirtualHosts[0], route, echo)
+		return rr
+	}
+	// echo sets X-Request-Length, if only to "", on what reaches it.
+	reachedRouter := func(rr *httptest.ResponseRecorder) bool {
+		_, ok := rr.Header()["X-Request-Length"]
+		return ok
+	}
+
+	rr := serveFrom(http.MethodOptions, "https://app.example.com")
+	if rr.Code != http.StatusOK || reachedRouter(rr) {
+		t.Fatalf("expected the preflight to be answered by the filter, got %d %v", rr.Code, rr.Header())
+	}
+	for key, want := range map[string]string{
+		"Access-Control-Allow-Origin":  "https://app.example.com",
+		"Access-Control-Allow-Methods": "POST, GET",
+		"Access-Control-Allow-Headers": "content-type,x-grpc-web,x-user-agent",
+		"Access-Control-Max-Age":       "600",
+	} {
+		if got := rr.Header().Get(key); got != want {
+			t.Errorf("preflight: expected %s %q, got %q", key, want, got)
+		}
+	}
+
+	rr = serveFrom(http.MethodPost, "https://app.example.com")
+	if rr.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" || rr.Header().Get("Access-Control-Expose-Headers") != "grpc-status,grpc-message" {
+		t.Errorf("expected the CORS headers on the actual response, got %v", rr.Header())
+	}
+
+	rr = serveFrom(http.MethodOptions, "https://evil.test")
+	if rr.Header().Get("Access-Control-Allow-Origin") != "" || !reachedRouter(rr) {
+		t.Errorf("expected a preflight from another origin to pass through without CORS headers, got %d %v", rr.Code, rr.Header())
+	}
+
+	for _, document := range []string{
+		`allow_methods: "GET"`,
+		`allow_origin_string_match: [{ prefix: "a", suffix: "b" }]`,
+		`{ allow_origin_string_match: [{ exact: "https://a.test" }], max_age: "forever" }`,
+	} {
+		if _, err := (corsFactory{}).ParseRouteConfig(typedConfig(t, document)); err == nil {
+			t.Errorf("expected %s to be rejected", document)
+		}
+	}
+}
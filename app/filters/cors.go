@@ -0,0 +1,119 @@
+package filters
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"seateam/config"
+)
+
+// CorsFilter applies the CorsPolicy in a route's or virtual host's
+// typed_per_filter_config: it answers preflight requests from allowed
+// origins itself and adds the CORS headers to the responses to their actual
+// requests. Requests without a policy or from other origins pass untouched.
+const CorsFilter = "envoy.filters.http.cors"
+
+type corsPolicy struct {
+	AllowOriginStringMatch []config.StringMatcher `yaml:"allow_origin_string_match,omitempty"`
+	// AllowMethods, AllowHeaders and ExposeHeaders are comma-separated
+	// lists, sent as they are.
+	AllowMethods  string `yaml:"allow_methods,omitempty"`
+	AllowHeaders  string `yaml:"allow_headers,omitempty"`
+	ExposeHeaders string `yaml:"expose_headers,omitempty"`
+	// MaxAge is how many seconds browsers may cache a preflight answer.
+	MaxAge           string `yaml:"max_age,omitempty"`
+	AllowCredentials bool   `yaml:"allow_credentials,omitempty"`
+}
+
+type corsFactory struct{}
+
+func (corsFactory) NewFilterFactory(typedConfig config.TypedConfig) (func() StreamFilter, error) {
+	// Policies are per route; the filter itself has nothing to configure.
+	var c struct{}
+	if err := typedConfig.Decode(&c); err != nil {
+		return nil, err
+	}
+	return func() StreamFilter { return &corsFilter{} }, nil
+}
+
+func (corsFactory) ParseRouteConfig(typedConfig config.TypedConfig) (interface{}, error) {
+	var policy corsPolicy
+	if err := typedConfig.Decode(&policy); err != nil {
+		return nil, err
+	}
+	if len(policy.AllowOriginStringMatch) == 0 {
+		return nil, errors.New("allow_origin_string_match is required")
+	}
+	for i, matcher := range policy.AllowOriginStringMatch {
+		if err := matcher.Check(); err != nil {
+			return nil, fmt.Errorf("allow_origin_string_match[%d]: %v", i, err)
+		}
+	}
+	if policy.MaxAge != "" {
+		if seconds, err := strconv.Atoi(policy.MaxAge); err != nil || seconds < 0 {
+			return nil, fmt.Errorf("max_age must be a number of seconds, got %q", policy.MaxAge)
+		}
+	}
+	return policy, nil
+}
+
+func (p corsPolicy) allowsOrigin(origin string) bool {
+	for _, matcher := range p.AllowOriginStringMatch {
+		if matcher.Matches(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+type corsFilter struct {
+	PassThroughFilter
+	policy corsPolicy
+	// origin is the allowed origin of an actual request, whose response
+	// gets the CORS headers.
+	origin string
+}
+
+func (f *corsFilter) DecodeHeaders(r *http.Request, endStream bool) Status {
+	policy, ok := f.Callbacks.PerRouteConfig().(corsPolicy)
+	origin := r.Header.Get("Origin")
+	if !ok || origin == "" || !policy.allowsOrigin(origin) {
+		return Continue
+	}
+	if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+		header := make(http.Header)
+		header.Set("Access-Control-Allow-Origin", origin)
+		if policy.AllowCredentials {
+			header.Set("Access-Control-Allow-Credentials", "true")
+		}
+		if policy.AllowMethods != "" {
+			header.Set("Access-Control-Allow-Methods", policy.AllowMethods)
+		}
+		if policy.AllowHeaders != "" {
+			header.Set("Access-Control-Allow-Headers", policy.AllowHeaders)
+		}
+		if policy.MaxAge != "" {
+			header.Set("Access-Control-Max-Age", policy.MaxAge)
+		}
+		f.Callbacks.SendLocalReply(http.StatusOK, "", header)
+		return StopIteration
+	}
+	f.policy, f.origin = policy, origin
+	return Continue
+}
+
+func (f *corsFilter) EncodeHeaders(h *ResponseHeaders, endStream bool) Status {
+	if f.origin == "" {
+		return Continue
+	}
+	h.Header.Set("Access-Control-Allow-Origin", f.origin)
+	if f.policy.AllowCredentials {
+		h.Header.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if f.policy.ExposeHeaders != "" {
+		h.Header.Set("Access-Control-Expose-Headers", f.policy.ExposeHeaders)
+	}
+	return Continue
+}
@@ -0,0 +1,120 @@
+// Package filters runs the http_filters of an HTTP connection manager. Each
+// request passes through the filters in order as headers, data and trailers
+// before reaching the router filter, and the response passes back through
+// them in reverse. A filter can change what it sees, hold it back until it is
+// ready, or answer the request itself with a local reply.
+package filters
+
+import (
+	"bytes"
+	"net/http"
+
+	"seateam/config"
+	"seateam/logger"
+)
+
+var filterLog = logger.Get("http")
+
+// Status tells the chain what to do after a filter callback returns.
+type Status int
+
+const (
+	// Continue hands the headers, data or trailers on to the next filter.
+	Continue Status = iota
+	// StopIteration holds them back, together with everything that follows,
+	// until the filter returns Continue from a later callback or calls
+	// ContinueDecoding or ContinueEncoding. Held data is buffered and handed
+	// on as one piece.
+	StopIteration
+	// StopIterationNoBuffer drops data the filter has taken over. For headers
+	// and trailers it is the same as StopIteration.
+	StopIterationNoBuffer
+)
+
+// ResponseHeaders are the status and headers of a response being encoded.
+type ResponseHeaders struct {
+	Status int
+	Header http.Header
+}
+
+// StreamFilter is one filter's instance for one request. Callbacks for a
+// request never run concurrently.
+type StreamFilter interface {
+	// DecodeHeaders is called with the request. Its body is passed to
+	// DecodeData rather than read from r.Body. endStream is true when the
+	// request has no body.
+	DecodeHeaders(r *http.Request, endStream bool) Status
+	DecodeData(data *bytes.Buffer, endStream bool) Status
+	DecodeTrailers(trailers http.Header) Status
+
+	EncodeHeaders(h *ResponseHeaders, endStream bool) Status
+	EncodeData(data *bytes.Buffer, endStream bool) Status
+	EncodeTrailers(trailers http.Header) Status
+
+	// SetCallbacks is called once, before any other callback.
+	SetCallbacks(callbacks Callbacks)
+}
+
+// Callbacks let a filter act on the request it is filtering.
+type Callbacks interface {
+	// Route returns the route the request matched, or nil.
+	Route() *config.Route
+	// PerRouteConfig returns the filter's typed_per_filter_config for the
+	// request's route, or failing that its virtual host, as returned by
+	// Factory.ParseRouteConfig. It is nil when neither has one.
+	PerRouteConfig() interface{}
+	// SendLocalReply answers the request without going upstream. The reply
+	// is encoded by the filters before this one. It has no effect once
+	// response headers have been sent downstream, other than resetting the
+	// stream. A gRPC request gets a gRPC reply, with the grpc-status status
+	// maps to and body as its grpc-message.
+	SendLocalReply(status int, body string, header http.Header)
+	// AddDecodedData and AddEncodedData send data on to the filters after
+	// this one as more of the request or response body. They may only be
+	// called from the filter's own callbacks. Added in a headers callback
+	// with endStream set, the data becomes the body; added in a trailers
+	// callback, it goes ahead of the trailers, which the filter may then
+	// empty to end the body with the data instead.
+	AddDecodedData(data *bytes.Buffer)
+	AddEncodedData(data *bytes.Buffer)
+	// ContinueDecoding resumes the request after the filter stopped it.
+	// It may be called from another goroutine.
+	ContinueDecoding()
+	// ContinueEncoding resumes the response after the filter stopped it.
+	// It may be called from another goroutine.
+	ContinueEncoding()
+}
+
+// PassThroughFilter continues on every callback. Filters embed it and
+// override the callbacks they need.
+type PassThroughFilter struct {
+	Callbacks Callbacks
+}
+
+func (f *PassThroughFilter) DecodeHeaders(r *http.Request, endStream bool) Status {
+	return Continue
+}
+
+func (f *PassThroughFilter) DecodeData(data *bytes.Buffer, endStream bool) Status {
+	return Continue
+}
+
+func (f *PassThroughFilter) DecodeTrailers(trailers http.Header) Status {
+	return Continue
+}
+
+func (f *PassThroughFilter) EncodeHeaders(h *ResponseHeaders, endStream bool) Status {
+	return Continue
+}
+
+func (f *PassThroughFilter) EncodeData(data *bytes.Buffer, endStream bool) Status {
+	return Continue
+}
+
+func (f *PassThroughFilter) EncodeTrailers(trailers http.Header) Status {
+	return Continue
+}
+
+func (f *PassThroughFilter) SetCallbacks(callbacks Callbacks) {
+	f.Callbacks = callbacks
+}
@@ -0,0 +1,141 @@
+package filters
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+
+	"seateam/config"
+	"seateam/grpc"
+)
+
+// GrpcWebFilter bridges browsers' gRPC-Web to gRPC: requests in either the
+// binary or the base64 text mode go upstream as gRPC, and the response comes
+// back in the request's mode, its trailers sent as the last frame of the
+// body.
+const GrpcWebFilter = "envoy.filters.http.grpc_web"
+
+type grpcWebFactory struct{}
+
+func (grpcWebFactory) NewFilterFactory(typedConfig config.TypedConfig) (func() StreamFilter, error) {
+	// The filter has nothing to configure, but fields it does not know are
+	// still errors.
+	var c struct{}
+	if err := typedConfig.Decode(&c); err != nil {
+		return nil, err
+	}
+	return func() StreamFilter { return &grpcWebFilter{} }, nil
+}
+
+func (grpcWebFactory) ParseRouteConfig(typedConfig config.TypedConfig) (interface{}, error) {
+	return nil, errNoRouteConfig
+}
+
+type grpcWebFilter struct {
+	PassThroughFilter
+	// web is set for gRPC-Web requests, and text for those in text mode.
+	web, text bool
+	// grpcResponse is set once the upstream answers with gRPC, which is
+	// translated back to gRPC-Web.
+	grpcResponse bool
+	// undecoded holds the end of a text request body that is not yet a
+	// whole base64 quantum.
+	undecoded []byte
+}
+
+func (f *grpcWebFilter) DecodeHeaders(r *http.Request, endStream bool) Status {
+	f.web, f.text = grpc.IsGrpcWeb(r.Header)
+	if !f.web {
+		return Continue
+	}
+	r.Header.Set("Content-Type", grpc.ContentType+grpc.Subtype(r.Header.Get("Content-Type")))
+	// Go's HTTP/2 client only passes on a TE of "trailers".
+	r.Header.Set("Te", "trailers")
+	if f.text {
+		r.Header.Del("Content-Length")
+		r.ContentLength = -1
+	}
+	return Continue
+}
+
+func (f *grpcWebFilter) DecodeData(data *bytes.Buffer, endStream bool) Status {
+	if !f.text {
+		return Continue
+	}
+	f.undecoded = append(f.undecoded, data.Bytes()...)
+	whole := len(f.undecoded) / 4 * 4
+	decoded, err := decodeBase64Segments(f.undecoded[:whole])
+	if err != nil || endStream && whole != len(f.undecoded) {
+		f.Callbacks.SendLocalReply(http.StatusBadRequest, "invalid base64 in gRPC-Web text request", nil)
+		return StopIterationNoBuffer
+	}
+	f.undecoded = append(f.undecoded[:0], f.undecoded[whole:]...)
+	data.Reset()
+	data.Write(decoded)
+	return Continue
+}
+
+// decodeBase64Segments decodes b, a run of whole base64 quanta that may be
+// several padded encodings back to back, as gRPC-Web clients send one per
+// message.
+func decodeBase64Segments(b []byte) ([]byte, error) {
+	var decoded []byte
+	for len(b) > 0 {
+		end := len(b)
+		if i := bytes.IndexByte(b, '='); i >= 0 {
+			end = i/4*4 + 4
+		}
+		segment := make([]byte, base64.StdEncoding.DecodedLen(end))
+		n, err := base64.StdEncoding.Decode(segment, b[:end])
+		if err != nil {
+			return nil, err
+		}
+		decoded = append(decoded, segment[:n]...)
+		b = b[end:]
+	}
+	return decoded, nil
+}
+
+func (f *grpcWebFilter) EncodeHeaders(h *ResponseHeaders, endStream bool) Status {
+	if !f.web || !grpc.IsGrpc(h.Header) {
+		return Continue
+	}
+	f.grpcResponse = true
+	subtype := grpc.Subtype(h.Header.Get("Content-Type"))
+	if subtype == "" {
+		subtype = "+proto"
+	}
+	if f.text {
+		h.Header.Set("Content-Type", grpc.ContentTypeWebText+subtype)
+	} else {
+		h.Header.Set("Content-Type", grpc.ContentTypeWeb+subtype)
+	}
+	h.Header.Del("Content-Length")
+	return Continue
+}
+
+func (f *grpcWebFilter) EncodeData(data *bytes.Buffer, endStream bool) Status {
+	if f.grpcResponse && f.text && data.Len() > 0 {
+		encoded := base64.StdEncoding.EncodeToString(data.Bytes())
+		data.Reset()
+		data.WriteString(encoded)
+	}
+	return Continue
+}
+
+// EncodeTrailers moves the trailers into the body, where browsers can read
+// them.
+func (f *grpcWebFilter) EncodeTrailers(trailers http.Header) Status {
+	if !f.grpcResponse {
+		return Continue
+	}
+	frame := grpc.AppendTrailerFrame(nil, trailers)
+	if f.text {
+		frame = []byte(base64.StdEncoding.EncodeToString(frame))
+	}
+	f.Callbacks.AddEncodedData(bytes.NewBuffer(frame))
+	for key := range trailers {
+		delete(trailers, key)
+	}
+	return Continue
+}
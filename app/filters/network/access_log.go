@@ -0,0 +1,124 @@
+package network
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"seateam/config"
+)
+
+// connectionInfo is what the access log knows about a proxied connection.
+type connectionInfo struct {
+	startTime       time.Time
+	downstream      string
+	downstreamLocal string
+	upstream        string
+	cluster         string
+	responseFlags   string
+	bytesReceived   atomic.Int64
+	bytesSent       atomic.Int64
+	duration        time.Duration
+}
+
+// accessLog writes a line per connection in its format.
+type accessLog struct {
+	format string
+	out    *logWriter
+}
+
+// logWriter serializes the lines written to one file or stream.
+type logWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+var (
+	stdoutLog = &logWriter{w: os.Stdout}
+	stderrLog = &logWriter{w: os.Stderr}
+
+	// logFiles keeps access log files open across config reloads, so a
+	// reload does not leave a file handle behind for each logger.
+	logFilesMu sync.Mutex
+	logFiles   = make(map[string]*logWriter)
+)
+
+func newAccessLog(c config.AccessLog) (*accessLog, error) {
+	a := &accessLog{format: c.Format()}
+	switch c.Name {
+	case config.StdoutAccessLog:
+		a.out = stdoutLog
+	case config.StderrAccessLog:
+		a.out = stderrLog
+	case config.FileAccessLog:
+		out, err := logFile(c.TypedConfig.Path)
+		if err != nil {
+			return nil, err
+		}
+		a.out = out
+	default:
+		return nil, fmt.Errorf("unsupported access logger %q", c.Name)
+	}
+	return a, nil
+}
+
+func logFile(path string) (*logWriter, error) {
+	logFilesMu.Lock()
+	defer logFilesMu.Unlock()
+
+	if out, ok := logFiles[path]; ok {
+		return out, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	out := &logWriter{w: f}
+	logFiles[path] = out
+	return out, nil
+}
+
+func (a *accessLog) write(info *connectionInfo) {
+	line := config.AccessLogCommandPattern.ReplaceAllStringFunc(a.format, func(command string) string {
+		return info.value(strings.Trim(command, "%"))
+	})
+	a.out.mu.Lock()
+	defer a.out.mu.Unlock()
+	if _, err := io.WriteString(a.out.w, line); err != nil {
+		networkLog.Warnf("Writing access log: %v", err)
+	}
+}
+
+// value returns the value of a log format command, "-" when it is not known.
+func (info *connectionInfo) value(command string) string {
+	value := ""
+	switch command {
+	case "START_TIME":
+		value = info.startTime.UTC().Format("2006-01-02T15:04:05.000Z")
+	case "DOWNSTREAM_REMOTE_ADDRESS":
+		value = info.downstream
+	case "DOWNSTREAM_LOCAL_ADDRESS":
+		value = info.downstreamLocal
+	case "UPSTREAM_HOST":
+		value = info.upstream
+	case "UPSTREAM_CLUSTER":
+		value = info.cluster
+	case "BYTES_RECEIVED":
+		value = strconv.FormatInt(info.bytesReceived.Load(), 10)
+	case "BYTES_SENT":
+		value = strconv.FormatInt(info.bytesSent.Load(), 10)
+	case "DURATION":
+		value = strconv.FormatInt(info.duration.Milliseconds(), 10)
+	case "RESPONSE_FLAGS":
+		value = info.responseFlags
+	}
+	if value == "" {
+		return "-"
+	}
+	return value
+}
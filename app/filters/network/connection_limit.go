@@ -0,0 +1,78 @@
+package network
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"seateam/config"
+	"seateam/stats"
+)
+
+var (
+	limitedConnections = stats.NewCounterVec("connection_limit", "limited_connections", "Connections closed for going over the connection limit.", "envoy_connection_limit_prefix")
+	activeConnections  = stats.NewGaugeVec("connection_limit", "active_connections", "Connections counted against the connection limit.", "envoy_connection_limit_prefix")
+)
+
+// connectionLimit closes connections that would take the number open through
+// it over the limit.
+type connectionLimit struct {
+	statPrefix     string
+	maxConnections int64
+	delay          time.Duration
+	open           atomic.Int64
+	limited        prometheus.Counter
+	active         prometheus.Gauge
+}
+
+func newConnectionLimit(c config.ConnectionLimit) (*connectionLimit, error) {
+	f := &connectionLimit{statPrefix: c.StatPrefix, maxConnections: int64(c.MaxConnections)}
+	if c.Delay != "" {
+		var err error
+		if f.delay, err = time.ParseDuration(c.Delay); err != nil {
+			return nil, err
+		}
+	}
+	labels := prometheus.Labels{"envoy_connection_limit_prefix": c.StatPrefix}
+	f.limited = limitedConnections.With(labels)
+	f.active = activeConnections.With(labels)
+	return f, nil
+}
+
+func (f *connectionLimit) OnNewConnection(conn net.Conn) net.Conn {
+	if f.open.Add(1) > f.maxConnections {
+		f.open.Add(-1)
+		f.limited.Inc()
+		networkLog.Debugf("connection_limit %s: closing connection from %s", f.statPrefix, conn.RemoteAddr())
+		if f.delay > 0 {
+			time.AfterFunc(f.delay, func() { conn.Close() })
+		} else {
+			conn.Close()
+		}
+		return nil
+	}
+	f.active.Inc()
+	return &limitedConn{Conn: conn, limit: f}
+}
+
+// limitedConn gives its place back to the limit when it is closed.
+type limitedConn struct {
+	net.Conn
+	limit *connectionLimit
+	once  sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(func() {
+		c.limit.open.Add(-1)
+		c.limit.active.Dec()
+	})
+	return c.Conn.Close()
+}
+
+func (c *limitedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
@@ -0,0 +1,60 @@
+package network
+
+import (
+	"math"
+	"strings"
+
+	"seateam/config"
+)
+
+// MatchFilterChain returns the index of the filter chain for a connection, or
+// -1 if none matches. As in Envoy, the server name decides first: chains
+// listing it exactly win over wildcards, longer wildcards over shorter ones,
+// and those over chains without server names. Among the chains that are left,
+// one for the connection's transport protocol wins over one for any.
+func MatchFilterChain(chains []config.FilterChain, serverName, transportProtocol string) int {
+	serverName = strings.ToLower(serverName)
+	bestRank := -1
+	for _, chain := range chains {
+		bestRank = max(bestRank, serverNameRank(chain.FilterChainMatch.ServerNames, serverName))
+	}
+	if bestRank < 0 {
+		return -1
+	}
+
+	match := -1
+	for i, chain := range chains {
+		if serverNameRank(chain.FilterChainMatch.ServerNames, serverName) != bestRank {
+			continue
+		}
+		switch chain.FilterChainMatch.TransportProtocol {
+		case transportProtocol:
+			return i
+		case "":
+			if match < 0 {
+				match = i
+			}
+		}
+	}
+	return match
+}
+
+// serverNameRank says how specifically serverNames match serverName: -1 for
+// not at all, 0 for a chain without server names, the length of the suffix
+// for a wildcard and the highest rank for an exact name.
+func serverNameRank(serverNames []string, serverName string) int {
+	if len(serverNames) == 0 {
+		return 0
+	}
+	rank := -1
+	for _, name := range serverNames {
+		name = strings.ToLower(name)
+		switch {
+		case name == serverName:
+			return math.MaxInt
+		case strings.HasPrefix(name, "*.") && strings.HasSuffix(serverName, name[1:]):
+			rank = max(rank, len(name)-1)
+		}
+	}
+	return rank
+}
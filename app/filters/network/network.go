@@ -0,0 +1,111 @@
+// Package network runs the network filters of a listener's filter chain: the
+// connection filters that decide whether a new connection is let through, and
+// tcp_proxy, which forwards the connection's bytes to an upstream cluster. It
+// also has udp_proxy, the listener filter that does the same for datagrams.
+package network
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+
+	"seateam/cluster"
+	"seateam/config"
+	"seateam/logger"
+)
+
+var networkLog = logger.Get("connection")
+
+// Filter looks at each new connection before it reaches the terminal filter.
+type Filter interface {
+	// OnNewConnection returns the connection to carry on with, which may
+	// wrap conn, or nil when the filter has rejected conn. A filter that
+	// rejects a connection closes it.
+	OnNewConnection(conn net.Conn) net.Conn
+}
+
+// HandshakeFilter is a Filter that also looks at connections once their TLS
+// handshake is done, on filter chains that terminate TLS.
+type HandshakeFilter interface {
+	Filter
+	// OnHandshake reports whether conn may carry on. The caller closes
+	// rejected connections.
+	OnHandshake(conn *tls.Conn) bool
+}
+
+// Chain is the network filters of one filter chain.
+type Chain struct {
+	filters []Filter
+	// TcpProxy is the terminal filter when it is tcp_proxy, and nil when it
+	// is the HTTP connection manager.
+	TcpProxy *TcpProxy
+}
+
+// NewChain builds the filters of filterChain. The tcp_proxy forwards to
+// clusters looked up in clusters for each connection.
+func NewChain(filterChain config.FilterChain, clusters *cluster.Manager) (*Chain, error) {
+	c := &Chain{}
+	for _, filter := range filterChain.Filters {
+		switch {
+		case filter.RBAC != nil:
+			c.filters = append(c.filters, newRBAC(*filter.RBAC, filterChain.TransportSocket != nil))
+		case filter.ConnectionLimit != nil:
+			connectionLimit, err := newConnectionLimit(*filter.ConnectionLimit)
+			if err != nil {
+				return nil, fmt.Errorf("network filter %q: %v", filter.Name, err)
+			}
+			c.filters = append(c.filters, connectionLimit)
+		case filter.TcpProxy != nil:
+			tcpProxy, err := NewTcpProxy(*filter.TcpProxy, clusters)
+			if err != nil {
+				return nil, fmt.Errorf("network filter %q: %v", filter.Name, err)
+			}
+			c.TcpProxy = tcpProxy
+		}
+	}
+	return c, nil
+}
+
+// OnNewConnection runs conn through every filter in turn. It returns nil if
+// one of them rejected the connection.
+func (c *Chain) OnNewConnection(conn net.Conn) net.Conn {
+	if c == nil {
+		return conn
+	}
+	for _, filter := range c.filters {
+		if conn = filter.OnNewConnection(conn); conn == nil {
+			return nil
+		}
+	}
+	return conn
+}
+
+// OnHandshake runs conn through the filters that look at TLS connections. It
+// closes conn and returns false if one of them rejected it.
+func (c *Chain) OnHandshake(conn *tls.Conn) bool {
+	if c == nil {
+		return true
+	}
+	for _, filter := range c.filters {
+		if handshakeFilter, ok := filter.(HandshakeFilter); ok && !handshakeFilter.OnHandshake(conn) {
+			conn.Close()
+			return false
+		}
+	}
+	return true
+}
+
+// closeWriter is implemented by connections that can be half-closed, such as
+// *net.TCPConn.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// closeWrite tells the peer no more data follows, closing conn entirely if it
+// cannot be half-closed.
+func closeWrite(conn net.Conn) error {
+	if cw, ok := conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return conn.Close()
+}
@@ -0,0 +1,545 @@
+package network
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"seateam/cluster"
+	"seateam/config"
+)
+
+// serve accepts connections on a local port and hands each to handle.
+func serve(t *testing.T, handle func(net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handle(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// echoUpstream reads until the client half-closes, then answers with what it
+// read.
+func echoUpstream(t *testing.T) string {
+	return serve(t, func(conn net.Conn) {
+		defer conn.Close()
+		data, _ := io.ReadAll(conn)
+		conn.Write(append([]byte("echo: "), data...))
+	})
+}
+
+func testClusters(t *testing.T, name string, addresses ...string) *cluster.Manager {
+	t.Helper()
+	var locality config.LocalityLbEndpoints
+	for _, address := range addresses {
+		host, port, _ := net.SplitHostPort(address)
+		var lbEndpoint config.LbEndpoint
+		lbEndpoint.Endpoint.Address.SocketAddress.Address = host
+		lbEndpoint.Endpoint.Address.SocketAddress.PortValue, _ = strconv.Atoi(port)
+		locality.LbEndpoints = append(locality.LbEndpoints, lbEndpoint)
+	}
+	c := config.Cluster{Name: name, ConnectTimeout: "1s"}
+	c.LoadAssignment.Endpoints = []config.LocalityLbEndpoints{locality}
+
+	clusters := cluster.NewManager()
+	if err := clusters.Apply([]config.Cluster{c}); err != nil {
+		t.Fatal(err)
+	}
+	return clusters
+}
+
+// proxy serves chain on a local port and returns its address.
+func proxy(t *testing.T, chain *Chain) string {
+	return serve(t, func(conn net.Conn) {
+		if conn = chain.OnNewConnection(conn); conn != nil {
+			chain.TcpProxy.ServeConn(conn)
+		}
+	})
+}
+
+func newChain(t *testing.T, clusters *cluster.Manager, filters ...config.Filter) *Chain {
+	t.Helper()
+	chain, err := NewChain(config.FilterChain{Filters: filters}, clusters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chain
+}
+
+func tcpProxyFilter(c config.TcpProxy) config.Filter {
+	return config.Filter{Name: config.TcpProxyFilter, TcpProxy: &c}
+}
+
+// roundTrip sends message, half-closes and returns everything read back.
+func roundTrip(t *testing.T, address, message string) (string, error) {
+	t.Helper()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, message); err != nil {
+		return "", err
+	}
+	conn.(*net.TCPConn).CloseWrite()
+	data, err := io.ReadAll(conn)
+	return string(data), err
+}
+
+func waitForFile(t *testing.T, path string) string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		data, _ := os.ReadFile(path)
+		if len(data) > 0 || time.Now().After(deadline) {
+			return string(data)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTcpProxyForwardsBothWays(t *testing.T) {
+	upstream := echoUpstream(t)
+	logPath := filepath.Join(t.TempDir(), "access.log")
+	var accessLog config.AccessLog
+	accessLog.Name = config.FileAccessLog
+	accessLog.TypedConfig.Path = logPath
+	accessLog.TypedConfig.LogFormat.TextFormatSource.InlineString = "%UPSTREAM_CLUSTER% %UPSTREAM_HOST% %RESPONSE_FLAGS% %BYTES_RECEIVED% %BYTES_SENT%\n"
+
+	chain := newChain(t, testClusters(t, "postgres", upstream), tcpProxyFilter(config.TcpProxy{
+		StatPrefix: "postgres",
+		Cluster:    "postgres",
+		AccessLog:  []config.AccessLog{accessLog},
+	}))
+	address := proxy(t, chain)
+
+	response, err := roundTrip(t, address, "hello")
+	if err != nil || response != "echo: hello" {
+		t.Fatalf("expected the upstream's answer after a half-close, got %q (%v)", response, err)
+	}
+	expected := "postgres " + upstream + " - 5 11\n"
+	if line := waitForFile(t, logPath); line != expected {
+		t.Errorf("expected access log line %q, got %q", expected, line)
+	}
+}
+
+func TestTcpProxyRetriesOtherEndpoints(t *testing.T) {
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddress := closed.Addr().String()
+	closed.Close()
+
+	clusters := testClusters(t, "backend", closedAddress, echoUpstream(t))
+	for _, attempts := range []int{1, 2} {
+		chain := newChain(t, clusters, tcpProxyFilter(config.TcpProxy{StatPrefix: "backend", Cluster: "backend", MaxConnectAttempts: attempts}))
+		address := proxy(t, chain)
+		// Round robin starts with the closed endpoint on every other
+		// connection, so one of two connections needs a second attempt.
+		failures := 0
+		for i := 0; i < 2; i++ {
+			if response, _ := roundTrip(t, address, "ping"); response != "echo: ping" {
+				failures++
+			}
+		}
+		if expected := 2 - attempts; failures != expected {
+			t.Errorf("with %d attempts expected %d failed connections, got %d", attempts, expected, failures)
+		}
+	}
+}
+
+func TestTcpProxyUnknownCluster(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "access.log")
+	var accessLog config.AccessLog
+	accessLog.Name = config.FileAccessLog
+	accessLog.TypedConfig.Path = logPath
+	accessLog.TypedConfig.LogFormat.TextFormatSource.InlineString = "%RESPONSE_FLAGS% %UPSTREAM_HOST%\n"
+
+	chain := newChain(t, cluster.NewManager(), tcpProxyFilter(config.TcpProxy{StatPrefix: "missing", Cluster: "missing", AccessLog: []config.AccessLog{accessLog}}))
+	if response, _ := roundTrip(t, proxy(t, chain), "hello"); response != "" {
+		t.Errorf("expected the connection to be closed, got %q", response)
+	}
+	if line := waitForFile(t, logPath); line != "NC -\n" {
+		t.Errorf("expected a no cluster found flag, got %q", line)
+	}
+}
+
+func TestTcpProxyIdleTimeout(t *testing.T) {
+	silent := serve(t, func(conn net.Conn) {
+		defer conn.Close()
+		io.Copy(io.Discard, conn)
+	})
+	chain := newChain(t, testClusters(t, "silent", silent), tcpProxyFilter(config.TcpProxy{StatPrefix: "silent", Cluster: "silent", IdleTimeout: "50ms"}))
+
+	conn, err := net.Dial("tcp", proxy(t, chain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the idle connection to be closed, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected the idle timeout to close the connection, took %v", elapsed)
+	}
+}
+
+func TestRBAC(t *testing.T) {
+	upstream := echoUpstream(t)
+	clusters := testClusters(t, "backend", upstream)
+	prefixLen := 8
+	loopback := config.RBACPolicy{
+		Permissions: []config.RBACPermission{{Any: true}},
+		Principals:  []config.RBACPrincipal{{DirectRemoteIP: &config.CidrRange{AddressPrefix: "127.0.0.0", PrefixLen: &prefixLen}}},
+	}
+	other := config.RBACPolicy{
+		Permissions: []config.RBACPermission{{Any: true}},
+		Principals:  []config.RBACPrincipal{{RemoteIP: &config.CidrRange{AddressPrefix: "10.1.2.3"}}},
+	}
+
+	for _, test := range []struct {
+		name    string
+		rules   *config.RBACRules
+		allowed bool
+	}{
+		{"no rules", nil, true},
+		{"allow matching", &config.RBACRules{Policies: map[string]config.RBACPolicy{"loopback": loopback}}, true},
+		{"allow not matching", &config.RBACRules{Policies: map[string]config.RBACPolicy{"other": other}}, false},
+		{"deny matching", &config.RBACRules{Action: "DENY", Policies: map[string]config.RBACPolicy{"loopback": loopback}}, false},
+		{"deny not matching", &config.RBACRules{Action: "DENY", Policies: map[string]config.RBACPolicy{"other": other}}, true},
+	} {
+		chain := newChain(t, clusters,
+			config.Filter{Name: config.RBACFilter, RBAC: &config.RBAC{StatPrefix: "test", Rules: test.rules}},
+			tcpProxyFilter(config.TcpProxy{StatPrefix: "backend", Cluster: "backend"}))
+		response, _ := roundTrip(t, proxy(t, chain), "hello")
+		if allowed := response == "echo: hello"; allowed != test.allowed {
+			t.Errorf("%s: expected allowed %v, got response %q", test.name, test.allowed, response)
+		}
+	}
+}
+
+func TestRBACAuthenticated(t *testing.T) {
+	f := newRBAC(config.RBAC{StatPrefix: "mtls", Rules: &config.RBACRules{Policies: map[string]config.RBACPolicy{
+		"web": {
+			Permissions: []config.RBACPermission{{Any: true}},
+			Principals: []config.RBACPrincipal{{Authenticated: &config.RBACAuthenticated{
+				PrincipalName: &config.StringMatcher{Exact: "spiffe://example.com/web"},
+			}}},
+		},
+	}}}, true)
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+
+	// The policies wait for the handshake on chains that terminate TLS.
+	if f.OnNewConnection(conn) == nil {
+		t.Fatal("expected the connection to be let through until the handshake")
+	}
+	web, _ := url.Parse("spiffe://example.com/web")
+	db, _ := url.Parse("spiffe://example.com/db")
+	for _, test := range []struct {
+		name        string
+		certificate *x509.Certificate
+		allowed     bool
+	}{
+		{"matching uri", &x509.Certificate{URIs: []*url.URL{web}, DNSNames: []string{"db.example.com"}}, true},
+		{"other uri", &x509.Certificate{URIs: []*url.URL{db}}, false},
+		{"subject", &x509.Certificate{Subject: pkix.Name{CommonName: "spiffe://example.com/web"}}, false},
+		{"no certificate", nil, false},
+	} {
+		if allowed := f.allow(conn, test.certificate); allowed != test.allowed {
+			t.Errorf("%s: expected allowed %v, got %v", test.name, test.allowed, allowed)
+		}
+	}
+
+	if name := principalName(&x509.Certificate{Subject: pkix.Name{CommonName: "client", Organization: []string{"Example"}}}); name != "CN=client,O=Example" {
+		t.Errorf("expected the subject as the principal name, got %q", name)
+	}
+}
+
+func TestConnectionLimit(t *testing.T) {
+	held := serve(t, func(conn net.Conn) {
+		defer conn.Close()
+		io.Copy(io.Discard, conn)
+	})
+	chain := newChain(t, testClusters(t, "held", held),
+		config.Filter{Name: config.ConnectionLimitFilter, ConnectionLimit: &config.ConnectionLimit{StatPrefix: "held", MaxConnections: 1}},
+		tcpProxyFilter(config.TcpProxy{StatPrefix: "held", Cluster: "held"}))
+	address := proxy(t, chain)
+
+	first, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Give the proxy time to accept the first connection, so it counts
+	// against the limit.
+	time.Sleep(50 * time.Millisecond)
+
+	second, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := second.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected the connection over the limit to be closed, got %v", err)
+	}
+
+	// Closing the first connection frees its place.
+	first.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for chain.filters[0].(*connectionLimit).open.Load() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the closed connection to give its place back")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMatchFilterChain(t *testing.T) {
+	chain := func(transportProtocol string, serverNames ...string) config.FilterChain {
+		return config.FilterChain{FilterChainMatch: config.FilterChainMatch{ServerNames: serverNames, TransportProtocol: transportProtocol}}
+	}
+	chains := []config.FilterChain{
+		chain("", "db.example.com"),
+		chain("", "*.example.com"),
+		chain("", "*.eu.example.com"),
+		chain("tls"),
+		chain(""),
+	}
+	for _, test := range []struct {
+		serverName, transportProtocol string
+		expected                      int
+	}{
+		{"db.example.com", "tls", 0},
+		{"DB.Example.com", "tls", 0},
+		{"web.example.com", "tls", 1},
+		{"web.eu.example.com", "tls", 2},
+		{"example.com", "tls", 3},
+		{"", "tls", 3},
+		{"", "raw_buffer", 4},
+	} {
+		if i := MatchFilterChain(chains, test.serverName, test.transportProtocol); i != test.expected {
+			t.Errorf("%q over %s: expected filter chain %d, got %d", test.serverName, test.transportProtocol, test.expected, i)
+		}
+	}
+
+	if i := MatchFilterChain(chains[:2], "example.org", "tls"); i != -1 {
+		t.Errorf("expected no filter chain for an unknown name without a default chain, got %d", i)
+	}
+}
+
+func TestInspectTLS(t *testing.T) {
+	certificate := testCertificate(t)
+	type result struct {
+		serverName, transportProtocol string
+		data                          string
+		err                           error
+	}
+	results := make(chan result, 1)
+	address := serve(t, func(conn net.Conn) {
+		defer conn.Close()
+		conn, serverName, transportProtocol, err := InspectTLS(conn, time.Second)
+		r := result{serverName: serverName, transportProtocol: transportProtocol, err: err}
+		if err == nil && transportProtocol == config.TLSTransportProtocol {
+			// The bytes read while inspecting are replayed, so the
+			// handshake can still complete.
+			conn = tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{certificate}})
+		}
+		if err == nil {
+			data := make([]byte, 5)
+			_, r.err = io.ReadFull(conn, data)
+			r.data = string(data)
+		}
+		results <- r
+	})
+
+	conn, err := tls.Dial("tcp", address, &tls.Config{ServerName: "db.example.com", InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(conn, "hello")
+	conn.Close()
+	if r := <-results; r.err != nil || r.serverName != "db.example.com" || r.transportProtocol != "tls" || r.data != "hello" {
+		t.Errorf("expected server name db.example.com over tls and the data, got %+v", r)
+	}
+
+	plain, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(plain, "hello")
+	plain.Close()
+	if r := <-results; r.err != nil || r.serverName != "" || r.transportProtocol != "raw_buffer" || r.data != "hello" {
+		t.Errorf("expected a raw_buffer connection with its data intact, got %+v", r)
+	}
+}
+
+// testCertificate returns a self-signed certificate for *.example.com.
+func testCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com", "*.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// udpUpstream answers each datagram with its own address and the datagram.
+func udpUpstream(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo([]byte(conn.LocalAddr().String()+" "+string(buf[:n])), addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// udpProxy serves c on a local UDP port and returns its address.
+func udpProxy(t *testing.T, clusters *cluster.Manager, c config.UdpProxy) string {
+	t.Helper()
+	p, err := NewUdpProxy(c, clusters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go ServeUDP(conn, func() *UdpProxy { return p })
+	return conn.LocalAddr().String()
+}
+
+// exchange sends message on conn and returns the reply.
+func exchange(t *testing.T, conn net.Conn, message string) string {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, message); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func dialUDP(t *testing.T, address string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestUdpProxyKeepsClientsOnTheirSession(t *testing.T) {
+	first, second := udpUpstream(t), udpUpstream(t)
+	address := udpProxy(t, testClusters(t, "dns", first, second), config.UdpProxy{StatPrefix: "dns", Cluster: "dns"})
+
+	client := dialUDP(t, address)
+	reply := exchange(t, client, "one")
+	upstream, _, _ := strings.Cut(reply, " ")
+	if reply != upstream+" one" {
+		t.Fatalf("expected the upstream to answer, got %q", reply)
+	}
+	// Round robin would move a new session to the other endpoint.
+	if reply := exchange(t, client, "two"); reply != upstream+" two" {
+		t.Errorf("expected the session to stay on %s, got %q", upstream, reply)
+	}
+	if reply := exchange(t, dialUDP(t, address), "three"); strings.HasPrefix(reply, upstream) {
+		t.Errorf("expected another client to get a session of its own, got %q", reply)
+	}
+}
+
+func TestUdpProxyIdleTimeout(t *testing.T) {
+	first, second := udpUpstream(t), udpUpstream(t)
+	address := udpProxy(t, testClusters(t, "idle", first, second), config.UdpProxy{StatPrefix: "idle", Cluster: "idle", IdleTimeout: "50ms"})
+
+	client := dialUDP(t, address)
+	upstream, _, _ := strings.Cut(exchange(t, client, "one"), " ")
+	time.Sleep(200 * time.Millisecond)
+	if reply := exchange(t, client, "two"); strings.HasPrefix(reply, upstream) {
+		t.Errorf("expected a new session on the other endpoint after the idle timeout, got %q", reply)
+	}
+}
+
+func TestUdpProxyHashesSourceIP(t *testing.T) {
+	first, second, third := udpUpstream(t), udpUpstream(t), udpUpstream(t)
+	address := udpProxy(t, testClusters(t, "hashed", first, second, third), config.UdpProxy{
+		StatPrefix:   "hashed",
+		Cluster:      "hashed",
+		HashPolicies: []config.UdpHashPolicy{{SourceIP: true}},
+	})
+
+	upstream, _, _ := strings.Cut(exchange(t, dialUDP(t, address), "one"), " ")
+	for i := 0; i < 5; i++ {
+		if reply := exchange(t, dialUDP(t, address), "again"); !strings.HasPrefix(reply, upstream) {
+			t.Errorf("expected every client from 127.0.0.1 to go to %s, got %q", upstream, reply)
+		}
+	}
+}
+
+func TestUdpProxyUnknownCluster(t *testing.T) {
+	address := udpProxy(t, testClusters(t, "known", udpUpstream(t)), config.UdpProxy{StatPrefix: "unknown", Cluster: "unknown"})
+
+	client := dialUDP(t, address)
+	client.SetDeadline(time.Now().Add(100 * time.Millisecond))
+	client.Write([]byte("lost"))
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Error("expected the datagram to be dropped")
+	}
+}
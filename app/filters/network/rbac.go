@@ -0,0 +1,181 @@
+package network
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/netip"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"seateam/config"
+	"seateam/stats"
+)
+
+var (
+	rbacAllowed = stats.NewCounterVec("rbac", "allowed", "Connections let through by an rbac filter.", "envoy_rbac_prefix")
+	rbacDenied  = stats.NewCounterVec("rbac", "denied", "Connections turned away by an rbac filter.", "envoy_rbac_prefix")
+)
+
+// rbac allows or denies connections by the address they come from, the port
+// they arrive on and the client certificate they present.
+type rbac struct {
+	statPrefix string
+	// enforce is false when there are no rules, which lets everything
+	// through.
+	enforce bool
+	deny    bool
+	// afterHandshake is set on filter chains that terminate TLS, where the
+	// policies are checked once the client certificate is known.
+	afterHandshake bool
+	policies       []rbacPolicy
+	allowed        prometheus.Counter
+	denied         prometheus.Counter
+}
+
+type rbacPolicy struct {
+	name string
+	// anyPort is set by an any permission; otherwise ports lists the
+	// destination ports that match.
+	anyPort bool
+	ports   []int
+	// anyAddress is set by an any principal; otherwise prefixes lists the
+	// remote address ranges that match.
+	anyAddress bool
+	prefixes   []netip.Prefix
+	// principalNames match the principal name of a verified client
+	// certificate. A nil matcher matches any certificate.
+	principalNames []*config.StringMatcher
+}
+
+func newRBAC(c config.RBAC, afterHandshake bool) *rbac {
+	labels := prometheus.Labels{"envoy_rbac_prefix": c.StatPrefix}
+	f := &rbac{
+		statPrefix:     c.StatPrefix,
+		afterHandshake: afterHandshake,
+		allowed:        rbacAllowed.With(labels),
+		denied:         rbacDenied.With(labels),
+	}
+	if c.Rules == nil {
+		return f
+	}
+	f.enforce = true
+	f.deny = c.Rules.Action == "DENY"
+	for _, name := range c.Rules.PolicyNames() {
+		policy := rbacPolicy{name: name}
+		for _, permission := range c.Rules.Policies[name].Permissions {
+			policy.anyPort = policy.anyPort || permission.Any
+			if permission.DestinationPort != 0 {
+				policy.ports = append(policy.ports, permission.DestinationPort)
+			}
+		}
+		for _, principal := range c.Rules.Policies[name].Principals {
+			policy.anyAddress = policy.anyAddress || principal.Any
+			if principal.Authenticated != nil {
+				policy.principalNames = append(policy.principalNames, principal.Authenticated.PrincipalName)
+			}
+			for _, cidrRange := range []*config.CidrRange{principal.DirectRemoteIP, principal.RemoteIP} {
+				if cidrRange == nil {
+					continue
+				}
+				// Validation has already rejected ranges that do not parse.
+				if prefix, err := cidrRange.Prefix(); err == nil {
+					policy.prefixes = append(policy.prefixes, prefix)
+				}
+			}
+		}
+		f.policies = append(f.policies, policy)
+	}
+	return f
+}
+
+func (f *rbac) OnNewConnection(conn net.Conn) net.Conn {
+	if f.afterHandshake {
+		return conn
+	}
+	if !f.allow(conn, nil) {
+		conn.Close()
+		return nil
+	}
+	return conn
+}
+
+// OnHandshake checks the policies with the client certificate, if the
+// client presented one.
+func (f *rbac) OnHandshake(conn *tls.Conn) bool {
+	if !f.afterHandshake {
+		return true
+	}
+	var peer *x509.Certificate
+	if certificates := conn.ConnectionState().PeerCertificates; len(certificates) > 0 {
+		peer = certificates[0]
+	}
+	return f.allow(conn, peer)
+}
+
+// allow checks the policies and counts the outcome. peer is the verified
+// client certificate, or nil.
+func (f *rbac) allow(conn net.Conn, peer *x509.Certificate) bool {
+	if !f.enforce {
+		f.allowed.Inc()
+		return true
+	}
+	remote := addrPort(conn.RemoteAddr())
+	local := addrPort(conn.LocalAddr())
+
+	matched := ""
+	for _, policy := range f.policies {
+		if policy.matches(remote.Addr(), int(local.Port()), peer) {
+			matched = policy.name
+			break
+		}
+	}
+	if (matched != "") == f.deny {
+		networkLog.Debugf("rbac %s: denied connection from %s (policy %q)", f.statPrefix, conn.RemoteAddr(), matched)
+		f.denied.Inc()
+		return false
+	}
+	f.allowed.Inc()
+	return true
+}
+
+func (p rbacPolicy) matches(remote netip.Addr, port int, peer *x509.Certificate) bool {
+	portMatches := p.anyPort
+	for _, policyPort := range p.ports {
+		portMatches = portMatches || policyPort == port
+	}
+	principalMatches := p.anyAddress
+	for _, prefix := range p.prefixes {
+		principalMatches = principalMatches || prefix.Contains(remote)
+	}
+	if peer != nil {
+		name := principalName(peer)
+		for _, matcher := range p.principalNames {
+			principalMatches = principalMatches || matcher == nil || matcher.Matches(name)
+		}
+	}
+	return portMatches && principalMatches
+}
+
+// principalName is what an authenticated principal matches in a client
+// certificate: its first URI SAN, else its first DNS SAN, else its subject.
+func principalName(certificate *x509.Certificate) string {
+	switch {
+	case len(certificate.URIs) > 0:
+		return certificate.URIs[0].String()
+	case len(certificate.DNSNames) > 0:
+		return certificate.DNSNames[0]
+	}
+	return certificate.Subject.String()
+}
+
+// addrPort returns the IP address and port of addr, with IPv4-mapped IPv6
+// addresses turned into plain IPv4 so they match IPv4 ranges.
+func addrPort(addr net.Addr) netip.AddrPort {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return netip.AddrPort{}
+	}
+	addrPort := tcpAddr.AddrPort()
+	return netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port())
+}
@@ -0,0 +1,219 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"seateam/cluster"
+	"seateam/config"
+	"seateam/stats"
+)
+
+// defaultIdleTimeout matches Envoy's default when idle_timeout is left out.
+const defaultIdleTimeout = time.Hour
+
+var (
+	downstreamCxTotal        = stats.NewCounterVec("tcp", "downstream_cx_total", "Total connections handled by a tcp_proxy.", "envoy_tcp_prefix")
+	downstreamCxNoRoute      = stats.NewCounterVec("tcp", "downstream_cx_no_route", "Connections whose cluster was not found.", "envoy_tcp_prefix")
+	downstreamCxRxBytesTotal = stats.NewCounterVec("tcp", "downstream_cx_rx_bytes_total", "Bytes received from downstream.", "envoy_tcp_prefix")
+	downstreamCxTxBytesTotal = stats.NewCounterVec("tcp", "downstream_cx_tx_bytes_total", "Bytes sent to downstream.", "envoy_tcp_prefix")
+	idleTimeout              = stats.NewCounterVec("tcp", "idle_timeout", "Connections closed for being idle.", "envoy_tcp_prefix")
+)
+
+type tcpStats struct {
+	downstreamCxTotal        prometheus.Counter
+	downstreamCxNoRoute      prometheus.Counter
+	downstreamCxRxBytesTotal prometheus.Counter
+	downstreamCxTxBytesTotal prometheus.Counter
+	idleTimeout              prometheus.Counter
+}
+
+func newTcpStats(statPrefix string) *tcpStats {
+	labels := prometheus.Labels{"envoy_tcp_prefix": statPrefix}
+	return &tcpStats{
+		downstreamCxTotal:        downstreamCxTotal.With(labels),
+		downstreamCxNoRoute:      downstreamCxNoRoute.With(labels),
+		downstreamCxRxBytesTotal: downstreamCxRxBytesTotal.With(labels),
+		downstreamCxTxBytesTotal: downstreamCxTxBytesTotal.With(labels),
+		idleTimeout:              idleTimeout.With(labels),
+	}
+}
+
+// Response flags written to the access log, as Envoy names them.
+const (
+	noHealthyUpstream      = "UH"
+	upstreamConnectFailure = "UF"
+	noClusterFound         = "NC"
+)
+
+// TcpProxy forwards the bytes of each connection to an endpoint of its
+// cluster and back.
+type TcpProxy struct {
+	cluster            string
+	clusters           *cluster.Manager
+	idleTimeout        time.Duration
+	maxConnectAttempts int
+	accessLogs         []*accessLog
+	stats              *tcpStats
+}
+
+// NewTcpProxy builds a proxy for c. The cluster is looked up in clusters for
+// each connection, so it follows config reloads.
+func NewTcpProxy(c config.TcpProxy, clusters *cluster.Manager) (*TcpProxy, error) {
+	p := &TcpProxy{
+		cluster:            c.Cluster,
+		clusters:           clusters,
+		idleTimeout:        defaultIdleTimeout,
+		maxConnectAttempts: 1,
+		stats:              newTcpStats(c.StatPrefix),
+	}
+	if c.IdleTimeout != "" {
+		var err error
+		if p.idleTimeout, err = time.ParseDuration(c.IdleTimeout); err != nil {
+			return nil, err
+		}
+	}
+	if c.MaxConnectAttempts > 0 {
+		p.maxConnectAttempts = c.MaxConnectAttempts
+	}
+	for _, accessLogConfig := range c.AccessLog {
+		accessLog, err := newAccessLog(accessLogConfig)
+		if err != nil {
+			return nil, err
+		}
+		p.accessLogs = append(p.accessLogs, accessLog)
+	}
+	return p, nil
+}
+
+// ServeConn proxies downstream until either side closes it or it goes idle,
+// and closes it.
+func (p *TcpProxy) ServeConn(downstream net.Conn) {
+	defer downstream.Close()
+
+	info := &connectionInfo{
+		startTime:       time.Now(),
+		downstreamLocal: downstream.LocalAddr().String(),
+		downstream:      downstream.RemoteAddr().String(),
+		cluster:         p.cluster,
+	}
+	defer p.log(info)
+	p.stats.downstreamCxTotal.Inc()
+
+	upstreamCluster := p.clusters.Get(p.cluster)
+	if upstreamCluster == nil {
+		p.stats.downstreamCxNoRoute.Inc()
+		info.responseFlags = noClusterFound
+		return
+	}
+	upstream, endpoint := p.connect(upstreamCluster, info)
+	if upstream == nil {
+		return
+	}
+	defer upstreamCluster.LoadBalancer.Release(endpoint)
+	defer upstream.Close()
+	upstreamCluster.Stats.UpstreamCxTotal.Inc()
+	upstreamCluster.Stats.UpstreamCxActive.Inc()
+	defer upstreamCluster.Stats.UpstreamCxActive.Dec()
+
+	p.splice(downstream, upstream, info)
+}
+
+// connect dials endpoints of upstreamCluster until one answers or the
+// attempts run out. The endpoint returned must be released once the
+// connection is done with.
+func (p *TcpProxy) connect(upstreamCluster *cluster.Cluster, info *connectionInfo) (net.Conn, string) {
+	for attempt := 0; attempt < p.maxConnectAttempts; attempt++ {
+		endpoint := upstreamCluster.LoadBalancer.NextEndpoint()
+		if endpoint == "" {
+			info.responseFlags = noHealthyUpstream
+			return nil, ""
+		}
+		info.upstream = endpoint
+		upstream, err := upstreamCluster.Dial(context.Background(), endpoint)
+		if err == nil {
+			info.responseFlags = ""
+			return upstream, endpoint
+		}
+		upstreamCluster.LoadBalancer.Release(endpoint)
+		upstreamCluster.Stats.UpstreamCxConnectFail.Inc()
+		info.responseFlags = upstreamConnectFailure
+		networkLog.Debugf("tcp_proxy: connecting to %s of cluster %s: %v", endpoint, upstreamCluster.Name, err)
+	}
+	return nil, ""
+}
+
+// splice copies bytes both ways. When one side finishes sending, the other is
+// told with a half-close and the copy the other way carries on; any error
+// ends both.
+func (p *TcpProxy) splice(downstream, upstream net.Conn, info *connectionInfo) {
+	var idled atomic.Bool
+	var idleTimer *time.Timer
+	if p.idleTimeout > 0 {
+		idleTimer = time.AfterFunc(p.idleTimeout, func() {
+			idled.Store(true)
+			downstream.Close()
+			upstream.Close()
+		})
+		defer idleTimer.Stop()
+	}
+	active := func() {
+		if idleTimer != nil {
+			idleTimer.Reset(p.idleTimeout)
+		}
+	}
+
+	var wg sync.WaitGroup
+	copyConn := func(dst, src net.Conn, counter prometheus.Counter, total *atomic.Int64) {
+		defer wg.Done()
+		_, err := io.Copy(dst, &countingReader{r: src, counter: counter, total: total, active: active})
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			networkLog.Debugf("tcp_proxy: copying from %s to %s: %v", src.RemoteAddr(), dst.RemoteAddr(), err)
+		}
+		if err != nil || closeWrite(dst) != nil {
+			downstream.Close()
+			upstream.Close()
+		}
+	}
+	wg.Add(2)
+	go copyConn(upstream, downstream, p.stats.downstreamCxRxBytesTotal, &info.bytesReceived)
+	go copyConn(downstream, upstream, p.stats.downstreamCxTxBytesTotal, &info.bytesSent)
+	wg.Wait()
+
+	if idled.Load() {
+		p.stats.idleTimeout.Inc()
+	}
+}
+
+func (p *TcpProxy) log(info *connectionInfo) {
+	info.duration = time.Since(info.startTime)
+	for _, accessLog := range p.accessLogs {
+		accessLog.write(info)
+	}
+}
+
+// countingReader counts the bytes read through it and reports each read as
+// activity.
+type countingReader struct {
+	r       io.Reader
+	counter prometheus.Counter
+	total   *atomic.Int64
+	active  func()
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if n > 0 {
+		r.counter.Add(float64(n))
+		r.total.Add(int64(n))
+		r.active()
+	}
+	return n, err
+}
@@ -0,0 +1,114 @@
+package network
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"seateam/config"
+	"seateam/stats"
+)
+
+var (
+	tlsFound    = stats.NewCounterVec("tls_inspector", "tls_found", "Connections the TLS inspector found to be TLS.")
+	tlsNotFound = stats.NewCounterVec("tls_inspector", "tls_not_found", "Connections the TLS inspector found not to be TLS.")
+	sniFound    = stats.NewCounterVec("tls_inspector", "sni_found", "TLS connections with a server name.")
+	sniNotFound = stats.NewCounterVec("tls_inspector", "sni_not_found", "TLS connections without a server name.")
+)
+
+// recordTypeHandshake is the first byte of a TLS connection.
+const recordTypeHandshake = 0x16
+
+// errHelloRead stops the handshake once the ClientHello has been read.
+var errHelloRead = errors.New("client hello read")
+
+// InspectTLS reads the start of conn to tell whether it is TLS and, if it is,
+// the server name in its ClientHello. It gives up after timeout, if that is
+// not zero. The returned connection replays the bytes read, so whatever
+// serves it sees the connection from the start, still encrypted.
+func InspectTLS(conn net.Conn, timeout time.Duration) (inspected net.Conn, serverName, transportProtocol string, err error) {
+	if timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		defer conn.SetReadDeadline(time.Time{})
+	}
+	recorder := &recordingReader{r: conn}
+	inspected = &replayConn{Conn: conn, replay: &recorder.recorded}
+
+	first := make([]byte, 1)
+	if _, err := io.ReadFull(recorder, first); err != nil {
+		return inspected, "", "", err
+	}
+	if first[0] != recordTypeHandshake {
+		tlsNotFound.WithLabelValues().Inc()
+		return inspected, "", config.RawBufferTransportProtocol, nil
+	}
+
+	var hello *tls.ClientHelloInfo
+	server := tls.Server(&helloConn{Conn: conn, r: io.MultiReader(bytes.NewReader(first), recorder)}, &tls.Config{
+		GetConfigForClient: func(clientHello *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = clientHello
+			return nil, errHelloRead
+		},
+	})
+	handshakeErr := server.Handshake()
+	if hello == nil {
+		var netErr net.Error
+		if errors.As(handshakeErr, &netErr) && netErr.Timeout() || errors.Is(handshakeErr, io.EOF) {
+			return inspected, "", "", handshakeErr
+		}
+		// It looked like TLS but was not.
+		tlsNotFound.WithLabelValues().Inc()
+		return inspected, "", config.RawBufferTransportProtocol, nil
+	}
+
+	tlsFound.WithLabelValues().Inc()
+	if hello.ServerName != "" {
+		sniFound.WithLabelValues().Inc()
+	} else {
+		sniNotFound.WithLabelValues().Inc()
+	}
+	return inspected, hello.ServerName, config.TLSTransportProtocol, nil
+}
+
+// recordingReader keeps a copy of everything read through it.
+type recordingReader struct {
+	r        io.Reader
+	recorded bytes.Buffer
+}
+
+func (r *recordingReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.recorded.Write(b[:n])
+	return n, err
+}
+
+// helloConn feeds the handshake the bytes already read and throws away what
+// it writes, such as the alert sent when the handshake is stopped.
+type helloConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *helloConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c *helloConn) Write(b []byte) (int, error) { return len(b), nil }
+func (c *helloConn) Close() error                { return nil }
+
+// replayConn reads the bytes the inspector read before reading on from conn.
+type replayConn struct {
+	net.Conn
+	replay *bytes.Buffer
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	if c.replay.Len() > 0 {
+		return c.replay.Read(b)
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *replayConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
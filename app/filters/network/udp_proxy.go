@@ -0,0 +1,264 @@
+package network
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"seateam/cluster"
+	"seateam/config"
+	"seateam/loadbalancer"
+	"seateam/stats"
+)
+
+// defaultUdpIdleTimeout matches Envoy's default when idle_timeout is left out.
+const defaultUdpIdleTimeout = time.Minute
+
+// maxDatagramSize is the largest UDP payload.
+const maxDatagramSize = 65535
+
+var (
+	downstreamSessTotal       = stats.NewCounterVec("udp", "downstream_sess_total", "Total sessions started by a udp_proxy.", "envoy_udp_prefix")
+	downstreamSessActive      = stats.NewGaugeVec("udp", "downstream_sess_active", "Sessions open.", "envoy_udp_prefix")
+	downstreamSessNoRoute     = stats.NewCounterVec("udp", "downstream_sess_no_route", "Datagrams dropped for having no cluster or endpoint to go to.", "envoy_udp_prefix")
+	downstreamSessRxDatagrams = stats.NewCounterVec("udp", "downstream_sess_rx_datagrams", "Datagrams received from downstream.", "envoy_udp_prefix")
+	downstreamSessRxBytes     = stats.NewCounterVec("udp", "downstream_sess_rx_bytes", "Bytes received from downstream.", "envoy_udp_prefix")
+	downstreamSessRxErrors    = stats.NewCounterVec("udp", "downstream_sess_rx_errors", "Datagrams from downstream that could not be sent upstream.", "envoy_udp_prefix")
+	downstreamSessTxDatagrams = stats.NewCounterVec("udp", "downstream_sess_tx_datagrams", "Datagrams sent to downstream.", "envoy_udp_prefix")
+	downstreamSessTxBytes     = stats.NewCounterVec("udp", "downstream_sess_tx_bytes", "Bytes sent to downstream.", "envoy_udp_prefix")
+	downstreamSessTxErrors    = stats.NewCounterVec("udp", "downstream_sess_tx_errors", "Datagrams from upstream that could not be sent downstream.", "envoy_udp_prefix")
+	udpIdleTimeout            = stats.NewCounterVec("udp", "idle_timeout", "Sessions closed for being idle.", "envoy_udp_prefix")
+)
+
+type udpStats struct {
+	downstreamSessTotal       prometheus.Counter
+	downstreamSessActive      prometheus.Gauge
+	downstreamSessNoRoute     prometheus.Counter
+	downstreamSessRxDatagrams prometheus.Counter
+	downstreamSessRxBytes     prometheus.Counter
+	downstreamSessRxErrors    prometheus.Counter
+	downstreamSessTxDatagrams prometheus.Counter
+	downstreamSessTxBytes     prometheus.Counter
+	downstreamSessTxErrors    prometheus.Counter
+	idleTimeout               prometheus.Counter
+}
+
+func newUdpStats(statPrefix string) *udpStats {
+	labels := prometheus.Labels{"envoy_udp_prefix": statPrefix}
+	return &udpStats{
+		downstreamSessTotal:       downstreamSessTotal.With(labels),
+		downstreamSessActive:      downstreamSessActive.With(labels),
+		downstreamSessNoRoute:     downstreamSessNoRoute.With(labels),
+		downstreamSessRxDatagrams: downstreamSessRxDatagrams.With(labels),
+		downstreamSessRxBytes:     downstreamSessRxBytes.With(labels),
+		downstreamSessRxErrors:    downstreamSessRxErrors.With(labels),
+		downstreamSessTxDatagrams: downstreamSessTxDatagrams.With(labels),
+		downstreamSessTxBytes:     downstreamSessTxBytes.With(labels),
+		downstreamSessTxErrors:    downstreamSessTxErrors.With(labels),
+		idleTimeout:               udpIdleTimeout.With(labels),
+	}
+}
+
+// UdpProxy forwards the datagrams of each client to an endpoint of its
+// cluster over a session of its own, and the replies back.
+type UdpProxy struct {
+	cluster      string
+	clusters     *cluster.Manager
+	idleTimeout  time.Duration
+	hashSourceIP bool
+	stats        *udpStats
+}
+
+// NewUdpProxy builds a proxy for c. The cluster is looked up in clusters for
+// each session, so it follows config reloads.
+func NewUdpProxy(c config.UdpProxy, clusters *cluster.Manager) (*UdpProxy, error) {
+	p := &UdpProxy{
+		cluster:     c.Cluster,
+		clusters:    clusters,
+		idleTimeout: defaultUdpIdleTimeout,
+		stats:       newUdpStats(c.StatPrefix),
+	}
+	if c.IdleTimeout != "" {
+		var err error
+		if p.idleTimeout, err = time.ParseDuration(c.IdleTimeout); err != nil {
+			return nil, err
+		}
+	}
+	for _, hashPolicy := range c.HashPolicies {
+		p.hashSourceIP = p.hashSourceIP || hashPolicy.SourceIP
+	}
+	return p, nil
+}
+
+// ServeUDP reads datagrams from conn until it is closed, then closes the
+// sessions left open. A datagram from a client without a session starts one
+// with the proxy that proxy returns at the time, so sessions keep the config
+// they started with across reloads, as proxied TCP connections do. Datagrams
+// are dropped while proxy returns nil.
+func ServeUDP(conn net.PacketConn, proxy func() *UdpProxy) error {
+	s := &udpSessions{conn: conn, sessions: make(map[string]*udpSession)}
+	defer s.closeAll()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return err
+		} else if err != nil {
+			networkLog.Debugf("udp_proxy: reading from %s: %v", conn.LocalAddr(), err)
+			continue
+		}
+		if p := proxy(); p != nil {
+			s.forward(p, addr, buf[:n])
+		}
+	}
+}
+
+// udpSessions is the sessions of the clients of one socket, keyed by client
+// address.
+type udpSessions struct {
+	conn     net.PacketConn
+	mu       sync.Mutex
+	sessions map[string]*udpSession
+}
+
+type udpSession struct {
+	proxy      *UdpProxy
+	cluster    *cluster.Cluster
+	endpoint   string
+	downstream net.Addr
+	upstream   net.Conn
+	idleTimer  *time.Timer
+	closeOnce  sync.Once
+}
+
+// forward sends datagram upstream on the session of addr, starting one if the
+// client has none.
+func (s *udpSessions) forward(p *UdpProxy, addr net.Addr, datagram []byte) {
+	s.mu.Lock()
+	session := s.sessions[addr.String()]
+	if session == nil {
+		session = s.open(p, addr)
+		if session == nil {
+			s.mu.Unlock()
+			return
+		}
+		s.sessions[addr.String()] = session
+	}
+	s.mu.Unlock()
+
+	session.proxy.stats.downstreamSessRxDatagrams.Inc()
+	session.proxy.stats.downstreamSessRxBytes.Add(float64(len(datagram)))
+	session.idleTimer.Reset(session.proxy.idleTimeout)
+	if _, err := session.upstream.Write(datagram); err != nil {
+		session.proxy.stats.downstreamSessRxErrors.Inc()
+		networkLog.Debugf("udp_proxy: sending to %s: %v", session.endpoint, err)
+	}
+}
+
+// open starts a session for addr on an endpoint of p's cluster, or returns nil
+// if there is no endpoint to send to. s.mu must be held.
+func (s *udpSessions) open(p *UdpProxy, addr net.Addr) *udpSession {
+	upstreamCluster := p.clusters.Get(p.cluster)
+	if upstreamCluster == nil {
+		p.stats.downstreamSessNoRoute.Inc()
+		return nil
+	}
+	var endpoint string
+	if p.hashSourceIP {
+		endpoint = loadbalancer.HashEndpoint(upstreamCluster.LoadBalancer, sourceIP(addr))
+	} else {
+		endpoint = upstreamCluster.LoadBalancer.NextEndpoint()
+	}
+	if endpoint == "" {
+		p.stats.downstreamSessNoRoute.Inc()
+		return nil
+	}
+	upstream, err := net.Dial("udp", endpoint)
+	if err != nil {
+		upstreamCluster.LoadBalancer.Release(endpoint)
+		upstreamCluster.Stats.UpstreamCxConnectFail.Inc()
+		p.stats.downstreamSessNoRoute.Inc()
+		networkLog.Debugf("udp_proxy: connecting to %s of cluster %s: %v", endpoint, upstreamCluster.Name, err)
+		return nil
+	}
+
+	session := &udpSession{proxy: p, cluster: upstreamCluster, endpoint: endpoint, downstream: addr, upstream: upstream}
+	session.idleTimer = time.AfterFunc(p.idleTimeout, func() {
+		p.stats.idleTimeout.Inc()
+		s.close(session)
+	})
+	p.stats.downstreamSessTotal.Inc()
+	p.stats.downstreamSessActive.Inc()
+	upstreamCluster.Stats.UpstreamCxTotal.Inc()
+	upstreamCluster.Stats.UpstreamCxActive.Inc()
+	go s.reply(session)
+	return session
+}
+
+// reply sends the datagrams the endpoint sends back to the client, until the
+// session is closed.
+func (s *udpSessions) reply(session *udpSession) {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, err := session.upstream.Read(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				networkLog.Debugf("udp_proxy: reading from %s: %v", session.endpoint, err)
+				s.close(session)
+			}
+			return
+		}
+		session.idleTimer.Reset(session.proxy.idleTimeout)
+		if _, err := s.conn.WriteTo(buf[:n], session.downstream); err != nil {
+			session.proxy.stats.downstreamSessTxErrors.Inc()
+			networkLog.Debugf("udp_proxy: sending to %s: %v", session.downstream, err)
+			continue
+		}
+		session.proxy.stats.downstreamSessTxDatagrams.Inc()
+		session.proxy.stats.downstreamSessTxBytes.Add(float64(n))
+	}
+}
+
+func (s *udpSessions) close(session *udpSession) {
+	session.closeOnce.Do(func() {
+		s.mu.Lock()
+		if s.sessions[session.downstream.String()] == session {
+			delete(s.sessions, session.downstream.String())
+		}
+		s.mu.Unlock()
+
+		session.idleTimer.Stop()
+		session.upstream.Close()
+		session.cluster.LoadBalancer.Release(session.endpoint)
+		session.cluster.Stats.UpstreamCxActive.Dec()
+		session.proxy.stats.downstreamSessActive.Dec()
+	})
+}
+
+func (s *udpSessions) closeAll() {
+	s.mu.Lock()
+	sessions := make([]*udpSession, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	s.mu.Unlock()
+	for _, session := range sessions {
+		s.close(session)
+	}
+}
+
+// sourceIP returns the IP of addr without its port.
+func sourceIP(addr net.Addr) string {
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		return udpAddr.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,199 @@
+package filters
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// pathTemplate is the path of a google.api.http rule, such as
+// "/v1/{name=shelves/*/books/*}:publish". Its segments are literals, "*" for
+// any one segment or "**" for the rest of the path, and variables name the
+// fields of the request message that the segments they cover go into.
+type pathTemplate struct {
+	segments  []string
+	variables []pathVariable
+	verb      string
+}
+
+type pathVariable struct {
+	fieldPath []string
+	// start and end are the segments the variable covers.
+	start, end int
+}
+
+// parsePathTemplate parses a path template, whose grammar is that of
+// google/api/http.proto.
+func parsePathTemplate(template string) (*pathTemplate, error) {
+	if !strings.HasPrefix(template, "/") {
+		return nil, fmt.Errorf("path template %q must start with /", template)
+	}
+	p := &pathTemplateParser{s: template, i: 1}
+	t := &pathTemplate{}
+	if err := p.segments(t, false); err != nil {
+		return nil, fmt.Errorf("path template %q: %v", template, err)
+	}
+	if p.peek() == ':' {
+		p.i++
+		t.verb = p.literal()
+		if t.verb == "" {
+			return nil, fmt.Errorf("path template %q: empty verb", template)
+		}
+	}
+	if p.i != len(p.s) {
+		return nil, fmt.Errorf("path template %q: unexpected %q at %d", template, p.s[p.i], p.i)
+	}
+	for i, segment := range t.segments {
+		if segment == "**" && i != len(t.segments)-1 {
+			return nil, fmt.Errorf("path template %q: ** must be the last segment", template)
+		}
+	}
+	return t, nil
+}
+
+type pathTemplateParser struct {
+	s string
+	i int
+}
+
+func (p *pathTemplateParser) peek() byte {
+	if p.i < len(p.s) {
+		return p.s[p.i]
+	}
+	return 0
+}
+
+// literal reads up to the next character with a meaning in templates.
+func (p *pathTemplateParser) literal() string {
+	start := p.i
+	for p.i < len(p.s) && !strings.ContainsRune("/{}=:*", rune(p.s[p.i])) {
+		p.i++
+	}
+	return p.s[start:p.i]
+}
+
+// segments reads "/"-separated segments into t, stopping at a verb or, in a
+// variable, at its closing brace.
+func (p *pathTemplateParser) segments(t *pathTemplate, inVariable bool) error {
+	for {
+		switch {
+		case strings.HasPrefix(p.s[p.i:], "**"):
+			p.i += 2
+			t.segments = append(t.segments, "**")
+		case p.peek() == '*':
+			p.i++
+			t.segments = append(t.segments, "*")
+		case p.peek() == '{':
+			if inVariable {
+				return errors.New("variables cannot be nested")
+			}
+			if err := p.variable(t); err != nil {
+				return err
+			}
+		default:
+			literal := p.literal()
+			if literal == "" {
+				return fmt.Errorf("empty segment at %d", p.i)
+			}
+			t.segments = append(t.segments, literal)
+		}
+		if p.peek() != '/' {
+			return nil
+		}
+		p.i++
+	}
+}
+
+// variable reads "{field.path}" or "{field.path=segments}".
+func (p *pathTemplateParser) variable(t *pathTemplate) error {
+	p.i++
+	fieldPath := p.literal()
+	if fieldPath == "" {
+		return fmt.Errorf("variable without a field path at %d", p.i)
+	}
+	v := pathVariable{fieldPath: strings.Split(fieldPath, "."), start: len(t.segments)}
+	if p.peek() == '=' {
+		p.i++
+		if err := p.segments(t, true); err != nil {
+			return err
+		}
+	} else {
+		t.segments = append(t.segments, "*")
+	}
+	if p.peek() != '}' {
+		return fmt.Errorf("unterminated variable %q", fieldPath)
+	}
+	p.i++
+	v.end = len(t.segments)
+	t.variables = append(t.variables, v)
+	return nil
+}
+
+// literals counts the literal segments and verb, by which the most specific
+// of several matching templates is picked.
+func (t *pathTemplate) literals() int {
+	n := 0
+	for _, segment := range t.segments {
+		if segment != "*" && segment != "**" {
+			n++
+		}
+	}
+	if t.verb != "" {
+		n++
+	}
+	return n
+}
+
+// match matches an escaped request path, returning the unescaped value of
+// each variable.
+func (t *pathTemplate) match(path string) ([]string, bool) {
+	if t.verb != "" {
+		var ok bool
+		if path, ok = strings.CutSuffix(path, ":"+t.verb); !ok {
+			return nil, false
+		}
+	}
+	if !strings.HasPrefix(path, "/") {
+		return nil, false
+	}
+	parts := strings.Split(path[1:], "/")
+	// starts[i] is the part segment i matched first, for the variables.
+	starts := make([]int, len(t.segments)+1)
+	j := 0
+	for i, segment := range t.segments {
+		starts[i] = j
+		switch segment {
+		case "**":
+			j = len(parts)
+		case "*":
+			if j == len(parts) || parts[j] == "" {
+				return nil, false
+			}
+			j++
+		default:
+			if j == len(parts) || parts[j] != segment {
+				return nil, false
+			}
+			j++
+		}
+	}
+	starts[len(t.segments)] = j
+	if j != len(parts) {
+		return nil, false
+	}
+
+	values := make([]string, len(t.variables))
+	for i, v := range t.variables {
+		matched := parts[starts[v.start]:starts[v.end]]
+		unescaped := make([]string, len(matched))
+		for k, part := range matched {
+			var err error
+			if unescaped[k], err = url.PathUnescape(part); err != nil {
+				return nil, false
+			}
+		}
+		values[i] = strings.Join(unescaped, "/")
+	}
+	return values, true
+}
@@ -0,0 +1,77 @@
+package filters
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"seateam/config"
+)
+
+// Factory builds the filters registered under one Envoy filter name.
+type Factory interface {
+	// NewFilterFactory checks an http_filters entry's typed_config and
+	// returns what creates the filter for each request.
+	NewFilterFactory(typedConfig config.TypedConfig) (func() StreamFilter, error)
+	// ParseRouteConfig checks a typed_per_filter_config entry, returning
+	// the value the filter gets back from Callbacks.PerRouteConfig.
+	ParseRouteConfig(typedConfig config.TypedConfig) (interface{}, error)
+}
+
+var (
+	mu        sync.RWMutex
+	factories = make(map[string]Factory)
+)
+
+// Register makes factory the implementation of the HTTP filter called name,
+// such as "envoy.filters.http.buffer", and has configs naming it checked by
+// config.Validate.
+func Register(name string, factory Factory) {
+	mu.Lock()
+	factories[name] = factory
+	mu.Unlock()
+
+	config.RegisterHTTPFilter(name, config.HTTPFilterCheck{
+		Config: func(typedConfig config.TypedConfig) error {
+			_, err := factory.NewFilterFactory(typedConfig)
+			return err
+		},
+		RouteConfig: func(typedConfig config.TypedConfig) error {
+			_, err := factory.ParseRouteConfig(typedConfig)
+			return err
+		},
+	})
+}
+
+func lookup(name string) (Factory, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	factory, ok := factories[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown http filter %q", name)
+	}
+	return factory, nil
+}
+
+// errNoRouteConfig is returned by filters that take no per-route config.
+var errNoRouteConfig = errors.New("has no per-route config")
+
+// routerFactory stands in for the router filter, which the chain hands
+// requests to once every other filter has let them through.
+type routerFactory struct{}
+
+func (routerFactory) NewFilterFactory(typedConfig config.TypedConfig) (func() StreamFilter, error) {
+	return nil, nil
+}
+
+func (routerFactory) ParseRouteConfig(typedConfig config.TypedConfig) (interface{}, error) {
+	return nil, errNoRouteConfig
+}
+
+func init() {
+	Register(config.RouterFilter, routerFactory{})
+	Register(BufferFilter, bufferFactory{})
+	Register(GrpcWebFilter, grpcWebFactory{})
+	Register(CorsFilter, corsFactory{})
+	Register(GrpcJsonTranscoderFilter, transcoderFactory{})
+}
@@ -0,0 +1,769 @@
+package filters
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"seateam/config"
+	"seateam/grpc"
+)
+
+// maxUpstreamBuffer is how much request body may wait for the router to read
+// it before the chain stops reading from downstream.
+const maxUpstreamBuffer = 1 << 20
+
+// errStreamReset is what the router reads from the request body, and gets
+// writing the response, once the stream has ended without it.
+var errStreamReset = errors.New("stream reset")
+
+type direction int
+
+const (
+	decoding direction = iota
+	encoding
+)
+
+type eventKind int
+
+const (
+	headersEvent eventKind = iota
+	dataEvent
+	trailersEvent
+)
+
+// event is one step of a request or response. The headers and trailers
+// themselves live on the stream.
+type event struct {
+	kind      eventKind
+	data      *bytes.Buffer
+	endStream bool
+}
+
+// iteration is how far each filter has let a request or response through.
+// Positions count filters in the order they see events: the configured order
+// when decoding and the reverse when encoding.
+type iteration struct {
+	stopped []bool
+	held    [][]event
+}
+
+func newIteration(n int) *iteration {
+	return &iteration{stopped: make([]bool, n), held: make([][]event, n)}
+}
+
+// hold keeps ev at position until the filter there continues, merging data
+// that follows data.
+func (it *iteration) hold(position int, ev event) {
+	held := it.held[position]
+	if last := len(held) - 1; ev.kind == dataEvent && last >= 0 && held[last].kind == dataEvent {
+		held[last].data.Write(ev.data.Bytes())
+		held[last].endStream = ev.endStream
+		return
+	}
+	it.held[position] = append(held, ev)
+}
+
+// stream is one request on its way through a chain.
+type stream struct {
+	chain       *Chain
+	w           http.ResponseWriter
+	virtualHost *config.VirtualHost
+	route       *config.Route
+	terminal    http.Handler
+	// filters has a nil entry for each filter disabled on the route.
+	filters []StreamFilter
+
+	// downstream is done when the client goes away. ctx, which the router
+	// gets, is also cancelled by a local reply.
+	downstream        context.Context
+	downstreamTrailer http.Header
+	ctx               context.Context
+	cancel            context.CancelFunc
+	body              *bodyPipe
+
+	// mu is held while filters run and guards everything below, so
+	// callbacks for one stream never run concurrently.
+	mu               sync.Mutex
+	request          *http.Request
+	requestTrailers  http.Header
+	response         *ResponseHeaders
+	responseTrailers http.Header
+	// iterations is replaced for encoding when a local reply takes over
+	// the response.
+	iterations [2]*iteration
+	// added is the data filters have added in each direction while
+	// handling the event being delivered.
+	added        [2]*bytes.Buffer
+	terminalDone chan struct{}
+	// decodingDone stops the request once a local reply has been sent.
+	decodingDone bool
+	// discardTerminal drops what the router writes after a local reply.
+	discardTerminal bool
+	responseStarted bool
+	finished        bool
+	aborted         bool
+	done            chan struct{}
+
+	// pending holds what filters ask for while one of them is running, to
+	// be done as soon as it returns.
+	pendingMu   sync.Mutex
+	dispatching int
+	pending     []func()
+}
+
+func newStream(c *Chain, w http.ResponseWriter, r *http.Request, virtualHost *config.VirtualHost, route *config.Route, terminal http.Handler) *stream {
+	s := &stream{
+		chain:       c,
+		w:           w,
+		virtualHost: virtualHost,
+		route:       route,
+		terminal:    terminal,
+		filters:     make([]StreamFilter, len(c.filters)),
+		body:        newBodyPipe(),
+		iterations:  [2]*iteration{newIteration(len(c.filters)), newIteration(len(c.filters))},
+		done:        make(chan struct{}),
+	}
+	s.downstream = r.Context()
+	s.downstreamTrailer = r.Trailer
+	s.ctx, s.cancel = context.WithCancel(r.Context())
+	s.request = r.Clone(s.ctx)
+	s.request.Trailer = make(http.Header, len(r.Trailer))
+	for key := range r.Trailer {
+		s.request.Trailer[key] = nil
+	}
+
+	for i, f := range c.filters {
+		if routeConfig, ok := c.routeConfig(virtualHost, route, f.name); ok && routeConfig.disabled {
+			continue
+		}
+		s.filters[i] = f.newFilter()
+		s.filters[i].SetCallbacks(&callbacks{stream: s, index: i, name: f.name})
+	}
+	return s
+}
+
+// run decodes the request from downstream and waits for the response to be
+// encoded.
+func (s *stream) run() {
+	body, trailer := s.request.Body, s.downstreamTrailer
+	endStream := body == nil || body == http.NoBody
+	s.mu.Lock()
+	s.deliver(decoding, 0, event{kind: headersEvent, endStream: endStream})
+	s.mu.Unlock()
+	if !endStream {
+		s.readBody(body, trailer)
+	}
+
+	select {
+	case <-s.done:
+	case <-s.downstream.Done():
+	}
+	s.mu.Lock()
+	s.finish()
+	aborted, terminalDone := s.aborted, s.terminalDone
+	s.mu.Unlock()
+
+	s.cancel()
+	if terminalDone != nil {
+		<-terminalDone
+	}
+	if aborted {
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func (s *stream) readBody(downstreamBody io.Reader, trailer http.Header) {
+	buf := make([]byte, 32*1024)
+	for {
+		s.body.waitBelow(maxUpstreamBuffer)
+
+		n, err := downstreamBody.Read(buf)
+		s.mu.Lock()
+		if s.finished || s.decodingDone {
+			s.mu.Unlock()
+			return
+		}
+		if n > 0 {
+			s.deliver(decoding, 0, event{kind: dataEvent, data: bytes.NewBuffer(bytes.Clone(buf[:n]))})
+		}
+		switch {
+		case err == io.EOF && hasValues(trailer):
+			s.requestTrailers = trailer.Clone()
+			s.deliver(decoding, 0, event{kind: trailersEvent, endStream: true})
+		case err == io.EOF:
+			s.deliver(decoding, 0, event{kind: dataEvent, data: new(bytes.Buffer), endStream: true})
+		case err != nil:
+			filterLog.Debugf("reading request body: %v", err)
+			s.finish()
+		}
+		s.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func hasValues(header http.Header) bool {
+	for _, values := range header {
+		if len(values) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// filterAt returns the filter at position when going in direction d.
+func (s *stream) filterAt(d direction, position int) StreamFilter {
+	if d == encoding {
+		return s.filters[len(s.filters)-1-position]
+	}
+	return s.filters[position]
+}
+
+// deliver hands ev to the filter at position and on down the chain for as
+// long as the filters continue. s.mu must be held.
+func (s *stream) deliver(d direction, position int, ev event) {
+	it := s.iterations[d]
+	for ; position < len(s.filters); position++ {
+		if s.ended(d, it) {
+			return
+		}
+		f := s.filterAt(d, position)
+		if f == nil {
+			continue
+		}
+
+		status := s.invoke(d, f, ev)
+		before, after := s.takeAdded(d, &ev)
+		wasStopped := it.stopped[position]
+		switch {
+		case status == StopIterationNoBuffer && ev.kind == dataEvent:
+		case status != Continue || wasStopped:
+			if before != nil {
+				it.hold(position, *before)
+			}
+			it.hold(position, ev)
+			if after != nil {
+				it.hold(position, *after)
+			}
+		}
+		if status != Continue {
+			it.stopped[position] = true
+		} else if wasStopped {
+			s.resume(d, position)
+		}
+		s.runPending()
+		if status != Continue || wasStopped {
+			return
+		}
+		if before != nil {
+			s.deliver(d, position+1, *before)
+		}
+		if after != nil {
+			defer s.deliver(d, position+1, *after)
+		}
+	}
+	if s.ended(d, it) {
+		return
+	}
+	s.sink(d, ev)
+}
+
+// ended reports whether events going through it in direction d are no longer
+// wanted, because the stream finished or a local reply replaced them.
+func (s *stream) ended(d direction, it *iteration) bool {
+	return s.finished || s.iterations[d] != it || (d == decoding && s.decodingDone)
+}
+
+// resume hands on everything the filter at position held back. s.mu must be
+// held.
+func (s *stream) resume(d direction, position int) {
+	it := s.iterations[d]
+	it.stopped[position] = false
+	held := it.held[position]
+	it.held[position] = nil
+	for _, ev := range held {
+		if s.ended(d, it) {
+			return
+		}
+		s.deliver(d, position+1, ev)
+	}
+}
+
+func (s *stream) invoke(d direction, f StreamFilter, ev event) Status {
+	s.pendingMu.Lock()
+	s.dispatching++
+	s.pendingMu.Unlock()
+	defer func() {
+		s.pendingMu.Lock()
+		s.dispatching--
+		s.pendingMu.Unlock()
+	}()
+
+	switch {
+	case d == decoding && ev.kind == headersEvent:
+		return f.DecodeHeaders(s.request, ev.endStream)
+	case d == decoding && ev.kind == dataEvent:
+		return f.DecodeData(ev.data, ev.endStream)
+	case d == decoding:
+		return f.DecodeTrailers(s.requestTrailers)
+	case ev.kind == headersEvent:
+		return f.EncodeHeaders(s.response, ev.endStream)
+	case ev.kind == dataEvent:
+		return f.EncodeData(ev.data, ev.endStream)
+	default:
+		return f.EncodeTrailers(s.responseTrailers)
+	}
+}
+
+// do runs action with s.mu held. Called from a filter callback, it runs as
+// soon as the callback returns instead.
+func (s *stream) do(action func()) {
+	s.pendingMu.Lock()
+	if s.dispatching > 0 {
+		s.pending = append(s.pending, action)
+		s.pendingMu.Unlock()
+		return
+	}
+	s.pendingMu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	action()
+	s.runPending()
+}
+
+// runPending does what filters asked for while they were running. s.mu must
+// be held.
+func (s *stream) runPending() {
+	for {
+		s.pendingMu.Lock()
+		if s.dispatching > 0 || len(s.pending) == 0 {
+			s.pendingMu.Unlock()
+			return
+		}
+		actions := s.pending
+		s.pending = nil
+		s.pendingMu.Unlock()
+		for _, action := range actions {
+			action()
+		}
+	}
+}
+
+// continueIteration resumes the filter at index. Called from one of the
+// filter's callbacks, it takes effect once the filter has stopped.
+func (s *stream) continueIteration(d direction, index int) {
+	s.do(func() {
+		position := index
+		if d == encoding {
+			position = len(s.filters) - 1 - index
+		}
+		if !s.finished && s.iterations[d].stopped[position] {
+			s.resume(d, position)
+		}
+	})
+}
+
+// sink takes an event that has passed every filter: requests go to the
+// router and responses downstream. s.mu must be held.
+func (s *stream) sink(d direction, ev event) {
+	if d == decoding {
+		switch ev.kind {
+		case headersEvent:
+			s.startTerminal(ev.endStream)
+		case dataEvent:
+			s.body.write(ev.data.Bytes())
+			if ev.endStream {
+				s.body.closeWrite(nil, nil)
+			}
+		case trailersEvent:
+			s.body.closeWrite(s.request.Trailer, s.requestTrailers)
+		}
+		return
+	}
+
+	switch ev.kind {
+	case headersEvent:
+		header := s.w.Header()
+		for key, values := range s.response.Header {
+			header[key] = values
+		}
+		s.responseStarted = true
+		s.w.WriteHeader(s.response.Status)
+		// A streamed response, such as gRPC's, may have a client waiting
+		// for its headers before it sends more of the request.
+		if !ev.endStream && header.Get("Content-Length") == "" {
+			http.NewResponseController(s.w).Flush()
+		}
+	case dataEvent:
+		if ev.data.Len() > 0 {
+			if _, err := s.w.Write(ev.data.Bytes()); err != nil {
+				filterLog.Debugf("writing response body: %v", err)
+				s.finish()
+				return
+			}
+			http.NewResponseController(s.w).Flush()
+		}
+	case trailersEvent:
+		header := s.w.Header()
+		for key, values := range s.responseTrailers {
+			header[http.TrailerPrefix+key] = values
+		}
+	}
+	if ev.endStream {
+		s.finish()
+	}
+}
+
+// startTerminal hands the request to the router. s.mu must be held.
+func (s *stream) startTerminal(endStream bool) {
+	request := s.request
+	if endStream {
+		request.Body = http.NoBody
+	} else {
+		request.Body = s.body
+	}
+	s.terminalDone = make(chan struct{})
+	go func() {
+		defer close(s.terminalDone)
+		w := &terminalWriter{stream: s, header: make(http.Header)}
+		s.terminal.ServeHTTP(w, request)
+		s.body.Close()
+		w.end()
+	}()
+}
+
+// sendLocalReply answers the request on behalf of the filter at index, with
+// the filters before it encoding the reply. s.mu must be held.
+func (s *stream) sendLocalReply(index int, status int, body string, header http.Header) {
+	if s.finished {
+		return
+	}
+	if s.responseStarted {
+		filterLog.Warnf("local reply %d after the response started, resetting the stream", status)
+		s.aborted = true
+		s.finish()
+		return
+	}
+
+	s.decodingDone = true
+	s.discardTerminal = true
+	s.cancel()
+	s.body.fail(errStreamReset)
+	s.iterations[encoding] = newIteration(len(s.filters))
+
+	header = header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	if grpc.IsGrpc(s.request.Header) {
+		// gRPC clients take the reply as the call's status.
+		grpc.SetStatus(header, grpc.CodeForHTTPStatus(status), body)
+		status, body = http.StatusOK, ""
+	}
+	if body != "" && header.Get("Content-Type") == "" {
+		header.Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	s.response = &ResponseHeaders{Status: status, Header: header}
+	s.responseTrailers = nil
+
+	position := len(s.filters) - index
+	s.deliver(encoding, position, event{kind: headersEvent, endStream: body == ""})
+	if body != "" {
+		s.deliver(encoding, position, event{kind: dataEvent, data: bytes.NewBufferString(body), endStream: true})
+	}
+}
+
+// addData keeps data a filter added in direction d while handling an event,
+// for deliver to hand on with it. s.mu must be held.
+func (s *stream) addData(d direction, data *bytes.Buffer) {
+	if s.added[d] == nil {
+		s.added[d] = new(bytes.Buffer)
+	}
+	s.added[d].Write(data.Bytes())
+}
+
+// takeAdded returns the data the filter that just handled ev added, as an
+// event to go before ev and one to go after it. Data added to headers that
+// end the stream becomes its body, data added to trailers goes ahead of them
+// and data added to data is appended to it.
+func (s *stream) takeAdded(d direction, ev *event) (before, after *event) {
+	data := s.added[d]
+	if data == nil {
+		return nil, nil
+	}
+	s.added[d] = nil
+	switch {
+	case ev.kind == headersEvent && ev.endStream:
+		ev.endStream = false
+		return nil, &event{kind: dataEvent, data: data, endStream: true}
+	case ev.kind == trailersEvent:
+		return &event{kind: dataEvent, data: data}, nil
+	case ev.kind == dataEvent:
+		ev.data.Write(data.Bytes())
+	}
+	return nil, nil
+}
+
+// finish ends the stream. s.mu must be held.
+func (s *stream) finish() {
+	if !s.finished {
+		s.finished = true
+		s.body.fail(errStreamReset)
+		close(s.done)
+	}
+}
+
+// terminalWriter turns what the router writes into response events.
+type terminalWriter struct {
+	stream      *stream
+	header      http.Header
+	wroteHeader bool
+	// hijacked is set once the router takes over the downstream
+	// connection, leaving the filters out of the rest of the exchange.
+	hijacked bool
+}
+
+func (w *terminalWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *terminalWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader || statusCode < 200 {
+		return
+	}
+	w.wroteHeader = true
+
+	header := w.header.Clone()
+	for key := range header {
+		if strings.HasPrefix(key, http.TrailerPrefix) {
+			delete(header, key)
+		}
+	}
+	w.encode(func(s *stream) {
+		s.response = &ResponseHeaders{Status: statusCode, Header: header}
+		s.deliver(encoding, 0, event{kind: headersEvent})
+	})
+}
+
+func (w *terminalWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	ok := w.encode(func(s *stream) {
+		s.deliver(encoding, 0, event{kind: dataEvent, data: bytes.NewBuffer(bytes.Clone(b))})
+	})
+	if !ok {
+		return 0, errStreamReset
+	}
+	return len(b), nil
+}
+
+// Flush does nothing: data is flushed downstream as soon as the filters let
+// it through.
+func (w *terminalWriter) Flush() {}
+
+// Hijack hands the downstream connection to the router, as long as no
+// response has been started for it.
+func (w *terminalWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	s := w.stream
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.finished || s.discardTerminal || s.responseStarted {
+		return nil, nil, errStreamReset
+	}
+	conn, brw, err := http.NewResponseController(s.w).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.hijacked = true
+	s.decodingDone = true
+	s.discardTerminal = true
+	return conn, brw, nil
+}
+
+// end finishes the response once the router returns.
+func (w *terminalWriter) end() {
+	if w.hijacked {
+		w.stream.mu.Lock()
+		w.stream.finish()
+		w.stream.mu.Unlock()
+		return
+	}
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	trailers := make(http.Header)
+	for _, declared := range w.header.Values("Trailer") {
+		for _, key := range strings.Split(declared, ",") {
+			key = strings.TrimSpace(key)
+			if values := w.header.Values(key); key != "" && len(values) > 0 {
+				trailers[http.CanonicalHeaderKey(key)] = values
+			}
+		}
+	}
+	for key, values := range w.header {
+		if name, ok := strings.CutPrefix(key, http.TrailerPrefix); ok {
+			trailers[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+
+	w.encode(func(s *stream) {
+		if len(trailers) > 0 {
+			s.responseTrailers = trailers
+			s.deliver(encoding, 0, event{kind: trailersEvent, endStream: true})
+			return
+		}
+		s.deliver(encoding, 0, event{kind: dataEvent, data: new(bytes.Buffer), endStream: true})
+	})
+}
+
+// encode runs deliver for the router's response, reporting false once the
+// response is no longer wanted.
+func (w *terminalWriter) encode(deliver func(s *stream)) bool {
+	s := w.stream
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.finished || s.discardTerminal {
+		return false
+	}
+	deliver(s)
+	return true
+}
+
+// callbacks are what a filter is given to act on its stream.
+type callbacks struct {
+	stream *stream
+	index  int
+	name   string
+}
+
+func (c *callbacks) Route() *config.Route {
+	return c.stream.route
+}
+
+func (c *callbacks) PerRouteConfig() interface{} {
+	routeConfig, _ := c.stream.chain.routeConfig(c.stream.virtualHost, c.stream.route, c.name)
+	return routeConfig.config
+}
+
+func (c *callbacks) SendLocalReply(status int, body string, header http.Header) {
+	c.stream.do(func() {
+		c.stream.sendLocalReply(c.index, status, body, header)
+	})
+}
+
+func (c *callbacks) AddDecodedData(data *bytes.Buffer) {
+	c.stream.addData(decoding, data)
+}
+
+func (c *callbacks) AddEncodedData(data *bytes.Buffer) {
+	c.stream.addData(encoding, data)
+}
+
+func (c *callbacks) ContinueDecoding() {
+	c.stream.continueIteration(decoding, c.index)
+}
+
+func (c *callbacks) ContinueEncoding() {
+	c.stream.continueIteration(encoding, c.index)
+}
+
+// bodyPipe carries the request body from the chain to the router. Writes
+// never block, so the chain can write while holding the stream lock; the
+// chain waits with waitBelow before reading more from downstream instead.
+type bodyPipe struct {
+	mu     sync.Mutex
+	cond   sync.Cond
+	buf    bytes.Buffer
+	closed bool
+	err    error
+	// readerClosed is set once the router is done with the body.
+	readerClosed bool
+}
+
+func newBodyPipe() *bodyPipe {
+	p := &bodyPipe{}
+	p.cond.L = &p.mu
+	return p
+}
+
+func (p *bodyPipe) Read(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.buf.Len() == 0 && !p.closed && p.err == nil {
+		p.cond.Wait()
+	}
+	if p.buf.Len() > 0 {
+		n, _ := p.buf.Read(b)
+		p.cond.Broadcast()
+		return n, nil
+	}
+	if p.err != nil {
+		return 0, p.err
+	}
+	return 0, io.EOF
+}
+
+func (p *bodyPipe) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.readerClosed = true
+	p.buf.Reset()
+	p.cond.Broadcast()
+	return nil
+}
+
+func (p *bodyPipe) write(b []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.readerClosed && !p.closed && p.err == nil {
+		p.buf.Write(b)
+		p.cond.Broadcast()
+	}
+}
+
+// closeWrite ends the body, first copying trailers into the request's
+// Trailer for the router to read once it reaches the end.
+func (p *bodyPipe) closeWrite(requestTrailer, trailers http.Header) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, values := range trailers {
+		requestTrailer[key] = values
+	}
+	p.closed = true
+	p.cond.Broadcast()
+}
+
+// fail makes reads return err once the buffered body is drained, unless the
+// body has already ended.
+func (p *bodyPipe) fail(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.closed && p.err == nil {
+		p.err = err
+		p.cond.Broadcast()
+	}
+}
+
+// waitBelow blocks until less than n bytes are waiting to be read.
+func (p *bodyPipe) waitBelow(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.buf.Len() >= n && !p.readerClosed && p.err == nil {
+		p.cond.Wait()
+	}
+}
@@ -0,0 +1,699 @@
+package filters
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"google.golang.org/genproto/googleapis/api/annotations"
+	statuspb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	"seateam/config"
+	"seateam/grpc"
+)
+
+// GrpcJsonTranscoderFilter turns REST requests with JSON bodies into calls of
+// the gRPC methods they map to with google.api.http annotations, read from a
+// protobuf descriptor set, and the gRPC responses back into JSON. Requests
+// that map to no method pass through untouched.
+const GrpcJsonTranscoderFilter = "envoy.filters.http.grpc_json_transcoder"
+
+type transcoderConfig struct {
+	// ProtoDescriptor is the path of a FileDescriptorSet, as written by
+	// protoc --include_imports --descriptor_set_out, and
+	// ProtoDescriptorBin the set itself, base64-encoded. Exactly one is
+	// required.
+	ProtoDescriptor    string `yaml:"proto_descriptor,omitempty"`
+	ProtoDescriptorBin string `yaml:"proto_descriptor_bin,omitempty"`
+	// Services are the fully qualified names of the services transcoded.
+	Services     []string               `yaml:"services"`
+	PrintOptions transcoderPrintOptions `yaml:"print_options,omitempty"`
+	// AutoMapping also maps POST /package.Service/Method, with the request
+	// message as the body, for methods without annotations.
+	AutoMapping bool `yaml:"auto_mapping,omitempty"`
+	// IgnoredQueryParameters are left out of the request message. Any
+	// other query parameter naming no field fails the request, unless
+	// IgnoreUnknownQueryParameters is set.
+	IgnoredQueryParameters       []string `yaml:"ignored_query_parameters,omitempty"`
+	IgnoreUnknownQueryParameters bool     `yaml:"ignore_unknown_query_parameters,omitempty"`
+	// ConvertGrpcStatus adds the details of grpc-status-details-bin to the
+	// JSON of errors, which otherwise only has their code and message.
+	ConvertGrpcStatus bool `yaml:"convert_grpc_status,omitempty"`
+}
+
+type transcoderPrintOptions struct {
+	AddWhitespace              bool `yaml:"add_whitespace,omitempty"`
+	AlwaysPrintPrimitiveFields bool `yaml:"always_print_primitive_fields,omitempty"`
+	AlwaysPrintEnumsAsInts     bool `yaml:"always_print_enums_as_ints,omitempty"`
+	PreserveProtoFieldNames    bool `yaml:"preserve_proto_field_names,omitempty"`
+	// StreamNewlineDelimited sends the messages of server streaming
+	// methods one per line rather than as a JSON array.
+	StreamNewlineDelimited bool `yaml:"stream_newline_delimited,omitempty"`
+}
+
+type transcoderFactory struct{}
+
+func (transcoderFactory) NewFilterFactory(typedConfig config.TypedConfig) (func() StreamFilter, error) {
+	var c transcoderConfig
+	if err := typedConfig.Decode(&c); err != nil {
+		return nil, err
+	}
+	t, err := newTranscoder(c)
+	if err != nil {
+		return nil, err
+	}
+	return func() StreamFilter { return &transcoderFilter{transcoder: t} }, nil
+}
+
+func (transcoderFactory) ParseRouteConfig(typedConfig config.TypedConfig) (interface{}, error) {
+	return nil, errNoRouteConfig
+}
+
+// transcoder is what a transcoderConfig is turned into once, for every
+// request of the filter.
+type transcoder struct {
+	config    transcoderConfig
+	types     *dynamicpb.Types
+	bindings  []httpBinding
+	methods   map[string]protoreflect.MethodDescriptor
+	ignored   map[string]bool
+	marshal   protojson.MarshalOptions
+	unmarshal protojson.UnmarshalOptions
+}
+
+// httpBinding is one HTTP method and path template a gRPC method is mapped
+// to.
+type httpBinding struct {
+	method     protoreflect.MethodDescriptor
+	httpMethod string
+	path       *pathTemplate
+	// body is the request field the JSON body goes into, "*" for the
+	// whole message or "" for none. responseBody is the response field
+	// sent back, "" for the whole message.
+	body, responseBody string
+}
+
+func newTranscoder(c transcoderConfig) (*transcoder, error) {
+	files, err := loadDescriptorSet(c)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.Services) == 0 {
+		return nil, errors.New("services is required")
+	}
+	t := &transcoder{
+		config:  c,
+		types:   dynamicpb.NewTypes(files),
+		methods: make(map[string]protoreflect.MethodDescriptor),
+		ignored: make(map[string]bool),
+	}
+	for _, name := range c.IgnoredQueryParameters {
+		t.ignored[name] = true
+	}
+	t.marshal = protojson.MarshalOptions{
+		EmitUnpopulated: c.PrintOptions.AlwaysPrintPrimitiveFields,
+		UseEnumNumbers:  c.PrintOptions.AlwaysPrintEnumsAsInts,
+		UseProtoNames:   c.PrintOptions.PreserveProtoFieldNames,
+		Resolver:        t.types,
+	}
+	if c.PrintOptions.AddWhitespace {
+		t.marshal.Multiline, t.marshal.Indent = true, "  "
+	}
+	t.unmarshal = protojson.UnmarshalOptions{Resolver: t.types}
+
+	for _, name := range c.Services {
+		descriptor, err := files.FindDescriptorByName(protoreflect.FullName(name))
+		if err != nil {
+			return nil, fmt.Errorf("service %q is not in the descriptor set", name)
+		}
+		service, ok := descriptor.(protoreflect.ServiceDescriptor)
+		if !ok {
+			return nil, fmt.Errorf("%q is not a service", name)
+		}
+		methods := service.Methods()
+		for i := 0; i < methods.Len(); i++ {
+			if err := t.addMethod(methods.Get(i)); err != nil {
+				return nil, fmt.Errorf("method %s: %v", methods.Get(i).FullName(), err)
+			}
+		}
+	}
+	return t, nil
+}
+
+func loadDescriptorSet(c transcoderConfig) (*protoregistry.Files, error) {
+	var data []byte
+	var err error
+	switch {
+	case (c.ProtoDescriptor == "") == (c.ProtoDescriptorBin == ""):
+		return nil, errors.New("exactly one of proto_descriptor and proto_descriptor_bin is required")
+	case c.ProtoDescriptor != "":
+		data, err = os.ReadFile(c.ProtoDescriptor)
+	default:
+		data, err = base64.StdEncoding.DecodeString(c.ProtoDescriptorBin)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading the descriptor set: %v", err)
+	}
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("parsing the descriptor set: %v", err)
+	}
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, fmt.Errorf("parsing the descriptor set: %v", err)
+	}
+	return files, nil
+}
+
+// addMethod adds the bindings of a method's google.api.http rule. Methods
+// streaming their requests are not transcoded.
+func (t *transcoder) addMethod(method protoreflect.MethodDescriptor) error {
+	if method.IsStreamingClient() {
+		return nil
+	}
+	t.methods["/"+string(method.Parent().FullName())+"/"+string(method.Name())] = method
+
+	options, ok := method.Options().(*descriptorpb.MethodOptions)
+	if !ok || !proto.HasExtension(options, annotations.E_Http) {
+		return nil
+	}
+	rule := proto.GetExtension(options, annotations.E_Http).(*annotations.HttpRule)
+	if err := t.addRule(method, rule); err != nil {
+		return err
+	}
+	for _, additional := range rule.GetAdditionalBindings() {
+		if err := t.addRule(method, additional); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *transcoder) addRule(method protoreflect.MethodDescriptor, rule *annotations.HttpRule) error {
+	b := httpBinding{method: method, body: rule.GetBody(), responseBody: rule.GetResponseBody()}
+	var path string
+	switch pattern := rule.GetPattern().(type) {
+	case *annotations.HttpRule_Get:
+		b.httpMethod, path = http.MethodGet, pattern.Get
+	case *annotations.HttpRule_Put:
+		b.httpMethod, path = http.MethodPut, pattern.Put
+	case *annotations.HttpRule_Post:
+		b.httpMethod, path = http.MethodPost, pattern.Post
+	case *annotations.HttpRule_Delete:
+		b.httpMethod, path = http.MethodDelete, pattern.Delete
+	case *annotations.HttpRule_Patch:
+		b.httpMethod, path = http.MethodPatch, pattern.Patch
+	case *annotations.HttpRule_Custom:
+		b.httpMethod, path = pattern.Custom.GetKind(), pattern.Custom.GetPath()
+	default:
+		return errors.New("google.api.http rule has no pattern")
+	}
+	var err error
+	if b.path, err = parsePathTemplate(path); err != nil {
+		return err
+	}
+	if b.body != "" && b.body != "*" && method.Input().Fields().ByName(protoreflect.Name(b.body)) == nil {
+		return fmt.Errorf("body field %q is not in %s", b.body, method.Input().FullName())
+	}
+	if b.responseBody != "" && method.Output().Fields().ByName(protoreflect.Name(b.responseBody)) == nil {
+		return fmt.Errorf("response_body field %q is not in %s", b.responseBody, method.Output().FullName())
+	}
+	for _, v := range b.path.variables {
+		if _, err := findFieldPath(method.Input(), v.fieldPath); err != nil {
+			return err
+		}
+	}
+	t.bindings = append(t.bindings, b)
+	return nil
+}
+
+// match returns the binding of a request, with the values of its path
+// variables, or nil if the request is not for a transcoded method.
+func (t *transcoder) match(r *http.Request) (*httpBinding, []string) {
+	path := r.URL.EscapedPath()
+	var best *httpBinding
+	var bestValues []string
+	for i := range t.bindings {
+		b := &t.bindings[i]
+		if b.httpMethod != r.Method {
+			continue
+		}
+		values, ok := b.path.match(path)
+		if ok && (best == nil || b.path.literals() > best.path.literals()) {
+			best, bestValues = b, values
+		}
+	}
+	if best == nil && t.config.AutoMapping && r.Method == http.MethodPost {
+		if method, ok := t.methods[path]; ok {
+			return &httpBinding{method: method, httpMethod: http.MethodPost, path: &pathTemplate{}, body: "*"}, nil
+		}
+	}
+	return best, bestValues
+}
+
+// findFieldPath returns the fields a dotted field path goes through.
+func findFieldPath(message protoreflect.MessageDescriptor, fieldPath []string) ([]protoreflect.FieldDescriptor, error) {
+	fields := make([]protoreflect.FieldDescriptor, len(fieldPath))
+	for i, name := range fieldPath {
+		if message == nil {
+			return nil, fmt.Errorf("%q is not a message field", strings.Join(fieldPath[:i], "."))
+		}
+		fd := message.Fields().ByName(protoreflect.Name(name))
+		if fd == nil {
+			fd = message.Fields().ByJSONName(name)
+		}
+		if fd == nil {
+			return nil, fmt.Errorf("%s has no field %q", message.FullName(), name)
+		}
+		if fd.IsMap() || fd.IsList() && i < len(fieldPath)-1 {
+			return nil, fmt.Errorf("field %q cannot be set from a path or query", name)
+		}
+		fields[i] = fd
+		message = fd.Message()
+	}
+	return fields, nil
+}
+
+// requestMessage builds the request message of b's method from the JSON
+// body, the path variables and the query parameters.
+func (t *transcoder) requestMessage(b *httpBinding, variables []string, r *http.Request, body []byte) (proto.Message, error) {
+	message := dynamicpb.NewMessage(b.method.Input())
+	switch {
+	case b.body == "*" && len(bytes.TrimSpace(body)) > 0:
+		if err := t.unmarshal.Unmarshal(body, message); err != nil {
+			return nil, fmt.Errorf("invalid JSON body: %v", err)
+		}
+	case b.body != "" && b.body != "*" && len(bytes.TrimSpace(body)) > 0:
+		fd := b.method.Input().Fields().ByName(protoreflect.Name(b.body))
+		wrapped := fmt.Sprintf("{%q:%s}", fd.JSONName(), body)
+		if err := t.unmarshal.Unmarshal([]byte(wrapped), message); err != nil {
+			return nil, fmt.Errorf("invalid JSON body: %v", err)
+		}
+	}
+
+	bound := make(map[string]bool)
+	for i, v := range b.path.variables {
+		if err := t.setField(message, v.fieldPath, []string{variables[i]}); err != nil {
+			return nil, err
+		}
+		bound[strings.Join(v.fieldPath, ".")] = true
+	}
+	if b.body == "*" {
+		return message, nil
+	}
+	for key, values := range r.URL.Query() {
+		if t.ignored[key] || bound[key] {
+			continue
+		}
+		if err := t.setField(message, strings.Split(key, "."), values); err != nil {
+			if t.config.IgnoreUnknownQueryParameters {
+				continue
+			}
+			return nil, fmt.Errorf("query parameter %q: %v", key, err)
+		}
+	}
+	return message, nil
+}
+
+// setField sets the field at fieldPath from the strings of a path variable or
+// query parameter, parsing them as protojson would parse JSON strings.
+func (t *transcoder) setField(message *dynamicpb.Message, fieldPath []string, values []string) error {
+	fields, err := findFieldPath(message.Descriptor(), fieldPath)
+	if err != nil {
+		return err
+	}
+	leaf := fields[len(fields)-1]
+	if leaf.Kind() == protoreflect.MessageKind && !isWellKnownScalar(leaf.Message()) {
+		return fmt.Errorf("message field %q cannot be set from a string", leaf.Name())
+	}
+	var value interface{}
+	if leaf.IsList() {
+		list := make([]json.RawMessage, len(values))
+		for i, v := range values {
+			list[i] = jsonScalar(leaf, v)
+		}
+		value = list
+	} else {
+		value = jsonScalar(leaf, values[len(values)-1])
+	}
+	for i := len(fields) - 1; i >= 0; i-- {
+		value = map[string]interface{}{fields[i].JSONName(): value}
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	parsed := dynamicpb.NewMessage(message.Descriptor())
+	if err := t.unmarshal.Unmarshal(data, parsed); err != nil {
+		return err
+	}
+	proto.Merge(message, parsed)
+	return nil
+}
+
+// isWellKnownScalar reports whether a message type is written as a single
+// JSON value that a string can hold, such as a Timestamp or an Int64Value.
+func isWellKnownScalar(message protoreflect.MessageDescriptor) bool {
+	switch message.FullName() {
+	case "google.protobuf.Timestamp", "google.protobuf.Duration", "google.protobuf.FieldMask",
+		"google.protobuf.DoubleValue", "google.protobuf.FloatValue",
+		"google.protobuf.Int64Value", "google.protobuf.UInt64Value",
+		"google.protobuf.Int32Value", "google.protobuf.UInt32Value",
+		"google.protobuf.BoolValue", "google.protobuf.StringValue", "google.protobuf.BytesValue":
+		return true
+	}
+	return false
+}
+
+// jsonScalar writes s as the JSON protojson expects for field: a literal for
+// booleans, a string for everything else, which numbers may also be.
+func jsonScalar(field protoreflect.FieldDescriptor, s string) json.RawMessage {
+	isBool := field.Kind() == protoreflect.BoolKind ||
+		field.Kind() == protoreflect.MessageKind && field.Message().FullName() == "google.protobuf.BoolValue"
+	if isBool && (s == "true" || s == "false") {
+		return json.RawMessage(s)
+	}
+	quoted, _ := json.Marshal(s)
+	return quoted
+}
+
+// transcoderFilter transcodes one request and its response. Unary responses
+// are held until their trailers, so errors get their own HTTP status; a
+// stream's headers are held until its first message.
+type transcoderFilter struct {
+	PassThroughFilter
+	transcoder *transcoder
+	binding    *httpBinding
+	variables  []string
+	request    *http.Request
+	body       bytes.Buffer
+
+	response *ResponseHeaders
+	// frames holds response body not yet a whole frame.
+	frames bytes.Buffer
+	// sent counts the stream's messages sent downstream.
+	sent int
+}
+
+func (f *transcoderFilter) DecodeHeaders(r *http.Request, endStream bool) Status {
+	f.binding, f.variables = f.transcoder.match(r)
+	if f.binding == nil {
+		return Continue
+	}
+	f.request = r
+	if !endStream {
+		return StopIteration
+	}
+	frame, ok := f.transcodeRequest()
+	if !ok {
+		return StopIteration
+	}
+	f.Callbacks.AddDecodedData(bytes.NewBuffer(frame))
+	return Continue
+}
+
+func (f *transcoderFilter) DecodeData(data *bytes.Buffer, endStream bool) Status {
+	if f.binding == nil {
+		return Continue
+	}
+	f.body.Write(data.Bytes())
+	data.Reset()
+	if !endStream {
+		return StopIterationNoBuffer
+	}
+	frame, ok := f.transcodeRequest()
+	if !ok {
+		return StopIterationNoBuffer
+	}
+	data.Write(frame)
+	return Continue
+}
+
+func (f *transcoderFilter) DecodeTrailers(trailers http.Header) Status {
+	if f.binding == nil {
+		return Continue
+	}
+	frame, ok := f.transcodeRequest()
+	if !ok {
+		return StopIteration
+	}
+	f.Callbacks.AddDecodedData(bytes.NewBuffer(frame))
+	return Continue
+}
+
+// transcodeRequest turns the request into a gRPC call and returns its body,
+// or answers it with a 400 if it does not fit the method.
+func (f *transcoderFilter) transcodeRequest() ([]byte, bool) {
+	message, err := f.transcoder.requestMessage(f.binding, f.variables, f.request, f.body.Bytes())
+	if err != nil {
+		f.binding = nil
+		f.Callbacks.SendLocalReply(http.StatusBadRequest, err.Error(), nil)
+		return nil, false
+	}
+	payload, err := proto.Marshal(message)
+	if err != nil {
+		f.binding = nil
+		f.Callbacks.SendLocalReply(http.StatusBadRequest, err.Error(), nil)
+		return nil, false
+	}
+	frame := grpc.AppendFrame(nil, 0, payload)
+
+	r, method := f.request, f.binding.method
+	r.Method = http.MethodPost
+	r.URL.Path = "/" + string(method.Parent().FullName()) + "/" + string(method.Name())
+	r.URL.RawPath, r.URL.RawQuery = "", ""
+	r.Header.Set("Content-Type", grpc.ContentType)
+	r.Header.Set("Te", "trailers")
+	r.Header.Set("Content-Length", strconv.Itoa(len(frame)))
+	r.ContentLength = int64(len(frame))
+	return frame, true
+}
+
+func (f *transcoderFilter) EncodeHeaders(h *ResponseHeaders, endStream bool) Status {
+	if f.binding == nil || !grpc.IsGrpc(h.Header) {
+		return Continue
+	}
+	f.response = h
+	if endStream {
+		// A trailers-only response: the status is in the headers.
+		if out := f.finish(h.Header); len(out) > 0 {
+			f.Callbacks.AddEncodedData(bytes.NewBuffer(out))
+		}
+		return Continue
+	}
+	return StopIteration
+}
+
+func (f *transcoderFilter) EncodeData(data *bytes.Buffer, endStream bool) Status {
+	if f.response == nil {
+		return Continue
+	}
+	f.frames.Write(data.Bytes())
+	data.Reset()
+	if endStream {
+		// The upstream ended without trailers; any status is in the
+		// headers.
+		data.Write(f.finish(f.response.Header))
+		return Continue
+	}
+	if !f.binding.method.IsStreamingServer() {
+		return StopIterationNoBuffer
+	}
+	out, err := f.streamMessages()
+	if err != nil {
+		f.fail(err)
+		return StopIterationNoBuffer
+	}
+	if len(out) == 0 {
+		return StopIterationNoBuffer
+	}
+	data.Write(out)
+	return Continue
+}
+
+func (f *transcoderFilter) EncodeTrailers(trailers http.Header) Status {
+	if f.response == nil {
+		return Continue
+	}
+	if out := f.finish(trailers); len(out) > 0 {
+		f.Callbacks.AddEncodedData(bytes.NewBuffer(out))
+	}
+	for key := range trailers {
+		delete(trailers, key)
+	}
+	return Continue
+}
+
+// streamMessages converts the whole messages received so far, setting the
+// response headers before the first.
+func (f *transcoderFilter) streamMessages() ([]byte, error) {
+	var out []byte
+	for {
+		message, ok, err := f.nextMessage()
+		if err != nil || !ok {
+			return out, err
+		}
+		if f.sent == 0 {
+			f.setJSONHeaders(http.StatusOK)
+		}
+		switch {
+		case f.transcoder.config.PrintOptions.StreamNewlineDelimited:
+			out = append(append(out, message...), '\n')
+		case f.sent == 0:
+			out = append(append(out, '['), message...)
+		default:
+			out = append(append(out, ','), message...)
+		}
+		f.sent++
+	}
+}
+
+// nextMessage takes the next whole message out of frames, as JSON.
+func (f *transcoderFilter) nextMessage() ([]byte, bool, error) {
+	flags, payload, n := grpc.ReadFrame(f.frames.Bytes())
+	if n == 0 {
+		return nil, false, nil
+	}
+	defer f.frames.Next(n)
+	if flags&grpc.FlagCompressed != 0 {
+		return nil, false, errors.New("compressed responses cannot be transcoded")
+	}
+	message := dynamicpb.NewMessage(f.binding.method.Output())
+	if err := proto.Unmarshal(payload, message); err != nil {
+		return nil, false, err
+	}
+	out, err := f.responseJSON(message)
+	return out, err == nil, err
+}
+
+// responseJSON writes message, or its response_body field, as JSON.
+func (f *transcoderFilter) responseJSON(message *dynamicpb.Message) ([]byte, error) {
+	if f.binding.responseBody == "" {
+		return f.transcoder.marshal.Marshal(message)
+	}
+	fd := message.Descriptor().Fields().ByName(protoreflect.Name(f.binding.responseBody))
+	only := dynamicpb.NewMessage(message.Descriptor())
+	if message.Has(fd) {
+		only.Set(fd, message.Get(fd))
+	}
+	data, err := f.transcoder.marshal.Marshal(only)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	name := fd.JSONName()
+	if f.transcoder.config.PrintOptions.PreserveProtoFieldNames {
+		name = string(fd.Name())
+	}
+	if value, ok := fields[name]; ok {
+		return value, nil
+	}
+	return []byte("null"), nil
+}
+
+// finish ends the response with the status in statusHeader and returns the
+// rest of the body.
+func (f *transcoderFilter) finish(statusHeader http.Header) []byte {
+	code := codes.Unknown
+	if value := statusHeader.Get(grpc.HeaderStatus); value != "" {
+		if n, err := strconv.Atoi(value); err == nil {
+			code = codes.Code(n)
+		}
+	}
+	if code != codes.OK {
+		if f.sent > 0 {
+			// The stream is already under way with a 200; all that is
+			// left is to cut it short.
+			f.fail(fmt.Errorf("stream failed with %v", code))
+			return nil
+		}
+		// statusHeader may be the response headers, which
+		// setJSONHeaders clears of the status.
+		out := f.errorJSON(code, statusHeader)
+		f.setJSONHeaders(grpc.HTTPStatusForCode(code))
+		return out
+	}
+
+	if f.binding.method.IsStreamingServer() {
+		out, err := f.streamMessages()
+		if err != nil {
+			f.fail(err)
+			return nil
+		}
+		switch {
+		case f.transcoder.config.PrintOptions.StreamNewlineDelimited:
+		case f.sent == 0:
+			out = append(out, "[]"...)
+		default:
+			out = append(out, ']')
+		}
+		if f.sent == 0 {
+			f.setJSONHeaders(http.StatusOK)
+		}
+		return out
+	}
+
+	out, ok, err := f.nextMessage()
+	if err == nil && !ok {
+		err = errors.New("upstream sent no response message")
+	}
+	if err != nil {
+		f.setJSONHeaders(http.StatusBadGateway)
+		return f.errorJSON(codes.Internal, http.Header{grpc.HeaderMessage: {err.Error()}})
+	}
+	f.setJSONHeaders(http.StatusOK)
+	f.response.Header.Set("Content-Length", strconv.Itoa(len(out)))
+	return out
+}
+
+// fail resets a response that cannot be transcoded after it started.
+func (f *transcoderFilter) fail(err error) {
+	filterLog.Warnf("transcoding the response of %s: %v", f.binding.method.FullName(), err)
+	f.response = nil
+	f.Callbacks.SendLocalReply(http.StatusBadGateway, err.Error(), nil)
+}
+
+func (f *transcoderFilter) setJSONHeaders(status int) {
+	h := f.response.Header
+	f.response.Status = status
+	h.Set("Content-Type", "application/json")
+	for _, key := range []string{"Content-Length", grpc.HeaderStatus, grpc.HeaderMessage, "Grpc-Status-Details-Bin"} {
+		h.Del(key)
+	}
+}
+
+// errorJSON writes a failed call's status as a google.rpc.Status.
+func (f *transcoderFilter) errorJSON(code codes.Code, statusHeader http.Header) []byte {
+	status := &statuspb.Status{Code: int32(code), Message: grpc.DecodeMessage(statusHeader.Get(grpc.HeaderMessage))}
+	if details := statusHeader.Get("Grpc-Status-Details-Bin"); details != "" && f.transcoder.config.ConvertGrpcStatus {
+		data, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(details, "="))
+		var detailed statuspb.Status
+		if err == nil && proto.Unmarshal(data, &detailed) == nil {
+			status = &detailed
+		}
+	}
+	out, err := f.transcoder.marshal.Marshal(status)
+	if err != nil {
+		// Details of types the descriptor set lacks cannot be written.
+		status.Details = nil
+		out, _ = f.transcoder.marshal.Marshal(status)
+	}
+	return out
+}
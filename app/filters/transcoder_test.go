@@ -0,0 +1,291 @@
+package filters
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	"seateam/config"
+	"seateam/grpc"
+)
+
+func TestPathTemplate(t *testing.T) {
+	for _, test := range []struct {
+		template, path string
+		values         []string
+	}{
+		{"/v1/shelves", "/v1/shelves", []string{}},
+		{"/v1/shelves", "/v1/shelves/1", nil},
+		{"/v1/shelves/{shelf}", "/v1/shelves/a%2Fb", []string{"a/b"}},
+		{"/v1/shelves/{shelf}", "/v1/shelves/", nil},
+		{"/v1/{name=shelves/*/books/*}", "/v1/shelves/1/books/2", []string{"shelves/1/books/2"}},
+		{"/v1/{name=shelves/*/books/*}", "/v1/shelves/1/books", nil},
+		{"/v1/files/{path=**}", "/v1/files/a/b/c", []string{"a/b/c"}},
+		{"/v1/{shelf}/books/{book.id}:publish", "/v1/1/books/2:publish", []string{"1", "2"}},
+		{"/v1/{shelf}:publish", "/v1/1", nil},
+	} {
+		template, err := parsePathTemplate(test.template)
+		if err != nil {
+			t.Errorf("%s: %v", test.template, err)
+			continue
+		}
+		values, ok := template.match(test.path)
+		if ok != (test.values != nil) || fmt.Sprint(values) != fmt.Sprint(test.values) {
+			t.Errorf("%s on %s: expected %q, got %q (%v)", test.template, test.path, test.values, values, ok)
+		}
+	}
+
+	for _, template := range []string{"v1/shelves", "/v1/**/books", "/v1/{shelf", "/v1/{a={b}}", "/v1//shelves", "/v1/shelves:"} {
+		if _, err := parsePathTemplate(template); err == nil {
+			t.Errorf("expected %q to be rejected", template)
+		}
+	}
+}
+
+// shelfFile describes the service of the transcoder tests:
+//
+//	service Shelves {
+//	  rpc GetBook(GetBookRequest) returns (Book) { get: "/v1/shelves/{shelf}/books/{id}" }
+//	  rpc CreateBook(CreateBookRequest) returns (Book) { post: "/v1/shelves/{shelf}/books" body: "book" }
+//	  rpc ListBooks(ListBooksRequest) returns (stream Book) { get: "/v1/shelves/{shelf}/books" }
+//	}
+func shelfFile() *descriptorpb.FileDescriptorProto {
+	field := func(name string, number int32, kind descriptorpb.FieldDescriptorProto_Type, typeName string, repeated bool) *descriptorpb.FieldDescriptorProto {
+		label := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL
+		if repeated {
+			label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED
+		}
+		f := &descriptorpb.FieldDescriptorProto{Name: proto.String(name), Number: proto.Int32(number), Type: kind.Enum(), Label: label.Enum()}
+		if typeName != "" {
+			f.TypeName = proto.String(typeName)
+		}
+		return f
+	}
+	message := func(name string, fields ...*descriptorpb.FieldDescriptorProto) *descriptorpb.DescriptorProto {
+		return &descriptorpb.DescriptorProto{Name: proto.String(name), Field: fields}
+	}
+	method := func(name, input string, streaming bool, rule *annotations.HttpRule) *descriptorpb.MethodDescriptorProto {
+		options := &descriptorpb.MethodOptions{}
+		proto.SetExtension(options, annotations.E_Http, rule)
+		return &descriptorpb.MethodDescriptorProto{
+			Name: proto.String(name), InputType: proto.String(".shelf." + input), OutputType: proto.String(".shelf.Book"),
+			ServerStreaming: proto.Bool(streaming), Options: options,
+		}
+	}
+	const (
+		str   = descriptorpb.FieldDescriptorProto_TYPE_STRING
+		int64 = descriptorpb.FieldDescriptorProto_TYPE_INT64
+		bool  = descriptorpb.FieldDescriptorProto_TYPE_BOOL
+		msg   = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE
+	)
+	return &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("shelf.proto"),
+		Package: proto.String("shelf"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			message("Book", field("id", 1, int64, "", false), field("title", 2, str, "", false), field("tags", 3, str, "", true)),
+			message("GetBookRequest", field("shelf", 1, str, "", false), field("id", 2, int64, "", false), field("full", 3, bool, "", false), field("tags", 4, str, "", true)),
+			message("CreateBookRequest", field("shelf", 1, str, "", false), field("book", 2, msg, ".shelf.Book", false)),
+			message("ListBooksRequest", field("shelf", 1, str, "", false)),
+		},
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name: proto.String("Shelves"),
+			Method: []*descriptorpb.MethodDescriptorProto{
+				method("GetBook", "GetBookRequest", false, &annotations.HttpRule{Pattern: &annotations.HttpRule_Get{Get: "/v1/shelves/{shelf}/books/{id}"}}),
+				method("CreateBook", "CreateBookRequest", false, &annotations.HttpRule{Pattern: &annotations.HttpRule_Post{Post: "/v1/shelves/{shelf}/books"}, Body: "book"}),
+				method("ListBooks", "ListBooksRequest", true, &annotations.HttpRule{Pattern: &annotations.HttpRule_Get{Get: "/v1/shelves/{shelf}/books"}}),
+			},
+		}},
+	}
+}
+
+// shelfServer answers like a gRPC server of the Shelves service: GetBook and
+// CreateBook echo what they were asked for, GetBook of book 0 is NOT_FOUND
+// and ListBooks sends two books.
+func shelfServer(t *testing.T, file protoreflect.FileDescriptor) http.HandlerFunc {
+	service := file.Services().ByName("Shelves")
+	book := file.Messages().ByName("Book")
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !grpc.IsGrpc(r.Header) || r.Method != http.MethodPost {
+			http.Error(w, "not gRPC", http.StatusBadRequest)
+			return
+		}
+		name, _ := strings.CutPrefix(r.URL.Path, "/shelf.Shelves/")
+		method := service.Methods().ByName(protoreflect.Name(name))
+		body, _ := io.ReadAll(r.Body)
+		_, payload, n := grpc.ReadFrame(body)
+		if method == nil || n != len(body) {
+			http.Error(w, "bad call", http.StatusBadRequest)
+			return
+		}
+		request := dynamicpb.NewMessage(method.Input())
+		if err := proto.Unmarshal(payload, request); err != nil {
+			t.Error(err)
+		}
+		get := func(field string) protoreflect.Value {
+			return request.Get(method.Input().Fields().ByName(protoreflect.Name(field)))
+		}
+
+		w.Header().Set("Content-Type", grpc.ContentType)
+		send := func(id int64, title string, tags ...string) {
+			b := dynamicpb.NewMessage(book)
+			b.Set(book.Fields().ByName("id"), protoreflect.ValueOfInt64(id))
+			b.Set(book.Fields().ByName("title"), protoreflect.ValueOfString(title))
+			list := b.Mutable(book.Fields().ByName("tags")).List()
+			for _, tag := range tags {
+				list.Append(protoreflect.ValueOfString(tag))
+			}
+			data, _ := proto.Marshal(b)
+			w.Write(grpc.AppendFrame(nil, 0, data))
+			w.(http.Flusher).Flush()
+		}
+		switch name {
+		case "GetBook":
+			if get("id").Int() == 0 {
+				grpc.SetStatus(w.Header(), 5, "no book 0 on shelf "+get("shelf").String())
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+			var tags []string
+			for i := 0; i < get("tags").List().Len(); i++ {
+				tags = append(tags, get("tags").List().Get(i).String())
+			}
+			send(get("id").Int(), fmt.Sprintf("%s %v", get("shelf").String(), get("full").Bool()), tags...)
+		case "CreateBook":
+			created := get("book").Message()
+			send(created.Get(book.Fields().ByName("id")).Int(), get("shelf").String()+": "+created.Get(book.Fields().ByName("title")).String())
+		case "ListBooks":
+			send(1, "first")
+			send(2, "second")
+		}
+		w.Header().Set(http.TrailerPrefix+grpc.HeaderStatus, "0")
+	}
+}
+
+func newTranscoderChain(t *testing.T, options string) (*Chain, protoreflect.FileDescriptor) {
+	t.Helper()
+	fileProto := shelfFile()
+	file, err := protodesc.NewFile(fileProto, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, err := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{fileProto}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, err := NewChain([]config.HttpFilter{
+		{Name: GrpcJsonTranscoderFilter, TypedConfig: typedConfig(t, fmt.Sprintf(`
+proto_descriptor_bin: %s
+services: [shelf.Shelves]
+%s`, base64.StdEncoding.EncodeToString(set), options))},
+		{Name: config.RouterFilter},
+	}, &config.RouteConfiguration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chain, file
+}
+
+func TestGrpcJsonTranscoderFilter(t *testing.T) {
+	chain, file := newTranscoderChain(t, "")
+	server := shelfServer(t, file)
+	serve := func(method, target, body string) *httptest.ResponseRecorder {
+		var r *http.Request
+		if body == "" {
+			r = httptest.NewRequest(method, target, nil)
+		} else {
+			r = httptest.NewRequest(method, target, strings.NewReader(body))
+			r.Header.Set("Content-Type", "application/json")
+		}
+		rr := httptest.NewRecorder()
+		chain.Serve(rr, r, nil, nil, server)
+		return rr
+	}
+
+	for _, test := range []struct {
+		method, target, body string
+		status               int
+		response             string
+	}{
+		{"GET", "/v1/shelves/fiction/books/7?full=true&tags=a&tags=b", "", 200, `{"id":"7","title":"fiction true","tags":["a","b"]}`},
+		{"POST", "/v1/shelves/fiction/books", `{"id":"3","title":"Dune"}`, 200, `{"id":"3","title":"fiction: Dune"}`},
+		{"GET", "/v1/shelves/fiction/books", "", 200, `[{"id":"1","title":"first"},{"id":"2","title":"second"}]`},
+		{"GET", "/v1/shelves/fiction/books/0", "", 404, `{"code":5,"message":"no book 0 on shelf fiction"}`},
+	} {
+		rr := serve(test.method, test.target, test.body)
+		if rr.Code != test.status || rr.Header().Get("Content-Type") != "application/json" || compactJSON(rr.Body.String()) != test.response {
+			t.Errorf("%s %s: expected %d %s, got %d %q %s", test.method, test.target, test.status, test.response, rr.Code, rr.Header().Get("Content-Type"), rr.Body.String())
+		}
+		if rr.Header().Get(grpc.HeaderStatus) != "" || len(rr.Result().Trailer) != 0 {
+			t.Errorf("%s %s: expected no gRPC headers or trailers, got %v %v", test.method, test.target, rr.Header(), rr.Result().Trailer)
+		}
+	}
+
+	if rr := serve("GET", "/v1/shelves/fiction/books/7?color=red", ""); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected an unknown query parameter to be rejected, got %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := serve("POST", "/v1/shelves/fiction/books", `{"id":`); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected a bad JSON body to be rejected, got %d %s", rr.Code, rr.Body.String())
+	}
+	// Requests for no method are passed on as they are.
+	if rr := serve("GET", "/v2/shelves", ""); rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "not gRPC") {
+		t.Errorf("expected an unmapped request to reach the server untouched, got %d %s", rr.Code, rr.Body.String())
+	}
+
+	chain, _ = newTranscoderChain(t, `
+auto_mapping: true
+ignore_unknown_query_parameters: true
+print_options: { stream_newline_delimited: true }`)
+	for _, test := range []struct {
+		method, target, body, response string
+	}{
+		{"GET", "/v1/shelves/fiction/books", "", "{\"id\":\"1\",\"title\":\"first\"}\n{\"id\":\"2\",\"title\":\"second\"}\n"},
+		{"GET", "/v1/shelves/fiction/books/7?color=red", "", `{"id":"7","title":"fiction false"}`},
+		{"POST", "/shelf.Shelves/GetBook", `{"shelf":"poetry","id":"2"}`, `{"id":"2","title":"poetry false"}`},
+	} {
+		rr := serve(test.method, test.target, test.body)
+		if rr.Code != http.StatusOK || compactJSON(rr.Body.String()) != test.response {
+			t.Errorf("%s %s: expected %q, got %d %q", test.method, test.target, test.response, rr.Code, rr.Body.String())
+		}
+	}
+
+	for _, document := range []string{
+		"services: [shelf.Shelves]",
+		"proto_descriptor_bin: AAAA\nservices: [shelf.Shelves]",
+		"proto_descriptor: /nonexistent.pb\nservices: [shelf.Shelves]",
+		"proto_descriptor: /nonexistent.pb\nservices: [shelf.Shelves]\nmatch_incoming_request_route: true",
+	} {
+		if _, err := (transcoderFactory{}).NewFilterFactory(typedConfig(t, document)); err == nil {
+			t.Errorf("expected %q to be rejected", document)
+		}
+	}
+}
+
+// compactJSON drops the spaces protojson may put between fields.
+func compactJSON(s string) string {
+	var b bytes.Buffer
+	inString := false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' && (i == 0 || s[i-1] != '\\'):
+			inString = !inString
+			b.WriteByte(c)
+		case !inString && c == ' ':
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
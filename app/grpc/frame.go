@@ -0,0 +1,36 @@
+package grpc
+
+import "encoding/binary"
+
+// Frame flags. Messages travel in frames, each a flags byte and a big-endian
+// 4-byte length followed by that many bytes.
+const (
+	FlagCompressed byte = 0x01
+	// FlagTrailer marks the gRPC-Web frame that carries the trailers at the
+	// end of the response body.
+	FlagTrailer byte = 0x80
+)
+
+// FrameHeaderLen is the length of the flags and length prefix of a frame.
+const FrameHeaderLen = 5
+
+// AppendFrame appends a frame with flags and payload to b.
+func AppendFrame(b []byte, flags byte, payload []byte) []byte {
+	b = append(b, flags)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(payload)))
+	return append(b, payload...)
+}
+
+// ReadFrame returns the first frame in b, and how many bytes of b it took,
+// or n of zero if b does not hold a whole frame yet.
+func ReadFrame(b []byte) (flags byte, payload []byte, n int) {
+	if len(b) < FrameHeaderLen {
+		return 0, nil, 0
+	}
+	length := binary.BigEndian.Uint32(b[1:FrameHeaderLen])
+	if uint64(len(b)-FrameHeaderLen) < uint64(length) {
+		return 0, nil, 0
+	}
+	n = FrameHeaderLen + int(length)
+	return b[0], b[FrameHeaderLen:n], n
+}
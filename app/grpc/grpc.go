@@ -0,0 +1,198 @@
+// Package grpc holds what the router needs to know of gRPC over HTTP/2 to
+// proxy it: telling gRPC requests apart, reading their grpc-timeout and
+// answering them with a grpc-status rather than an HTTP error page. It also
+// has the framing of gRPC-Web, which the grpc_web filter bridges to gRPC.
+package grpc
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+// ContentType is the media type of gRPC requests and responses. It may be
+// followed by "+" and the message encoding, as in "application/grpc+proto".
+const ContentType = "application/grpc"
+
+// Header names of the gRPC protocol.
+const (
+	HeaderTimeout = "Grpc-Timeout"
+	HeaderStatus  = "Grpc-Status"
+	HeaderMessage = "Grpc-Message"
+)
+
+// IsGrpc reports whether a request or response with header is gRPC.
+func IsGrpc(header http.Header) bool {
+	contentType := header.Get("Content-Type")
+	if !strings.HasPrefix(contentType, ContentType) {
+		return false
+	}
+	rest := contentType[len(ContentType):]
+	return rest == "" || rest[0] == '+' || rest[0] == ';'
+}
+
+// maxTimeoutDigits is how long the value of a grpc-timeout may be.
+const maxTimeoutDigits = 8
+
+var timeoutUnits = map[byte]time.Duration{
+	'H': time.Hour,
+	'M': time.Minute,
+	'S': time.Second,
+	'm': time.Millisecond,
+	'u': time.Microsecond,
+	'n': time.Nanosecond,
+}
+
+// ParseTimeout parses the value of a grpc-timeout header: up to eight digits
+// followed by a unit, as in "100m" for 100 milliseconds.
+func ParseTimeout(value string) (time.Duration, error) {
+	if len(value) < 2 || len(value) > maxTimeoutDigits+1 {
+		return 0, fmt.Errorf("invalid grpc-timeout %q", value)
+	}
+	unit, ok := timeoutUnits[value[len(value)-1]]
+	if !ok {
+		return 0, fmt.Errorf("invalid grpc-timeout unit in %q", value)
+	}
+	digits := value[:len(value)-1]
+	for i := 0; i < len(digits); i++ {
+		if digits[i] < '0' || digits[i] > '9' {
+			return 0, fmt.Errorf("invalid grpc-timeout %q", value)
+		}
+	}
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	// Eight digits of hours do not fit a time.Duration.
+	if n > int64(1<<63-1)/int64(unit) {
+		return 0, errors.New("grpc-timeout out of range")
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// CodeForHTTPStatus returns the gRPC status of an error the router answers
+// with the HTTP status code status. It follows the mapping of the gRPC
+// specification, except that 504, which the router only sends when the
+// upstream timed out, is DEADLINE_EXCEEDED and 413, a request larger than a
+// buffer allows, is RESOURCE_EXHAUSTED.
+func CodeForHTTPStatus(status int) codes.Code {
+	switch status {
+	case http.StatusBadRequest:
+		return codes.Internal
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.Unimplemented
+	case http.StatusRequestEntityTooLarge:
+		return codes.ResourceExhausted
+	case http.StatusGatewayTimeout:
+		return codes.DeadlineExceeded
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable:
+		return codes.Unavailable
+	default:
+		return codes.Unknown
+	}
+}
+
+// HTTPStatusForCode returns the HTTP status code of a REST response for a
+// call that ended with code, as mapped in google.rpc.Code.
+func HTTPStatusForCode(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		// Client Closed Request, which net/http has no name for.
+		return 499
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// SetStatus sets the headers of a trailers-only gRPC response, which ends
+// the call with code and message before any message is sent.
+func SetStatus(header http.Header, code codes.Code, message string) {
+	header.Set("Content-Type", ContentType)
+	header.Set(HeaderStatus, strconv.Itoa(int(code)))
+	if message != "" {
+		header.Set(HeaderMessage, EncodeMessage(message))
+	} else {
+		header.Del(HeaderMessage)
+	}
+}
+
+// SetTrailerStatus ends a gRPC response whose headers have been sent with
+// code and message, set as trailers of header.
+func SetTrailerStatus(header http.Header, code codes.Code, message string) {
+	header.Set(http.TrailerPrefix+HeaderStatus, strconv.Itoa(int(code)))
+	if message != "" {
+		header.Set(http.TrailerPrefix+HeaderMessage, EncodeMessage(message))
+	}
+}
+
+// WriteError answers a gRPC request that failed with the HTTP status code
+// status with a trailers-only response carrying the matching grpc-status.
+func WriteError(w http.ResponseWriter, message string, status int) {
+	w.Header().Del("Content-Length")
+	SetStatus(w.Header(), CodeForHTTPStatus(status), message)
+	w.WriteHeader(http.StatusOK)
+}
+
+// EncodeMessage percent-encodes a grpc-message, which may only hold
+// printable ASCII.
+func EncodeMessage(message string) string {
+	var b strings.Builder
+	for i := 0; i < len(message); i++ {
+		c := message[i]
+		if c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// DecodeMessage undoes EncodeMessage. Malformed escapes are kept as they
+// are.
+func DecodeMessage(message string) string {
+	if !strings.Contains(message, "%") {
+		return message
+	}
+	var b strings.Builder
+	for i := 0; i < len(message); i++ {
+		if message[i] == '%' && i+2 < len(message) {
+			if c, err := strconv.ParseUint(message[i+1:i+3], 16, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(message[i])
+	}
+	return b.String()
+}
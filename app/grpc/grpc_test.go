@@ -0,0 +1,80 @@
+package grpc
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+func TestIsGrpc(t *testing.T) {
+	for contentType, want := range map[string]bool{
+		"application/grpc":               true,
+		"application/grpc+proto":         true,
+		"application/grpc; charset=utf8": true,
+		"application/grpc-web":           false,
+		"application/json":               false,
+		"":                               false,
+	} {
+		header := http.Header{"Content-Type": {contentType}}
+		if got := IsGrpc(header); got != want {
+			t.Errorf("IsGrpc(%q) = %v, want %v", contentType, got, want)
+		}
+	}
+}
+
+func TestParseTimeout(t *testing.T) {
+	for value, want := range map[string]time.Duration{
+		"1H":        time.Hour,
+		"2M":        2 * time.Minute,
+		"3S":        3 * time.Second,
+		"100m":      100 * time.Millisecond,
+		"5u":        5 * time.Microsecond,
+		"99999999n": 99999999 * time.Nanosecond,
+	} {
+		got, err := ParseTimeout(value)
+		if err != nil || got != want {
+			t.Errorf("ParseTimeout(%q) = %v, %v, want %v", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"", "m", "10", "10s", "-1S", "1.5S", "123456789S", "99999999H"} {
+		if got, err := ParseTimeout(value); err == nil {
+			t.Errorf("ParseTimeout(%q) = %v, want an error", value, got)
+		}
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	rr := httptest.NewRecorder()
+	WriteError(rr, "no healthy upstream", http.StatusServiceUnavailable)
+	if rr.Code != http.StatusOK || rr.Body.Len() != 0 {
+		t.Errorf("expected an empty 200 response, got %d %q", rr.Code, rr.Body.String())
+	}
+	header := rr.Header()
+	if header.Get("Content-Type") != ContentType || header.Get(HeaderStatus) != "14" || header.Get(HeaderMessage) != "no healthy upstream" {
+		t.Errorf("unexpected headers: %v", header)
+	}
+}
+
+func TestCodeForHTTPStatus(t *testing.T) {
+	for status, want := range map[int]codes.Code{
+		http.StatusBadRequest:            codes.Internal,
+		http.StatusNotFound:              codes.Unimplemented,
+		http.StatusRequestEntityTooLarge: codes.ResourceExhausted,
+		http.StatusServiceUnavailable:    codes.Unavailable,
+		http.StatusGatewayTimeout:        codes.DeadlineExceeded,
+		http.StatusInternalServerError:   codes.Unknown,
+	} {
+		if got := CodeForHTTPStatus(status); got != want {
+			t.Errorf("CodeForHTTPStatus(%d) = %v, want %v", status, got, want)
+		}
+	}
+}
+
+func TestEncodeMessage(t *testing.T) {
+	if got, want := EncodeMessage("100% done\n"), "100%25 done%0A"; got != want {
+		t.Errorf("EncodeMessage = %q, want %q", got, want)
+	}
+}
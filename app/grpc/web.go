@@ -0,0 +1,56 @@
+package grpc
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Media types of gRPC-Web, which browsers speak over HTTP/1.1 or HTTP/2. The
+// text variant carries the same frames base64-encoded.
+const (
+	ContentTypeWeb     = "application/grpc-web"
+	ContentTypeWebText = "application/grpc-web-text"
+)
+
+// IsGrpcWeb reports whether a request with header is gRPC-Web, and if so
+// whether it is in text mode.
+func IsGrpcWeb(header http.Header) (web, text bool) {
+	contentType := header.Get("Content-Type")
+	for _, base := range []string{ContentTypeWebText, ContentTypeWeb} {
+		if rest, ok := strings.CutPrefix(contentType, base); ok && (rest == "" || rest[0] == '+' || rest[0] == ';') {
+			return true, base == ContentTypeWebText
+		}
+	}
+	return false, false
+}
+
+// Subtype returns the message encoding of a gRPC or gRPC-Web content type,
+// such as "+proto", or "" if it names none.
+func Subtype(contentType string) string {
+	if i := strings.IndexByte(contentType, '+'); i >= 0 {
+		subtype, _, _ := strings.Cut(contentType[i:], ";")
+		return strings.TrimSpace(subtype)
+	}
+	return ""
+}
+
+// AppendTrailerFrame appends the gRPC-Web frame carrying trailers to b, one
+// "name:value" line each, with names in lower case.
+func AppendTrailerFrame(b []byte, trailers http.Header) []byte {
+	keys := make([]string, 0, len(trailers))
+	for key := range trailers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var payload []byte
+	for _, key := range keys {
+		for _, value := range trailers[key] {
+			payload = append(payload, strings.ToLower(key)...)
+			payload = append(payload, ':')
+			payload = append(payload, value...)
+			payload = append(payload, "\r\n"...)
+		}
+	}
+	return AppendFrame(b, FlagTrailer, payload)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// serveHTTP hands the connection of an HTTP filter chain to the HTTP/2 or
+// the HTTP/1.1 server, by what the client speaks: the protocol it negotiated
+// with ALPN or, over plaintext, whether it opens with the HTTP/2 preface.
+// Connections speaking a version the chain's codec_type rules out are closed.
+func (l *listener) serveHTTP(conn net.Conn, info *httpConn) {
+	chain := info.chain
+	useHTTP2 := false
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		useHTTP2 = tlsConn.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS
+	} else if chain.acceptsHTTP2() {
+		untrack := l.track(conn)
+		sniffed, preface, err := sniffHTTP2Preface(conn, l.handler.Load().inspectTimeout)
+		untrack()
+		if err != nil {
+			conn.Close()
+			return
+		}
+		conn, useHTTP2 = sniffed, preface
+		info.conn = conn
+	}
+
+	switch {
+	case useHTTP2 && chain.acceptsHTTP2():
+		l.serveHTTP2(conn, info)
+	case !useHTTP2 && chain.acceptsHTTP1():
+		l.httpConnInfo.Store(conn, info)
+		if !l.httpConns.push(conn) {
+			l.httpConnInfo.Delete(conn)
+		}
+	default:
+		mainLog.Debugf("Listener %s: connection from %s speaks an HTTP version its filter chain does not serve", l.name, conn.RemoteAddr())
+		conn.Close()
+	}
+}
+
+// serveHTTP2 serves conn as an HTTP/2 connection until it closes.
+func (l *listener) serveHTTP2(conn net.Conn, info *httpConn) {
+	defer l.track(conn)()
+	l.http2Server(info.chain).ServeConn(conn, &http2.ServeConnOpts{
+		Context:    context.WithValue(context.Background(), httpConnKey{}, info),
+		BaseConfig: l.server,
+		Handler:    l,
+	})
+}
+
+// upgradeH2C switches a plaintext HTTP/1.1 connection to HTTP/2 at the
+// client's request and answers the request it asked with over HTTP/2. That
+// request still carries its upgrade headers, so it goes straight to the
+// filter chain.
+func (l *listener) upgradeH2C(w http.ResponseWriter, r *http.Request, conn *httpConn, chain *filterChainHandler) {
+	defer l.track(conn.conn)()
+	serveChain := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l.advertise(w, r)
+		l.chain(conn).http.ServeHTTP(w, r)
+	})
+	h2c.NewHandler(serveChain, l.http2Server(chain)).ServeHTTP(w, r)
+}
+
+// isH2CUpgrade reports whether r asks to switch its connection to h2c.
+func isH2CUpgrade(r *http.Request) bool {
+	return r.TLS == nil && upgradeType(r) == "h2c" && headerHasToken(r.Header, "Connection", "HTTP2-Settings")
+}
+
+// http2Server returns the HTTP/2 server for a connection of chain, with the
+// chain's http2_protocol_options. It is a copy of the listener's server,
+// which shares its state, so draining the listener still reaches it.
+func (l *listener) http2Server(chain *filterChainHandler) *http2.Server {
+	server := *l.http2
+	if chain.hcm != nil && chain.hcm.Http2ProtocolOptions != nil {
+		options := chain.hcm.Http2ProtocolOptions
+		if options.MaxConcurrentStreams > 0 {
+			server.MaxConcurrentStreams = uint32(options.MaxConcurrentStreams)
+		}
+		if options.InitialStreamWindowSize > 0 {
+			server.MaxUploadBufferPerStream = int32(options.InitialStreamWindowSize)
+		}
+		if options.InitialConnectionWindowSize > 0 {
+			server.MaxUploadBufferPerConnection = int32(options.InitialConnectionWindowSize)
+		}
+	}
+	return &server
+}
+
+// sniffHTTP2Preface reads from conn until what the client sent either is the
+// HTTP/2 client preface or cannot be, and reports which. The returned
+// connection reads what was sniffed again. Like the TLS inspector, it gives
+// up on clients that send too little within timeout, unless timeout is 0.
+func sniffHTTP2Preface(conn net.Conn, timeout time.Duration) (net.Conn, bool, error) {
+	if timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		defer conn.SetReadDeadline(time.Time{})
+	}
+	r := bufio.NewReaderSize(conn, len(http2.ClientPreface))
+	for n := 1; ; n++ {
+		peeked, err := r.Peek(n)
+		if err != nil {
+			return nil, false, err
+		}
+		if !strings.HasPrefix(http2.ClientPreface, string(peeked)) {
+			return &sniffedConn{Conn: conn, r: r}, false, nil
+		}
+		if n == len(http2.ClientPreface) {
+			return &sniffedConn{Conn: conn, r: r}, true, nil
+		}
+	}
+}
+
+// sniffedConn is a connection whose first bytes were read ahead into r.
+type sniffedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *sniffedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,543 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+
+	"seateam/config"
+	"seateam/filters/network"
+	"seateam/transport"
+)
+
+// defaultListenerFiltersTimeout matches Envoy's default when
+// listener_filters_timeout is left out.
+const defaultListenerFiltersTimeout = 15 * time.Second
+
+// listenerHandler is what a listener does with the connections it accepts.
+// Each gets a filter chain, picked on what the TLS inspector finds if the
+// listener has one, and is run through the chain's network filters before it
+// is served as HTTP or, when the chain ends in tcp_proxy, proxied as it is.
+// Chains with a TLS transport socket terminate TLS first. A UDP listener has
+// no filter chains and hands its datagrams to udp, except a QUIC listener,
+// whose chains serve HTTP/3 with quicOptions.
+type listenerHandler struct {
+	// filterChains are the configs chains are matched against, in the order
+	// of chains.
+	filterChains   []config.FilterChain
+	chains         []filterChainHandler
+	inspectTLS     bool
+	inspectTimeout time.Duration
+	udp            *network.UdpProxy
+	quicOptions    *config.QuicListenerOptions
+}
+
+// filterChainHandler is a filter chain ready to serve. A chain with neither an
+// HTTP nor a TCP handler could not be built, and its connections are closed.
+type filterChainHandler struct {
+	filters *network.Chain
+	tls     *transport.ServerConfig
+	http    http.Handler
+	tcp     *network.TcpProxy
+	// hcm is the connection manager http was built from, if any. Its
+	// codec_type says which HTTP versions http is served over.
+	hcm *config.HttpConnectionManager
+}
+
+func (c *filterChainHandler) acceptsHTTP1() bool {
+	return c.hcm == nil || c.hcm.AcceptsHTTP1()
+}
+
+func (c *filterChainHandler) acceptsHTTP2() bool {
+	return c.hcm == nil || c.hcm.AcceptsHTTP2()
+}
+
+// match returns the chain for a connection with the given server name and
+// transport protocol, or nil if no chain matches.
+func (h *listenerHandler) match(serverName, transportProtocol string) *filterChainHandler {
+	i := network.MatchFilterChain(h.filterChains, serverName, transportProtocol)
+	if i < 0 {
+		return nil
+	}
+	return &h.chains[i]
+}
+
+// close releases what the handler's chains hold once it is replaced. Chains
+// already serving connections carry on.
+func (h *listenerHandler) close() {
+	for _, chain := range h.chains {
+		if chain.tls != nil {
+			chain.tls.Close()
+		}
+	}
+}
+
+// listener is one bound socket from static_resources.listeners. Its handler can
+// be swapped on reload without closing the socket.
+type listener struct {
+	name    string
+	network string
+	address string
+	ln      net.Listener
+	// packetConn is the socket of a UDP or QUIC listener, which has no ln.
+	packetConn net.PacketConn
+	// quic serves the HTTP/3 connections of a QUIC listener.
+	quic *http3.Server
+	// altSvc is the alt-svc header a TCP listener advertises HTTP/3 with.
+	altSvc atomic.Value
+	// server serves the connections of HTTP filter chains, which httpConns
+	// hands to it.
+	server    *http.Server
+	httpConns *connListener
+	// http2 serves the HTTP/2 connections of HTTP filter chains. It is
+	// configured on server so that draining server sends them GOAWAY.
+	http2 *http2.Server
+	// httpConnInfo holds the *httpConn of each connection pushed to
+	// httpConns until the HTTP server picks it up.
+	httpConnInfo sync.Map
+	handler      atomic.Pointer[listenerHandler]
+	closing      atomic.Bool
+
+	// conns are the connections being proxied by TCP filter chains.
+	connsMu sync.Mutex
+	conns   map[net.Conn]struct{}
+}
+
+// httpConn is what the filter chain of a connection handed to the HTTP server
+// was picked on. It is kept beside the connection rather than wrapping it, so
+// the server still sees TLS connections as *tls.Conn.
+type httpConn struct {
+	conn              net.Conn
+	serverName        string
+	transportProtocol string
+	chain             *filterChainHandler
+}
+
+type httpConnKey struct{}
+
+// ServeHTTP serves a request with the filter chain of its connection, unless
+// the request switches the connection to h2c. A QUIC connection whose chain
+// was removed before it was set up has none and is answered with 503.
+func (l *listener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn := r.Context().Value(httpConnKey{}).(*httpConn)
+	chain := l.chain(conn)
+	if chain == nil || chain.http == nil {
+		http.Error(w, "no filter chain for the connection", http.StatusServiceUnavailable)
+		return
+	}
+	l.advertise(w, r)
+	if chain.acceptsHTTP2() && isH2CUpgrade(r) {
+		l.upgradeH2C(w, r, conn, chain)
+		return
+	}
+	chain.http.ServeHTTP(w, r)
+}
+
+// chain returns the filter chain conn matches in the running config, so
+// requests on open connections pick up new routes. When the connection no
+// longer matches an HTTP chain it keeps the one it started with.
+func (l *listener) chain(conn *httpConn) *filterChainHandler {
+	chain := l.handler.Load().match(conn.serverName, conn.transportProtocol)
+	if chain == nil || chain.http == nil {
+		chain = conn.chain
+	}
+	return chain
+}
+
+// setHandler installs handler and releases the one it replaces.
+func (l *listener) setHandler(handler *listenerHandler) {
+	if old := l.handler.Swap(handler); old != nil {
+		old.close()
+	}
+}
+
+// addr returns the address the listener is bound to.
+func (l *listener) addr() net.Addr {
+	if l.packetConn != nil {
+		return l.packetConn.LocalAddr()
+	}
+	return l.ln.Addr()
+}
+
+// close closes the socket, which stops new connections and datagrams. The
+// socket of a QUIC listener is shared by its connections, so it is only
+// closed once they are drained.
+func (l *listener) close() {
+	l.closing.Store(true)
+	switch {
+	case l.quic != nil:
+	case l.packetConn != nil:
+		l.packetConn.Close()
+	default:
+		l.ln.Close()
+	}
+}
+
+// drain stops accepting new connections straight away and lets requests in
+// flight, and connections being proxied, finish for up to drainTime. UDP
+// sessions have no end to wait for and are closed with the socket.
+func (l *listener) drain(drainTime time.Duration) error {
+	l.close()
+	defer l.handler.Load().close()
+	if l.quic != nil {
+		return l.drainQUIC(drainTime)
+	}
+	if l.packetConn != nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), drainTime)
+	defer cancel()
+	httpErr := l.server.Shutdown(ctx)
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		l.connsMu.Lock()
+		open := len(l.conns)
+		if ctx.Err() != nil {
+			for conn := range l.conns {
+				conn.Close()
+			}
+		}
+		l.connsMu.Unlock()
+		switch {
+		case open == 0:
+			return httpErr
+		case ctx.Err() != nil:
+			return ctx.Err()
+		}
+		select {
+		case <-ctx.Done():
+		case <-ticker.C:
+		}
+	}
+}
+
+// serve accepts connections until the socket is closed.
+func (l *listener) serve() {
+	for {
+		conn, err := l.ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			if !l.closing.Load() {
+				mainLog.Errorf("Listener %s stopped: %v", l.name, err)
+			}
+			l.httpConns.Close()
+			return
+		} else if err != nil {
+			mainLog.Warnf("Listener %s: %v", l.name, err)
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		go l.serveConn(conn)
+	}
+}
+
+// serveConn picks the filter chain for conn and runs it.
+func (l *listener) serveConn(conn net.Conn) {
+	handler := l.handler.Load()
+	var serverName, transportProtocol string
+	if handler.inspectTLS {
+		var err error
+		if conn, serverName, transportProtocol, err = network.InspectTLS(conn, handler.inspectTimeout); err != nil {
+			mainLog.Debugf("Listener %s: inspecting connection from %s: %v", l.name, conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+	}
+	chain := handler.match(serverName, transportProtocol)
+	if chain == nil {
+		mainLog.Debugf("Listener %s: no filter chain for connection from %s (server name %q)", l.name, conn.RemoteAddr(), serverName)
+		conn.Close()
+		return
+	}
+	if chain.http == nil && chain.tcp == nil {
+		conn.Close()
+		return
+	}
+	if conn = chain.filters.OnNewConnection(conn); conn == nil {
+		return
+	}
+	if chain.tls != nil {
+		tlsConn, err := chain.tls.Server(conn)
+		if err != nil {
+			mainLog.Debugf("Listener %s: TLS handshake with %s: %v", l.name, conn.RemoteAddr(), err)
+			return
+		}
+		if !chain.filters.OnHandshake(tlsConn) {
+			return
+		}
+		conn = tlsConn
+	}
+
+	if chain.tcp == nil {
+		l.serveHTTP(conn, &httpConn{conn: conn, serverName: serverName, transportProtocol: transportProtocol, chain: chain})
+		return
+	}
+	defer l.track(conn)()
+	chain.tcp.ServeConn(conn)
+}
+
+// track counts conn as open until the returned func is called, so draining
+// the listener waits for it.
+func (l *listener) track(conn net.Conn) func() {
+	l.connsMu.Lock()
+	l.conns[conn] = struct{}{}
+	l.connsMu.Unlock()
+	return func() {
+		l.connsMu.Lock()
+		delete(l.conns, conn)
+		l.connsMu.Unlock()
+	}
+}
+
+// connListener is a net.Listener for connections accepted elsewhere.
+type connListener struct {
+	addr  net.Addr
+	conns chan net.Conn
+	once  sync.Once
+	done  chan struct{}
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{addr: addr, conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+// push hands conn to Accept, closing it and returning false if the listener
+// is closed first.
+func (l *connListener) push(conn net.Conn) bool {
+	select {
+	case l.conns <- conn:
+		return true
+	case <-l.done:
+		conn.Close()
+		return false
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
+
+func listenerNetwork(c config.Listener) string {
+	if c.IsQUIC() {
+		return "quic"
+	}
+	if c.IsUDP() {
+		return "udp"
+	}
+	return "tcp"
+}
+
+func listenerAddress(c config.Listener) string {
+	socketAddress := c.Address.SocketAddress
+	return net.JoinHostPort(socketAddress.Address, fmt.Sprint(socketAddress.PortValue))
+}
+
+// listenerManager keeps the bound listeners in line with the config, starting
+// and stopping them as listeners are added to or removed from it.
+type listenerManager struct {
+	mu         sync.Mutex
+	listeners  map[string]*listener
+	newHandler func(config.Listener) *listenerHandler
+	drainTime  time.Duration
+	drained    bool
+}
+
+func newListenerManager(newHandler func(config.Listener) *listenerHandler, drainTime time.Duration) *listenerManager {
+	return &listenerManager{
+		listeners:  make(map[string]*listener),
+		newHandler: newHandler,
+		drainTime:  drainTime,
+	}
+}
+
+// Apply binds every listener in configs. Listeners whose address and protocol
+// are unchanged keep their socket and only get new filter chains; listeners
+// that were removed or moved are drained in the background. Bind failures are
+// returned together after the rest of the listeners have been applied.
+func (lm *listenerManager) Apply(configs []config.Listener) error {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	if lm.drained {
+		mainLog.Infof("Listeners have been drained, not applying %d listeners", len(configs))
+		return nil
+	}
+
+	type socket struct{ network, address string }
+	wanted := make(map[string]socket, len(configs))
+	for _, c := range configs {
+		wanted[c.Name] = socket{listenerNetwork(c), listenerAddress(c)}
+	}
+
+	// Release sockets first so a listener can move to a port another one gave up.
+	for name, l := range lm.listeners {
+		if want, ok := wanted[name]; !ok || want != (socket{l.network, l.address}) {
+			lm.stop(l)
+		}
+	}
+
+	var errs []error
+	for _, c := range configs {
+		handler := lm.newHandler(c)
+		if l, ok := lm.listeners[c.Name]; ok {
+			l.setHandler(handler)
+			continue
+		}
+		l, err := startListener(c.Name, wanted[c.Name].network, wanted[c.Name].address, handler)
+		if err != nil {
+			// Nothing else holds the handler, so its certificates are
+			// released here.
+			handler.close()
+			errs = append(errs, err)
+			continue
+		}
+		lm.listeners[c.Name] = l
+	}
+	lm.advertiseHTTP3()
+	return errors.Join(errs...)
+}
+
+func (lm *listenerManager) stop(l *listener) {
+	delete(lm.listeners, l.name)
+	mainLog.Infof("Stopping listener %s on %s", l.name, l.address)
+	// Close the socket now rather than in the background, so a listener
+	// started next can bind the address.
+	l.close()
+	go func() {
+		if err := l.drain(lm.drainTime); err != nil {
+			mainLog.Warnf("Listener %s still had open connections after drain time: %v", l.name, err)
+		}
+	}()
+}
+
+// Drain stops every listener in the background. Listeners stay stopped, even
+// if a later config reload lists them again.
+func (lm *listenerManager) Drain() {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	lm.drained = true
+	for _, l := range lm.listeners {
+		lm.stop(l)
+	}
+}
+
+// Shutdown drains every listener and waits for them to finish.
+func (lm *listenerManager) Shutdown() {
+	lm.mu.Lock()
+	lm.drained = true
+	listeners := make([]*listener, 0, len(lm.listeners))
+	for _, l := range lm.listeners {
+		listeners = append(listeners, l)
+		delete(lm.listeners, l.name)
+	}
+	lm.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, l := range listeners {
+		wg.Add(1)
+		go func(l *listener) {
+			defer wg.Done()
+			if err := l.drain(lm.drainTime); err != nil {
+				mainLog.Warnf("Listener %s still had open connections after drain time: %v", l.name, err)
+			}
+		}(l)
+	}
+	wg.Wait()
+}
+
+// Listeners returns the running listeners sorted by name.
+func (lm *listenerManager) Listeners() []*listener {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	all := make([]*listener, 0, len(lm.listeners))
+	for _, l := range lm.listeners {
+		all = append(all, l)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].name < all[j].name })
+	return all
+}
+
+func startListener(name, protocol, address string, handler *listenerHandler) (*listener, error) {
+	switch protocol {
+	case "udp":
+		return startUDPListener(name, address, handler)
+	case "quic":
+		return startQUICListener(name, address, handler)
+	}
+	ln, err := net.Listen(protocol, address)
+	if err != nil {
+		return nil, fmt.Errorf("listener %s: %v", name, err)
+	}
+
+	l := &listener{name: name, network: protocol, address: address, ln: ln, conns: make(map[net.Conn]struct{})}
+	l.setHandler(handler)
+	l.httpConns = newConnListener(ln.Addr())
+	l.server = &http.Server{
+		Handler: l,
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			info, _ := l.httpConnInfo.LoadAndDelete(conn)
+			return context.WithValue(ctx, httpConnKey{}, info)
+		},
+	}
+	l.http2 = &http2.Server{}
+	if err := http2.ConfigureServer(l.server, l.http2); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("listener %s: %v", name, err)
+	}
+
+	go func() {
+		if err := l.server.Serve(l.httpConns); err != nil && err != http.ErrServerClosed && !l.closing.Load() {
+			mainLog.Errorf("Listener %s stopped: %v", name, err)
+		}
+	}()
+	go l.serve()
+	mainLog.Infof("Listener %s started on %s", name, ln.Addr())
+	return l, nil
+}
+
+// startUDPListener binds a UDP listener and proxies its datagrams with the
+// udp_proxy of whichever handler is current.
+func startUDPListener(name, address string, handler *listenerHandler) (*listener, error) {
+	packetConn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("listener %s: %v", name, err)
+	}
+
+	l := &listener{name: name, network: "udp", address: address, packetConn: packetConn}
+	l.setHandler(handler)
+	go func() {
+		err := network.ServeUDP(packetConn, func() *network.UdpProxy { return l.handler.Load().udp })
+		if !l.closing.Load() {
+			mainLog.Errorf("Listener %s stopped: %v", name, err)
+		}
+	}()
+	mainLog.Infof("Listener %s started on udp %s", name, packetConn.LocalAddr())
+	return l, nil
+}
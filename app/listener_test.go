@@ -0,0 +1,717 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+
+	"seateam/cluster"
+	"seateam/config"
+	"seateam/filters/network"
+	"seateam/transport"
+)
+
+func testListener(name, body string) config.Listener {
+	l := config.Listener{Name: name}
+	l.Address.SocketAddress = config.SocketAddress{Address: "127.0.0.1"}
+	l.FilterChains = []config.FilterChain{{}}
+	l.FilterChains[0].Filters = []config.Filter{{Name: config.HttpConnectionManagerFilter}}
+	l.FilterChains[0].Filters[0].TypedConfig.StatPrefix = body
+	return l
+}
+
+// statPrefixHandler answers every request with the listener's stat_prefix, so
+// tests can tell which config a listener is serving.
+func statPrefixHandler(l config.Listener) *listenerHandler {
+	handler := &listenerHandler{filterChains: l.FilterChains, inspectTLS: l.HasListenerFilter(config.TLSInspectorFilter)}
+	for _, filterChain := range l.FilterChains {
+		var statPrefix string
+		if hcm := httpConnectionManager(filterChain); hcm != nil {
+			statPrefix = hcm.StatPrefix
+		}
+		handler.chains = append(handler.chains, filterChainHandler{http: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, statPrefix)
+		})})
+	}
+	return handler
+}
+
+func get(t *testing.T, address string) (string, error) {
+	t.Helper()
+	client := &http.Client{Timeout: time.Second, Transport: &http.Transport{DisableKeepAlives: true}}
+	resp, err := client.Get("http://" + address + "/")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func TestListenerManagerApply(t *testing.T) {
+	lm := newListenerManager(statPrefixHandler, time.Second)
+	defer lm.Shutdown()
+
+	if err := lm.Apply([]config.Listener{testListener("internal", "internal v1"), testListener("public", "public v1")}); err != nil {
+		t.Fatal(err)
+	}
+	listeners := lm.Listeners()
+	if len(listeners) != 2 {
+		t.Fatalf("expected 2 listeners, got %d", len(listeners))
+	}
+	internalAddress, publicAddress := listeners[0].ln.Addr().String(), listeners[1].ln.Addr().String()
+
+	for address, expected := range map[string]string{internalAddress: "internal v1", publicAddress: "public v1"} {
+		if body, err := get(t, address); err != nil || body != expected {
+			t.Errorf("expected %q from %s, got %q (%v)", expected, address, body, err)
+		}
+	}
+
+	// Reloading keeps the internal socket, swaps its routes and stops the public one.
+	if err := lm.Apply([]config.Listener{testListener("internal", "internal v2")}); err != nil {
+		t.Fatal(err)
+	}
+	if body, err := get(t, internalAddress); err != nil || body != "internal v2" {
+		t.Errorf("expected reloaded routes on %s, got %q (%v)", internalAddress, body, err)
+	}
+	if _, err := get(t, publicAddress); err == nil {
+		t.Errorf("expected removed listener on %s to stop accepting connections", publicAddress)
+	}
+}
+
+func TestListenerManagerReportsBindErrors(t *testing.T) {
+	lm := newListenerManager(statPrefixHandler, time.Second)
+	defer lm.Shutdown()
+
+	if err := lm.Apply([]config.Listener{testListener("first", "first")}); err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := splitHostPort(lm.Listeners()[0].ln.Addr().String())
+
+	taken := testListener("second", "second")
+	taken.Address.SocketAddress.PortValue = port
+	if err := lm.Apply([]config.Listener{testListener("first", "first"), taken}); err == nil {
+		t.Error("expected an error binding a port that is already in use")
+	}
+	if len(lm.Listeners()) != 1 {
+		t.Errorf("expected the listener that did bind to keep running")
+	}
+}
+
+func TestListenerManagerServesTCP(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			io.WriteString(conn, "from upstream")
+			conn.Close()
+		}
+	}()
+	clusters := cluster.NewManager()
+	if err := clusters.Apply([]config.Cluster{testCluster("backend", upstream.Addr().String())}); err != nil {
+		t.Fatal(err)
+	}
+
+	newHandler := func(l config.Listener) *listenerHandler {
+		chain, err := network.NewChain(l.FilterChains[0], clusters)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if chain.TcpProxy == nil {
+			return statPrefixHandler(l)
+		}
+		return &listenerHandler{filterChains: l.FilterChains, chains: []filterChainHandler{{filters: chain, tcp: chain.TcpProxy}}}
+	}
+	lm := newListenerManager(newHandler, time.Second)
+	defer lm.Shutdown()
+
+	tcpListener := testListener("db", "")
+	tcpListener.FilterChains[0].Filters = []config.Filter{{
+		Name:     config.TcpProxyFilter,
+		TcpProxy: &config.TcpProxy{StatPrefix: "db", Cluster: "backend"},
+	}}
+	if err := lm.Apply([]config.Listener{tcpListener}); err != nil {
+		t.Fatal(err)
+	}
+	address := lm.Listeners()[0].ln.Addr().String()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	data, err := io.ReadAll(conn)
+	conn.Close()
+	if err != nil || string(data) != "from upstream" {
+		t.Errorf("expected the upstream's bytes through the TCP listener, got %q (%v)", data, err)
+	}
+
+	// Changing the filter chain to an HTTP one keeps the socket, and new
+	// connections are served as HTTP.
+	_, port, _ := splitHostPort(address)
+	httpListener := testListener("db", "http")
+	httpListener.Address.SocketAddress.PortValue = port
+	if err := lm.Apply([]config.Listener{httpListener}); err != nil {
+		t.Fatal(err)
+	}
+	if body, err := get(t, address); err != nil || body != "http" {
+		t.Errorf("expected the listener to serve HTTP after the reload, got %q (%v)", body, err)
+	}
+}
+
+func TestListenerRoutesTLSByServerName(t *testing.T) {
+	backends := make(map[string]*httptest.Server)
+	clusters := cluster.NewManager()
+	var clusterConfigs []config.Cluster
+	for _, name := range []string{"db", "web"} {
+		name := name
+		backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name)
+		}))
+		defer backend.Close()
+		backends[name] = backend
+		clusterConfigs = append(clusterConfigs, testCluster(name, backend.Listener.Addr().String()))
+	}
+	if err := clusters.Apply(clusterConfigs); err != nil {
+		t.Fatal(err)
+	}
+
+	l := testListener("edge", "plain http")
+	l.ListenerFilters = []config.ListenerFilter{{Name: config.TLSInspectorFilter}}
+	tcpProxyChain := func(cluster string, serverNames ...string) config.FilterChain {
+		filterChain := config.FilterChain{Filters: []config.Filter{{
+			Name:     config.TcpProxyFilter,
+			TcpProxy: &config.TcpProxy{StatPrefix: cluster, Cluster: cluster},
+		}}}
+		filterChain.FilterChainMatch.ServerNames = serverNames
+		return filterChain
+	}
+	l.FilterChains = append(l.FilterChains, tcpProxyChain("db", "db.example.com"), tcpProxyChain("web", "*.example.com"))
+
+	newHandler := func(l config.Listener) *listenerHandler {
+		handler := statPrefixHandler(l)
+		for i, filterChain := range l.FilterChains {
+			if httpConnectionManager(filterChain) != nil {
+				continue
+			}
+			chain, err := network.NewChain(filterChain, clusters)
+			if err != nil {
+				t.Fatal(err)
+			}
+			handler.chains[i] = filterChainHandler{filters: chain, tcp: chain.TcpProxy}
+		}
+		return handler
+	}
+	lm := newListenerManager(newHandler, time.Second)
+	defer lm.Shutdown()
+	if err := lm.Apply([]config.Listener{l}); err != nil {
+		t.Fatal(err)
+	}
+	address := lm.Listeners()[0].ln.Addr().String()
+
+	// The backends' certificates are for example.com, which the client
+	// checks, so the TLS connection must reach them untouched.
+	roots := x509.NewCertPool()
+	roots.AddCert(backends["db"].Certificate())
+	roots.AddCert(backends["web"].Certificate())
+	client := &http.Client{Timeout: 5 * time.Second, Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, address)
+		},
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+	}}
+	for host, expected := range map[string]string{"db.example.com": "db", "www.example.com": "web"} {
+		resp, err := client.Get("https://" + host + "/")
+		if err != nil {
+			t.Errorf("%s: %v", host, err)
+			continue
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != expected {
+			t.Errorf("expected %s to reach %s, got %q", host, expected, body)
+		}
+	}
+	client.CloseIdleConnections()
+
+	if body, err := get(t, address); err != nil || body != "plain http" {
+		t.Errorf("expected plain HTTP to get the default filter chain, got %q (%v)", body, err)
+	}
+}
+
+func TestListenerManagerServesUDP(t *testing.T) {
+	upstream, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := upstream.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			upstream.WriteTo(append([]byte("echo: "), buf[:n]...), addr)
+		}
+	}()
+	clusters := cluster.NewManager()
+	if err := clusters.Apply([]config.Cluster{testCluster("dns", upstream.LocalAddr().String())}); err != nil {
+		t.Fatal(err)
+	}
+
+	lm := newListenerManager(func(l config.Listener) *listenerHandler {
+		proxy, err := network.NewUdpProxy(*l.UdpProxy(), clusters)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &listenerHandler{udp: proxy}
+	}, time.Second)
+	defer lm.Shutdown()
+
+	udpListener := config.Listener{Name: "dns"}
+	udpListener.Address.SocketAddress = config.SocketAddress{Protocol: "UDP", Address: "127.0.0.1"}
+	udpListener.ListenerFilters = []config.ListenerFilter{{
+		Name:     config.UdpProxyFilter,
+		UdpProxy: &config.UdpProxy{StatPrefix: "dns", Cluster: "dns"},
+	}}
+	if err := lm.Apply([]config.Listener{udpListener}); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("udp", lm.Listeners()[0].addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "query")
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "echo: query" {
+		t.Errorf("expected the upstream's reply through the UDP listener, got %q (%v)", buf[:n], err)
+	}
+}
+
+// testTlsCertificate returns an inline self-signed certificate for
+// example.com and the pool that trusts it.
+func testTlsCertificate(t *testing.T) (config.TlsCertificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	return config.TlsCertificate{
+		CertificateChain: config.DataSource{InlineString: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))},
+		PrivateKey:       config.DataSource{InlineString: string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))},
+	}, roots
+}
+
+func TestListenerTerminatesTLS(t *testing.T) {
+	certificate, roots := testTlsCertificate(t)
+	l := testListener("https", "")
+	l.FilterChains[0].TransportSocket = &config.DownstreamTransportSocket{Name: config.TLSTransportSocket}
+	l.FilterChains[0].TransportSocket.TypedConfig.CommonTlsContext.TlsCertificates = []config.TlsCertificate{certificate}
+
+	lm := newListenerManager(func(l config.Listener) *listenerHandler {
+		handler := statPrefixHandler(l)
+		tlsConfig, err := transport.NewServerConfig("https", l.FilterChains[0].TransportSocket.TypedConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler.chains[0].tls = tlsConfig
+		handler.chains[0].http = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.TLS == nil {
+				io.WriteString(w, "plaintext")
+				return
+			}
+			io.WriteString(w, "tls for "+r.TLS.ServerName)
+		})
+		return handler
+	}, time.Second)
+	defer lm.Shutdown()
+	if err := lm.Apply([]config.Listener{l}); err != nil {
+		t.Fatal(err)
+	}
+	address := lm.Listeners()[0].ln.Addr().String()
+
+	client := &http.Client{Timeout: 5 * time.Second, Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, address)
+		},
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+	}}
+	resp, err := client.Get("https://example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "tls for example.com" {
+		t.Errorf("expected the request to arrive over TLS, got %q", body)
+	}
+
+	if _, err := get(t, address); err == nil {
+		t.Error("expected a plaintext request to fail")
+	}
+}
+
+// protoHandler answers every request with the HTTP version it came over,
+// serving each filter chain with its connection manager's codec_type.
+func protoHandler(l config.Listener) *listenerHandler {
+	handler := &listenerHandler{filterChains: l.FilterChains}
+	for _, filterChain := range l.FilterChains {
+		handler.chains = append(handler.chains, filterChainHandler{
+			hcm: httpConnectionManager(filterChain),
+			http: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, r.Proto)
+			}),
+		})
+	}
+	return handler
+}
+
+// getProto sends a request with client and returns the body of the response.
+func getProto(client *http.Client, url string) (string, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+// h2cClient speaks HTTP/2 over plaintext with prior knowledge.
+func h2cClient() *http.Client {
+	return &http.Client{Timeout: 5 * time.Second, Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, address string, _ *tls.Config) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, address)
+		},
+	}}
+}
+
+// TestListenerServesHTTP2 checks that plaintext listeners tell HTTP/2 with
+// prior knowledge from HTTP/1.1 and only serve what their codec_type allows.
+func TestListenerServesHTTP2(t *testing.T) {
+	for _, test := range []struct {
+		codec        string
+		http1, http2 string
+	}{
+		{"", "HTTP/1.1", "HTTP/2.0"},
+		{config.CodecAuto, "HTTP/1.1", "HTTP/2.0"},
+		{config.CodecHTTP1, "HTTP/1.1", ""},
+		{config.CodecHTTP2, "", "HTTP/2.0"},
+	} {
+		l := testListener("h2c", "")
+		l.FilterChains[0].Filters[0].TypedConfig.CodecType = test.codec
+		lm := newListenerManager(protoHandler, time.Second)
+		if err := lm.Apply([]config.Listener{l}); err != nil {
+			t.Fatal(err)
+		}
+		url := "http://" + lm.Listeners()[0].ln.Addr().String() + "/"
+
+		if got, err := getProto(&http.Client{Timeout: 5 * time.Second}, url); got != test.http1 {
+			t.Errorf("codec %q: expected HTTP/1.1 to get %q, got %q (%v)", test.codec, test.http1, got, err)
+		}
+		if got, err := getProto(h2cClient(), url); got != test.http2 {
+			t.Errorf("codec %q: expected HTTP/2 to get %q, got %q (%v)", test.codec, test.http2, got, err)
+		}
+		lm.Shutdown()
+	}
+}
+
+// TestListenerTimesOutSilentClients checks that a plaintext connection that
+// never says whether it speaks HTTP/2 is closed once the listener filters
+// timeout passes.
+func TestListenerTimesOutSilentClients(t *testing.T) {
+	lm := newListenerManager(func(l config.Listener) *listenerHandler {
+		handler := protoHandler(l)
+		handler.inspectTimeout = 50 * time.Millisecond
+		return handler
+	}, time.Second)
+	defer lm.Shutdown()
+	if err := lm.Apply([]config.Listener{testListener("h2c", "")}); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", lm.Listeners()[0].ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected the listener to close the connection, got %v", err)
+	}
+}
+
+// TestListenerUpgradesToH2C checks that an HTTP/1.1 request asking to switch
+// to h2c is answered over HTTP/2.
+func TestListenerUpgradesToH2C(t *testing.T) {
+	lm := newListenerManager(protoHandler, time.Second)
+	defer lm.Shutdown()
+	if err := lm.Apply([]config.Listener{testListener("h2c", "")}); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", lm.Listeners()[0].ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: AAMAAABkAAQAAP__\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Upgrade") != "h2c" {
+		t.Fatalf("expected the connection to switch to h2c, got %d %v", resp.StatusCode, resp.Header)
+	}
+
+	// The request is answered on stream 1 once the client has sent its
+	// preface. It keeps the version it was sent with.
+	io.WriteString(conn, http2.ClientPreface)
+	framer := http2.NewFramer(conn, reader)
+	if err := framer.WriteSettings(); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data, ok := frame.(*http2.DataFrame); ok && data.StreamID == 1 {
+			if body := string(data.Data()); body != "HTTP/1.1" {
+				t.Errorf("expected the upgrade request to be answered over HTTP/2, got %q", body)
+			}
+			return
+		}
+	}
+}
+
+// TestListenerNegotiatesHTTP2 checks that TLS listeners serve HTTP/2 to
+// clients that negotiate it with ALPN, with the connection manager's
+// http2_protocol_options.
+func TestListenerNegotiatesHTTP2(t *testing.T) {
+	certificate, roots := testTlsCertificate(t)
+	l := testListener("https", "")
+	l.FilterChains[0].TransportSocket = &config.DownstreamTransportSocket{Name: config.TLSTransportSocket}
+	l.FilterChains[0].TransportSocket.TypedConfig.CommonTlsContext.TlsCertificates = []config.TlsCertificate{certificate}
+	l.FilterChains[0].TransportSocket.TypedConfig.CommonTlsContext.AlpnProtocols = []string{config.AlpnHTTP2, config.AlpnHTTP1}
+	l.FilterChains[0].Filters[0].TypedConfig.Http2ProtocolOptions = &config.Http2ProtocolOptions{MaxConcurrentStreams: 7}
+
+	lm := newListenerManager(func(l config.Listener) *listenerHandler {
+		handler := protoHandler(l)
+		tlsConfig, err := transport.NewServerConfig("https", l.FilterChains[0].TransportSocket.TypedConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler.chains[0].tls = tlsConfig
+		return handler
+	}, time.Second)
+	defer lm.Shutdown()
+	if err := lm.Apply([]config.Listener{l}); err != nil {
+		t.Fatal(err)
+	}
+	address := lm.Listeners()[0].ln.Addr().String()
+
+	for _, alpn := range []string{config.AlpnHTTP2, config.AlpnHTTP1} {
+		conn, err := tls.Dial("tcp", address, &tls.Config{RootCAs: roots, ServerName: "example.com", NextProtos: []string{alpn}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resp *http.Response
+		var cc *http2.ClientConn
+		req := httptest.NewRequest("GET", "https://example.com/", nil).WithContext(context.Background())
+		req.RequestURI = ""
+		if alpn == config.AlpnHTTP2 {
+			if cc, err = (&http2.Transport{}).NewClientConn(conn); err == nil {
+				resp, err = cc.RoundTrip(req)
+			}
+		} else {
+			req.Write(conn)
+			resp, err = http.ReadResponse(bufio.NewReader(conn), req)
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", alpn, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if want := map[string]string{config.AlpnHTTP2: "HTTP/2.0", config.AlpnHTTP1: "HTTP/1.1"}[alpn]; string(body) != want {
+			t.Errorf("%s: expected the request to arrive over %s, got %q", alpn, want, body)
+		}
+		if cc != nil && cc.State().MaxConcurrentStreams != 7 {
+			t.Errorf("expected the listener to allow 7 concurrent streams, got %d", cc.State().MaxConcurrentStreams)
+		}
+		conn.Close()
+	}
+}
+
+// testQUICListener is a QUIC listener on port with certificate for
+// example.com.
+func testQUICListener(certificate config.TlsCertificate, port int) config.Listener {
+	l := testListener("quic", "")
+	l.Address.SocketAddress = config.SocketAddress{Protocol: "UDP", Address: "127.0.0.1", PortValue: port}
+	l.UdpListenerConfig = &config.UdpListenerConfig{QuicOptions: &config.QuicListenerOptions{}}
+	l.FilterChains[0].TransportSocket = &config.DownstreamTransportSocket{Name: config.QuicTransportSocket}
+	l.FilterChains[0].TransportSocket.TypedConfig.CommonTlsContext.TlsCertificates = []config.TlsCertificate{certificate}
+	l.FilterChains[0].Filters[0].TypedConfig.CodecType = config.CodecHTTP3
+	return l
+}
+
+// quicProtoHandler is protoHandler with the TLS config of QUIC listeners'
+// chains.
+func quicProtoHandler(t *testing.T) func(config.Listener) *listenerHandler {
+	return func(l config.Listener) *listenerHandler {
+		handler := protoHandler(l)
+		if l.IsQUIC() {
+			for i, filterChain := range l.FilterChains {
+				tlsConfig, err := transport.NewServerConfig("quic", filterChain.TransportSocket.TypedConfig)
+				if err != nil {
+					t.Fatal(err)
+				}
+				handler.chains[i].tls = tlsConfig
+			}
+		}
+		return handler
+	}
+}
+
+// TestListenerServesHTTP3 checks that a QUIC listener serves HTTP/3 and that
+// the TCP listener on the same port advertises it.
+func TestListenerServesHTTP3(t *testing.T) {
+	certificate, roots := testTlsCertificate(t)
+	free, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := free.LocalAddr().(*net.UDPAddr).Port
+	free.Close()
+
+	tcpListener := testListener("http", "")
+	tcpListener.Address.SocketAddress.PortValue = port
+	quicListener := testQUICListener(certificate, port)
+
+	lm := newListenerManager(quicProtoHandler(t), time.Second)
+	defer lm.Shutdown()
+	if err := lm.Apply([]config.Listener{tcpListener, quicListener}); err != nil {
+		t.Fatal(err)
+	}
+	url := fmt.Sprintf("https://127.0.0.1:%d/", port)
+
+	h3 := &http3.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "example.com"}}
+	defer h3.Close()
+	if got, err := getProto(&http.Client{Timeout: 5 * time.Second, Transport: h3}, url); got != "HTTP/3.0" {
+		t.Errorf("expected the request to arrive over HTTP/3, got %q (%v)", got, err)
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if want := fmt.Sprintf(`h3=":%d"; ma=86400`, port); resp.Header.Get("Alt-Svc") != want {
+		t.Errorf("expected the TCP listener to advertise %q, got %q", want, resp.Header.Get("Alt-Svc"))
+	}
+
+	if err := lm.Apply([]config.Listener{tcpListener}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.Get(fmt.Sprintf("http://127.0.0.1:%d/", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if altSvc := resp.Header.Get("Alt-Svc"); altSvc != "" {
+		t.Errorf("expected no alt-svc once the QUIC listener is removed, got %q", altSvc)
+	}
+}
+
+// TestListenerReloadRemovesQUICChain checks that open QUIC connections keep
+// the chain they started with once a reload removes it, that new ones are
+// refused, and that a connection left without a chain is answered with 503
+// rather than served by nothing.
+func TestListenerReloadRemovesQUICChain(t *testing.T) {
+	certificate, roots := testTlsCertificate(t)
+	quicListener := testQUICListener(certificate, 0)
+	lm := newListenerManager(quicProtoHandler(t), time.Second)
+	defer lm.Shutdown()
+	if err := lm.Apply([]config.Listener{quicListener}); err != nil {
+		t.Fatal(err)
+	}
+	l := lm.Listeners()[0]
+	url := fmt.Sprintf("https://%s/", l.addr())
+
+	h3 := &http3.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "example.com"}}
+	defer h3.Close()
+	client := &http.Client{Timeout: 5 * time.Second, Transport: h3}
+	if got, err := getProto(client, url); got != "HTTP/3.0" {
+		t.Fatalf("expected the request to arrive over HTTP/3, got %q (%v)", got, err)
+	}
+
+	quicListener.FilterChains[0].FilterChainMatch.ServerNames = []string{"other.example.com"}
+	if err := lm.Apply([]config.Listener{quicListener}); err != nil {
+		t.Fatal(err)
+	}
+	if lm.Listeners()[0] != l {
+		t.Fatal("expected the listener to keep its socket")
+	}
+	if got, err := getProto(client, url); got != "HTTP/3.0" {
+		t.Errorf("expected the open connection to keep its chain, got %q (%v)", got, err)
+	}
+
+	fresh := &http3.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "example.com"}}
+	defer fresh.Close()
+	if got, err := getProto(&http.Client{Timeout: 5 * time.Second, Transport: fresh}, url); err == nil {
+		t.Errorf("expected a new connection to be refused, got %q", got)
+	}
+
+	rr := httptest.NewRecorder()
+	info := &httpConn{serverName: "example.com", transportProtocol: config.TLSTransportProtocol}
+	l.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil).WithContext(context.WithValue(context.Background(), httpConnKey{}, info)))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected a connection without a chain to get 503, got %d", rr.Code)
+	}
+}
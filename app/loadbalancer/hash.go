@@ -0,0 +1,35 @@
+package loadbalancer
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+// HashEndpoint picks the endpoint of lb for key by rendezvous hashing, so the
+// same key keeps going to the same server while that server stays, and only
+// the keys of a server that leaves move elsewhere. Weights are honoured and
+// draining endpoints skipped. The server returned counts as a request to it
+// and must be given back with Release. It returns "" if there is no endpoint.
+func HashEndpoint(lb LoadBalancer, key string) string {
+	best, bestScore := "", math.Inf(-1)
+	for _, endpoint := range lb.Endpoints() {
+		if endpoint.Draining || endpoint.Weight <= 0 {
+			continue
+		}
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(endpoint.Address))
+		// Map the hash into (0, 1) and weight it as in weighted rendezvous
+		// hashing: -weight / ln(u).
+		u := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+		score := -float64(endpoint.Weight) / math.Log(u)
+		if score > bestScore {
+			best, bestScore = endpoint.Address, score
+		}
+	}
+	if best != "" {
+		lb.UpdateConnectionCount(best)
+	}
+	return best
+}
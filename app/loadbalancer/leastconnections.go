@@ -1,14 +1,15 @@
 package loadbalancer
 
 import (
-	"fmt"
 	"io"
 	"net/http"
 	"sync"
 )
 
+// LeastConnectionsLoadBalancer picks the server with the fewest connections
+// relative to its weight, so a server of weight 2 takes twice the connections.
 type LeastConnectionsLoadBalancer struct {
-	servers         []string
+	endpointSet
 	connectionCount map[string]int
 	mutex           sync.Mutex
 }
@@ -20,13 +21,19 @@ func NewLeastConnectionsLoadBalancer(servers []string) *LeastConnectionsLoadBala
 	}
 
 	return &LeastConnectionsLoadBalancer{
-		servers:         servers,
+		endpointSet:     newEndpointSet(NewEndpoints(servers)),
 		connectionCount: connectionCount,
 	}
 }
 
 func (lb *LeastConnectionsLoadBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	server := lb.getLeastConnectionsServer()
+	if server == "" {
+		http.Error(w, "no healthy upstream", http.StatusServiceUnavailable)
+		return
+	}
+	defer lb.Release(server)
+
 	proxyRequest, err := http.NewRequest(r.Method, "http://"+server+r.URL.String(), r.Body)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadGateway)
@@ -62,19 +69,23 @@ func (lb *LeastConnectionsLoadBalancer) getLeastConnectionsServer() string {
 	lb.mutex.Lock()
 	defer lb.mutex.Unlock()
 
-	leastConnectionsServer := lb.servers[0]
-	minConnections := lb.connectionCount[leastConnectionsServer]
+	leastConnectionsServer := ""
+	var minLoad float64
 
-	fmt.Printf("Current connection counts:\n")
-	for _, server := range lb.servers {
-		fmt.Printf("%s: %d connections\n", server, lb.connectionCount[server])
-	}
 	for _, server := range lb.servers {
-		if lb.connectionCount[server] < minConnections {
+		if lb.draining[server] {
+			continue
+		}
+		// Compare the load a server would have with one more connection
+		load := float64(lb.connectionCount[server]+1) / float64(lb.weights[server])
+		if leastConnectionsServer == "" || load < minLoad {
 			leastConnectionsServer = server
-			minConnections = lb.connectionCount[server]
+			minLoad = load
 		}
 	}
+	if leastConnectionsServer == "" {
+		return ""
+	}
 
 	lb.connectionCount[leastConnectionsServer]++
 	return leastConnectionsServer
@@ -87,33 +98,18 @@ func (lb *LeastConnectionsLoadBalancer) NextEndpoint() string {
 	return server
 }
 
-func (lb *LeastConnectionsLoadBalancer) UpdateEndpoints(newServers []string) {
+func (lb *LeastConnectionsLoadBalancer) UpdateEndpoints(endpoints []Endpoint) {
 	lb.mutex.Lock()
 	defer lb.mutex.Unlock()
 
-	// Create a map to check for existing servers
-	existingServers := make(map[string]bool)
-	for _, server := range lb.servers {
-		existingServers[server] = true
-	}
-
-	// Remove servers that are no longer present
-	var updatedServers []string
-	for _, server := range lb.servers {
-		if existingServers[server] && contains(newServers, server) {
-			updatedServers = append(updatedServers, server)
+	lb.endpointSet.update(endpoints)
+	// Removed servers are forgotten once their requests are done, which
+	// Release takes care of for those still busy.
+	for server, count := range lb.connectionCount {
+		if _, ok := lb.weights[server]; !ok && count == 0 {
+			delete(lb.connectionCount, server)
 		}
 	}
-
-	// Add new servers that are not already present
-	for _, server := range newServers {
-		if !existingServers[server] {
-			updatedServers = append(updatedServers, server)
-		}
-	}
-
-	// Update the list of servers and length
-	lb.servers = updatedServers
 }
 
 // UpdateConnectionCount updates the connection count for a specific server.
@@ -126,3 +122,27 @@ func (lb *LeastConnectionsLoadBalancer) updateConnectionCount(server string) {
 	defer lb.mutex.Unlock()
 	lb.connectionCount[server]++
 }
+
+// Release decrements the connection count once a request to server is done.
+func (lb *LeastConnectionsLoadBalancer) Release(server string) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	if lb.connectionCount[server] > 0 {
+		lb.connectionCount[server]--
+	}
+	if _, ok := lb.weights[server]; !ok && lb.connectionCount[server] == 0 {
+		delete(lb.connectionCount, server)
+	}
+}
+
+func (lb *LeastConnectionsLoadBalancer) ActiveRequests() map[string]int {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	return activeRequests(lb.servers, lb.connectionCount)
+}
+
+func (lb *LeastConnectionsLoadBalancer) Endpoints() []Endpoint {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	return lb.endpointSet.endpoints()
+}
@@ -9,34 +9,140 @@ import (
 )
 
 // LoadBalancer is the interface that defines the methods for a load balancer.
+// Every server handed out by NextEndpoint, or passed to UpdateConnectionCount,
+// counts as an active request until it is given back with Release.
 type LoadBalancer interface {
 	ServeHTTP(w http.ResponseWriter, r *http.Request)
 	NextEndpoint() string
-	UpdateEndpoints(newServers []string)
+	// UpdateEndpoints replaces the set of endpoints. Servers that stay keep
+	// their place and their active request counts.
+	UpdateEndpoints(endpoints []Endpoint)
+
+	// UpdateConnectionCount records a request to a server that was chosen
+	// without asking the load balancer.
+	UpdateConnectionCount(server string)
+	// Release records that a request to server has finished.
+	Release(server string)
+	// ActiveRequests returns the number of requests in flight per server.
+	ActiveRequests() map[string]int
+	// Endpoints returns the endpoints the load balancer is choosing from.
+	Endpoints() []Endpoint
+}
+
+// Endpoint is a "host:port" server along with how it should be picked. A
+// draining endpoint gets no new requests but the ones in flight may finish.
+// Metadata is whatever service discovery knows about the server.
+type Endpoint struct {
+	Address  string
+	Weight   int
+	Draining bool
+	Metadata map[string]string
+}
+
+// NewEndpoints turns plain server addresses into endpoints of equal weight.
+func NewEndpoints(servers []string) []Endpoint {
+	endpoints := make([]Endpoint, len(servers))
+	for i, server := range servers {
+		endpoints[i] = Endpoint{Address: server, Weight: 1}
+	}
+	return endpoints
 }
 
+// endpointSet is the list of servers shared by the load balancers, kept in the
+// order they were first added, with their weights and drain state.
+type endpointSet struct {
+	servers  []string
+	weights  map[string]int
+	draining map[string]bool
+	metadata map[string]map[string]string
+}
+
+func newEndpointSet(endpoints []Endpoint) endpointSet {
+	set := endpointSet{weights: make(map[string]int), draining: make(map[string]bool), metadata: make(map[string]map[string]string)}
+	set.update(endpoints)
+	return set
+}
+
+func (set *endpointSet) update(endpoints []Endpoint) {
+	newServers := make([]string, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		newServers = append(newServers, endpoint.Address)
+	}
+
+	// Create a map to check for existing servers
+	existingServers := make(map[string]bool)
+	for _, server := range set.servers {
+		existingServers[server] = true
+	}
+
+	// Remove servers that are no longer present
+	var updatedServers []string
+	for _, server := range set.servers {
+		if contains(newServers, server) {
+			updatedServers = append(updatedServers, server)
+		} else {
+			delete(set.weights, server)
+			delete(set.draining, server)
+			delete(set.metadata, server)
+		}
+	}
+
+	// Add new servers that are not already present
+	for _, server := range newServers {
+		if !existingServers[server] {
+			updatedServers = append(updatedServers, server)
+			existingServers[server] = true
+		}
+	}
+
+	for _, endpoint := range endpoints {
+		weight := endpoint.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		set.weights[endpoint.Address] = weight
+		set.draining[endpoint.Address] = endpoint.Draining
+		set.metadata[endpoint.Address] = endpoint.Metadata
+	}
+	set.servers = updatedServers
+}
+
+func (set *endpointSet) endpoints() []Endpoint {
+	endpoints := make([]Endpoint, len(set.servers))
+	for i, server := range set.servers {
+		endpoints[i] = Endpoint{Address: server, Weight: set.weights[server], Draining: set.draining[server], Metadata: set.metadata[server]}
+	}
+	return endpoints
+}
+
+// RoundRobinLoadBalancer hands out servers in turn. Weighted servers are spread
+// out with smooth weighted round robin, so with equal weights it is plain
+// round robin.
 type RoundRobinLoadBalancer struct {
-	servers   []string
-	current   int
-	mutex     sync.Mutex
-	serverLen int
+	endpointSet
+	mutex          sync.Mutex
+	serverLen      int
+	currentWeights map[string]int
+	activeRequests map[string]int
 }
 
 func NewRoundRobinLoadBalancer(servers []string) *RoundRobinLoadBalancer {
 	return &RoundRobinLoadBalancer{
-		servers:   servers,
-		current:   0,
-		mutex:     sync.Mutex{},
-		serverLen: len(servers),
+		endpointSet:    newEndpointSet(NewEndpoints(servers)),
+		mutex:          sync.Mutex{},
+		serverLen:      len(servers),
+		currentWeights: make(map[string]int),
+		activeRequests: make(map[string]int),
 	}
 }
 
 func (lb *RoundRobinLoadBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	lb.mutex.Lock()
-	defer lb.mutex.Unlock()
-
-	server := lb.servers[lb.current]
-	lb.current = (lb.current + 1) % lb.serverLen
+	server := lb.NextEndpoint()
+	if server == "" {
+		http.Error(w, "no healthy upstream", http.StatusServiceUnavailable)
+		return
+	}
+	defer lb.Release(server)
 
 	proxyRequest, err := http.NewRequest(r.Method, "http://"+server+r.URL.String(), r.Body)
 	if err != nil {
@@ -70,49 +176,84 @@ func (lb *RoundRobinLoadBalancer) ServeHTTP(w http.ResponseWriter, r *http.Reque
 }
 
 // NextEndpoint returns the next backend server based on round-robin logic.
+// It returns an empty string when there is no server that is not draining.
 func (lb *RoundRobinLoadBalancer) NextEndpoint() string {
 	lb.mutex.Lock()
 	defer lb.mutex.Unlock()
 
-	server := lb.servers[lb.current]
-	lb.current = (lb.current + 1) % lb.serverLen
+	server, totalWeight := "", 0
+	for _, candidate := range lb.servers {
+		if lb.draining[candidate] {
+			continue
+		}
+		weight := lb.weights[candidate]
+		lb.currentWeights[candidate] += weight
+		totalWeight += weight
+		if server == "" || lb.currentWeights[candidate] > lb.currentWeights[server] {
+			server = candidate
+		}
+	}
+	if server == "" {
+		return ""
+	}
+	lb.currentWeights[server] -= totalWeight
+	lb.activeRequests[server]++
 
 	return server
 }
 
-func (lb *RoundRobinLoadBalancer) UpdateEndpoints(newServers []string) {
+func (lb *RoundRobinLoadBalancer) UpdateConnectionCount(server string) {
 	lb.mutex.Lock()
 	defer lb.mutex.Unlock()
+	lb.activeRequests[server]++
+}
 
-	// Create a map to check for existing servers
-	existingServers := make(map[string]bool)
-	for _, server := range lb.servers {
-		existingServers[server] = true
-	}
+func (lb *RoundRobinLoadBalancer) Release(server string) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	release(lb.activeRequests, server)
+}
 
-	// Remove servers that are no longer present
-	var updatedServers []string
-	for _, server := range lb.servers {
-		if existingServers[server] && contains(newServers, server) {
-			updatedServers = append(updatedServers, server)
-		}
-	}
+func (lb *RoundRobinLoadBalancer) ActiveRequests() map[string]int {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	return activeRequests(lb.servers, lb.activeRequests)
+}
 
-	// Add new servers that are not already present
-	for _, server := range newServers {
-		if !existingServers[server] {
-			updatedServers = append(updatedServers, server)
-		}
-	}
+func (lb *RoundRobinLoadBalancer) Endpoints() []Endpoint {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	return lb.endpointSet.endpoints()
+}
 
-	// Update the list of servers and length
-	lb.servers = updatedServers
-	lb.serverLen = len(updatedServers)
+func (lb *RoundRobinLoadBalancer) UpdateEndpoints(endpoints []Endpoint) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	lb.endpointSet.update(endpoints)
+	lb.serverLen = len(lb.servers)
+
+	// Start the rotation over so the new weights take effect evenly
+	lb.currentWeights = make(map[string]int)
+}
 
-	// If the current index is out of bounds, reset to 0
-	if lb.current >= lb.serverLen {
-		lb.current = 0
+// release decrements the count for server, forgetting servers that have no
+// requests left so removed servers do not linger in the map.
+func release(counts map[string]int, server string) {
+	if counts[server] <= 1 {
+		delete(counts, server)
+		return
+	}
+	counts[server]--
+}
+
+// activeRequests copies counts for every current server, including idle ones.
+func activeRequests(servers []string, counts map[string]int) map[string]int {
+	active := make(map[string]int, len(servers))
+	for _, server := range servers {
+		active[server] = counts[server]
 	}
+	return active
 }
 
 func contains(servers []string, target string) bool {
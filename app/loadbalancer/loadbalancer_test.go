@@ -36,4 +36,87 @@ func TestRoundRobinLoadBalancer(t *testing.T) {
         lb.ServeHTTP(w, r)
     })
 }
-*/
\ No newline at end of file
+*/
+
+func TestRoundRobinWeightsAndDraining(t *testing.T) {
+	lb := NewRoundRobinLoadBalancer([]string{"server1", "server2", "server3"})
+	lb.UpdateEndpoints([]Endpoint{
+		{Address: "server1", Weight: 3},
+		{Address: "server2", Weight: 1},
+		{Address: "server3", Weight: 1, Draining: true},
+	})
+
+	counts := make(map[string]int)
+	for i := 0; i < 8; i++ {
+		counts[lb.NextEndpoint()]++
+	}
+	if counts["server1"] != 6 || counts["server2"] != 2 || counts["server3"] != 0 {
+		t.Errorf("expected a 3:1 split that skips the draining server, got %v", counts)
+	}
+}
+
+func TestLeastConnectionsWeightsAndDraining(t *testing.T) {
+	lb := NewLeastConnectionsLoadBalancer([]string{"server1", "server2", "server3"})
+	lb.UpdateEndpoints([]Endpoint{
+		{Address: "server1", Weight: 2},
+		{Address: "server2", Weight: 1},
+		{Address: "server3", Weight: 1, Draining: true},
+	})
+
+	counts := make(map[string]int)
+	for i := 0; i < 6; i++ {
+		counts[lb.NextEndpoint()]++
+	}
+	if counts["server1"] != 4 || counts["server2"] != 2 || counts["server3"] != 0 {
+		t.Errorf("expected connections in proportion to weight, got %v", counts)
+	}
+
+	lb.UpdateEndpoints([]Endpoint{{Address: "server2", Weight: 1}})
+	if active := lb.ActiveRequests(); active["server2"] != 2 || len(active) != 1 {
+		t.Errorf("expected server2 to keep its active requests after the update, got %v", active)
+	}
+}
+
+func TestLeastConnectionsForgetsRemovedEndpoints(t *testing.T) {
+	lb := NewLeastConnectionsLoadBalancer([]string{"server1", "server2"})
+	busy := lb.NextEndpoint()
+	idle := "server1"
+	if busy == idle {
+		idle = "server2"
+	}
+
+	lb.UpdateEndpoints([]Endpoint{{Address: "server3", Weight: 1}})
+	if _, ok := lb.connectionCount[idle]; ok {
+		t.Errorf("expected the idle removed server %s to be forgotten", idle)
+	}
+	if lb.connectionCount[busy] != 1 {
+		t.Errorf("expected the busy removed server %s to be kept until its request is done", busy)
+	}
+	lb.Release(busy)
+	if _, ok := lb.connectionCount[busy]; ok {
+		t.Errorf("expected %s to be forgotten once its request is done", busy)
+	}
+}
+
+func TestHashEndpoint(t *testing.T) {
+	lb := NewRoundRobinLoadBalancer([]string{"server1", "server2", "server3"})
+	picked := make(map[string]string)
+	for _, key := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5", "10.0.0.6"} {
+		picked[key] = HashEndpoint(lb, key)
+		if again := HashEndpoint(lb, key); again != picked[key] {
+			t.Errorf("expected %s to stay on %s, got %s", key, picked[key], again)
+		}
+	}
+	if active := lb.ActiveRequests(); active["server1"]+active["server2"]+active["server3"] != 12 {
+		t.Errorf("expected every pick to count as a request, got %v", active)
+	}
+
+	// Only the keys of the draining server move.
+	lb.UpdateEndpoints([]Endpoint{{Address: "server1", Weight: 1}, {Address: "server2", Weight: 1}, {Address: "server3", Weight: 1, Draining: true}})
+	for key, server := range picked {
+		moved := HashEndpoint(lb, key)
+		if moved == "server3" || server != "server3" && moved != server {
+			t.Errorf("expected %s to move only off server3, went from %s to %s", key, server, moved)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+// Package logger provides named, leveled loggers whose levels can be changed
+// while the router is running.
+package logger
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type Level int32
+
+const (
+	Trace Level = iota
+	Debug
+	Info
+	Warning
+	Error
+	Critical
+	Off
+)
+
+var levelNames = []string{"trace", "debug", "info", "warning", "error", "critical", "off"}
+
+func (l Level) String() string {
+	if l < Trace || l > Off {
+		return fmt.Sprintf("level(%d)", int32(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel accepts the level names used by Envoy's --log-level flag.
+func ParseLevel(name string) (Level, error) {
+	name = strings.ToLower(name)
+	if name == "warn" {
+		return Warning, nil
+	}
+	for i, levelName := range levelNames {
+		if levelName == name {
+			return Level(i), nil
+		}
+	}
+	return Info, fmt.Errorf("unknown log level %q, expected one of %s", name, strings.Join(levelNames, ", "))
+}
+
+type Logger struct {
+	name  string
+	level atomic.Int32
+	out   *log.Logger
+}
+
+var (
+	mu           sync.Mutex
+	loggers      = make(map[string]*Logger)
+	defaultLevel = Info
+	output       = log.New(os.Stderr, "", log.Ldate|log.Ltime|log.Lmicroseconds)
+)
+
+// Get returns the logger with the given name, creating it at the default level
+// the first time it is asked for.
+func Get(name string) *Logger {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if l, ok := loggers[name]; ok {
+		return l
+	}
+	l := &Logger{name: name, out: output}
+	l.level.Store(int32(defaultLevel))
+	loggers[name] = l
+	return l
+}
+
+// SetLevel changes the level of every logger, including ones created later.
+func SetLevel(level Level) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	defaultLevel = level
+	for _, l := range loggers {
+		l.SetLevel(level)
+	}
+}
+
+// Loggers returns all loggers sorted by name.
+func Loggers() []*Logger {
+	mu.Lock()
+	defer mu.Unlock()
+
+	all := make([]*Logger, 0, len(loggers))
+	for _, l := range loggers {
+		all = append(all, l)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].name < all[j].name })
+	return all
+}
+
+func (l *Logger) Name() string {
+	return l.name
+}
+
+func (l *Logger) Level() Level {
+	return Level(l.level.Load())
+}
+
+func (l *Logger) SetLevel(level Level) {
+	l.level.Store(int32(level))
+}
+
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.Level() && level < Off
+}
+
+func (l *Logger) logf(level Level, format string, args ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	l.out.Printf("[%s][%s] %s", level, l.name, fmt.Sprintf(format, args...))
+}
+
+func (l *Logger) Tracef(format string, args ...interface{}) {
+	l.logf(Trace, format, args...)
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.logf(Debug, format, args...)
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.logf(Info, format, args...)
+}
+
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.logf(Warning, format, args...)
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.logf(Error, format, args...)
+}
+
+func (l *Logger) Criticalf(format string, args ...interface{}) {
+	l.logf(Critical, format, args...)
+}
+
+// Fatalf logs at critical level regardless of the configured level and exits.
+func (l *Logger) Fatalf(format string, args ...interface{}) {
+	l.out.Printf("[%s][%s] %s", Critical, l.name, fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
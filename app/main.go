@@ -2,108 +2,103 @@ package main
 
 import (
 	"fmt"
-	"log"
-	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
-	"time"
 
 	"github.com/fsnotify/fsnotify"
 
-	api "seateam/api"
 	config "seateam/config"
-	loadbalancer "seateam/loadbalancer"
+	"seateam/discovery"
+	"seateam/logger"
 )
 
-func main() {
-	// Initial config load
-	configuration, backendServers := loadConfig()
+var mainLog = logger.Get("main")
 
-	lbPolicy := configuration.StaticResources.Clusters[0].LbPolicy
+func main() {
+	opts, err := parseOptions(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	logger.SetLevel(opts.logLevel)
 
-	// Grabbing all endpoints from the config
-	var backendAddresses []string
-	for _, server := range backendServers {
-		backendAddresses = append(backendAddresses, fmt.Sprintf("http://%s:%d/", server.Address, server.Port))
+	if opts.checkConfig {
+		paths := opts.checkPaths
+		if len(paths) == 0 {
+			paths = []string{opts.configPath}
+		}
+		os.Exit(runCheckConfig(paths))
 	}
 
-	// Create loadbalancer with grabbed endpoints
-	var loadBalancer loadbalancer.LoadBalancer
-	switch lbPolicy {
-	case "ROUND_ROBIN":
-		loadBalancer = loadbalancer.NewRoundRobinLoadBalancer(backendAddresses)
-	case "LEAST_CONNECTIONS":
-		loadBalancer = loadbalancer.NewLeastConnectionsLoadBalancer(backendAddresses)
-	default:
-		// Default to Round Robin if lbPolicy is not recognized
-		loadBalancer = loadbalancer.NewRoundRobinLoadBalancer(backendAddresses)
+	mainLog.Infof("starting node %q (cluster %q, base id %d) with config %s", opts.serviceNode, opts.serviceCluster, opts.baseID, opts.configPath)
+
+	// Load persisted registrations before the REGISTRY clusters start
+	if opts.registryPath != "" {
+		if err := discovery.DefaultRegistry.Persist(opts.registryPath); err != nil {
+			mainLog.Fatalf("Failed to start: %v", err)
+		}
 	}
 
-	r := &Router{
-		Timeout:      10 * time.Second, // Example timeout value
-		Config:       configuration,
-		LoadBalancer: loadBalancer,
-		ErrorLogger:  log.New(os.Stderr, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile),
+	// Initial config load
+	server := NewServer(opts)
+	if err := server.Reload(); err != nil {
+		mainLog.Fatalf("Failed to start:\n%v", err)
+	}
+	if err := server.StartAdmin(); err != nil {
+		mainLog.Fatalf("Failed to start: %v", err)
+	}
+	if err := server.StartXDS(); err != nil {
+		mainLog.Fatalf("Failed to start: %v", err)
 	}
 
 	// Watch for changes in the config file
-	go watchConfigFile("config/static.yaml", func() {
-		configuration, backendServers = loadConfig()
-		lbPolicy = configuration.StaticResources.Clusters[0].LbPolicy
-		var updatedBackendAddresses []string
-		for _, server := range backendServers {
-			updatedBackendAddresses = append(updatedBackendAddresses, fmt.Sprintf("http://%s:%d/", server.Address, server.Port))
-		}
-
-		var updatedLoadBalancer loadbalancer.LoadBalancer
-		switch lbPolicy {
-		case "ROUND_ROBIN":
-			updatedLoadBalancer = loadbalancer.NewRoundRobinLoadBalancer(updatedBackendAddresses)
-		case "LEAST_CONNECTIONS":
-			updatedLoadBalancer = loadbalancer.NewLeastConnectionsLoadBalancer(updatedBackendAddresses)
-		default:
-			updatedLoadBalancer = loadbalancer.NewRoundRobinLoadBalancer(updatedBackendAddresses)
+	go watchConfigFile(opts.configPath, func() {
+		if err := server.Reload(); err != nil {
+			mainLog.Errorf("Reload failed, keeping previous configuration where it could not be applied:\n%v", err)
 		}
-
-		r.LoadBalancer = updatedLoadBalancer
-		r.Config = configuration
 	})
 
-	// Serve the API endpoints
-	http.Handle("/", r)
-	http.HandleFunc("/health", api.HealthCheckHandler)
-	http.HandleFunc("/endpoint1", api.Endpoint1Handler)
-	http.HandleFunc("/endpoint2", api.Endpoint2Handler)
-
-	// Serve frontend files
-	fs := http.FileServer(http.Dir("./frontend"))
-	http.Handle("/static/", http.StripPrefix("/static/", fs))
-
-	log.Println("Server started on :8000")
-	if err := http.ListenAndServe(":8000", nil); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
-	}
-
 	// Wait for termination signals
 	signalChannel := make(chan os.Signal, 1)
 	signal.Notify(signalChannel, syscall.SIGINT, syscall.SIGTERM)
 	<-signalChannel
-	log.Println("Shutting down the server...")
+	mainLog.Infof("Shutting down the server, draining connections for up to %s...", opts.drainTime)
+	server.Shutdown()
 }
 
-func loadConfig() (config.StaticBootstrap, []config.BackendServer) {
+func loadConfig(opts options) (config.StaticBootstrap, []config.BackendServer, error) {
 	// Load configuration from file
-	configuration, servers := config.GetYAMLdata()
-	fmt.Println("Configuration loaded successfully:", configuration)
-	fmt.Println("Backend servers:", servers)
-	return configuration, servers
+	configuration, servers, err := config.GetYAMLdata(opts.configPath)
+	if err != nil {
+		return configuration, servers, err
+	}
+	opts.applyOverrides(&configuration)
+	mainLog.Debugf("Configuration loaded successfully: %+v", configuration)
+	mainLog.Infof("Backend servers: %v", servers)
+	return configuration, servers, nil
+}
+
+// runCheckConfig validates each file and returns the process exit code, so the
+// command can gate config changes in CI before they are deployed.
+func runCheckConfig(paths []string) int {
+	exitCode := 0
+	for _, path := range paths {
+		if _, err := config.Load(path); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: invalid configuration\n%v\n", path, err)
+			exitCode = 1
+			continue
+		}
+		fmt.Printf("%s: configuration OK\n", path)
+	}
+	return exitCode
 }
 
 func watchConfigFile(filePath string, reloadFunc func()) {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
-		log.Fatalf("Error creating file watcher: %v", err)
+		mainLog.Fatalf("Error creating file watcher: %v", err)
 	}
 	defer watcher.Close()
 
@@ -115,22 +110,24 @@ func watchConfigFile(filePath string, reloadFunc func()) {
 				if !ok {
 					return
 				}
-				if event.Op&fsnotify.Write == fsnotify.Write {
-					log.Println("Config file modified. Reloading...")
+				// The directory is watched, so the file is still seen after
+				// it is replaced with a rename, as persisted changes are.
+				if filepath.Clean(event.Name) == filepath.Clean(filePath) && event.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+					mainLog.Infof("Config file modified. Reloading...")
 					reloadFunc()
 				}
 			case err, ok := <-watcher.Errors:
 				if !ok {
 					return
 				}
-				log.Printf("Error watching config file: %v", err)
+				mainLog.Errorf("Error watching config file: %v", err)
 			}
 		}
 	}()
 
-	err = watcher.Add(filePath)
+	err = watcher.Add(filepath.Dir(filePath))
 	if err != nil {
-		log.Fatalf("Error adding config file to watcher: %v", err)
+		mainLog.Fatalf("Error adding config file to watcher: %v", err)
 	}
 
 	<-done // This will block until the watcher is closed (which never happens in this code)
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"seateam/config"
+	"seateam/logger"
+)
+
+// options holds the command line settings. Every flag can also be set through
+// an ENVOYROUTER_* environment variable; a flag on the command line wins.
+type options struct {
+	configPath     string
+	serviceNode    string
+	serviceCluster string
+	serviceZone    string
+	logLevel       logger.Level
+	drainTime      time.Duration
+	baseID         int
+	adminAddress   string
+	adminToken     string
+	registryToken  string
+	registryPath   string
+	checkConfig    bool
+	checkPaths     []string
+}
+
+func parseOptions(args []string) (options, error) {
+	var opts options
+	fs := flag.NewFlagSet("envoyrouter", flag.ContinueOnError)
+
+	defaultLogLevel := envOr("ENVOYROUTER_LOG_LEVEL", "info")
+	defaultDrainTime, err := envInt("ENVOYROUTER_DRAIN_TIME_S", 600)
+	if err != nil {
+		return opts, err
+	}
+	defaultBaseID, err := envInt("ENVOYROUTER_BASE_ID", 0)
+	if err != nil {
+		return opts, err
+	}
+
+	var logLevel string
+	var drainTimeSeconds int
+	fs.StringVar(&opts.configPath, "config-path", envOr("ENVOYROUTER_CONFIG_PATH", config.DefaultPath), "path to the bootstrap config file (env ENVOYROUTER_CONFIG_PATH)")
+	fs.StringVar(&opts.configPath, "c", envOr("ENVOYROUTER_CONFIG_PATH", config.DefaultPath), "shorthand for --config-path")
+	fs.StringVar(&opts.serviceNode, "service-node", envOr("ENVOYROUTER_SERVICE_NODE", hostname()), "name of this router instance (env ENVOYROUTER_SERVICE_NODE)")
+	fs.StringVar(&opts.serviceCluster, "service-cluster", envOr("ENVOYROUTER_SERVICE_CLUSTER", ""), "name of the cluster this router belongs to (env ENVOYROUTER_SERVICE_CLUSTER)")
+	fs.StringVar(&opts.serviceZone, "service-zone", envOr("ENVOYROUTER_SERVICE_ZONE", ""), "zone this router runs in, overriding node.locality.zone in the config (env ENVOYROUTER_SERVICE_ZONE)")
+	fs.StringVar(&logLevel, "log-level", defaultLogLevel, "trace, debug, info, warning, error, critical or off (env ENVOYROUTER_LOG_LEVEL)")
+	fs.StringVar(&logLevel, "l", defaultLogLevel, "shorthand for --log-level")
+	fs.IntVar(&drainTimeSeconds, "drain-time-s", defaultDrainTime, "seconds to wait for open connections to finish on shutdown (env ENVOYROUTER_DRAIN_TIME_S)")
+	fs.IntVar(&opts.baseID, "base-id", defaultBaseID, "identifies this instance when several routers run on one host (env ENVOYROUTER_BASE_ID)")
+	fs.StringVar(&opts.adminAddress, "admin-address", envOr("ENVOYROUTER_ADMIN_ADDRESS", ""), "host:port overriding the admin address in the config (env ENVOYROUTER_ADMIN_ADDRESS)")
+	fs.StringVar(&opts.adminToken, "admin-token", envOr("ENVOYROUTER_ADMIN_TOKEN", ""), "bearer token for the admin management API, which is off without one (env ENVOYROUTER_ADMIN_TOKEN)")
+	fs.StringVar(&opts.registryToken, "registry-token", envOr("ENVOYROUTER_REGISTRY_TOKEN", ""), "bearer token backends register with in REGISTRY clusters, which is off without one (env ENVOYROUTER_REGISTRY_TOKEN)")
+	fs.StringVar(&opts.registryPath, "registry-path", envOr("ENVOYROUTER_REGISTRY_PATH", ""), "file persistent registrations are kept in (env ENVOYROUTER_REGISTRY_PATH)")
+	fs.BoolVar(&opts.checkConfig, "check-config", false, "validate the config files given as arguments (or the configured config path) and exit")
+
+	if err := fs.Parse(args); err != nil {
+		return opts, err
+	}
+	opts.checkPaths = fs.Args()
+
+	if opts.logLevel, err = logger.ParseLevel(logLevel); err != nil {
+		return opts, err
+	}
+	if drainTimeSeconds < 0 {
+		return opts, fmt.Errorf("drain time must not be negative, got %d", drainTimeSeconds)
+	}
+	opts.drainTime = time.Duration(drainTimeSeconds) * time.Second
+	if opts.adminAddress != "" {
+		if _, _, err := splitHostPort(opts.adminAddress); err != nil {
+			return opts, fmt.Errorf("invalid admin address %q: %v", opts.adminAddress, err)
+		}
+	}
+	return opts, nil
+}
+
+// applyOverrides replaces config values that were overridden on the command line.
+func (opts options) applyOverrides(configuration *config.StaticBootstrap) {
+	if opts.adminAddress != "" {
+		host, port, _ := splitHostPort(opts.adminAddress)
+		configuration.Admin.Address.SocketAddress.Address = host
+		configuration.Admin.Address.SocketAddress.PortValue = port
+	}
+	if opts.serviceZone != "" {
+		configuration.Node.Locality.Zone = opts.serviceZone
+	}
+}
+
+func splitHostPort(address string) (string, int, error) {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil || port < 0 || port > 65535 {
+		return "", 0, fmt.Errorf("invalid port %q", portString)
+	}
+	return host, port, nil
+}
+
+func envOr(name, fallback string) string {
+	if value, ok := os.LookupEnv(name); ok && value != "" {
+		return value
+	}
+	return fallback
+}
+
+func envInt(name string, fallback int) (int, error) {
+	value := envOr(name, "")
+	if value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %v", name, value, err)
+	}
+	return n, nil
+}
+
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	return name
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"seateam/config"
+	"seateam/logger"
+)
+
+func TestParseOptionsDefaults(t *testing.T) {
+	opts, err := parseOptions(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.configPath != config.DefaultPath {
+		t.Errorf("expected default config path %q, got %q", config.DefaultPath, opts.configPath)
+	}
+	if opts.logLevel != logger.Info {
+		t.Errorf("expected info log level, got %v", opts.logLevel)
+	}
+	if opts.drainTime != 600*time.Second {
+		t.Errorf("expected 600s drain time, got %v", opts.drainTime)
+	}
+}
+
+func TestParseOptionsFlagsOverrideEnvironment(t *testing.T) {
+	t.Setenv("ENVOYROUTER_CONFIG_PATH", "/config/static.yaml")
+	t.Setenv("ENVOYROUTER_LOG_LEVEL", "debug")
+	t.Setenv("ENVOYROUTER_DRAIN_TIME_S", "5")
+
+	opts, err := parseOptions([]string{"-l", "error", "--admin-address", "0.0.0.0:9902", "--service-zone", "zone-a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.configPath != "/config/static.yaml" {
+		t.Errorf("expected config path from environment, got %q", opts.configPath)
+	}
+	if opts.logLevel != logger.Error {
+		t.Errorf("expected flag to override log level, got %v", opts.logLevel)
+	}
+	if opts.drainTime != 5*time.Second {
+		t.Errorf("expected drain time from environment, got %v", opts.drainTime)
+	}
+
+	var configuration config.StaticBootstrap
+	opts.applyOverrides(&configuration)
+	if address := configuration.Admin.Address.SocketAddress; address.Address != "0.0.0.0" || address.PortValue != 9902 {
+		t.Errorf("expected admin address override, got %+v", address)
+	}
+	if zone := configuration.Node.Locality.Zone; zone != "zone-a" {
+		t.Errorf("expected service zone override, got %q", zone)
+	}
+}
+
+func TestParseOptionsRejectsBadValues(t *testing.T) {
+	for _, args := range [][]string{
+		{"--log-level", "loud"},
+		{"--drain-time-s", "-1"},
+		{"--admin-address", "localhost"},
+	} {
+		if _, err := parseOptions(args); err == nil {
+			t.Errorf("expected %v to be rejected", args)
+		}
+	}
+}
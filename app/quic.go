@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+
+	"seateam/config"
+)
+
+// altSvcMaxAge is how many seconds clients may remember that a QUIC listener
+// serves HTTP/3, as advertised in alt-svc.
+const altSvcMaxAge = 86400
+
+// startQUICListener binds a QUIC listener and serves HTTP/3 on it with the
+// filter chains of whichever handler is current. The quic_options of the
+// handler it starts with apply for as long as the socket stays bound.
+func startQUICListener(name, address string, handler *listenerHandler) (*listener, error) {
+	packetConn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("listener %s: %v", name, err)
+	}
+
+	l := &listener{name: name, network: "quic", address: address, packetConn: packetConn}
+	l.setHandler(handler)
+	l.quic = &http3.Server{
+		Handler:    l,
+		TLSConfig:  &tls.Config{GetConfigForClient: l.quicTLSConfig},
+		QUICConfig: newQUICConfig(handler.quicOptions),
+		ConnContext: func(ctx context.Context, conn quic.Connection) context.Context {
+			info := &httpConn{
+				serverName:        conn.ConnectionState().TLS.ServerName,
+				transportProtocol: config.TLSTransportProtocol,
+			}
+			info.chain = l.handler.Load().match(info.serverName, info.transportProtocol)
+			if info.chain == nil || info.chain.http == nil {
+				// A reload removed the chain the handshake was done for.
+				conn.CloseWithError(quic.ApplicationErrorCode(http3.ErrCodeNoError), "no filter chain for the connection")
+			}
+			return context.WithValue(ctx, httpConnKey{}, info)
+		},
+	}
+	go func() {
+		if err := l.quic.Serve(packetConn); err != nil && err != http.ErrServerClosed && !l.closing.Load() {
+			mainLog.Errorf("Listener %s stopped: %v", name, err)
+		}
+	}()
+	mainLog.Infof("Listener %s started on quic %s", name, packetConn.LocalAddr())
+	return l, nil
+}
+
+// quicTLSConfig returns the TLS config of the filter chain a new QUIC
+// connection matches. Connections matching no chain that can serve them fail
+// their handshake.
+func (l *listener) quicTLSConfig(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	chain := l.handler.Load().match(hello.ServerName, config.TLSTransportProtocol)
+	if chain == nil || chain.tls == nil || chain.http == nil {
+		return nil, errors.New("no filter chain for the connection")
+	}
+	return chain.tls.QUICConfig(), nil
+}
+
+func newQUICConfig(options *config.QuicListenerOptions) *quic.Config {
+	// 0-RTT requests could be replayed by an attacker, so they are not
+	// taken.
+	c := &quic.Config{Allow0RTT: false}
+	if options == nil {
+		return c
+	}
+	if streams := options.QuicProtocolOptions.MaxConcurrentStreams; streams > 0 {
+		c.MaxIncomingStreams = int64(streams)
+	}
+	if options.IdleTimeout != "" {
+		// Validation has already checked the timeout.
+		c.MaxIdleTimeout, _ = time.ParseDuration(options.IdleTimeout)
+	}
+	return c
+}
+
+// drainQUIC sends GOAWAY on the listener's connections and waits up to
+// drainTime for their requests to finish before closing the socket, which
+// the connections share.
+func (l *listener) drainQUIC(drainTime time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), drainTime)
+	defer cancel()
+	err := l.quic.Shutdown(ctx)
+	l.packetConn.Close()
+	return err
+}
+
+// advertiseHTTP3 makes every TCP listener advertise the QUIC listener bound
+// to the same port, if there is one, in the alt-svc header of its
+// responses.
+func (lm *listenerManager) advertiseHTTP3() {
+	quicPorts := make(map[int]bool)
+	for _, l := range lm.listeners {
+		if l.quic != nil {
+			quicPorts[l.addr().(*net.UDPAddr).Port] = true
+		}
+	}
+	for _, l := range lm.listeners {
+		if l.ln == nil {
+			continue
+		}
+		altSvc := ""
+		if port := l.ln.Addr().(*net.TCPAddr).Port; quicPorts[port] {
+			altSvc = fmt.Sprintf(`%s=":%d"; ma=%d`, config.AlpnHTTP3, port, altSvcMaxAge)
+		}
+		l.altSvc.Store(altSvc)
+	}
+}
+
+// advertise sets the alt-svc header of a response served over HTTP/1.1 or
+// HTTP/2, if the listener has one. Responses from upstream may add their own.
+func (l *listener) advertise(w http.ResponseWriter, r *http.Request) {
+	if altSvc, _ := l.altSvc.Load().(string); altSvc != "" && r.ProtoMajor < 3 {
+		w.Header().Set("Alt-Svc", altSvc)
+	}
+}
@@ -1,25 +1,87 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+
+	"seateam/cluster"
 	"seateam/config"
-	"seateam/loadbalancer"
+	"seateam/filters"
+	"seateam/grpc"
+	"seateam/stats"
+	"seateam/transport"
+)
+
+var (
+	downstreamRqTotal     = stats.NewCounterVec("http", "downstream_rq_total", "Total requests received by a connection manager.", "envoy_http_conn_manager_prefix")
+	downstreamRqCompleted = stats.NewCounterVec("http", "downstream_rq_{}xx", "Responses by status code class.", "envoy_http_conn_manager_prefix", "envoy_response_code_class")
+	downstreamRqActive    = stats.NewGaugeVec("http", "downstream_rq_active", "Requests currently being handled.", "envoy_http_conn_manager_prefix")
 )
 
-// Router struct and its methods are defined here, reflecting the original design and functionality.
+// Router routes requests for one listener. It picks a virtual host by the Host
+// header and a route by path prefix, then forwards to the route's cluster.
 type Router struct {
-	Timeout      time.Duration
-	LoadBalancer loadbalancer.LoadBalancer
-	ErrorLogger  *log.Logger
-	Config       config.StaticBootstrap
-	Routes       map[string]http.Handler
+	Timeout     time.Duration
+	Clusters    *cluster.Manager
+	ErrorLogger *log.Logger
+	RouteConfig config.RouteConfiguration
+	Routes      map[string]http.Handler
+	// StatPrefix names the listener's stats, as in http.<stat_prefix>.downstream_rq_total.
+	StatPrefix string
+	// Filters are the listener's http_filters, which requests pass through
+	// before they are routed. It must be built for RouteConfig.
+	Filters *filters.Chain
+	// ForwardClientCertDetails and SetCurrentClientCertDetails say what
+	// becomes of the x-forwarded-client-cert header, as in the connection
+	// manager's config.
+	ForwardClientCertDetails    string
+	SetCurrentClientCertDetails config.SetCurrentClientCertDetails
+}
+
+// statusWriter remembers the status code written so it can be counted.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Hijack takes over the connection for a protocol the request switched to,
+// which counts as a 101 response.
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil && w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, brw, err
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
 }
 
 func (sr *Router) AddRoute(path string, handler http.Handler) {
@@ -29,78 +91,221 @@ func (sr *Router) AddRoute(path string, handler http.Handler) {
 	sr.Routes[path] = handler
 }
 
-func handleError(w http.ResponseWriter, message string, statusCode int) {
-	// Implement the error handling logic
+// handleError answers r with an error the router ran into. gRPC clients get
+// the matching grpc-status instead of an error page.
+func handleError(w http.ResponseWriter, r *http.Request, message string, statusCode int) {
 	fmt.Println(message)
+	if grpc.IsGrpc(r.Header) {
+		grpc.WriteError(w, message, statusCode)
+		return
+	}
 	http.Error(w, message, statusCode)
 }
 
+// notFound answers a request no route or endpoint matched.
+func notFound(w http.ResponseWriter, r *http.Request) {
+	if grpc.IsGrpc(r.Header) {
+		grpc.WriteError(w, "route not found", http.StatusNotFound)
+		return
+	}
+	http.NotFound(w, r)
+}
+
 // ServeHTTP implements the http.Handler interface for Router.
 func (sr *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if transport.ServeACMEChallenge(w, r) {
+		return
+	}
+	labels := prometheus.Labels{"envoy_http_conn_manager_prefix": sr.StatPrefix}
+	downstreamRqTotal.With(labels).Inc()
+	downstreamRqActive.With(labels).Inc()
+	defer downstreamRqActive.With(labels).Dec()
+
+	sw := &statusWriter{ResponseWriter: w}
+	defer func() {
+		if sw.status != 0 {
+			downstreamRqCompleted.MustCurryWith(labels).WithLabelValues(fmt.Sprint(sw.status / 100)).Inc()
+		}
+	}()
+	sr.setForwardedClientCert(r)
+	virtualHost, route := sr.match(r)
+	sr.Filters.Serve(sw, r, virtualHost, route, http.HandlerFunc(sr.route))
+}
+
+func (sr *Router) route(w http.ResponseWriter, r *http.Request) {
+	if handler, ok := sr.Routes[r.URL.Path]; ok {
+		handler.ServeHTTP(w, r)
+		return
+	}
+
+	route := sr.matchRoute(r)
+	if route == nil {
+		notFound(w, r)
+		return
+	}
+	if upgrade := upgradeType(r); upgrade != "" && !route.AllowsUpgrade(upgrade) {
+		handleError(w, r, "upgrade not allowed", http.StatusForbidden)
+		return
+	}
+	upstream := sr.Clusters.Get(route.Route.Cluster)
+	if upstream == nil {
+		handleError(w, r, fmt.Sprintf("unknown cluster %q", route.Route.Cluster), http.StatusServiceUnavailable)
+		return
+	}
+
 	endpointIndexStr := r.URL.Query().Get("endpoint")
-	if endpointIndexStr != "lb" {
+	if endpointIndexStr != "" && endpointIndexStr != "lb" {
 		endpointIndex, err := strconv.Atoi(endpointIndexStr)
 		if err != nil {
-			http.Error(w, "Invalid endpoint index", http.StatusBadRequest)
+			handleError(w, r, "Invalid endpoint index", http.StatusBadRequest)
 			return
 		}
-		backendURL := sr.determineBackendURL(r, endpointIndex)
-		if backendURL == "" {
-			http.NotFound(w, r)
+		// The endpoints of a DNS cluster change as it is resolved again, so
+		// index one snapshot of them.
+		endpoints := upstream.Endpoints()
+		if endpointIndex < 0 || endpointIndex >= len(endpoints) {
+			notFound(w, r)
 			return
 		}
-		forwardRequest(w, r, backendURL)
+		endpoint := endpoints[endpointIndex]
+		backendURL := backendURL(upstream.Scheme(), endpoint, r)
+		upstream.LoadBalancer.UpdateConnectionCount(endpoint)
+		defer upstream.LoadBalancer.Release(endpoint)
+		sr.forwardRequest(w, r, upstream, route, backendURL)
 	} else {
-		// No specific endpoint index provided, use the load balancer to determine the backend
-		backendURL := sr.LoadBalancer.NextEndpoint()
-		if backendURL == "" {
-			http.NotFound(w, r)
+		// No specific endpoint index provided, use the cluster's load balancer to determine the backend
+		endpoint := upstream.LoadBalancer.NextEndpoint()
+		if endpoint == "" {
+			handleError(w, r, "no healthy upstream", http.StatusServiceUnavailable)
 			return
 		}
-		forwardRequest(w, r, backendURL)
+		defer upstream.LoadBalancer.Release(endpoint)
+		sr.forwardRequest(w, r, upstream, route, backendURL(upstream.Scheme(), endpoint, r))
 	}
 }
 
-// determineBackendURL determines the backend URL based on the request.
-func (sr *Router) determineBackendURL(r *http.Request, endpointIndex int) string {
-	// Extract the URL path from the request
-	urlPath := r.URL.Path
-
-	// Extract route information from the request path and the configuration
-	routeConfig := sr.Config.StaticResources.Listeners[0].FilterChains[0].Filters[0].TypedConfig.RouteConfig
-	virtualHost := routeConfig.VirtualHosts[0]
-
-	for _, route := range virtualHost.Routes {
-		if strings.HasPrefix(urlPath, route.Match.Prefix) {
-			// Extract the part of the URL path that follows the route's prefix
-			suffix := urlPath
-
-			// Check if the suffix is empty or starts with a "/"
-			if suffix == "" || strings.HasPrefix(suffix, "/") {
-				port := sr.Config.StaticResources.Clusters[0].LoadAssignment.Endpoints[0].LbEndpoints[endpointIndex].Endpoint.Address.SocketAddress.PortValue
-				address := sr.Config.StaticResources.Clusters[0].LoadAssignment.Endpoints[0].LbEndpoints[endpointIndex].Endpoint.Address.SocketAddress.Address
-
-				// Include the retrieved port and address in the backend URL
-				backendURL := fmt.Sprintf("http://%s:%d/%s", address, port, suffix)
-				fmt.Println("Determined backend URL:", backendURL)
-				return backendURL
+// matchRoute returns the first route of the matching virtual host whose prefix
+// matches the request path and whose header matchers all match, or nil if
+// nothing matches.
+func (sr *Router) matchRoute(r *http.Request) *config.Route {
+	_, route := sr.match(r)
+	return route
+}
+
+// match returns the virtual host for the request and the route in it, either
+// of which may be nil.
+func (sr *Router) match(r *http.Request) (*config.VirtualHost, *config.Route) {
+	virtualHost := sr.matchVirtualHost(r.Host)
+	if virtualHost == nil {
+		return nil, nil
+	}
+	for i, route := range virtualHost.Routes {
+		if strings.HasPrefix(r.URL.Path, route.Match.Prefix) && matchesHeaders(route.Match.Headers, r.Header) {
+			return virtualHost, &virtualHost.Routes[i]
+		}
+	}
+	return virtualHost, nil
+}
+
+func matchesHeaders(matchers []config.HeaderMatcher, header http.Header) bool {
+	for _, matcher := range matchers {
+		if !matcher.Matches(header) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchVirtualHost picks a virtual host the way Envoy does: an exact domain
+// wins over a suffix wildcard ("*.example.com"), which wins over a prefix
+// wildcard ("example.*"), which wins over "*".
+func (sr *Router) matchVirtualHost(host string) *config.VirtualHost {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+
+	var best *config.VirtualHost
+	bestRank, bestLength := 0, 0
+	for i, virtualHost := range sr.RouteConfig.VirtualHosts {
+		for _, domain := range virtualHost.Domains {
+			domain = strings.ToLower(domain)
+			rank := 0
+			switch {
+			case domain == host:
+				rank = 4
+			case domain == "*":
+				rank = 1
+			case strings.HasPrefix(domain, "*") && strings.HasSuffix(host, domain[1:]):
+				rank = 3
+			case strings.HasSuffix(domain, "*") && strings.HasPrefix(host, domain[:len(domain)-1]):
+				rank = 2
+			}
+			if rank > bestRank || (rank == bestRank && rank > 0 && len(domain) > bestLength) {
+				best, bestRank, bestLength = &sr.RouteConfig.VirtualHosts[i], rank, len(domain)
 			}
 		}
 	}
+	return best
+}
+
+// determineBackendURL determines the backend URL for the request when it pins
+// a specific endpoint of the routed cluster with ?endpoint=N.
+func (sr *Router) determineBackendURL(r *http.Request, endpointIndex int) string {
+	route := sr.matchRoute(r)
+	if route == nil {
+		return ""
+	}
+	upstream := sr.Clusters.Get(route.Route.Cluster)
+	if upstream == nil {
+		return ""
+	}
+	endpoints := upstream.Endpoints()
+	if endpointIndex < 0 || endpointIndex >= len(endpoints) {
+		return ""
+	}
 
-	return ""
+	backendURL := backendURL(upstream.Scheme(), endpoints[endpointIndex], r)
+	fmt.Println("Determined backend URL:", backendURL)
+	return backendURL
 }
-//Good ^
 
+// backendURL builds the upstream URL for endpoint, keeping the request path and
+// query but dropping the router's own endpoint parameter.
+func backendURL(scheme, endpoint string, r *http.Request) string {
+	query := r.URL.Query()
+	query.Del("endpoint")
+
+	backendURL := scheme + "://" + endpoint + r.URL.EscapedPath()
+	if encoded := query.Encode(); encoded != "" {
+		backendURL += "?" + encoded
+	}
+	return backendURL
+}
 
 // forwardRequest forwards the HTTP request to the backend service.
-func forwardRequest(w http.ResponseWriter, r *http.Request, backendURL string) {
+func (sr *Router) forwardRequest(w http.ResponseWriter, r *http.Request, upstream *cluster.Cluster, route *config.Route, backendURL string) {
+	if upgradeType(r) != "" {
+		sr.forwardUpgrade(w, r, upstream, route, backendURL)
+		return
+	}
+	ctx := r.Context()
+	if timeout := sr.requestTimeout(r); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
 	// Create a new HTTP request to the backend.
-	req, err := http.NewRequest(r.Method, backendURL, r.Body)
+	req, err := http.NewRequestWithContext(ctx, r.Method, backendURL, r.Body)
 	if err != nil {
-		handleError(w, "Failed to create new request", http.StatusInternalServerError)
+		handleError(w, r, "Failed to create new request", http.StatusInternalServerError)
 		return
 	}
+	// Filters that change the body set the new length on the request.
+	req.ContentLength = r.ContentLength
+	// Trailers, such as a gRPC client's, follow the body upstream.
+	req.Trailer = r.Trailer
 
 	// Copy original headers to the new request.
 	for key, values := range r.Header {
@@ -108,15 +313,30 @@ func forwardRequest(w http.ResponseWriter, r *http.Request, backendURL string) {
 			req.Header.Add(key, value)
 		}
 	}
+	req.Host = r.Host
 
 	// Forward the request to the backend.
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	upstream.Stats.UpstreamRqTotal.Inc()
+	upstream.Stats.UpstreamRqActive.Inc()
+	defer upstream.Stats.UpstreamRqActive.Dec()
+
+	resp, err := upstream.Client.Do(req)
 	if err != nil {
-		handleError(w, "Failed to forward request", http.StatusInternalServerError)
+		var opErr *net.OpError
+		switch {
+		case ctx.Err() == context.DeadlineExceeded:
+			upstream.Stats.UpstreamRqTimeout.Inc()
+			handleError(w, r, "upstream request timeout", http.StatusGatewayTimeout)
+		case errors.As(err, &opErr) && opErr.Op == "dial":
+			upstream.Stats.UpstreamCxConnectFail.Inc()
+			handleError(w, r, "upstream connect error", http.StatusServiceUnavailable)
+		default:
+			handleError(w, r, "Failed to forward request", http.StatusBadGateway)
+		}
 		return
 	}
 	defer resp.Body.Close()
+	upstream.Stats.UpstreamRqCompleted(resp.StatusCode)
 
 	// Copy backend response headers to the original response writer.
 	for key, values := range resp.Header {
@@ -126,11 +346,76 @@ func forwardRequest(w http.ResponseWriter, r *http.Request, backendURL string) {
 	}
 
 	// Copy backend response body to the original response writer.
-	body, err := io.ReadAll(resp.Body)
+	w.WriteHeader(resp.StatusCode)
+	if err := copyResponseBody(w, resp); err != nil {
+		// A gRPC call whose deadline passes mid-stream still ends with a
+		// status, which upstream never got to send.
+		if ctx.Err() == context.DeadlineExceeded && grpc.IsGrpc(resp.Header) && resp.Header.Get(grpc.HeaderStatus) == "" {
+			upstream.Stats.UpstreamRqTimeout.Inc()
+			grpc.SetTrailerStatus(w.Header(), codes.DeadlineExceeded, "upstream request timeout")
+			return
+		}
+		if sr.ErrorLogger != nil {
+			sr.ErrorLogger.Printf("Failed to copy response body from %s: %v", backendURL, err)
+		}
+	}
+
+	// Trailers are only known once the body has been read.
+	for key, values := range resp.Trailer {
+		for _, value := range values {
+			w.Header().Add(http.TrailerPrefix+key, value)
+		}
+	}
+}
+
+// requestTimeout returns how long r may wait for the backend, or 0 for no
+// limit. The router's timeout only applies to plain HTTP: a gRPC call, which
+// may be a stream that lasts as long as its client wants, only has the
+// deadline of its grpc-timeout.
+func (sr *Router) requestTimeout(r *http.Request) time.Duration {
+	if !grpc.IsGrpc(r.Header) {
+		return sr.Timeout
+	}
+	value := r.Header.Get(grpc.HeaderTimeout)
+	if value == "" {
+		return 0
+	}
+	timeout, err := grpc.ParseTimeout(value)
 	if err != nil {
-		handleError(w, "Failed to read response body", http.StatusInternalServerError)
-		return
+		return 0
+	}
+	return timeout
+}
+
+// copyResponseBody copies the backend's response body to w. A body of unknown
+// length, such as a stream of gRPC messages, is flushed downstream as each
+// part arrives rather than when the buffer fills, starting with the headers,
+// which the client may be waiting for before it sends more.
+func copyResponseBody(w http.ResponseWriter, resp *http.Response) error {
+	if resp.ContentLength != -1 {
+		_, err := io.Copy(w, resp.Body)
+		return err
+	}
+	rc := http.NewResponseController(w)
+	if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			if ferr := rc.Flush(); ferr != nil && !errors.Is(ferr, http.ErrNotSupported) {
+				return ferr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
 	}
-	w.WriteHeader(resp.StatusCode)
-	w.Write(body)
 }
@@ -1,102 +1,736 @@
 package main
 
 import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
-    "net/http/httptest"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
-    "time"
-    lb "seateam/loadbalancer"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"gopkg.in/yaml.v3"
+
+	"seateam/cluster"
+	"seateam/config"
+	"seateam/filters"
 )
 
 // TestDetermineBackendURL checks if the correct backend URL is determined.
 func TestDetermineBackendURL(t *testing.T) {
-	r := NewRouter()
-    request1, _ := http.NewRequest("GET", "/service1", nil)
+	r := NewRouter(t)
+	request1, _ := http.NewRequest("GET", "/service1", nil)
 	url1 := r.determineBackendURL(request1, 0)
-	expectedURL1 := "http://backend-service-1-url"
+	expectedURL1 := "http://backend-service-1-url:80/service1"
 	if url1 != expectedURL1 {
 		t.Errorf("Expected URL: %s, Got: %s", expectedURL1, url1)
 	}
 
-	request2, _ := http.NewRequest("GET", "/service2", nil)
-	url2 := r.determineBackendURL(request2, 0)
-	expectedURL2 := "http://backend-service-2-url"
+	request2, _ := http.NewRequest("GET", "/service2?endpoint=1&q=x", nil)
+	url2 := r.determineBackendURL(request2, 1)
+	expectedURL2 := "http://backend-service-2-url:8080/service2?q=x"
 	if url2 != expectedURL2 {
 		t.Errorf("Expected URL: %s, Got: %s", expectedURL2, url2)
-}
+	}
+
+	if url := r.determineBackendURL(request2, 5); url != "" {
+		t.Errorf("Expected no URL for an out of range endpoint, Got: %s", url)
+	}
 }
 
 // Define a mock handler to use for testing
 func mockHandler() http.Handler {
-    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-        w.WriteHeader(http.StatusOK)
-        _, _ = w.Write([]byte("mock response"))
-    })
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("mock response"))
+	})
 }
 
 // TestRouter tests the basic routing logic
 func TestRouter(t *testing.T) {
-    // Initialize router with some routes for testing
-    r := NewRouter()
-    r.AddRoute("/test", mockHandler())
+	// Initialize router with some routes for testing
+	r := NewRouter(t)
+	r.AddRoute("/test", mockHandler())
 
-    // Create a new HTTP request to test the routing
-    req, err := http.NewRequest("GET", "/test", nil)
-    if err != nil {
-        t.Fatal(err)
-    }
+	// Create a new HTTP request to test the routing
+	req, err := http.NewRequest("GET", "/test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-    // Record the HTTP response using httptest
-    rr := httptest.NewRecorder()
-    handler := http.Handler(r)
+	// Record the HTTP response using httptest
+	rr := httptest.NewRecorder()
+	handler := http.Handler(r)
 
-    // Dispatch the request to the handler
-    handler.ServeHTTP(rr, req)
+	// Dispatch the request to the handler
+	handler.ServeHTTP(rr, req)
 
-    // Check the status code is what we expect.
-    if status := rr.Code; status != http.StatusOK {
-        t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
-    }
+	// Check the status code is what we expect.
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
 
-    // Check the response body is what we expect.
-    expected := `mock response`
-    if rr.Body.String() != expected {
-        t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), expected)
-    }
+	// Check the response body is what we expect.
+	expected := `mock response`
+	if rr.Body.String() != expected {
+		t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), expected)
+	}
 }
 
-
 // TestRouter_NoRoute tests the behavior when no route is matched
 func TestRouter_NoRoute(t *testing.T) {
-    // Initialize router without any routes
-    r := NewRouter()
-
-    // Create a request for a route that does not exist
-    req, err := http.NewRequest("GET", "/not-found", nil)
-    if err != nil {
-        t.Fatal(err)
-    }
-
-    // Record the HTTP response
-    rr := httptest.NewRecorder()
-    handler := http.Handler(r)
-
-    // Dispatch the request
-    handler.ServeHTTP(rr, req)
-
-    // Check that the status code reflects a not found error
-    if rr.Code != http.StatusNotFound {
-        t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
-    }
-}
-
-func NewRouter() *Router {
-    // Initialize your load balancer with appropriate parameters
-    loadBalancer := lb.NewRoundRobinLoadBalancer([]string{"backend-service-1-url", "backend-service-2-url"})
-    
-    return &Router{
-        Timeout:      10 * time.Second,
-        LoadBalancer: loadBalancer, // Note the dereference to make LoadBalancer a value, not a pointer
-        // other initialization logic if needed
-    }
+	// Initialize router without any routes
+	r := NewRouter(t)
+
+	// Create a request for a route that does not exist
+	req, err := http.NewRequest("GET", "/not-found", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Record the HTTP response
+	rr := httptest.NewRecorder()
+	handler := http.Handler(r)
+
+	// Dispatch the request
+	handler.ServeHTTP(rr, req)
+
+	// Check that the status code reflects a not found error
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+}
+
+// TestRouter_ForwardsToCluster checks that requests reach the routed cluster
+// with their path and query intact.
+func TestRouter_ForwardsToCluster(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "backend saw "+r.URL.RequestURI())
+	}))
+	defer backend.Close()
+
+	r := newTestRouter(t, `
+virtual_hosts:
+- name: api
+  domains: ["api.example.com"]
+  routes:
+  - match: { prefix: "/" }
+    route: { cluster: backend }
+- name: default
+  domains: ["*"]
+  routes:
+  - match: { prefix: "/other" }
+    route: { cluster: backend }
+`, testCluster("backend", strings.TrimPrefix(backend.URL, "http://")))
+
+	req := httptest.NewRequest("GET", "http://api.example.com:8000/users?id=7&endpoint=lb", nil)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || rr.Body.String() != "backend saw /users?id=7" {
+		t.Errorf("unexpected response: %d %q", rr.Code, rr.Body.String())
+	}
+
+	// The same path on another host falls through to the catch-all virtual host.
+	req = httptest.NewRequest("GET", "http://www.example.com/users", nil)
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected catch-all virtual host to 404, got %d", rr.Code)
+	}
+}
+
+// TestRouter_ForwardsOverTLS checks that clusters with a TLS transport socket
+// are sent HTTPS requests, and that the endpoints' certificates are verified.
+func TestRouter_ForwardsOverTLS(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "backend saw "+r.TLS.ServerName)
+	}))
+	defer backend.Close()
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: backend.Certificate().Raw})
+	otherCa, _ := testTlsCertificate(t)
+
+	for _, test := range []struct {
+		name      string
+		trustedCa string
+		status    int
+		body      string
+	}{
+		{"trusted", string(caPEM), http.StatusOK, "backend saw backend.example.com"},
+		{"untrusted", otherCa.CertificateChain.InlineString, http.StatusBadGateway, ""},
+	} {
+		c := testCluster("backend", strings.TrimPrefix(backend.URL, "https://"))
+		c.TransportSocket = &config.UpstreamTransportSocket{Name: config.TLSTransportSocket}
+		c.TransportSocket.TypedConfig.Sni = "backend.example.com"
+		c.TransportSocket.TypedConfig.CommonTlsContext.ValidationContext = &config.CertificateValidationContext{
+			TrustedCa: config.DataSource{InlineString: test.trustedCa},
+		}
+		r := newTestRouter(t, `
+virtual_hosts:
+- name: default
+  domains: ["*"]
+  routes:
+  - match: { prefix: "/" }
+    route: { cluster: backend }
+`, c)
+
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+		if rr.Code != test.status || (test.body != "" && rr.Body.String() != test.body) {
+			t.Errorf("%s: unexpected response: %d %q", test.name, rr.Code, rr.Body.String())
+		}
+	}
+}
+
+// TestRouter_RunsHTTPFilters checks that requests pass the listener's
+// http_filters, with typed_per_filter_config applied per route.
+func TestRouter_RunsHTTPFilters(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "backend saw %d bytes with length %d", len(body), r.ContentLength)
+	}))
+	defer backend.Close()
+
+	r := newTestRouter(t, `
+virtual_hosts:
+- name: default
+  domains: ["*"]
+  routes:
+  - match: { prefix: "/upload" }
+    route: { cluster: backend }
+    typed_per_filter_config:
+      envoy.filters.http.buffer:
+        "@type": type.googleapis.com/envoy.config.route.v3.FilterConfig
+        disabled: true
+  - match: { prefix: "/" }
+    route: { cluster: backend }
+`, testCluster("backend", strings.TrimPrefix(backend.URL, "http://")))
+
+	var httpFilters []config.HttpFilter
+	if err := decodeYAML(`
+- name: envoy.filters.http.buffer
+  typed_config:
+    "@type": type.googleapis.com/envoy.extensions.filters.http.buffer.v3.Buffer
+    max_request_bytes: 16
+- name: envoy.filters.http.router
+`, &httpFilters); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	if r.Filters, err = filters.NewChain(httpFilters, &r.RouteConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	body := strings.Repeat("x", 32)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("POST", "/items", strings.NewReader(body)))
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected the buffer filter to reject a large body, got %d %q", rr.Code, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("POST", "/upload", strings.NewReader(body)))
+	if rr.Code != http.StatusOK || rr.Body.String() != "backend saw 32 bytes with length 32" {
+		t.Errorf("expected the buffer filter to be disabled for /upload, got %d %q", rr.Code, rr.Body.String())
+	}
+}
+
+// TestRouter_MatchesHeaders checks that a route is only picked when all of its
+// header matchers match.
+func TestRouter_MatchesHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "backend saw "+r.URL.Path)
+	}))
+	defer backend.Close()
+
+	r := newTestRouter(t, `
+virtual_hosts:
+- name: default
+  domains: ["*"]
+  routes:
+  - match:
+      prefix: "/"
+      headers:
+      - name: x-tenant
+        string_match: { exact: blue, ignore_case: true }
+      - name: x-debug
+        present_match: true
+        invert_match: true
+    route: { cluster: backend }
+`, testCluster("backend", strings.TrimPrefix(backend.URL, "http://")))
+
+	for _, test := range []struct {
+		name   string
+		header http.Header
+		status int
+	}{
+		{"matching", http.Header{"X-Tenant": {"Blue"}}, http.StatusOK},
+		{"other value", http.Header{"X-Tenant": {"green"}}, http.StatusNotFound},
+		{"missing", http.Header{}, http.StatusNotFound},
+		{"inverted", http.Header{"X-Tenant": {"blue"}, "X-Debug": {"1"}}, http.StatusNotFound},
+	} {
+		req := httptest.NewRequest("GET", "/items", nil)
+		req.Header = test.header
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		if rr.Code != test.status {
+			t.Errorf("%s: expected %d, got %d %q", test.name, test.status, rr.Code, rr.Body.String())
+		}
+	}
+}
+
+// TestRouter_ForwardedClientCert checks each forward_client_cert_details
+// mode with and without a client certificate.
+func TestRouter_ForwardedClientCert(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get(forwardedClientCertHeader))
+	}))
+	defer backend.Close()
+
+	r := newTestRouter(t, `
+virtual_hosts:
+- name: default
+  domains: ["*"]
+  routes:
+  - match: { prefix: "/" }
+    route: { cluster: backend }
+`, testCluster("backend", strings.TrimPrefix(backend.URL, "http://")))
+	r.SetCurrentClientCertDetails = config.SetCurrentClientCertDetails{Subject: true, DNS: true}
+
+	certificate, _ := testTlsCertificate(t)
+	keyPair, err := certificate.LoadKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256(keyPair.Leaf.Raw)
+	current := fmt.Sprintf(`Hash=%x;Subject="";DNS=example.com`, hash)
+	const forwarded = `Hash=abc;DNS=edge.example.com`
+
+	for _, test := range []struct {
+		mode     string
+		mtls     bool
+		expected string
+	}{
+		{"", true, ""},
+		{config.ForwardOnly, true, forwarded},
+		{config.ForwardOnly, false, ""},
+		{config.AppendForward, true, forwarded + "," + current},
+		{config.AppendForward, false, ""},
+		{config.SanitizeSet, true, current},
+		{config.AlwaysForwardOnly, false, forwarded},
+	} {
+		r.ForwardClientCertDetails = test.mode
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set(forwardedClientCertHeader, forwarded)
+		if test.mtls {
+			req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{keyPair.Leaf}}
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		if rr.Body.String() != test.expected {
+			t.Errorf("%q with mTLS %v: expected %q, got %q", test.mode, test.mtls, test.expected, rr.Body.String())
+		}
+	}
+}
+
+func NewRouter(t *testing.T) *Router {
+	// Route each service prefix to its own cluster
+	return newTestRouter(t, `
+virtual_hosts:
+- name: local_service
+  domains: ["*"]
+  routes:
+  - match: { prefix: "/service1" }
+    route: { cluster: service1 }
+  - match: { prefix: "/service2" }
+    route: { cluster: service2 }
+`,
+		testCluster("service1", "backend-service-1-url:80"),
+		testCluster("service2", "backend-service-2-url:80", "backend-service-2-url:8080"),
+	)
+}
+
+func newTestRouter(t *testing.T, routeConfig string, clusters ...config.Cluster) *Router {
+	t.Helper()
+
+	var r Router
+	if err := decodeYAML(routeConfig, &r.RouteConfig); err != nil {
+		t.Fatal(err)
+	}
+	r.Timeout = 10 * time.Second
+	r.Clusters = cluster.NewManager()
+	if err := r.Clusters.Apply(clusters); err != nil {
+		t.Fatal(err)
+	}
+	return &r
+}
+
+func testCluster(name string, addresses ...string) config.Cluster {
+	var locality config.LocalityLbEndpoints
+	for _, address := range addresses {
+		host, port, _ := splitHostPort(address)
+		var lbEndpoint config.LbEndpoint
+		lbEndpoint.Endpoint.Address.SocketAddress = config.SocketAddress{Address: host, PortValue: port}
+		locality.LbEndpoints = append(locality.LbEndpoints, lbEndpoint)
+	}
+
+	c := config.Cluster{Name: name}
+	c.LoadAssignment.Endpoints = []config.LocalityLbEndpoints{locality}
+	return c
+}
+
+func decodeYAML(text string, out interface{}) error {
+	return yaml.Unmarshal([]byte(text), out)
+}
+
+// echoUpgradeBackend switches requests to the echo protocol and sends back
+// every line it gets.
+func echoUpgradeBackend() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" {
+			http.Error(w, "expected an upgrade", http.StatusBadRequest)
+			return
+		}
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(brw, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		brw.Flush()
+		for {
+			line, err := brw.ReadString('\n')
+			if err != nil {
+				return
+			}
+			io.WriteString(brw, "echo "+line)
+			brw.Flush()
+		}
+	}))
+}
+
+// dialUpgrade sends an upgrade request to server and returns the connection
+// with the response to it.
+func dialUpgrade(t *testing.T, server *httptest.Server, upgrade string) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	fmt.Fprintf(conn, "GET /chat HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: %s\r\n\r\n", upgrade)
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, reader, resp
+}
+
+// TestRouter_ProxiesUpgrades checks that a request to switch protocols is
+// tunnelled to the backend when the route allows it, and counted as active
+// on the endpoint until the tunnel closes.
+func TestRouter_ProxiesUpgrades(t *testing.T) {
+	backend := echoUpgradeBackend()
+	defer backend.Close()
+	endpoint := strings.TrimPrefix(backend.URL, "http://")
+
+	for _, withFilters := range []bool{false, true} {
+		r := newTestRouter(t, `
+virtual_hosts:
+- name: default
+  domains: ["*"]
+  routes:
+  - match: { prefix: "/" }
+    route:
+      cluster: backend
+      upgrade_configs:
+      - upgrade_type: Echo
+      - upgrade_type: h2c
+        enabled: false
+`, testCluster("backend", endpoint))
+		if withFilters {
+			var httpFilters []config.HttpFilter
+			if err := decodeYAML(`
+- name: envoy.filters.http.buffer
+  typed_config:
+    "@type": type.googleapis.com/envoy.extensions.filters.http.buffer.v3.Buffer
+    max_request_bytes: 16
+- name: envoy.filters.http.router
+`, &httpFilters); err != nil {
+				t.Fatal(err)
+			}
+			var err error
+			if r.Filters, err = filters.NewChain(httpFilters, &r.RouteConfig); err != nil {
+				t.Fatal(err)
+			}
+		}
+		server := httptest.NewServer(r)
+
+		_, _, resp := dialUpgrade(t, server, "h2c")
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("filters %v: expected a disabled upgrade to be refused, got %d", withFilters, resp.StatusCode)
+		}
+
+		conn, reader, resp := dialUpgrade(t, server, "echo")
+		if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Upgrade") != "echo" {
+			t.Fatalf("filters %v: expected the backend to switch protocols, got %d %v", withFilters, resp.StatusCode, resp.Header)
+		}
+		for _, message := range []string{"hello\n", "again\n"} {
+			io.WriteString(conn, message)
+			if line, err := reader.ReadString('\n'); err != nil || line != "echo "+message {
+				t.Errorf("filters %v: expected %q back, got %q, %v", withFilters, "echo "+message, line, err)
+			}
+		}
+		lb := r.Clusters.Get("backend").LoadBalancer
+		if active := lb.ActiveRequests()[endpoint]; active != 1 {
+			t.Errorf("filters %v: expected the tunnel to count as 1 active request, got %d", withFilters, active)
+		}
+
+		conn.Close()
+		deadline := time.Now().Add(5 * time.Second)
+		for lb.ActiveRequests()[endpoint] != 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if active := lb.ActiveRequests()[endpoint]; active != 0 {
+			t.Errorf("filters %v: expected the closed tunnel to be released, got %d active", withFilters, active)
+		}
+		server.Close()
+	}
+}
+
+// TestRouter_UpgradeIdleTimeout checks that a tunnel carrying nothing for the
+// route's idle_timeout is closed.
+func TestRouter_UpgradeIdleTimeout(t *testing.T) {
+	backend := echoUpgradeBackend()
+	defer backend.Close()
+
+	r := newTestRouter(t, `
+virtual_hosts:
+- name: default
+  domains: ["*"]
+  routes:
+  - match: { prefix: "/" }
+    route:
+      cluster: backend
+      upgrade_configs: [{ upgrade_type: echo }]
+      idle_timeout: 100ms
+`, testCluster("backend", strings.TrimPrefix(backend.URL, "http://")))
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	conn, reader, resp := dialUpgrade(t, server, "echo")
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected the backend to switch protocols, got %d", resp.StatusCode)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Errorf("expected the idle tunnel to be closed, got %v", err)
+	}
+}
+
+// TestRouter_ForwardsOverHTTP2 checks that clusters with
+// http2_protocol_options talk HTTP/2 to their endpoints, as h2c over
+// plaintext and negotiated with ALPN over TLS, and open another connection
+// rather than exceed max_concurrent_streams.
+func TestRouter_ForwardsOverHTTP2(t *testing.T) {
+	// Requests to /pair wait for each other, so two of them are in flight at
+	// once.
+	var pair sync.WaitGroup
+	pair.Add(2)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/pair" {
+			pair.Done()
+			pair.Wait()
+		}
+		io.WriteString(w, "backend saw "+r.Proto)
+	})
+	h2cBackend := httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	defer h2cBackend.Close()
+	tlsBackend := httptest.NewUnstartedServer(handler)
+	tlsBackend.EnableHTTP2 = true
+	tlsBackend.StartTLS()
+	defer tlsBackend.Close()
+
+	plaintext := testCluster("plaintext", strings.TrimPrefix(h2cBackend.URL, "http://"))
+	plaintext.Http2ProtocolOptions = &config.Http2ProtocolOptions{MaxConcurrentStreams: 1}
+	overTLS := testCluster("tls", strings.TrimPrefix(tlsBackend.URL, "https://"))
+	overTLS.Http2ProtocolOptions = &config.Http2ProtocolOptions{}
+	overTLS.TransportSocket = &config.UpstreamTransportSocket{Name: config.TLSTransportSocket}
+	r := newTestRouter(t, `
+virtual_hosts:
+- name: default
+  domains: ["*"]
+  routes:
+  - match: { prefix: "/tls" }
+    route: { cluster: tls }
+  - match: { prefix: "/" }
+    route: { cluster: plaintext }
+`, plaintext, overTLS)
+
+	opened := r.Clusters.Get("plaintext").Stats.UpstreamCxHttp2Total
+	before := testutil.ToFloat64(opened)
+
+	for _, path := range []string{"/", "/tls"} {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		if rr.Code != http.StatusOK || rr.Body.String() != "backend saw HTTP/2.0" {
+			t.Errorf("%s: expected the request to go over HTTP/2, got %d %q", path, rr.Code, rr.Body.String())
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, httptest.NewRequest("GET", "/pair", nil))
+			if rr.Code != http.StatusOK {
+				t.Errorf("unexpected response: %d %q", rr.Code, rr.Body.String())
+			}
+		}()
+	}
+	wg.Wait()
+	if connections := testutil.ToFloat64(opened) - before; connections != 2 {
+		t.Errorf("expected a second connection for the second stream, got %v connections", connections)
+	}
+}
+
+// grpcBackend answers like a gRPC server over h2c: it echoes each line of the
+// request as it arrives and ends with a grpc-status trailer. Requests to
+// /slow wait for the client to give up, and so do requests to /stream after
+// sending their first message.
+func grpcBackend() *httptest.Server {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-r.Context().Done()
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.WriteHeader(http.StatusOK)
+		http.NewResponseController(w).Flush()
+		if r.URL.Path == "/stream" {
+			io.WriteString(w, "first\n")
+			http.NewResponseController(w).Flush()
+			<-r.Context().Done()
+			return
+		}
+		lines := bufio.NewReader(r.Body)
+		for {
+			line, err := lines.ReadString('\n')
+			if err != nil {
+				break
+			}
+			io.WriteString(w, "echo "+line)
+			http.NewResponseController(w).Flush()
+		}
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+	})
+	return httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+}
+
+func TestRouter_ProxiesGrpc(t *testing.T) {
+	backend := grpcBackend()
+	defer backend.Close()
+
+	grpcCluster := testCluster("grpc", strings.TrimPrefix(backend.URL, "http://"))
+	grpcCluster.Http2ProtocolOptions = &config.Http2ProtocolOptions{}
+	for _, withFilters := range []bool{false, true} {
+		r := newTestRouter(t, `
+virtual_hosts:
+- name: default
+  domains: ["*"]
+  routes:
+  - match: { prefix: "/empty" }
+    route: { cluster: empty }
+  - match: { prefix: "/" }
+    route: { cluster: grpc }
+`, grpcCluster, testCluster("empty"))
+		// Streams without a grpc-timeout outlast the router's timeout.
+		r.Timeout = 50 * time.Millisecond
+		if withFilters {
+			var httpFilters []config.HttpFilter
+			if err := decodeYAML(`
+- name: envoy.filters.http.router
+`, &httpFilters); err != nil {
+				t.Fatal(err)
+			}
+			var err error
+			if r.Filters, err = filters.NewChain(httpFilters, &r.RouteConfig); err != nil {
+				t.Fatal(err)
+			}
+		}
+		front := httptest.NewServer(h2c.NewHandler(r, &http2.Server{}))
+		testProxiesGrpc(t, front.URL, withFilters)
+		front.Close()
+	}
+}
+
+func testProxiesGrpc(t *testing.T, url string, withFilters bool) {
+	t.Helper()
+	client := h2cClient()
+
+	// A bidirectional stream: each message is answered before the next is
+	// sent.
+	body, requests := io.Pipe()
+	req, _ := http.NewRequest("POST", url+"/echo.Echo/Chat", body)
+	req.Header.Set("Content-Type", "application/grpc")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	responses := bufio.NewReader(resp.Body)
+	for _, message := range []string{"one\n", "two\n"} {
+		time.Sleep(100 * time.Millisecond)
+		io.WriteString(requests, message)
+		if got, err := responses.ReadString('\n'); got != "echo "+message {
+			t.Fatalf("filters %v: expected %q back, got %q (%v)", withFilters, "echo "+message, got, err)
+		}
+	}
+	requests.Close()
+	if rest, err := io.ReadAll(responses); err != nil || len(rest) != 0 {
+		t.Fatalf("filters %v: expected the stream to end, got %q (%v)", withFilters, rest, err)
+	}
+	if status := resp.Trailer.Get("Grpc-Status"); status != "0" {
+		t.Errorf("filters %v: expected the grpc-status trailer to be passed on, got %q", withFilters, status)
+	}
+
+	for _, test := range []struct {
+		path, timeout, status string
+	}{
+		{"/echo.Echo/Unary", "", "0"},
+		{"/slow", "50m", "4"},
+		{"/stream", "50m", "4"},
+		{"/empty", "", "14"},
+	} {
+		req, _ := http.NewRequest("POST", url+test.path, nil)
+		req.Header.Set("Content-Type", "application/grpc+proto")
+		if test.timeout != "" {
+			req.Header.Set("Grpc-Timeout", test.timeout)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		status := resp.Header.Get("Grpc-Status")
+		if status == "" {
+			status = resp.Trailer.Get("Grpc-Status")
+		}
+		if resp.StatusCode != http.StatusOK || status != test.status {
+			t.Errorf("filters %v: %s: expected grpc-status %s, got %d with grpc-status %q", withFilters, test.path, test.status, resp.StatusCode, status)
+		}
+	}
 }
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	resourcev3 "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"gopkg.in/yaml.v3"
+
+	"seateam/admin"
+	"seateam/api"
+	"seateam/cluster"
+	"seateam/config"
+	"seateam/discovery"
+	"seateam/filters"
+	"seateam/filters/network"
+	"seateam/transport"
+	"seateam/xds"
+)
+
+// version is reported by the admin /server_info page. Release builds set it
+// with -ldflags "-X main.version=...".
+var version = "dev"
+
+// Server owns everything built from the config: the clusters and the listeners
+// routing to them. Apply moves the whole server to a new config.
+type Server struct {
+	opts      options
+	clusters  *cluster.Manager
+	listeners *listenerManager
+	admin     *admin.Server
+	config    atomic.Pointer[config.StaticBootstrap]
+	applyMu   sync.Mutex
+
+	// static is the bootstrap from the config file and dynamic what the
+	// management server sent; config is the two merged. Both are guarded by
+	// applyMu.
+	static  config.StaticBootstrap
+	dynamic xds.Resources
+	stopXDS context.CancelFunc
+}
+
+func NewServer(opts options) *Server {
+	s := &Server{
+		opts:     opts,
+		clusters: cluster.NewManager(),
+	}
+	s.listeners = newListenerManager(s.newListenerHandler, opts.drainTime)
+	s.admin = admin.New(s, admin.Info{
+		Version:        version,
+		ServiceNode:    opts.serviceNode,
+		ServiceCluster: opts.serviceCluster,
+		CommandLineOptions: map[string]interface{}{
+			"config_path":     opts.configPath,
+			"service_node":    opts.serviceNode,
+			"service_cluster": opts.serviceCluster,
+			"log_level":       opts.logLevel.String(),
+			"drain_time":      fmt.Sprintf("%ds", int(opts.drainTime.Seconds())),
+			"base_id":         opts.baseID,
+			"admin_address":   opts.adminAddress,
+		},
+	})
+
+	// The health check and demo pages live on the admin address so they do not
+	// shadow paths on the listeners, which carry only proxied traffic.
+	s.admin.Handle("/health", "router health check, fails after /healthcheck/fail", api.NewHealthCheckHandler(s.admin.HealthCheckFailed))
+	s.admin.Handle("/endpoint1", "demo endpoint", http.HandlerFunc(api.Endpoint1Handler))
+	s.admin.Handle("/endpoint2", "demo endpoint", http.HandlerFunc(api.Endpoint2Handler))
+
+	if opts.adminToken != "" {
+		s.admin.EnableManagementAPI(opts.adminToken)
+	}
+	if opts.registryToken != "" {
+		s.admin.EnableRegistrationAPI(opts.registryToken, discovery.DefaultRegistry)
+	}
+
+	// Serve frontend files
+	fs := http.FileServer(http.Dir("./frontend"))
+	s.admin.Handle("/static/", "frontend files", http.StripPrefix("/static/", fs))
+	return s
+}
+
+// Apply installs a validated bootstrap, together with any resources from the
+// management server.
+func (s *Server) Apply(static config.StaticBootstrap) error {
+	s.applyMu.Lock()
+	defer s.applyMu.Unlock()
+
+	if s.stopXDS != nil && !reflect.DeepEqual(static.DynamicResources, s.static.DynamicResources) {
+		mainLog.Warnf("dynamic_resources changed, the new settings take effect after a restart")
+	}
+	return s.applyResources(static, s.dynamic)
+}
+
+// applyDynamic installs resources from the management server. An error makes
+// the xDS client reject them.
+func (s *Server) applyDynamic(dynamic xds.Resources) error {
+	s.applyMu.Lock()
+	defer s.applyMu.Unlock()
+	return s.applyResources(s.static, dynamic)
+}
+
+// applyResources merges static and dynamic resources and applies the result if
+// it is valid.
+func (s *Server) applyResources(static config.StaticBootstrap, dynamic xds.Resources) error {
+	configuration := dynamic.Merge(static)
+	if err := config.Validate(&configuration); err != nil {
+		return err
+	}
+	s.static, s.dynamic = static, dynamic
+	return s.apply(configuration)
+}
+
+// apply installs a validated config. Clusters are swapped in before listeners
+// so that new routes never point at clusters that do not exist yet.
+func (s *Server) apply(configuration config.StaticBootstrap) error {
+	s.clusters.SetLocality(configuration.Node.Locality)
+	if err := s.clusters.Apply(configuration.StaticResources.Clusters); err != nil {
+		return err
+	}
+	s.config.Store(&configuration)
+	err := s.listeners.Apply(configuration.StaticResources.Listeners)
+	s.admin.SetLive()
+	return err
+}
+
+// Reload reads the config file again and applies it. An invalid file leaves the
+// running config untouched.
+func (s *Server) Reload() error {
+	configuration, _, err := loadConfig(s.opts)
+	if err != nil {
+		return err
+	}
+	return s.Apply(configuration)
+}
+
+// UpdateConfig applies mutate to a copy of the running bootstrap and, if the
+// result is valid, applies it like a reload. With persist the same change is
+// then made to the config file, so it survives the next reload or restart; a
+// change that fails to apply is never written. Resources from the management
+// server are not part of the bootstrap and cannot be changed this way.
+func (s *Server) UpdateConfig(mutate func(*config.StaticBootstrap) error, persist bool) error {
+	s.applyMu.Lock()
+	defer s.applyMu.Unlock()
+
+	static, err := s.static.Clone()
+	if err != nil {
+		return err
+	}
+	if err := mutate(&static); err != nil {
+		return err
+	}
+	merged := s.dynamic.Merge(static)
+	if err := config.Validate(&merged); err != nil {
+		return err
+	}
+	if err := s.applyResources(static, s.dynamic); err != nil {
+		return err
+	}
+	if persist {
+		if err := s.persist(mutate); err != nil {
+			return fmt.Errorf("persisting config: %w", err)
+		}
+	}
+	return nil
+}
+
+// persist makes the change to the config file rather than to the running
+// config, so command line overrides are not written back. The file is written
+// out again from the parsed config, which loses its comments and formatting,
+// and replaced with a rename so the config file watcher never reads it half
+// written. The watcher picks it up as a reload of the same config.
+func (s *Server) persist(mutate func(*config.StaticBootstrap) error) error {
+	fileConfig, err := config.Load(s.opts.configPath)
+	if err != nil {
+		return err
+	}
+	if err := mutate(&fileConfig); err != nil {
+		return err
+	}
+	if err := config.Validate(&fileConfig); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(fileConfig); err != nil {
+		return err
+	}
+	info, err := os.Stat(s.opts.configPath)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.opts.configPath, buf.Bytes(), info.Mode().Perm())
+}
+
+// writeFileAtomic replaces the file at path with data through a temporary file
+// in the same directory, so readers see either the old or the new file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Config returns the config that is currently applied.
+func (s *Server) Config() config.StaticBootstrap {
+	if configuration := s.config.Load(); configuration != nil {
+		return *configuration
+	}
+	return config.StaticBootstrap{}
+}
+
+// StartAdmin serves the admin interface on the configured admin address. A
+// config without an admin address runs without one.
+func (s *Server) StartAdmin() error {
+	socketAddress := s.Config().Admin.Address.SocketAddress
+	if socketAddress.Address == "" && socketAddress.PortValue == 0 {
+		mainLog.Infof("No admin address configured, admin interface disabled")
+		return nil
+	}
+
+	ln, err := net.Listen("tcp", net.JoinHostPort(socketAddress.Address, fmt.Sprint(socketAddress.PortValue)))
+	if err != nil {
+		return fmt.Errorf("admin: %v", err)
+	}
+	mainLog.Infof("Admin interface started on %s", ln.Addr())
+	go func() {
+		if err := http.Serve(ln, s.admin); err != nil {
+			mainLog.Errorf("Admin interface stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+// StartXDS starts fetching the dynamic resources named in dynamic_resources,
+// from the management server over ADS and from files. dynamic_resources is
+// only read here, so changing it needs a restart.
+func (s *Server) StartXDS() error {
+	s.applyMu.Lock()
+	static := s.static
+	s.applyMu.Unlock()
+
+	dynamicResources := static.DynamicResources
+	opts := xds.Options{
+		Node: static.Node,
+		CDS:  dynamicResources.CdsConfig != nil && dynamicResources.CdsConfig.Ads != nil,
+		LDS:  dynamicResources.LdsConfig != nil && dynamicResources.LdsConfig.Ads != nil,
+	}
+	if opts.Node.ID == "" {
+		opts.Node.ID = s.opts.serviceNode
+	}
+	if opts.Node.Cluster == "" {
+		opts.Node.Cluster = s.opts.serviceCluster
+	}
+	var staticEdsFiles []string
+	for _, c := range static.StaticResources.Clusters {
+		if c.Type != "EDS" {
+			continue
+		}
+		if edsConfig := c.EdsClusterConfig.EdsConfig; edsConfig.PathConfigSource != nil {
+			staticEdsFiles = append(staticEdsFiles, edsConfig.PathConfigSource.Path)
+		} else {
+			opts.StaticEdsClusters = append(opts.StaticEdsClusters, c.EdsServiceName())
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	store := xds.NewStore(ctx, s.applyDynamic, staticEdsFiles)
+
+	if adsConfig := dynamicResources.AdsConfig; adsConfig != nil {
+		adsCluster, err := static.Cluster(adsConfig.GrpcServices[0].EnvoyGrpc.ClusterName)
+		if err != nil {
+			cancel()
+			return fmt.Errorf("xds: %v", err)
+		}
+		for _, locality := range adsCluster.LoadAssignment.Endpoints {
+			for _, lbEndpoint := range locality.LbEndpoints {
+				if opts.Address == "" {
+					opts.Address = lbEndpoint.Address()
+				}
+			}
+		}
+		if opts.Address == "" {
+			cancel()
+			return fmt.Errorf("xds: cluster %q has no endpoints", adsCluster.Name)
+		}
+		mainLog.Infof("Fetching dynamic resources from %s (cluster %s)", opts.Address, adsCluster.Name)
+		go xds.NewClient(opts, store).Run(ctx)
+	}
+
+	for _, file := range []struct {
+		source  *config.ConfigSource
+		typeURL string
+	}{
+		{dynamicResources.CdsConfig, resourcev3.ClusterType},
+		{dynamicResources.LdsConfig, resourcev3.ListenerType},
+	} {
+		if file.source != nil && file.source.PathConfigSource != nil {
+			mainLog.Infof("Watching %s for dynamic resources", file.source.PathConfigSource.Path)
+			go store.WatchFile(ctx, file.source.PathConfigSource.Path, file.typeURL)
+		}
+	}
+	store.Start()
+
+	s.applyMu.Lock()
+	s.stopXDS = cancel
+	s.applyMu.Unlock()
+	return nil
+}
+
+func (s *Server) Shutdown() {
+	s.applyMu.Lock()
+	if s.stopXDS != nil {
+		s.stopXDS()
+	}
+	s.applyMu.Unlock()
+	s.admin.SetDraining()
+	s.listeners.Shutdown()
+}
+
+// Clusters, Listeners and DrainListeners let the admin server inspect and
+// control the running config.
+func (s *Server) Clusters() []*cluster.Cluster {
+	return s.clusters.All()
+}
+
+func (s *Server) Listeners() []admin.ListenerStatus {
+	var statuses []admin.ListenerStatus
+	for _, l := range s.listeners.Listeners() {
+		statuses = append(statuses, admin.ListenerStatus{Name: l.name, Address: l.addr().String()})
+	}
+	return statuses
+}
+
+func (s *Server) DrainListeners() {
+	s.listeners.Drain()
+}
+
+// newListenerHandler builds the data-plane handler for a listener, with a
+// chain for each of its filter chains, or its udp_proxy for a UDP listener.
+func (s *Server) newListenerHandler(l config.Listener) *listenerHandler {
+	if udpProxy := l.UdpProxy(); udpProxy != nil {
+		// Validation has already checked the filter.
+		proxy, err := network.NewUdpProxy(*udpProxy, s.clusters)
+		if err != nil {
+			mainLog.Errorf("listener %q: %v", l.Name, err)
+		}
+		return &listenerHandler{udp: proxy}
+	}
+	handler := &listenerHandler{
+		filterChains:   l.FilterChains,
+		inspectTLS:     l.HasListenerFilter(config.TLSInspectorFilter),
+		inspectTimeout: defaultListenerFiltersTimeout,
+	}
+	if l.IsQUIC() {
+		handler.quicOptions = l.UdpListenerConfig.QuicOptions
+	}
+	if l.ListenerFiltersTimeout != "" {
+		// Validation has already checked the timeout.
+		handler.inspectTimeout, _ = time.ParseDuration(l.ListenerFiltersTimeout)
+	}
+	for _, filterChain := range l.FilterChains {
+		handler.chains = append(handler.chains, s.newFilterChainHandler(l, filterChain))
+	}
+	return handler
+}
+
+// newFilterChainHandler builds the filters of a chain and, if the chain has a
+// transport socket, the TLS config that comes before them.
+func (s *Server) newFilterChainHandler(l config.Listener, filterChain config.FilterChain) filterChainHandler {
+	handler := s.newFilters(l.Name, filterChain)
+	if filterChain.TransportSocket == nil {
+		return handler
+	}
+	socketAddress := l.Address.SocketAddress
+	var err error
+	handler.tls, err = transport.NewServerConfig(fmt.Sprintf("%s_%d", socketAddress.Address, socketAddress.PortValue), filterChain.DownstreamTlsContext())
+	if err != nil {
+		// Serving the chain without TLS is no fallback, so its
+		// connections are closed instead.
+		mainLog.Errorf("listener %q: %v", l.Name, err)
+		return filterChainHandler{}
+	}
+	return handler
+}
+
+// newFilters builds a TCP proxy if the chain ends in tcp_proxy, otherwise a
+// router for its http_connection_manager filter.
+func (s *Server) newFilters(listenerName string, filterChain config.FilterChain) filterChainHandler {
+	// Validation has already checked the filters, so errors building them
+	// are not expected.
+	networkFilters, err := network.NewChain(filterChain, s.clusters)
+	if err != nil {
+		mainLog.Errorf("listener %q: %v", listenerName, err)
+		return filterChainHandler{http: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "invalid network filter chain", http.StatusInternalServerError)
+		})}
+	}
+	if networkFilters.TcpProxy != nil {
+		return filterChainHandler{filters: networkFilters, tcp: networkFilters.TcpProxy}
+	}
+
+	r := &Router{
+		Timeout:     10 * time.Second, // Example timeout value
+		Clusters:    s.clusters,
+		ErrorLogger: log.New(os.Stderr, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile),
+	}
+	if hcm := httpConnectionManager(filterChain); hcm != nil {
+		r.RouteConfig = hcm.RouteConfig
+		r.StatPrefix = hcm.StatPrefix
+		r.ForwardClientCertDetails = hcm.ForwardClientCertDetails
+		r.SetCurrentClientCertDetails = hcm.SetCurrentClientCertDetails
+		chain, err := filters.NewChain(hcm.HTTPFilters, &r.RouteConfig)
+		if err != nil {
+			mainLog.Errorf("listener %q: %v", listenerName, err)
+			return filterChainHandler{filters: networkFilters, http: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "invalid http filter chain", http.StatusInternalServerError)
+			})}
+		}
+		r.Filters = chain
+		return filterChainHandler{filters: networkFilters, http: r, hcm: hcm}
+	}
+	return filterChainHandler{filters: networkFilters, http: r}
+}
+
+func httpConnectionManager(filterChain config.FilterChain) *config.HttpConnectionManager {
+	for _, filter := range filterChain.Filters {
+		if filter.Name == config.HttpConnectionManagerFilter {
+			return &filter.TypedConfig
+		}
+	}
+	return nil
+}
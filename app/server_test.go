@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"seateam/config"
+)
+
+const serverTestConfig = `static_resources:
+  clusters:
+  - name: some_service
+    load_assignment:
+      endpoints:
+      - lb_endpoints:
+        - endpoint:
+            address:
+              socket_address: { address: 127.0.0.1, port_value: 1234 }
+`
+
+func TestUpdateConfigPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "static.yaml")
+	if err := os.WriteFile(path, []byte(serverTestConfig), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(options{configPath: path})
+	if err := server.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	setWeight := func(weight int) func(*config.StaticBootstrap) error {
+		return func(b *config.StaticBootstrap) error {
+			c, err := b.Cluster("some_service")
+			if err != nil {
+				return err
+			}
+			endpoint, err := c.Endpoint("127.0.0.1:1234")
+			if err != nil {
+				return err
+			}
+			endpoint.LoadBalancingWeight = weight
+			return nil
+		}
+	}
+
+	if err := server.UpdateConfig(setWeight(5), false); err != nil {
+		t.Fatal(err)
+	}
+	if weight := server.clusters.Get("some_service").LoadBalancer.Endpoints()[0].Weight; weight != 5 {
+		t.Errorf("expected the running cluster to have weight 5, got %d", weight)
+	}
+	if fileConfig, _ := config.Load(path); fileConfig.StaticResources.Clusters[0].LoadAssignment.Endpoints[0].LbEndpoints[0].LoadBalancingWeight != 0 {
+		t.Errorf("expected the config file to be left alone without persist")
+	}
+
+	if err := server.UpdateConfig(setWeight(-1), true); err == nil {
+		t.Errorf("expected an invalid change to be rejected")
+	}
+	if err := server.UpdateConfig(setWeight(7), true); err != nil {
+		t.Fatal(err)
+	}
+	fileConfig, err := config.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if weight := fileConfig.StaticResources.Clusters[0].LoadAssignment.Endpoints[0].LbEndpoints[0].LoadBalancingWeight; weight != 7 {
+		t.Errorf("expected the persisted config to have weight 7, got %d", weight)
+	}
+	if info, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if info.Mode().Perm() != 0o644 {
+		t.Errorf("expected the config file to keep its permissions, got %v", info.Mode())
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("expected no temporary files to be left behind, got %d entries", len(entries))
+	}
+}
@@ -0,0 +1,160 @@
+// Package stats holds the router's metrics. They are Prometheus collectors, but
+// each one also has an Envoy-style dotted name such as
+// "cluster.some_service.upstream_rq_total" used by the admin /stats page.
+package stats
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Registry contains every metric the router exports.
+var Registry = prometheus.NewRegistry()
+
+// stat records how a Prometheus family maps back to its Envoy name: the scope,
+// the label values that follow it and the stat name at the end.
+type stat struct {
+	scope  string
+	name   string
+	labels []string
+}
+
+var (
+	mu    sync.Mutex
+	stats = make(map[string]stat)
+)
+
+// familyName builds the Prometheus name. A "{}" in name marks where the last
+// label value goes in the Envoy name, as in "upstream_rq_{}xx", and is dropped
+// from the Prometheus name.
+func familyName(scope, name string) string {
+	return "envoy_" + scope + "_" + strings.Replace(name, "{}", "", 1)
+}
+
+func register(scope, name string, labels []string, collector prometheus.Collector) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	Registry.MustRegister(collector)
+	stats[familyName(scope, name)] = stat{scope: scope, name: name, labels: labels}
+}
+
+// NewCounterVec registers a counter named envoy_<scope>_<name>. Its label
+// values become part of the Envoy name, in the order given.
+func NewCounterVec(scope, name, help string, labels ...string) *prometheus.CounterVec {
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: familyName(scope, name), Help: help}, labels)
+	register(scope, name, labels, counter)
+	return counter
+}
+
+func NewGaugeVec(scope, name, help string, labels ...string) *prometheus.GaugeVec {
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: familyName(scope, name), Help: help}, labels)
+	register(scope, name, labels, gauge)
+	return gauge
+}
+
+func NewGaugeFunc(scope, name, help string, function func() float64) prometheus.GaugeFunc {
+	gauge := prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: familyName(scope, name), Help: help}, function)
+	register(scope, name, nil, gauge)
+	return gauge
+}
+
+// Value is a single stat under its Envoy name.
+type Value struct {
+	Name  string  `json:"name"`
+	Value float64 `json:"value"`
+}
+
+// Values gathers every stat whose Envoy name matches filter, sorted by name. A
+// nil filter matches everything.
+func Values(filter *regexp.Regexp) ([]Value, error) {
+	families, err := Registry.Gather()
+	if err != nil {
+		return nil, err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	var values []Value
+	for _, family := range families {
+		s, ok := stats[family.GetName()]
+		if !ok {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			parts := []string{s.scope}
+			for _, labelName := range s.labels {
+				for _, label := range metric.GetLabel() {
+					if label.GetName() == labelName {
+						parts = append(parts, label.GetValue())
+					}
+				}
+			}
+			statName := s.name
+			if strings.Contains(statName, "{}") && len(parts) > 1 {
+				statName = strings.Replace(statName, "{}", parts[len(parts)-1], 1)
+				parts = parts[:len(parts)-1]
+			}
+			name := strings.Join(append(parts, statName), ".")
+			if filter != nil && !filter.MatchString(name) {
+				continue
+			}
+			values = append(values, Value{Name: name, Value: metricValue(metric)})
+		}
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i].Name < values[j].Name })
+	return values, nil
+}
+
+func metricValue(metric *dto.Metric) float64 {
+	switch {
+	case metric.GetCounter() != nil:
+		return metric.GetCounter().GetValue()
+	case metric.GetGauge() != nil:
+		return metric.GetGauge().GetValue()
+	case metric.GetUntyped() != nil:
+		return metric.GetUntyped().GetValue()
+	}
+	return math.NaN()
+}
+
+// WriteText writes stats in Envoy's "name: value" text format.
+func WriteText(w io.Writer, values []Value) {
+	for _, value := range values {
+		fmt.Fprintf(w, "%s: %s\n", value.Name, formatValue(value.Value))
+	}
+}
+
+// WriteJSON writes stats in the {"stats": [...]} shape of Envoy's /stats?format=json.
+func WriteJSON(w io.Writer, values []Value) error {
+	if values == nil {
+		values = []Value{}
+	}
+	return json.NewEncoder(w).Encode(struct {
+		Stats []Value `json:"stats"`
+	}{values})
+}
+
+func formatValue(value float64) string {
+	if value == math.Trunc(value) && math.Abs(value) < 1e15 {
+		return fmt.Sprintf("%d", int64(value))
+	}
+	return fmt.Sprintf("%g", value)
+}
+
+// PrometheusHandler serves every stat in the Prometheus exposition format.
+func PrometheusHandler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
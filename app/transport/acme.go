@@ -0,0 +1,166 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"seateam/config"
+)
+
+// acmeChallengePath is where ACME CAs fetch HTTP-01 challenge responses.
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+var (
+	acmeMu sync.Mutex
+	// acmeManagers are the ACME managers in use, one for each account and
+	// storage directory, shared by the TLS contexts that use them.
+	acmeManagers = make(map[string]*acmeManager)
+)
+
+// acmeManager obtains and renews the certificates of the domains of the TLS
+// contexts that use it, counting how many use each domain.
+type acmeManager struct {
+	key     string
+	manager *autocert.Manager
+	// http01 answers HTTP-01 challenges, or is nil if they are not offered.
+	http01  http.Handler
+	domains map[string]int
+}
+
+// retainAcmeManager returns the manager for c, creating it if no TLS context
+// uses it yet, and adds c's domains to those it obtains certificates for.
+func retainAcmeManager(c config.Acme) (*acmeManager, error) {
+	trustedCa := ""
+	if c.TrustedCa != nil {
+		trustedCa = c.TrustedCa.Filename + c.TrustedCa.InlineString
+	}
+	key := fmt.Sprintf("%s|%s|%s|%s|%v|%s", c.DirectoryURL, c.Email, c.StorageDir, c.RenewBefore, c.Http01, trustedCa)
+
+	acmeMu.Lock()
+	defer acmeMu.Unlock()
+	m := acmeManagers[key]
+	if m == nil {
+		var err error
+		if m, err = newAcmeManager(key, c); err != nil {
+			return nil, err
+		}
+		acmeManagers[key] = m
+	}
+	for _, domain := range c.Domains {
+		m.domains[strings.ToLower(domain)]++
+	}
+	return m, nil
+}
+
+func newAcmeManager(key string, c config.Acme) (*acmeManager, error) {
+	renewBefore := config.DefaultAcmeRenewBefore
+	if c.RenewBefore != "" {
+		var err error
+		if renewBefore, err = time.ParseDuration(c.RenewBefore); err != nil {
+			return nil, fmt.Errorf("acme: invalid renew_before %q", c.RenewBefore)
+		}
+	}
+	client := &acme.Client{DirectoryURL: c.DirectoryURL}
+	if c.TrustedCa != nil {
+		roots, err := (config.CertificateValidationContext{TrustedCa: *c.TrustedCa}).LoadTrustedCa()
+		if err != nil {
+			return nil, fmt.Errorf("acme: trusted_ca: %v", err)
+		}
+		httpTransport := http.DefaultTransport.(*http.Transport).Clone()
+		httpTransport.TLSClientConfig = &tls.Config{RootCAs: roots}
+		client.HTTPClient = &http.Client{Transport: httpTransport}
+	}
+	m := &acmeManager{key: key, domains: make(map[string]int)}
+	m.manager = &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		Cache:       autocert.DirCache(c.StorageDir),
+		HostPolicy:  m.hostPolicy,
+		RenewBefore: renewBefore,
+		Client:      client,
+		Email:       c.Email,
+	}
+	if c.Http01 {
+		// Asking for the handler is what makes the manager offer HTTP-01.
+		m.http01 = m.manager.HTTPHandler(http.NotFoundHandler())
+	}
+	return m, nil
+}
+
+// hostPolicy lets certificates be obtained only for the domains in use. It is
+// also asked about the Host header of HTTP-01 requests, which may have a port.
+func (m *acmeManager) hostPolicy(_ context.Context, host string) error {
+	acmeMu.Lock()
+	defer acmeMu.Unlock()
+	if m.domains[hostname(host)] == 0 {
+		return fmt.Errorf("acme: %q is not a configured domain", host)
+	}
+	return nil
+}
+
+// release removes domains from those m obtains certificates for, and drops m
+// once no TLS context uses it.
+func (m *acmeManager) release(domains []string) {
+	acmeMu.Lock()
+	defer acmeMu.Unlock()
+	for _, domain := range domains {
+		domain = strings.ToLower(domain)
+		if m.domains[domain]--; m.domains[domain] <= 0 {
+			delete(m.domains, domain)
+		}
+	}
+	if len(m.domains) == 0 {
+		delete(acmeManagers, m.key)
+	}
+}
+
+// getCertificate returns the certificate for the server name the client asked
+// for, obtaining it first if there is none yet. It also answers TLS-ALPN-01
+// challenges.
+func (m *acmeManager) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if hello.ServerName == "" {
+		return nil, errors.New("acme: the client sent no server name")
+	}
+	return m.manager.GetCertificate(hello)
+}
+
+// ServeACMEChallenge answers r if it is an HTTP-01 challenge request for a
+// domain whose certificates are obtained with HTTP-01, and reports whether it
+// did.
+func ServeACMEChallenge(w http.ResponseWriter, r *http.Request) bool {
+	if !strings.HasPrefix(r.URL.Path, acmeChallengePath) {
+		return false
+	}
+	host := hostname(r.Host)
+	acmeMu.Lock()
+	var handler http.Handler
+	for _, m := range acmeManagers {
+		if m.http01 != nil && m.domains[host] > 0 {
+			handler = m.http01
+			break
+		}
+	}
+	acmeMu.Unlock()
+	if handler == nil {
+		return false
+	}
+	handler.ServeHTTP(w, r)
+	return true
+}
+
+// hostname returns host without its port, in lower case.
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
@@ -0,0 +1,127 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"seateam/config"
+)
+
+func newAcmeServerConfig(t *testing.T, acme config.Acme) *ServerConfig {
+	t.Helper()
+	filterChain := config.FilterChain{
+		TransportSocket: &config.DownstreamTransportSocket{Name: config.TLSTransportSocket},
+		Filters:         []config.Filter{{Name: config.HttpConnectionManagerFilter}},
+	}
+	filterChain.TransportSocket.TypedConfig.Acme = &acme
+	s, err := NewServerConfig("acme_test", filterChain.DownstreamTlsContext())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestServeACMEChallenge(t *testing.T) {
+	s := newAcmeServerConfig(t, config.Acme{
+		DirectoryURL: "https://127.0.0.1:1/dir",
+		StorageDir:   t.TempDir(),
+		Http01:       true,
+		Domains:      []string{"www.example.com"},
+	})
+	served := func(target string) bool {
+		return ServeACMEChallenge(httptest.NewRecorder(), httptest.NewRequest("GET", target, nil))
+	}
+
+	if !served("http://WWW.example.com:80/.well-known/acme-challenge/token") {
+		t.Error("expected the challenge for a configured domain to be answered")
+	}
+	if served("http://api.example.com/.well-known/acme-challenge/token") {
+		t.Error("expected the challenge for another domain to be left to the routes")
+	}
+	if served("http://www.example.com/index.html") {
+		t.Error("expected other paths to be left to the routes")
+	}
+	if err := s.acme.hostPolicy(context.Background(), "api.example.com"); err == nil {
+		t.Error("expected certificates to be refused for other domains")
+	}
+	if err := s.acme.hostPolicy(context.Background(), "www.example.com:80"); err != nil {
+		t.Errorf("expected the Host header of a challenge request to be allowed, got %v", err)
+	}
+
+	// Without http_01, the challenges are not answered.
+	newAcmeServerConfig(t, config.Acme{
+		DirectoryURL: "https://127.0.0.1:1/dir",
+		StorageDir:   t.TempDir(),
+		Domains:      []string{"api.example.com"},
+	})
+	if served("http://api.example.com/.well-known/acme-challenge/token") {
+		t.Error("expected HTTP-01 challenges to be off without http_01")
+	}
+
+	s.Close()
+	if served("http://www.example.com/.well-known/acme-challenge/token") {
+		t.Error("expected a closed config's domains to be dropped")
+	}
+}
+
+// TestAcmeOffersHTTP checks that an ACME chain without alpn_protocols offers
+// HTTP ahead of acme-tls/1, so clients offering ALPN can still connect.
+func TestAcmeOffersHTTP(t *testing.T) {
+	s := newAcmeServerConfig(t, config.Acme{
+		DirectoryURL: "https://127.0.0.1:1/dir",
+		StorageDir:   t.TempDir(),
+		Domains:      []string{"www.example.com"},
+	})
+	if want := []string{"h2", "http/1.1", "acme-tls/1"}; !reflect.DeepEqual(s.tls.NextProtos, want) {
+		t.Errorf("expected ALPN protocols %v, got %v", want, s.tls.NextProtos)
+	}
+}
+
+// TestAcmeWithPebble obtains a certificate with TLS-ALPN-01 from a local Pebble,
+// run for example with
+//
+//	pebble -config test/config/pebble-config.json
+//
+// and PEBBLE_DIRECTORY_URL=https://127.0.0.1:14000/dir, PEBBLE_CA set to
+// Pebble's test/certs/pebble.minica.pem and PEBBLE_TLS_ADDRESS to the address
+// of its tlsPort, 127.0.0.1:5001 by default.
+func TestAcmeWithPebble(t *testing.T) {
+	directoryURL := os.Getenv("PEBBLE_DIRECTORY_URL")
+	if directoryURL == "" {
+		t.Skip("PEBBLE_DIRECTORY_URL is not set")
+	}
+	address := os.Getenv("PEBBLE_TLS_ADDRESS")
+	if address == "" {
+		address = "127.0.0.1:5001"
+	}
+	storageDir := t.TempDir()
+	s := newAcmeServerConfig(t, config.Acme{
+		DirectoryURL: directoryURL,
+		StorageDir:   storageDir,
+		Domains:      []string{"seateam.localhost"},
+		TrustedCa:    &config.DataSource{Filename: os.Getenv("PEBBLE_CA")},
+	})
+	serveTLSOn(t, address, s)
+
+	state, err := handshake(t, address, &tls.Config{ServerName: "seateam.localhost", InsecureSkipVerify: true, NextProtos: []string{"h2", "http/1.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := state.PeerCertificates[0]
+	if len(leaf.DNSNames) != 1 || leaf.DNSNames[0] != "seateam.localhost" || leaf.Issuer.String() == leaf.Subject.String() {
+		t.Errorf("expected a certificate for seateam.localhost issued by Pebble, got %v issued by %v", leaf.DNSNames, leaf.Issuer)
+	}
+	if _, err := os.Stat(filepath.Join(storageDir, "seateam.localhost")); err != nil {
+		t.Errorf("expected the certificate to be stored: %v", err)
+	}
+
+	if _, err := handshake(t, address, &tls.Config{ServerName: "other.localhost", InsecureSkipVerify: true, NextProtos: []string{"h2", "http/1.1"}}); err == nil {
+		t.Error("expected no certificate for a domain that is not configured")
+	}
+}
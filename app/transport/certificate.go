@@ -0,0 +1,130 @@
+package transport
+
+import (
+	"crypto/tls"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"seateam/config"
+	"seateam/stats"
+)
+
+// reloadCheckInterval is how often a certificate's files are checked for
+// changes, at most. The check is made on a handshake, so certificates that
+// are not used are not checked.
+var reloadCheckInterval = time.Second
+
+var (
+	certificatesMu sync.Mutex
+	// certificates are the certificates of the TLS contexts in use, with how
+	// many contexts use each.
+	certificates = make(map[*certificate]int)
+
+	_ = stats.NewGaugeFunc("server", "days_until_first_cert_expiring", "Days until the first certificate in use expires.", daysUntilFirstCertExpiring)
+)
+
+// certificate is a key pair that is read again when its files change, so
+// rotated certificates are picked up without a restart. If the new files
+// cannot be loaded, as when only one of them has been replaced yet, the old
+// key pair stays in use until they can.
+type certificate struct {
+	source config.TlsCertificate
+
+	mu      sync.Mutex
+	current *tls.Certificate
+	stamp   fileStamp
+	checked time.Time
+}
+
+// fileStamp tells whether the files of a certificate have changed.
+type fileStamp struct {
+	chainModTime, keyModTime time.Time
+	chainSize, keySize       int64
+}
+
+func loadCertificate(source config.TlsCertificate) (*certificate, error) {
+	c := &certificate{source: source, stamp: stampOf(source), checked: time.Now()}
+	keyPair, err := source.LoadKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	c.current = &keyPair
+	return c, nil
+}
+
+func stampOf(source config.TlsCertificate) fileStamp {
+	var stamp fileStamp
+	if info, err := os.Stat(source.CertificateChain.Filename); err == nil && source.CertificateChain.Filename != "" {
+		stamp.chainModTime, stamp.chainSize = info.ModTime(), info.Size()
+	}
+	if info, err := os.Stat(source.PrivateKey.Filename); err == nil && source.PrivateKey.Filename != "" {
+		stamp.keyModTime, stamp.keySize = info.ModTime(), info.Size()
+	}
+	return stamp
+}
+
+// get returns the key pair, reloading it first if its files have changed
+// since they were last checked.
+func (c *certificate) get() *tls.Certificate {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.checked) < reloadCheckInterval {
+		return c.current
+	}
+	c.checked = time.Now()
+	stamp := stampOf(c.source)
+	if stamp == c.stamp {
+		return c.current
+	}
+	keyPair, err := c.source.LoadKeyPair()
+	if err != nil {
+		transportLog.Warnf("Reloading certificate %s: %v", c.source.CertificateChain.Filename, err)
+		return c.current
+	}
+	c.stamp, c.current = stamp, &keyPair
+	transportLog.Infof("Reloaded certificate %s", c.source.CertificateChain.Filename)
+	return c.current
+}
+
+// notAfter returns when the leaf certificate expires.
+func (c *certificate) notAfter() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.current.Leaf.NotAfter
+}
+
+func retainCertificates(cs []*certificate) {
+	certificatesMu.Lock()
+	defer certificatesMu.Unlock()
+	for _, c := range cs {
+		certificates[c]++
+	}
+}
+
+func releaseCertificates(cs []*certificate) {
+	certificatesMu.Lock()
+	defer certificatesMu.Unlock()
+	for _, c := range cs {
+		if certificates[c]--; certificates[c] <= 0 {
+			delete(certificates, c)
+		}
+	}
+}
+
+// daysUntilFirstCertExpiring is Envoy's server.days_until_first_cert_expiring:
+// the whole days left on the certificate in use that expires first. It is 0
+// once a certificate has expired, and the largest int32 while there are none.
+func daysUntilFirstCertExpiring() float64 {
+	certificatesMu.Lock()
+	defer certificatesMu.Unlock()
+
+	days := float64(math.MaxInt32)
+	for c := range certificates {
+		left := math.Floor(time.Until(c.notAfter()).Hours() / 24)
+		days = math.Min(days, math.Max(left, 0))
+	}
+	return days
+}
@@ -0,0 +1,115 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"seateam/config"
+	"seateam/stats"
+)
+
+var (
+	upstreamSslHandshake       = stats.NewCounterVec("cluster", "ssl_handshake", "Successful TLS handshakes with upstream endpoints.", "envoy_cluster_name")
+	upstreamSslConnectionError = stats.NewCounterVec("cluster", "ssl_connection_error", "TLS handshakes with upstream endpoints that failed.", "envoy_cluster_name")
+	upstreamSslFailVerifyError = stats.NewCounterVec("cluster", "ssl_fail_verify_error", "TLS handshakes that failed because the upstream certificate did not verify against the trusted CA.", "envoy_cluster_name")
+	upstreamSslFailVerifySan   = stats.NewCounterVec("cluster", "ssl_fail_verify_san", "TLS handshakes that failed because no subject alternative name of the upstream certificate matched.", "envoy_cluster_name")
+)
+
+// ClientConfig starts TLS on the connections to one cluster's endpoints.
+type ClientConfig struct {
+	tls          *tls.Config
+	certificates []*certificate
+	handshake    prometheus.Counter
+	handshakeErr prometheus.Counter
+	closeOnce    sync.Once
+
+	// Endpoint certificates are verified against trustedCa when it is set.
+	trustedCa       *x509.CertPool
+	sanMatchers     []config.SubjectAltNameMatcher
+	failVerifyError prometheus.Counter
+	failVerifySan   prometheus.Counter
+}
+
+// NewClientConfig builds the TLS config for c. Its stats are labelled with
+// clusterName. Close releases the config once the cluster is replaced.
+func NewClientConfig(clusterName string, c config.UpstreamTlsContext) (*ClientConfig, error) {
+	tlsConfig, err := newTLSConfig(c.CommonTlsContext)
+	if err != nil {
+		return nil, err
+	}
+	// Endpoints are not checked against the server name, only by
+	// verifyServer, which leaves them unverified without a
+	// validation_context, as Envoy does.
+	tlsConfig.ServerName = c.Sni
+	tlsConfig.InsecureSkipVerify = true
+	s := &ClientConfig{
+		tls:          tlsConfig,
+		handshake:    upstreamSslHandshake.WithLabelValues(clusterName),
+		handshakeErr: upstreamSslConnectionError.WithLabelValues(clusterName),
+	}
+	for _, source := range c.CommonTlsContext.TlsCertificates {
+		certificate, err := loadCertificate(source)
+		if err != nil {
+			return nil, err
+		}
+		s.certificates = append(s.certificates, certificate)
+	}
+	if len(s.certificates) > 0 {
+		s.tls.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return s.certificates[0].get(), nil
+		}
+	}
+	if validationContext := c.CommonTlsContext.ValidationContext; validationContext != nil {
+		if s.trustedCa, err = validationContext.LoadTrustedCa(); err != nil {
+			return nil, err
+		}
+		s.sanMatchers = validationContext.MatchTypedSubjectAltNames
+		s.failVerifyError = upstreamSslFailVerifyError.WithLabelValues(clusterName)
+		s.failVerifySan = upstreamSslFailVerifySan.WithLabelValues(clusterName)
+		s.tls.VerifyConnection = s.verifyServer
+	}
+	retainCertificates(s.certificates)
+	return s, nil
+}
+
+// verifyServer checks the endpoint's certificate against the trusted CA and
+// the SAN matchers.
+func (s *ClientConfig) verifyServer(state tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		s.failVerifyError.Inc()
+		return errors.New("upstream sent no certificate")
+	}
+	if err := verifyChain(state.PeerCertificates, s.trustedCa, x509.ExtKeyUsageServerAuth); err != nil {
+		s.failVerifyError.Inc()
+		return err
+	}
+	if len(s.sanMatchers) > 0 && !matchesAny(state.PeerCertificates[0], s.sanMatchers) {
+		s.failVerifySan.Inc()
+		return errors.New("upstream certificate has no matching subject alternative name")
+	}
+	return nil
+}
+
+// Client runs the TLS handshake on conn, a connection to an endpoint, and
+// returns the TLS connection. Failed handshakes are counted and close conn.
+func (s *ClientConfig) Client(ctx context.Context, conn net.Conn) (*tls.Conn, error) {
+	tlsConn := tls.Client(conn, s.tls)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		s.handshakeErr.Inc()
+		tlsConn.Close()
+		return nil, err
+	}
+	s.handshake.Inc()
+	return tlsConn, nil
+}
+
+// Close stops the config's certificates counting as in use.
+func (s *ClientConfig) Close() {
+	s.closeOnce.Do(func() { releaseCertificates(s.certificates) })
+}
@@ -0,0 +1,229 @@
+// Package transport builds the TLS transport sockets of listeners and
+// clusters: it turns a DownstreamTlsContext or an UpstreamTlsContext into a
+// crypto/tls config whose certificates are reloaded when their files change.
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/acme"
+
+	"seateam/config"
+	"seateam/logger"
+	"seateam/stats"
+)
+
+var transportLog = logger.Get("connection")
+
+// handshakeTimeout bounds how long a client has to finish the TLS handshake.
+const handshakeTimeout = 10 * time.Second
+
+var (
+	sslHandshake        = stats.NewCounterVec("listener", "ssl_handshake", "Successful TLS handshakes.", "envoy_listener_address")
+	sslConnectionError  = stats.NewCounterVec("listener", "ssl_connection_error", "TLS handshakes that failed.", "envoy_listener_address")
+	sslFailVerifyNoCert = stats.NewCounterVec("listener", "ssl_fail_verify_no_cert", "TLS handshakes that failed because a required client certificate was missing.", "envoy_listener_address")
+	sslFailVerifyError  = stats.NewCounterVec("listener", "ssl_fail_verify_error", "TLS handshakes that failed because the client certificate did not verify against the trusted CA.", "envoy_listener_address")
+	sslFailVerifySan    = stats.NewCounterVec("listener", "ssl_fail_verify_san", "TLS handshakes that failed because no subject alternative name of the client certificate matched.", "envoy_listener_address")
+)
+
+// ServerConfig terminates TLS for one filter chain.
+type ServerConfig struct {
+	tls          *tls.Config
+	quic         *tls.Config
+	certificates []*certificate
+	// acme obtains the certificates for acmeDomains instead, when set.
+	acme         *acmeManager
+	acmeDomains  []string
+	handshake    prometheus.Counter
+	handshakeErr prometheus.Counter
+	closeOnce    sync.Once
+
+	// Client certificates are verified against trustedCa when it is set.
+	trustedCa                *x509.CertPool
+	sanMatchers              []config.SubjectAltNameMatcher
+	requireClientCertificate bool
+	failVerifyNoCert         prometheus.Counter
+	failVerifyError          prometheus.Counter
+	failVerifySan            prometheus.Counter
+}
+
+// NewServerConfig builds the TLS config for c. Its stats are labelled with
+// listenerAddress. Close releases the config once it is no longer used, so
+// its certificates stop counting towards certificate expiry.
+func NewServerConfig(listenerAddress string, c config.DownstreamTlsContext) (*ServerConfig, error) {
+	tlsConfig, err := newTLSConfig(c.CommonTlsContext)
+	if err != nil {
+		return nil, err
+	}
+	s := &ServerConfig{
+		tls:          tlsConfig,
+		handshake:    sslHandshake.WithLabelValues(listenerAddress),
+		handshakeErr: sslConnectionError.WithLabelValues(listenerAddress),
+	}
+	if validationContext := c.CommonTlsContext.ValidationContext; validationContext != nil {
+		if s.trustedCa, err = validationContext.LoadTrustedCa(); err != nil {
+			return nil, err
+		}
+		s.sanMatchers = validationContext.MatchTypedSubjectAltNames
+		s.requireClientCertificate = c.RequireClientCertificate
+		s.failVerifyNoCert = sslFailVerifyNoCert.WithLabelValues(listenerAddress)
+		s.failVerifyError = sslFailVerifyError.WithLabelValues(listenerAddress)
+		s.failVerifySan = sslFailVerifySan.WithLabelValues(listenerAddress)
+		// Certificates are asked for but verified by verifyClient, which
+		// counts why they fail and applies the SAN matchers.
+		s.tls.ClientAuth = tls.RequestClientCert
+		s.tls.VerifyConnection = s.verifyClient
+	}
+	for _, source := range c.CommonTlsContext.TlsCertificates {
+		certificate, err := loadCertificate(source)
+		if err != nil {
+			return nil, err
+		}
+		s.certificates = append(s.certificates, certificate)
+	}
+	if c.Acme != nil {
+		if s.acme, err = retainAcmeManager(*c.Acme); err != nil {
+			return nil, err
+		}
+		s.acmeDomains = c.Acme.Domains
+		s.tls.NextProtos = append(s.tls.NextProtos, acme.ALPNProto)
+	}
+	s.tls.GetCertificate = s.getCertificate
+	s.quic = s.newQUICConfig()
+	retainCertificates(s.certificates)
+	return s, nil
+}
+
+// newQUICConfig derives the config of QUIC connections from the TLS one. QUIC
+// only runs over TLS 1.3, and its handshakes are done by the QUIC
+// implementation, so they are counted when the connection is verified.
+func (s *ServerConfig) newQUICConfig() *tls.Config {
+	quic := s.tls.Clone()
+	quic.MinVersion, quic.MaxVersion = tls.VersionTLS13, 0
+	verifyClient := quic.VerifyConnection
+	quic.VerifyConnection = func(state tls.ConnectionState) error {
+		if verifyClient != nil {
+			if err := verifyClient(state); err != nil {
+				s.handshakeErr.Inc()
+				return err
+			}
+		}
+		s.handshake.Inc()
+		return nil
+	}
+	return quic
+}
+
+// QUICConfig returns the TLS config for QUIC connections.
+func (s *ServerConfig) QUICConfig() *tls.Config {
+	return s.quic
+}
+
+// newTLSConfig sets the protocol versions, cipher suites and ALPN protocols of
+// common. Validation has already checked them.
+func newTLSConfig(common config.CommonTlsContext) (*tls.Config, error) {
+	cipherSuites, err := common.TlsParams.CipherSuiteIDs()
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:   config.TLSVersions[common.TlsParams.TlsMinimumProtocolVersion],
+		MaxVersion:   config.TLSVersions[common.TlsParams.TlsMaximumProtocolVersion],
+		CipherSuites: cipherSuites,
+		NextProtos:   common.AlpnProtocols,
+	}, nil
+}
+
+// getCertificate picks the first certificate that covers the server name the
+// client asked for and that it can use, or the first certificate if none
+// does. ACME certificates are picked by the ACME manager.
+func (s *ServerConfig) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if s.acme != nil {
+		return s.acme.getCertificate(hello)
+	}
+	for _, certificate := range s.certificates {
+		if keyPair := certificate.get(); hello.SupportsCertificate(keyPair) == nil {
+			return keyPair, nil
+		}
+	}
+	return s.certificates[0].get(), nil
+}
+
+// verifyClient checks the certificate the client sent, if any, against the
+// trusted CA and the SAN matchers. A certificate that fails ends the
+// handshake, so the peer certificates of an established connection have
+// been verified.
+func (s *ServerConfig) verifyClient(state tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		if s.requireClientCertificate {
+			s.failVerifyNoCert.Inc()
+			return errors.New("client certificate required")
+		}
+		return nil
+	}
+	if err := verifyChain(state.PeerCertificates, s.trustedCa, x509.ExtKeyUsageClientAuth); err != nil {
+		s.failVerifyError.Inc()
+		return err
+	}
+	if len(s.sanMatchers) > 0 && !matchesAny(state.PeerCertificates[0], s.sanMatchers) {
+		s.failVerifySan.Inc()
+		return errors.New("client certificate has no matching subject alternative name")
+	}
+	return nil
+}
+
+// verifyChain checks that the certificates, leaf first, chain up to one of
+// roots and that the leaf may be used for usage. The names in the leaf are
+// left to the SAN matchers.
+func verifyChain(certificates []*x509.Certificate, roots *x509.CertPool, usage x509.ExtKeyUsage) error {
+	intermediates := x509.NewCertPool()
+	for _, certificate := range certificates[1:] {
+		intermediates.AddCert(certificate)
+	}
+	_, err := certificates[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	})
+	return err
+}
+
+func matchesAny(certificate *x509.Certificate, matchers []config.SubjectAltNameMatcher) bool {
+	for _, matcher := range matchers {
+		if matcher.Matches(certificate) {
+			return true
+		}
+	}
+	return false
+}
+
+// Server runs the TLS handshake on conn and returns the TLS connection.
+// Failed handshakes are counted and close conn.
+func (s *ServerConfig) Server(conn net.Conn) (*tls.Conn, error) {
+	tlsConn := tls.Server(conn, s.tls)
+	tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		s.handshakeErr.Inc()
+		tlsConn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	s.handshake.Inc()
+	return tlsConn, nil
+}
+
+// Close stops the config's certificates counting as in use.
+func (s *ServerConfig) Close() {
+	s.closeOnce.Do(func() {
+		releaseCertificates(s.certificates)
+		if s.acme != nil {
+			s.acme.release(s.acmeDomains)
+		}
+	})
+}
@@ -0,0 +1,423 @@
+package transport
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"seateam/config"
+)
+
+// writeCertificate writes a self-signed certificate for dnsNames, valid for
+// validFor, and its key to dir, named after the first name.
+func writeCertificate(t *testing.T, dir string, validFor time.Duration, dnsNames ...string) config.TlsCertificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(validFor),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate := config.TlsCertificate{
+		CertificateChain: config.DataSource{Filename: filepath.Join(dir, dnsNames[0]+".crt")},
+		PrivateKey:       config.DataSource{Filename: filepath.Join(dir, dnsNames[0]+".key")},
+	}
+	if err := os.WriteFile(certificate.CertificateChain.Filename, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certificate.PrivateKey.Filename, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certificate
+}
+
+// serveTLS terminates TLS with s on a local port and returns its address.
+func serveTLS(t *testing.T, s *ServerConfig) string {
+	t.Helper()
+	return serveTLSOn(t, "127.0.0.1:0", s)
+}
+
+// serveTLSOn terminates TLS with s on address and returns the address it
+// listens on.
+func serveTLSOn(t *testing.T, address string, s *ServerConfig) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				if tlsConn, err := s.Server(conn); err == nil {
+					tlsConn.Close()
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// handshake connects to address and returns the state of the connection.
+func handshake(t *testing.T, address string, c *tls.Config) (tls.ConnectionState, error) {
+	t.Helper()
+	conn, err := tls.Dial("tcp", address, c)
+	if err != nil {
+		return tls.ConnectionState{}, err
+	}
+	defer conn.Close()
+	return conn.ConnectionState(), nil
+}
+
+// waitForCount waits for the server side of the handshakes, which may finish
+// after the client's, to reach want, and returns the count.
+func waitForCount(counter prometheus.Counter, want float64) float64 {
+	deadline := time.Now().Add(5 * time.Second)
+	for testutil.ToFloat64(counter) != want && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return testutil.ToFloat64(counter)
+}
+
+func newServerConfig(t *testing.T, listenerAddress string, common config.CommonTlsContext) *ServerConfig {
+	t.Helper()
+	s, err := NewServerConfig(listenerAddress, config.DownstreamTlsContext{CommonTlsContext: common})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestServerConfigPicksCertificateByServerName(t *testing.T) {
+	dir := t.TempDir()
+	s := newServerConfig(t, "sni_test", config.CommonTlsContext{TlsCertificates: []config.TlsCertificate{
+		writeCertificate(t, dir, time.Hour, "default.example.com"),
+		writeCertificate(t, dir, time.Hour, "api.example.com", "*.api.example.com"),
+	}})
+	address := serveTLS(t, s)
+	handshakes := sslHandshake.WithLabelValues("sni_test")
+	before := testutil.ToFloat64(handshakes)
+
+	for serverName, want := range map[string]string{
+		"api.example.com":     "api.example.com",
+		"v1.api.example.com":  "api.example.com",
+		"default.example.com": "default.example.com",
+		"unknown.example.com": "default.example.com",
+		"":                    "default.example.com",
+	} {
+		state, err := handshake(t, address, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("%q: %v", serverName, err)
+		}
+		if got := state.PeerCertificates[0].Subject.CommonName; got != want {
+			t.Errorf("%q: expected the %s certificate, got %s", serverName, want, got)
+		}
+	}
+	if count := waitForCount(handshakes, before+5) - before; count != 5 {
+		t.Errorf("expected 5 handshakes, got %v", count)
+	}
+}
+
+func TestServerConfigReloadsCertificates(t *testing.T) {
+	defer func(interval time.Duration) { reloadCheckInterval = interval }(reloadCheckInterval)
+	reloadCheckInterval = 0
+
+	dir := t.TempDir()
+	s := newServerConfig(t, "reload_test", config.CommonTlsContext{TlsCertificates: []config.TlsCertificate{
+		writeCertificate(t, dir, time.Hour, "rotated.example.com"),
+	}})
+	address := serveTLS(t, s)
+	client := &tls.Config{ServerName: "rotated.example.com", InsecureSkipVerify: true}
+
+	state, err := handshake(t, address, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := state.PeerCertificates[0].SerialNumber
+
+	// Make sure the new files get a different modification time.
+	time.Sleep(10 * time.Millisecond)
+	writeCertificate(t, dir, 48*time.Hour, "rotated.example.com")
+	if state, err = handshake(t, address, client); err != nil {
+		t.Fatal(err)
+	}
+	if after := state.PeerCertificates[0].SerialNumber; after.Cmp(before) == 0 {
+		t.Error("expected the rotated certificate after the files changed")
+	}
+
+	// A broken file keeps the certificate that was loaded.
+	os.WriteFile(filepath.Join(dir, "rotated.example.com.key"), []byte("not a key"), 0o600)
+	if _, err := handshake(t, address, client); err != nil {
+		t.Errorf("expected the old certificate to stay in use, got %v", err)
+	}
+}
+
+func TestServerConfigParams(t *testing.T) {
+	s := newServerConfig(t, "params_test", config.CommonTlsContext{
+		TlsParams: config.TlsParams{
+			TlsMinimumProtocolVersion: "TLSv1_2",
+			TlsMaximumProtocolVersion: "TLSv1_2",
+			CipherSuites:              []string{"ECDHE-ECDSA-AES128-GCM-SHA256"},
+		},
+		TlsCertificates: []config.TlsCertificate{writeCertificate(t, t.TempDir(), time.Hour, "params.example.com")},
+		AlpnProtocols:   []string{"h2", "http/1.1"},
+	})
+	address := serveTLS(t, s)
+	handshakeErrors := sslConnectionError.WithLabelValues("params_test")
+	before := testutil.ToFloat64(handshakeErrors)
+
+	state, err := handshake(t, address, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"http/1.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Version != tls.VersionTLS12 || state.CipherSuite != tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 || state.NegotiatedProtocol != "http/1.1" {
+		t.Errorf("expected TLS 1.2 with the configured cipher suite and http/1.1, got %x %x %q", state.Version, state.CipherSuite, state.NegotiatedProtocol)
+	}
+
+	if _, err := handshake(t, address, &tls.Config{InsecureSkipVerify: true, MinVersion: tls.VersionTLS13}); err == nil {
+		t.Error("expected a TLS 1.3 only client to be refused")
+	}
+	if count := waitForCount(handshakeErrors, before+1) - before; count != 1 {
+		t.Errorf("expected one failed handshake, got %v", count)
+	}
+}
+
+func TestDaysUntilFirstCertExpiring(t *testing.T) {
+	dir := t.TempDir()
+	soon := newServerConfig(t, "expiry_test", config.CommonTlsContext{TlsCertificates: []config.TlsCertificate{
+		writeCertificate(t, dir, 30*24*time.Hour+time.Hour, "later.example.com"),
+		writeCertificate(t, dir, 3*24*time.Hour+time.Hour, "soon.example.com"),
+	}})
+	if days := daysUntilFirstCertExpiring(); days != 3 {
+		t.Errorf("expected 3 days, got %v", days)
+	}
+	soon.Close()
+	newServerConfig(t, "expiry_test", config.CommonTlsContext{TlsCertificates: []config.TlsCertificate{
+		writeCertificate(t, dir, 30*24*time.Hour+time.Hour, "later.example.com"),
+	}})
+	if days := daysUntilFirstCertExpiring(); days != 30 {
+		t.Errorf("expected the closed config's certificates to stop counting, got %v days", days)
+	}
+}
+
+// issueCertificate returns a certificate for uri and usage signed by the CA,
+// or a self-signed CA certificate if ca is nil, with the certificate as PEM.
+func issueCertificate(t *testing.T, ca *tls.Certificate, uri string, usage x509.ExtKeyUsage) (tls.Certificate, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "issued"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	if uri != "" {
+		parsed, err := url.Parse(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template.URIs = []*url.URL{parsed}
+	}
+	parent, signer := template, any(key)
+	if ca != nil {
+		parent, signer = ca.Leaf, ca.PrivateKey
+	} else {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestServerConfigVerifiesClientCertificates(t *testing.T) {
+	ca, caPEM := issueCertificate(t, nil, "", x509.ExtKeyUsageAny)
+	otherCa, _ := issueCertificate(t, nil, "", x509.ExtKeyUsageAny)
+	web, _ := issueCertificate(t, &ca, "spiffe://example.com/web", x509.ExtKeyUsageClientAuth)
+	db, _ := issueCertificate(t, &ca, "spiffe://example.com/db", x509.ExtKeyUsageClientAuth)
+	untrusted, _ := issueCertificate(t, &otherCa, "spiffe://example.com/web", x509.ExtKeyUsageClientAuth)
+
+	s, err := NewServerConfig("mtls_test", config.DownstreamTlsContext{
+		RequireClientCertificate: true,
+		CommonTlsContext: config.CommonTlsContext{
+			TlsCertificates: []config.TlsCertificate{writeCertificate(t, t.TempDir(), time.Hour, "mtls.example.com")},
+			ValidationContext: &config.CertificateValidationContext{
+				TrustedCa: config.DataSource{InlineString: string(caPEM)},
+				MatchTypedSubjectAltNames: []config.SubjectAltNameMatcher{
+					{SanType: "URI", Matcher: config.StringMatcher{Exact: "spiffe://example.com/web"}},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	address := serveTLS(t, s)
+
+	for _, test := range []struct {
+		name        string
+		certificate *tls.Certificate
+		counter     prometheus.Counter
+	}{
+		{"trusted", &web, sslHandshake.WithLabelValues("mtls_test")},
+		{"no certificate", nil, sslFailVerifyNoCert.WithLabelValues("mtls_test")},
+		{"untrusted", &untrusted, sslFailVerifyError.WithLabelValues("mtls_test")},
+		{"san mismatch", &db, sslFailVerifySan.WithLabelValues("mtls_test")},
+	} {
+		client := &tls.Config{InsecureSkipVerify: true}
+		if test.certificate != nil {
+			client.Certificates = []tls.Certificate{*test.certificate}
+		}
+		before := testutil.ToFloat64(test.counter)
+		// With TLS 1.3 the client finishes its handshake before the server
+		// has verified its certificate, so read to see whether the server
+		// kept the connection.
+		conn, err := tls.Dial("tcp", address, client)
+		if err == nil {
+			_, err = conn.Read(make([]byte, 1))
+			conn.Close()
+		}
+		if count := waitForCount(test.counter, before+1) - before; count != 1 {
+			t.Errorf("%s: expected the handshake to be counted once, got %v (%v)", test.name, count, err)
+		}
+	}
+}
+
+func TestClientConfigVerifiesUpstreams(t *testing.T) {
+	ca, caPEM := issueCertificate(t, nil, "", x509.ExtKeyUsageAny)
+	otherCa, _ := issueCertificate(t, nil, "", x509.ExtKeyUsageAny)
+	backend, _ := issueCertificate(t, &ca, "spiffe://example.com/backend", x509.ExtKeyUsageServerAuth)
+	impostor, _ := issueCertificate(t, &ca, "spiffe://example.com/impostor", x509.ExtKeyUsageServerAuth)
+	untrusted, _ := issueCertificate(t, &otherCa, "spiffe://example.com/backend", x509.ExtKeyUsageServerAuth)
+	dir := t.TempDir()
+	client := writeCertificate(t, dir, time.Hour, "client.example.com")
+
+	// upstream serves certificate and reports the server name and client
+	// certificate each connection came with.
+	upstream := func(certificate tls.Certificate) (string, chan string) {
+		seen := make(chan string, 1)
+		ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+			Certificates: []tls.Certificate{certificate},
+			ClientAuth:   tls.RequireAnyClientCert,
+			VerifyConnection: func(state tls.ConnectionState) error {
+				seen <- state.ServerName + " " + state.PeerCertificates[0].Subject.CommonName
+				return nil
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ln.Close() })
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer conn.Close()
+					conn.(*tls.Conn).Handshake()
+				}()
+			}
+		}()
+		return ln.Addr().String(), seen
+	}
+
+	c, err := NewClientConfig("upstream_test", config.UpstreamTlsContext{
+		Sni: "backend.example.com",
+		CommonTlsContext: config.CommonTlsContext{
+			TlsCertificates: []config.TlsCertificate{client},
+			ValidationContext: &config.CertificateValidationContext{
+				TrustedCa: config.DataSource{InlineString: string(caPEM)},
+				MatchTypedSubjectAltNames: []config.SubjectAltNameMatcher{
+					{SanType: "URI", Matcher: config.StringMatcher{Exact: "spiffe://example.com/backend"}},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	dial := func(address string) error {
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			return err
+		}
+		tlsConn, err := c.Client(context.Background(), conn)
+		if err == nil {
+			tlsConn.Close()
+		}
+		return err
+	}
+
+	address, seen := upstream(backend)
+	if err := dial(address); err != nil {
+		t.Fatalf("expected the handshake to succeed, got %v", err)
+	}
+	if got := <-seen; got != "backend.example.com client.example.com" {
+		t.Errorf("expected the configured SNI and client certificate, got %q", got)
+	}
+
+	for _, test := range []struct {
+		name        string
+		certificate tls.Certificate
+		counter     prometheus.Counter
+	}{
+		{"untrusted", untrusted, upstreamSslFailVerifyError.WithLabelValues("upstream_test")},
+		{"san mismatch", impostor, upstreamSslFailVerifySan.WithLabelValues("upstream_test")},
+	} {
+		before := testutil.ToFloat64(test.counter)
+		address, _ := upstream(test.certificate)
+		if err := dial(address); err == nil {
+			t.Errorf("%s: expected the handshake to fail", test.name)
+		}
+		if count := testutil.ToFloat64(test.counter) - before; count != 1 {
+			t.Errorf("%s: expected the failure to be counted once, got %v", test.name, count)
+		}
+	}
+}
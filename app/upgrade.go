@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"seateam/cluster"
+	"seateam/config"
+	"seateam/stats"
+)
+
+var (
+	downstreamCxUpgradesTotal  = stats.NewCounterVec("http", "downstream_cx_upgrades_total", "Connections upgraded to another protocol, such as websocket.", "envoy_http_conn_manager_prefix")
+	downstreamCxUpgradesActive = stats.NewGaugeVec("http", "downstream_cx_upgrades_active", "Upgraded connections currently open.", "envoy_http_conn_manager_prefix")
+	downstreamCxIdleTimeout    = stats.NewCounterVec("http", "downstream_cx_idle_timeout", "Upgraded connections closed for being idle.", "envoy_http_conn_manager_prefix")
+)
+
+// upgradeType returns the protocol an HTTP/1.1 request asks to switch to, in
+// lower case, or "" if it asks for none.
+func upgradeType(r *http.Request) string {
+	if r.ProtoMajor != 1 || r.ProtoMinor < 1 || !headerHasToken(r.Header, "Connection", "upgrade") {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSpace(r.Header.Get("Upgrade")))
+}
+
+// headerHasToken reports whether a comma-separated header lists token.
+func headerHasToken(header http.Header, key, token string) bool {
+	for _, value := range header.Values(key) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// forwardUpgrade passes an upgrade request to the backend and, once it
+// switches protocols, hands the downstream connection over to it: bytes are
+// copied both ways until either side closes or the tunnel goes idle. Any
+// other answer is relayed as an ordinary response.
+func (sr *Router) forwardUpgrade(w http.ResponseWriter, r *http.Request, upstream *cluster.Cluster, route *config.Route, backendURL string) {
+	// The timeout covers the handshake only; the request's context must
+	// outlive it, as cancelling it would close the upgraded connection.
+	ctx, cancel := context.WithCancelCause(r.Context())
+	defer cancel(nil)
+	var timer *time.Timer
+	if sr.Timeout > 0 {
+		timer = time.AfterFunc(sr.Timeout, func() { cancel(context.DeadlineExceeded) })
+	}
+
+	req, err := http.NewRequestWithContext(ctx, r.Method, backendURL, nil)
+	if err != nil {
+		handleError(w, r, "Failed to create new request", http.StatusInternalServerError)
+		return
+	}
+	for key, values := range r.Header {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	req.Host = r.Host
+
+	upstream.Stats.UpstreamRqTotal.Inc()
+	upstream.Stats.UpstreamRqActive.Inc()
+	defer upstream.Stats.UpstreamRqActive.Dec()
+
+	resp, err := upstream.Client.Do(req)
+	if timer != nil {
+		timer.Stop()
+	}
+	if err != nil {
+		var opErr *net.OpError
+		switch {
+		case errors.Is(context.Cause(ctx), context.DeadlineExceeded):
+			upstream.Stats.UpstreamRqTimeout.Inc()
+			handleError(w, r, "upstream request timeout", http.StatusGatewayTimeout)
+		case errors.As(err, &opErr) && opErr.Op == "dial":
+			upstream.Stats.UpstreamCxConnectFail.Inc()
+			handleError(w, r, "upstream connect error", http.StatusServiceUnavailable)
+		default:
+			handleError(w, r, "Failed to forward request", http.StatusBadGateway)
+		}
+		return
+	}
+	defer resp.Body.Close()
+	upstream.Stats.UpstreamRqCompleted(resp.StatusCode)
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		for key, values := range resp.Header {
+			for _, value := range values {
+				w.Header().Add(key, value)
+			}
+		}
+		w.WriteHeader(resp.StatusCode)
+		if _, err := io.Copy(w, resp.Body); err != nil && sr.ErrorLogger != nil {
+			sr.ErrorLogger.Printf("Failed to copy response body from %s: %v", backendURL, err)
+		}
+		return
+	}
+
+	upstreamConn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok || !strings.EqualFold(strings.TrimSpace(resp.Header.Get("Upgrade")), upgradeType(r)) {
+		handleError(w, r, "upstream switched to an unexpected protocol", http.StatusBadGateway)
+		return
+	}
+	downstreamConn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		if sr.ErrorLogger != nil {
+			sr.ErrorLogger.Printf("Failed to take over the connection for %s: %v", backendURL, err)
+		}
+		return
+	}
+	defer downstreamConn.Close()
+
+	fmt.Fprintf(brw, "HTTP/1.1 %d %s\r\n", resp.StatusCode, http.StatusText(resp.StatusCode))
+	resp.Header.Write(brw)
+	brw.WriteString("\r\n")
+	if err := brw.Flush(); err != nil {
+		return
+	}
+
+	labels := prometheus.Labels{"envoy_http_conn_manager_prefix": sr.StatPrefix}
+	downstreamCxUpgradesTotal.With(labels).Inc()
+	downstreamCxUpgradesActive.With(labels).Inc()
+	defer downstreamCxUpgradesActive.With(labels).Dec()
+
+	if tunnel(downstreamConn, brw.Reader, upstreamConn, route.UpgradeIdleTimeout()) {
+		downstreamCxIdleTimeout.With(labels).Inc()
+	}
+}
+
+// tunnel copies bytes between an upgraded downstream connection, read
+// through downstreamReader so nothing it already buffered is lost, and the
+// upstream one, until either side closes or nothing is sent for idleTimeout.
+// It reports whether the tunnel was closed for being idle.
+func tunnel(downstream net.Conn, downstreamReader io.Reader, upstream io.ReadWriteCloser, idleTimeout time.Duration) bool {
+	var idled atomic.Bool
+	closeBoth := func() {
+		downstream.Close()
+		upstream.Close()
+	}
+	idleTimer := time.AfterFunc(idleTimeout, func() {
+		idled.Store(true)
+		closeBoth()
+	})
+	defer idleTimer.Stop()
+
+	var once sync.Once
+	var wg sync.WaitGroup
+	copyConn := func(dst io.Writer, src io.Reader) {
+		defer wg.Done()
+		io.Copy(dst, &activityReader{r: src, active: func() { idleTimer.Reset(idleTimeout) }})
+		once.Do(closeBoth)
+	}
+	wg.Add(2)
+	go copyConn(upstream, downstreamReader)
+	go copyConn(downstream, upstream)
+	wg.Wait()
+	return idled.Load()
+}
+
+// activityReader calls active for every read that returns data.
+type activityReader struct {
+	r      io.Reader
+	active func()
+}
+
+func (r *activityReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if n > 0 {
+		r.active()
+	}
+	return n, err
+}
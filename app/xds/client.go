@@ -0,0 +1,322 @@
+// Package xds fetches listeners, routes, clusters and endpoints from an xDS v3
+// management server over an aggregated discovery (ADS) stream.
+package xds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpointv3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	listenerv3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	routev3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	discoveryv3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	resourcev3 "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	statuspb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/proto"
+
+	"seateam/config"
+	"seateam/logger"
+)
+
+var xdsLog = logger.Get("config")
+
+// adsSource is the Store source for resources from the ADS stream.
+const adsSource = "ads"
+
+const (
+	initialBackoff = time.Second
+	maxBackoff     = 30 * time.Second
+)
+
+// Options configures a Client.
+type Options struct {
+	// Address is the host:port of the management server.
+	Address string
+	Node    config.Node
+	// CDS and LDS subscribe to every cluster and listener the server has.
+	CDS, LDS bool
+	// StaticEdsClusters are the service names of the EDS clusters in
+	// static_resources that use ADS, whose endpoints are requested along with
+	// those of clusters from CDS.
+	StaticEdsClusters []string
+}
+
+// Client keeps a stream to the management server and puts what it receives
+// in a Store. An update the store rejects is NACKed, and the resources from
+// before it stay in place. When the server cannot be reached the last accepted
+// resources stay applied while the client reconnects.
+type Client struct {
+	opts     Options
+	store    *Store
+	versions map[string]string
+}
+
+func NewClient(opts Options, store *Store) *Client {
+	return &Client{
+		opts:     opts,
+		store:    store,
+		versions: make(map[string]string),
+	}
+}
+
+// Run connects to the management server and reconnects with backoff until
+// ctx is cancelled.
+func (c *Client) Run(ctx context.Context) {
+	backoff := initialBackoff
+	for {
+		received, err := c.runStream(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if received {
+			backoff = initialBackoff
+		}
+		xdsLog.Warnf("xDS stream to %s closed, keeping the last accepted config and retrying in %s: %v", c.opts.Address, backoff, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxBackoff)
+	}
+}
+
+// stream is one ADS stream along with what has been requested on it.
+type stream struct {
+	discoveryv3.AggregatedDiscoveryService_StreamAggregatedResourcesClient
+	node      *corev3.Node
+	nonces    map[string]string
+	requested map[string][]string
+}
+
+func (c *Client) runStream(ctx context.Context) (received bool, err error) {
+	conn, err := grpc.Dial(c.opts.Address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ads, err := discoveryv3.NewAggregatedDiscoveryServiceClient(conn).StreamAggregatedResources(ctx)
+	if err != nil {
+		return false, err
+	}
+	s := &stream{
+		AggregatedDiscoveryService_StreamAggregatedResourcesClient: ads,
+		node: &corev3.Node{
+			Id:            c.opts.Node.ID,
+			Cluster:       c.opts.Node.Cluster,
+			UserAgentName: "envoyrouter",
+			Locality: &corev3.Locality{
+				Region:  c.opts.Node.Locality.Region,
+				Zone:    c.opts.Node.Locality.Zone,
+				SubZone: c.opts.Node.Locality.SubZone,
+			},
+		},
+		nonces:    make(map[string]string),
+		requested: make(map[string][]string),
+	}
+
+	// Like Envoy, ask for clusters first and for listeners once the clusters
+	// they route to are known. After a reconnect everything is known already.
+	if c.opts.CDS {
+		if err := c.subscribe(s, resourcev3.ClusterType, nil); err != nil {
+			return false, err
+		}
+	}
+	if !c.opts.CDS || c.versions[resourcev3.ClusterType] != "" {
+		if err := c.subscribeDependents(s); err != nil {
+			return false, err
+		}
+	}
+
+	for {
+		response, err := s.Recv()
+		if err != nil {
+			return received, err
+		}
+		received = true
+		if err := c.handleResponse(s, response); err != nil {
+			return received, err
+		}
+	}
+}
+
+func (c *Client) handleResponse(s *stream, response *discoveryv3.DiscoveryResponse) error {
+	typeURL := response.GetTypeUrl()
+	s.nonces[typeURL] = response.GetNonce()
+
+	resources, err := decodeResources(typeURL, response)
+	if err == nil {
+		err = c.store.Update(adsSource, typeURL, resources)
+	}
+	if err != nil {
+		xdsLog.Warnf("Rejecting %s version %s: %v", typeURL, response.GetVersionInfo(), err)
+		return c.send(s, typeURL, &statuspb.Status{Code: int32(codes.InvalidArgument), Message: err.Error()})
+	}
+
+	xdsLog.Infof("Accepted %s version %s with %d resources", typeURL, response.GetVersionInfo(), len(resources))
+	c.versions[typeURL] = response.GetVersionInfo()
+	if err := c.send(s, typeURL, nil); err != nil {
+		return err
+	}
+	return c.subscribeDependents(s)
+}
+
+// subscribeDependents asks for listeners, and for the route configs and
+// endpoints the accepted listeners and clusters name, when that changed.
+func (c *Client) subscribeDependents(s *stream) error {
+	if c.opts.LDS {
+		if _, ok := s.requested[resourcev3.ListenerType]; !ok {
+			if err := c.subscribe(s, resourcev3.ListenerType, nil); err != nil {
+				return err
+			}
+		}
+	}
+
+	routeNames := make(map[string]bool)
+	for _, l := range c.store.Resources(resourcev3.ListenerType) {
+		for _, name := range routeConfigNames(l.(*listenerv3.Listener)) {
+			routeNames[name] = true
+		}
+	}
+	edsNames := make(map[string]bool)
+	for _, name := range c.opts.StaticEdsClusters {
+		edsNames[name] = true
+	}
+	for _, m := range c.store.Resources(resourcev3.ClusterType) {
+		if cluster := m.(*clusterv3.Cluster); cluster.GetEdsClusterConfig().GetEdsConfig().GetAds() != nil {
+			edsNames[edsServiceName(cluster)] = true
+		}
+	}
+
+	for typeURL, names := range map[string]map[string]bool{resourcev3.EndpointType: edsNames, resourcev3.RouteType: routeNames} {
+		sorted := sortedKeys(names)
+		// An empty list would be a wildcard subscription, so keep the old one.
+		if len(sorted) == 0 || slices.Equal(sorted, s.requested[typeURL]) {
+			continue
+		}
+		if err := c.subscribe(s, typeURL, sorted); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) subscribe(s *stream, typeURL string, names []string) error {
+	s.requested[typeURL] = names
+	return c.send(s, typeURL, nil)
+}
+
+// send requests typeURL with the last accepted version, which ACKs the last
+// response, or NACKs it when errorDetail is set.
+func (c *Client) send(s *stream, typeURL string, errorDetail *statuspb.Status) error {
+	return s.Send(&discoveryv3.DiscoveryRequest{
+		Node:          s.node,
+		TypeUrl:       typeURL,
+		VersionInfo:   c.versions[typeURL],
+		ResourceNames: s.requested[typeURL],
+		ResponseNonce: s.nonces[typeURL],
+		ErrorDetail:   errorDetail,
+	})
+}
+
+func decodeResources(typeURL string, response *discoveryv3.DiscoveryResponse) (map[string]proto.Message, error) {
+	resources := make(map[string]proto.Message, len(response.GetResources()))
+	for _, resource := range response.GetResources() {
+		if resource.GetTypeUrl() != typeURL {
+			return nil, fmt.Errorf("resource of type %s in a %s response", resource.GetTypeUrl(), typeURL)
+		}
+		m, err := resource.UnmarshalNew()
+		if err != nil {
+			return nil, err
+		}
+		var name string
+		switch r := m.(type) {
+		case *clusterv3.Cluster:
+			name = r.GetName()
+		case *listenerv3.Listener:
+			name = r.GetName()
+		case *routev3.RouteConfiguration:
+			name = r.GetName()
+		case *endpointv3.ClusterLoadAssignment:
+			name = r.GetClusterName()
+		default:
+			return nil, fmt.Errorf("unsupported resource type %s", typeURL)
+		}
+		if _, ok := resources[name]; ok {
+			return nil, fmt.Errorf("duplicate resource %q", name)
+		}
+		resources[name] = m
+	}
+	return resources, nil
+}
+
+// build converts the resources into config. Listeners waiting for a route
+// config are left out until it arrives.
+func build(resources map[string]map[string]proto.Message) (Resources, error) {
+	var built Resources
+	var errs []error
+
+	for _, name := range sortedKeys(resources[resourcev3.ClusterType]) {
+		cluster, err := convertCluster(resources[resourcev3.ClusterType][name].(*clusterv3.Cluster))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		built.Clusters = append(built.Clusters, cluster)
+	}
+
+	built.LoadAssignments = make(map[string]config.ClusterLoadAssignment)
+	for name, m := range resources[resourcev3.EndpointType] {
+		loadAssignment, err := convertLoadAssignment(m.(*endpointv3.ClusterLoadAssignment))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("endpoints %q: %v", name, err))
+			continue
+		}
+		built.LoadAssignments[name] = loadAssignment
+	}
+
+	routes := make(map[string]*routev3.RouteConfiguration)
+	for name, m := range resources[resourcev3.RouteType] {
+		routes[name] = m.(*routev3.RouteConfiguration)
+	}
+	for _, name := range sortedKeys(resources[resourcev3.ListenerType]) {
+		listener, ok, err := convertListener(resources[resourcev3.ListenerType][name].(*listenerv3.Listener), routes)
+		switch {
+		case err != nil:
+			errs = append(errs, err)
+		case !ok:
+			xdsLog.Debugf("Listener %q is waiting for its route config", name)
+		default:
+			built.Listeners = append(built.Listeners, listener)
+		}
+	}
+	return built, errors.Join(errs...)
+}
+
+func edsServiceName(c *clusterv3.Cluster) string {
+	if name := c.GetEdsClusterConfig().GetServiceName(); name != "" {
+		return name
+	}
+	return c.GetName()
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
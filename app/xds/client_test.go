@@ -0,0 +1,272 @@
+package xds
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpointv3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	listenerv3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	routev3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	routerv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/router/v3"
+	echov3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/echo/v3"
+	hcmv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	discoveryv3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	resourcev3 "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	serverv3 "github.com/envoyproxy/go-control-plane/pkg/server/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"seateam/config"
+)
+
+const testNode = "router-1"
+
+// managementServer is a go-control-plane ADS server serving snapshots from a
+// cache, which reports every NACK it receives.
+type managementServer struct {
+	cache   cachev3.SnapshotCache
+	address string
+	grpc    *grpc.Server
+	nacks   chan string
+}
+
+func startManagementServer(t *testing.T, address string) *managementServer {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &managementServer{
+		cache:   cachev3.NewSnapshotCache(true, cachev3.IDHash{}, nil),
+		address: ln.Addr().String(),
+		grpc:    grpc.NewServer(),
+		nacks:   make(chan string, 10),
+	}
+	callbacks := serverv3.CallbackFuncs{
+		StreamRequestFunc: func(_ int64, request *discoveryv3.DiscoveryRequest) error {
+			if request.GetErrorDetail() != nil {
+				m.nacks <- request.GetErrorDetail().GetMessage()
+			}
+			return nil
+		},
+	}
+	discoveryv3.RegisterAggregatedDiscoveryServiceServer(m.grpc, serverv3.NewServer(context.Background(), m.cache, callbacks))
+	go m.grpc.Serve(ln)
+	t.Cleanup(m.grpc.Stop)
+	return m
+}
+
+func (m *managementServer) setSnapshot(t *testing.T, version string, resources map[resourcev3.Type][]types.Resource) {
+	t.Helper()
+	snapshot, err := cachev3.NewSnapshot(version, resources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.cache.SetSnapshot(context.Background(), testNode, snapshot); err != nil {
+		t.Fatal(err)
+	}
+}
+
+var adsConfigSource = &corev3.ConfigSource{
+	ResourceApiVersion:    corev3.ApiVersion_V3,
+	ConfigSourceSpecifier: &corev3.ConfigSource_Ads{Ads: &corev3.AggregatedConfigSource{}},
+}
+
+func mustAny(t *testing.T, m proto.Message) *anypb.Any {
+	t.Helper()
+	a, err := anypb.New(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// testResources returns an EDS cluster with one endpoint on port and a
+// listener routing to it through RDS.
+func testResources(t *testing.T, port uint32) map[resourcev3.Type][]types.Resource {
+	cluster := &clusterv3.Cluster{
+		Name:                 "backend",
+		ConnectTimeout:       durationpb.New(time.Second),
+		ClusterDiscoveryType: &clusterv3.Cluster_Type{Type: clusterv3.Cluster_EDS},
+		EdsClusterConfig:     &clusterv3.Cluster_EdsClusterConfig{EdsConfig: adsConfigSource},
+	}
+	endpoints := &endpointv3.ClusterLoadAssignment{
+		ClusterName: "backend",
+		Endpoints: []*endpointv3.LocalityLbEndpoints{{
+			LbEndpoints: []*endpointv3.LbEndpoint{{
+				HostIdentifier: &endpointv3.LbEndpoint_Endpoint{Endpoint: &endpointv3.Endpoint{
+					Address: &corev3.Address{Address: &corev3.Address_SocketAddress{SocketAddress: &corev3.SocketAddress{
+						Address:       "127.0.0.1",
+						PortSpecifier: &corev3.SocketAddress_PortValue{PortValue: port},
+					}}},
+				}},
+				LoadBalancingWeight: wrapperspb.UInt32(2),
+			}},
+		}},
+	}
+	route := &routev3.RouteConfiguration{
+		Name: "local_route",
+		VirtualHosts: []*routev3.VirtualHost{{
+			Name:    "local_service",
+			Domains: []string{"*"},
+			Routes: []*routev3.Route{{
+				Match:  &routev3.RouteMatch{PathSpecifier: &routev3.RouteMatch_Prefix{Prefix: "/"}},
+				Action: &routev3.Route_Route{Route: &routev3.RouteAction{ClusterSpecifier: &routev3.RouteAction_Cluster{Cluster: "backend"}}},
+			}},
+		}},
+	}
+	hcm := &hcmv3.HttpConnectionManager{
+		StatPrefix: "ingress_http",
+		RouteSpecifier: &hcmv3.HttpConnectionManager_Rds{Rds: &hcmv3.Rds{
+			RouteConfigName: "local_route",
+			ConfigSource:    adsConfigSource,
+		}},
+		HttpFilters: []*hcmv3.HttpFilter{{
+			Name:       "envoy.filters.http.router",
+			ConfigType: &hcmv3.HttpFilter_TypedConfig{TypedConfig: mustAny(t, &routerv3.Router{})},
+		}},
+	}
+	listener := &listenerv3.Listener{
+		Name: "listener_0",
+		Address: &corev3.Address{Address: &corev3.Address_SocketAddress{SocketAddress: &corev3.SocketAddress{
+			Address:       "127.0.0.1",
+			PortSpecifier: &corev3.SocketAddress_PortValue{PortValue: 10000},
+		}}},
+		FilterChains: []*listenerv3.FilterChain{{
+			Filters: []*listenerv3.Filter{{
+				Name:       config.HttpConnectionManagerFilter,
+				ConfigType: &listenerv3.Filter_TypedConfig{TypedConfig: mustAny(t, hcm)},
+			}},
+		}},
+	}
+
+	return map[resourcev3.Type][]types.Resource{
+		resourcev3.ClusterType:  {cluster},
+		resourcev3.EndpointType: {endpoints},
+		resourcev3.RouteType:    {route},
+		resourcev3.ListenerType: {listener},
+	}
+}
+
+func startClient(t *testing.T, address string) <-chan Resources {
+	t.Helper()
+	applied := make(chan Resources, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	store := NewStore(ctx, func(r Resources) error {
+		applied <- r
+		return nil
+	}, nil)
+	client := NewClient(Options{Address: address, Node: config.Node{ID: testNode}, CDS: true, LDS: true}, store)
+	go client.Run(ctx)
+	return applied
+}
+
+// waitFor returns the first applied resources that have a listener and an
+// endpoint on port.
+func waitFor(t *testing.T, applied <-chan Resources, port int) Resources {
+	t.Helper()
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case r := <-applied:
+			loadAssignment := r.LoadAssignments["backend"]
+			if len(r.Listeners) == 1 && len(loadAssignment.Endpoints) == 1 &&
+				loadAssignment.Endpoints[0].LbEndpoints[0].Endpoint.Address.SocketAddress.PortValue == port {
+				return r
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for resources with an endpoint on port %d", port)
+		}
+	}
+}
+
+func TestClientAppliesResources(t *testing.T) {
+	server := startManagementServer(t, "127.0.0.1:0")
+	server.setSnapshot(t, "1", testResources(t, 8080))
+	applied := startClient(t, server.address)
+
+	resources := waitFor(t, applied, 8080)
+
+	var static config.StaticBootstrap
+	static.DynamicResources.AdsConfig = &config.ApiConfigSource{ApiType: "GRPC", GrpcServices: make([]config.GrpcService, 1)}
+	static.DynamicResources.AdsConfig.GrpcServices[0].EnvoyGrpc.ClusterName = "xds_cluster"
+	var xdsEndpoint config.LbEndpoint
+	xdsEndpoint.Endpoint.Address.SocketAddress = config.SocketAddress{Address: "127.0.0.1", PortValue: 18000}
+	xdsCluster := config.Cluster{Name: "xds_cluster"}
+	xdsCluster.AddEndpoint(xdsEndpoint)
+	static.StaticResources.Clusters = []config.Cluster{xdsCluster}
+
+	merged := resources.Merge(static)
+	if err := config.Validate(&merged); err != nil {
+		t.Fatalf("expected the merged config to be valid: %v", err)
+	}
+	backend, err := merged.Cluster("backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint, err := backend.Endpoint("127.0.0.1:8080"); err != nil || endpoint.LoadBalancingWeight != 2 {
+		t.Errorf("expected the EDS endpoint with weight 2, got %+v (%v)", endpoint, err)
+	}
+	routeConfig := merged.StaticResources.Listeners[0].FilterChains[0].Filters[0].TypedConfig.RouteConfig
+	if routeConfig.Name != "local_route" || routeConfig.VirtualHosts[0].Routes[0].Route.Cluster != "backend" {
+		t.Errorf("expected the RDS route config to be inlined, got %+v", routeConfig)
+	}
+}
+
+func TestClientRejectsUnsupportedResources(t *testing.T) {
+	server := startManagementServer(t, "127.0.0.1:0")
+	server.setSnapshot(t, "1", testResources(t, 8080))
+	applied := startClient(t, server.address)
+	waitFor(t, applied, 8080)
+
+	bad := testResources(t, 8080)
+	listener := bad[resourcev3.ListenerType][0].(*listenerv3.Listener)
+	listener.FilterChains[0].Filters[0] = &listenerv3.Filter{
+		Name:       "envoy.filters.network.echo",
+		ConfigType: &listenerv3.Filter_TypedConfig{TypedConfig: mustAny(t, &echov3.Echo{})},
+	}
+	server.setSnapshot(t, "2", bad)
+
+	select {
+	case message := <-server.nacks:
+		if !strings.Contains(message, "unsupported network filter") {
+			t.Errorf("unexpected NACK: %s", message)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for a NACK")
+	}
+
+	// The next good version is accepted on top of the last accepted resources.
+	server.setSnapshot(t, "3", testResources(t, 8081))
+	waitFor(t, applied, 8081)
+}
+
+func TestClientReconnects(t *testing.T) {
+	server := startManagementServer(t, "127.0.0.1:0")
+	server.setSnapshot(t, "1", testResources(t, 8080))
+	applied := startClient(t, server.address)
+	waitFor(t, applied, 8080)
+
+	server.grpc.Stop()
+	select {
+	case r := <-applied:
+		t.Fatalf("expected nothing to be applied while the server is down, got %+v", r)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	restarted := startManagementServer(t, server.address)
+	restarted.setSnapshot(t, "2", testResources(t, 8081))
+	waitFor(t, applied, 8081)
+}
@@ -0,0 +1,89 @@
+package xds
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	discoveryv3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/fsnotify/fsnotify"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"gopkg.in/yaml.v3"
+)
+
+// WatchFile applies the resources of typeURL in the DiscoveryResponse document
+// at path, as Envoy's path_config_source does, and again whenever the file
+// changes, until ctx is cancelled. The directory is watched rather than the
+// file so that files replaced by a rename are picked up too. A file that
+// cannot be read or applied is logged and the resources from before it stay.
+func (s *Store) WatchFile(ctx context.Context, path, typeURL string) {
+	load := func() {
+		resources, err := readDiscoveryResponse(path, typeURL)
+		if err == nil {
+			err = s.updateFile(ctx, path, typeURL, resources)
+		}
+		if err != nil {
+			xdsLog.Errorf("Rejecting %s: %v", path, err)
+			return
+		}
+		xdsLog.Infof("Loaded %d resources from %s", len(resources), path)
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		xdsLog.Errorf("Cannot watch %s: %v", path, err)
+		return
+	}
+	defer watcher.Close()
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		xdsLog.Errorf("Cannot watch %s: %v", path, err)
+		return
+	}
+
+	load()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) == filepath.Clean(path) && event.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+				load()
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			xdsLog.Errorf("Error watching %s: %v", path, err)
+		}
+	}
+}
+
+// readDiscoveryResponse reads a DiscoveryResponse in YAML or JSON, with
+// resources of typeURL.
+func readDiscoveryResponse(path, typeURL string) (map[string]proto.Message, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// YAML is a superset of JSON, so both go through the same route.
+	var document interface{}
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+	data, err = json.Marshal(document)
+	if err != nil {
+		return nil, err
+	}
+	var response discoveryv3.DiscoveryResponse
+	if err := protojson.Unmarshal(data, &response); err != nil {
+		return nil, fmt.Errorf("invalid DiscoveryResponse: %v", err)
+	}
+	return decodeResources(typeURL, &response)
+}
@@ -0,0 +1,104 @@
+package xds
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	resourcev3 "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+)
+
+const cdsFile = `
+resources:
+- "@type": type.googleapis.com/envoy.config.cluster.v3.Cluster
+  name: backend
+  connect_timeout: 0.25s
+  type: EDS
+  eds_cluster_config:
+    eds_config:
+      resource_api_version: V3
+      path_config_source:
+        path: %s
+`
+
+const edsFile = `
+resources:
+- "@type": type.googleapis.com/envoy.config.endpoint.v3.ClusterLoadAssignment
+  cluster_name: backend
+  endpoints:
+  - lb_endpoints:
+    - endpoint:
+        address:
+          socket_address: { address: 127.0.0.1, port_value: %d }
+`
+
+// writeFile replaces path by a rename, the way deploy tooling writes files.
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatchFiles(t *testing.T) {
+	dir := t.TempDir()
+	cdsPath, edsPath := filepath.Join(dir, "cds.yaml"), filepath.Join(dir, "backend.yaml")
+	writeFile(t, cdsPath, fmt.Sprintf(cdsFile, edsPath))
+	writeFile(t, edsPath, fmt.Sprintf(edsFile, 8080))
+
+	applied := make(chan Resources, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	store := NewStore(ctx, func(r Resources) error {
+		applied <- r
+		return nil
+	}, nil)
+	go store.WatchFile(ctx, cdsPath, resourcev3.ClusterType)
+
+	waitForEndpoint := func(port int) Resources {
+		t.Helper()
+		timeout := time.After(10 * time.Second)
+		for {
+			select {
+			case r := <-applied:
+				loadAssignment := r.LoadAssignments["backend"]
+				if len(loadAssignment.Endpoints) == 1 && loadAssignment.Endpoints[0].LbEndpoints[0].Endpoint.Address.SocketAddress.PortValue == port {
+					return r
+				}
+			case <-timeout:
+				t.Fatalf("timed out waiting for an endpoint on port %d", port)
+			}
+		}
+	}
+
+	resources := waitForEndpoint(8080)
+	if len(resources.Clusters) != 1 || resources.Clusters[0].EdsClusterConfig.EdsConfig.PathConfigSource.Path != edsPath {
+		t.Errorf("expected the EDS cluster from the CDS file, got %+v", resources.Clusters)
+	}
+
+	// A broken file is rejected and the next good one is picked up.
+	writeFile(t, edsPath, "resources: [")
+	writeFile(t, edsPath, fmt.Sprintf(edsFile, 8081))
+	waitForEndpoint(8081)
+
+	// Wrong resource types are rejected, leaving the endpoints as they were.
+	writeFile(t, edsPath, fmt.Sprintf(cdsFile, edsPath))
+	timeout := time.After(200 * time.Millisecond)
+	for {
+		select {
+		case r := <-applied:
+			if loadAssignment := r.LoadAssignments["backend"]; len(loadAssignment.Endpoints) != 1 {
+				t.Fatalf("expected clusters in an EDS file to be rejected, got %+v", r)
+			}
+		case <-timeout:
+			return
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package xds
+
+import (
+	"errors"
+	"fmt"
+
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	upstreamhttpv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/upstreams/http/v3"
+	"google.golang.org/protobuf/proto"
+
+	"seateam/config"
+)
+
+// httpProtocolOptionsName is the key of a cluster's
+// typed_extension_protocol_options that holds its HTTP protocol options.
+const httpProtocolOptionsName = "envoy.extensions.upstreams.http.v3.HttpProtocolOptions"
+
+// convertHttp2ProtocolOptions turns HTTP/2 options into config. It supports
+// max_concurrent_streams and the initial window sizes.
+func convertHttp2ProtocolOptions(options *corev3.Http2ProtocolOptions) (*config.Http2ProtocolOptions, error) {
+	supported := &corev3.Http2ProtocolOptions{
+		MaxConcurrentStreams:        options.GetMaxConcurrentStreams(),
+		InitialStreamWindowSize:     options.GetInitialStreamWindowSize(),
+		InitialConnectionWindowSize: options.GetInitialConnectionWindowSize(),
+	}
+	if !proto.Equal(options, supported) {
+		return nil, errors.New("http2_protocol_options supports only max_concurrent_streams, initial_stream_window_size and initial_connection_window_size")
+	}
+	return &config.Http2ProtocolOptions{
+		MaxConcurrentStreams:        int(options.GetMaxConcurrentStreams().GetValue()),
+		InitialStreamWindowSize:     int(options.GetInitialStreamWindowSize().GetValue()),
+		InitialConnectionWindowSize: int(options.GetInitialConnectionWindowSize().GetValue()),
+	}, nil
+}
+
+// convertClusterHttp2ProtocolOptions returns the HTTP/2 options of c, from
+// its HTTP protocol options extension or its deprecated
+// http2_protocol_options, or nil if its endpoints are talked to over
+// HTTP/1.1.
+func convertClusterHttp2ProtocolOptions(c *clusterv3.Cluster) (*config.Http2ProtocolOptions, error) {
+	options := c.GetHttp2ProtocolOptions()
+	for name, typedConfig := range c.GetTypedExtensionProtocolOptions() {
+		if name != httpProtocolOptionsName {
+			return nil, fmt.Errorf("unsupported typed_extension_protocol_options %q", name)
+		}
+		var httpOptions upstreamhttpv3.HttpProtocolOptions
+		if err := typedConfig.UnmarshalTo(&httpOptions); err != nil {
+			return nil, err
+		}
+		explicit := httpOptions.GetExplicitHttpConfig()
+		if explicit == nil || explicit.GetHttp3ProtocolOptions() != nil || !proto.Equal(&httpOptions, &upstreamhttpv3.HttpProtocolOptions{
+			UpstreamProtocolOptions: &upstreamhttpv3.HttpProtocolOptions_ExplicitHttpConfig_{ExplicitHttpConfig: explicit},
+		}) {
+			return nil, errors.New("HTTP protocol options support only an explicit_http_config for HTTP/1.1 or HTTP/2")
+		}
+		options = explicit.GetHttp2ProtocolOptions()
+	}
+	if options == nil {
+		return nil, nil
+	}
+	return convertHttp2ProtocolOptions(options)
+}
@@ -0,0 +1,62 @@
+package xds
+
+import (
+	"errors"
+
+	routev3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	tlsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	matcherv3 "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	"google.golang.org/protobuf/proto"
+
+	"seateam/config"
+)
+
+func convertStringMatcher(matcher *matcherv3.StringMatcher) (config.StringMatcher, error) {
+	converted := config.StringMatcher{IgnoreCase: matcher.GetIgnoreCase()}
+	switch pattern := matcher.GetMatchPattern().(type) {
+	case *matcherv3.StringMatcher_Exact:
+		converted.Exact = pattern.Exact
+	case *matcherv3.StringMatcher_Prefix:
+		converted.Prefix = pattern.Prefix
+	case *matcherv3.StringMatcher_Suffix:
+		converted.Suffix = pattern.Suffix
+	case *matcherv3.StringMatcher_Contains:
+		converted.Contains = pattern.Contains
+	case *matcherv3.StringMatcher_SafeRegex:
+		// The engine is RE2 whether or not google_re2 is given.
+		converted.SafeRegex = &config.SafeRegex{Regex: pattern.SafeRegex.GetRegex()}
+	default:
+		return converted, errors.New("string matcher supports only exact, prefix, suffix, contains and safe_regex")
+	}
+	return converted, nil
+}
+
+// convertHeaderMatcher turns a route's header matcher into config. Only
+// string_match and present_match are supported.
+func convertHeaderMatcher(matcher *routev3.HeaderMatcher) (config.HeaderMatcher, error) {
+	converted := config.HeaderMatcher{Name: matcher.GetName(), InvertMatch: matcher.GetInvertMatch()}
+	supported := &routev3.HeaderMatcher{Name: matcher.GetName(), InvertMatch: matcher.GetInvertMatch()}
+	switch specifier := matcher.GetHeaderMatchSpecifier().(type) {
+	case *routev3.HeaderMatcher_StringMatch:
+		stringMatch, err := convertStringMatcher(specifier.StringMatch)
+		if err != nil {
+			return converted, err
+		}
+		converted.StringMatch = &stringMatch
+		supported.HeaderMatchSpecifier = specifier
+	case *routev3.HeaderMatcher_PresentMatch:
+		converted.PresentMatch = specifier.PresentMatch
+		supported.HeaderMatchSpecifier = specifier
+	}
+	if !proto.Equal(matcher, supported) {
+		return converted, errors.New("header matcher supports only name, string_match, present_match and invert_match")
+	}
+	return converted, nil
+}
+
+func convertSubjectAltNameMatcher(matcher *tlsv3.SubjectAltNameMatcher) (config.SubjectAltNameMatcher, error) {
+	converted := config.SubjectAltNameMatcher{SanType: matcher.GetSanType().String()}
+	var err error
+	converted.Matcher, err = convertStringMatcher(matcher.GetMatcher())
+	return converted, err
+}
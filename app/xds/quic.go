@@ -0,0 +1,63 @@
+package xds
+
+import (
+	"errors"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	listenerv3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	quicv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/quic/v3"
+	"google.golang.org/protobuf/proto"
+
+	"seateam/config"
+)
+
+// convertUdpListenerConfig turns the udp_listener_config of a listener into
+// config. It supports quic_options with max_concurrent_streams and
+// idle_timeout.
+func convertUdpListenerConfig(udpConfig *listenerv3.UdpListenerConfig) (*config.UdpListenerConfig, error) {
+	options := udpConfig.GetQuicOptions()
+	if !proto.Equal(udpConfig, &listenerv3.UdpListenerConfig{QuicOptions: options}) {
+		return nil, errors.New("udp_listener_config supports only quic_options")
+	}
+	converted := &config.UdpListenerConfig{}
+	if options == nil {
+		return converted, nil
+	}
+	supported := &listenerv3.QuicProtocolOptions{IdleTimeout: options.GetIdleTimeout()}
+	if streams := options.GetQuicProtocolOptions().GetMaxConcurrentStreams(); streams != nil {
+		supported.QuicProtocolOptions = &corev3.QuicProtocolOptions{MaxConcurrentStreams: streams}
+	}
+	if !proto.Equal(options, supported) {
+		return nil, errors.New("quic_options supports only quic_protocol_options.max_concurrent_streams and idle_timeout")
+	}
+	converted.QuicOptions = &config.QuicListenerOptions{}
+	converted.QuicOptions.QuicProtocolOptions.MaxConcurrentStreams = int(options.GetQuicProtocolOptions().GetMaxConcurrentStreams().GetValue())
+	if options.GetIdleTimeout() != nil {
+		converted.QuicOptions.IdleTimeout = options.GetIdleTimeout().AsDuration().String()
+	}
+	return converted, nil
+}
+
+// convertQuicTransportSocket turns a QUIC transport socket into config, with
+// its TLS context converted as a TLS transport socket's is. Early data is
+// never taken, so enable_early_data can only be false.
+func convertQuicTransportSocket(transportSocket *corev3.TransportSocket) (*config.DownstreamTransportSocket, error) {
+	var quic quicv3.QuicDownstreamTransport
+	if err := transportSocket.GetTypedConfig().UnmarshalTo(&quic); err != nil {
+		return nil, err
+	}
+	supported := &quicv3.QuicDownstreamTransport{DownstreamTlsContext: quic.GetDownstreamTlsContext()}
+	if quic.GetEnableEarlyData() != nil && !quic.GetEnableEarlyData().GetValue() {
+		supported.EnableEarlyData = quic.GetEnableEarlyData()
+	}
+	if !proto.Equal(&quic, supported) {
+		return nil, errors.New("QuicDownstreamTransport supports only downstream_tls_context, without early data")
+	}
+	converted := &config.DownstreamTransportSocket{Name: transportSocket.GetName()}
+	var err error
+	if converted.TypedConfig, err = convertDownstreamTlsContext(quic.GetDownstreamTlsContext()); err != nil {
+		return nil, err
+	}
+	converted.TypedConfig.Type = transportSocket.GetTypedConfig().GetTypeUrl()
+	return converted, nil
+}
@@ -0,0 +1,464 @@
+package xds
+
+import (
+	"errors"
+	"fmt"
+
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpointv3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	listenerv3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	routev3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	connectionlimitv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/connection_limit/v3"
+	hcmv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	udpproxyv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/udp/udp_proxy/v3"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"gopkg.in/yaml.v3"
+
+	"seateam/config"
+
+	// Filter configs are converted through their JSON form, and listener
+	// files refer to them by type URL, so their types must be known.
+	_ "github.com/envoyproxy/go-control-plane/envoy/extensions/access_loggers/file/v3"
+	_ "github.com/envoyproxy/go-control-plane/envoy/extensions/access_loggers/stream/v3"
+	_ "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/buffer/v3"
+	_ "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/cors/v3"
+	_ "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/grpc_json_transcoder/v3"
+	_ "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/grpc_web/v3"
+	_ "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/router/v3"
+	_ "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/listener/tls_inspector/v3"
+	_ "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/rbac/v3"
+	_ "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/tcp_proxy/v3"
+)
+
+// Resources is everything learned from the management server, already turned
+// into config types.
+type Resources struct {
+	Listeners []config.Listener
+	Clusters  []config.Cluster
+	// LoadAssignments holds the endpoints of EDS clusters by service name.
+	LoadAssignments map[string]config.ClusterLoadAssignment
+}
+
+// Merge returns static with the dynamic listeners and clusters added and the
+// endpoints of every EDS cluster, static or dynamic, filled in.
+func (r Resources) Merge(static config.StaticBootstrap) config.StaticBootstrap {
+	merged := static
+	merged.StaticResources.Listeners = append(append([]config.Listener(nil), static.StaticResources.Listeners...), r.Listeners...)
+	merged.StaticResources.Clusters = append(append([]config.Cluster(nil), static.StaticResources.Clusters...), r.Clusters...)
+	for i, c := range merged.StaticResources.Clusters {
+		if c.Type != "EDS" {
+			continue
+		}
+		loadAssignment, ok := r.LoadAssignments[c.EdsServiceName()]
+		if !ok {
+			loadAssignment = config.ClusterLoadAssignment{ClusterName: c.EdsServiceName()}
+		}
+		merged.StaticResources.Clusters[i].LoadAssignment = loadAssignment
+	}
+	return merged
+}
+
+func convertCluster(c *clusterv3.Cluster) (config.Cluster, error) {
+	converted := config.Cluster{Name: c.GetName()}
+	if c.GetConnectTimeout() != nil {
+		converted.ConnectTimeout = c.GetConnectTimeout().AsDuration().String()
+	}
+
+	switch c.GetLbPolicy() {
+	case clusterv3.Cluster_ROUND_ROBIN:
+		converted.LbPolicy = "ROUND_ROBIN"
+	case clusterv3.Cluster_LEAST_REQUEST:
+		converted.LbPolicy = "LEAST_CONNECTIONS"
+	default:
+		return converted, fmt.Errorf("cluster %q: unsupported lb_policy %s", c.GetName(), c.GetLbPolicy())
+	}
+
+	if transportSocket := c.GetTransportSocket(); transportSocket != nil {
+		var err error
+		if converted.TransportSocket, err = convertUpstreamTransportSocket(transportSocket); err != nil {
+			return converted, fmt.Errorf("cluster %q: transport_socket: %v", c.GetName(), err)
+		}
+	}
+	http2ProtocolOptions, err := convertClusterHttp2ProtocolOptions(c)
+	if err != nil {
+		return converted, fmt.Errorf("cluster %q: %v", c.GetName(), err)
+	}
+	converted.Http2ProtocolOptions = http2ProtocolOptions
+
+	switch c.GetType() {
+	case clusterv3.Cluster_STATIC, clusterv3.Cluster_STRICT_DNS, clusterv3.Cluster_LOGICAL_DNS:
+		converted.Type = c.GetType().String()
+		if converted.IsDNS() {
+			if c.GetDnsRefreshRate() != nil {
+				converted.DnsRefreshRate = c.GetDnsRefreshRate().AsDuration().String()
+			}
+			converted.RespectDnsTtl = c.GetRespectDnsTtl()
+			converted.DnsLookupFamily = c.GetDnsLookupFamily().String()
+		}
+		loadAssignment, err := convertLoadAssignment(c.GetLoadAssignment())
+		if err != nil {
+			return converted, fmt.Errorf("cluster %q: %v", c.GetName(), err)
+		}
+		converted.LoadAssignment = loadAssignment
+	case clusterv3.Cluster_EDS:
+		converted.Type = "EDS"
+		edsConfig, err := convertConfigSource(c.GetEdsClusterConfig().GetEdsConfig())
+		if err != nil {
+			return converted, fmt.Errorf("cluster %q: eds_config: %v", c.GetName(), err)
+		}
+		converted.EdsClusterConfig = &config.EdsClusterConfig{
+			EdsConfig:   edsConfig,
+			ServiceName: c.GetEdsClusterConfig().GetServiceName(),
+		}
+	default:
+		return converted, fmt.Errorf("cluster %q: unsupported cluster type %s", c.GetName(), c.GetType())
+	}
+	return converted, nil
+}
+
+func convertConfigSource(source *corev3.ConfigSource) (config.ConfigSource, error) {
+	var converted config.ConfigSource
+	switch {
+	case source.GetAds() != nil:
+		converted.Ads = &struct{}{}
+	case source.GetPathConfigSource() != nil:
+		converted.PathConfigSource = &config.PathConfigSource{Path: source.GetPathConfigSource().GetPath()}
+	default:
+		return converted, fmt.Errorf("only ads and path_config_source are supported")
+	}
+	if source.GetResourceApiVersion() == corev3.ApiVersion_V3 {
+		converted.ResourceApiVersion = "V3"
+	}
+	return converted, nil
+}
+
+func convertLoadAssignment(cla *endpointv3.ClusterLoadAssignment) (config.ClusterLoadAssignment, error) {
+	converted := config.ClusterLoadAssignment{ClusterName: cla.GetClusterName()}
+	for _, locality := range cla.GetEndpoints() {
+		var convertedLocality config.LocalityLbEndpoints
+		for _, lbEndpoint := range locality.GetLbEndpoints() {
+			socketAddress := lbEndpoint.GetEndpoint().GetAddress().GetSocketAddress()
+			if socketAddress == nil {
+				return converted, fmt.Errorf("endpoint without a socket address")
+			}
+			var convertedEndpoint config.LbEndpoint
+			convertedEndpoint.Endpoint.Address.SocketAddress = config.SocketAddress{
+				Address:   socketAddress.GetAddress(),
+				PortValue: int(socketAddress.GetPortValue()),
+			}
+			convertedEndpoint.LoadBalancingWeight = int(lbEndpoint.GetLoadBalancingWeight().GetValue())
+			switch lbEndpoint.GetHealthStatus() {
+			case corev3.HealthStatus_UNKNOWN:
+			case corev3.HealthStatus_HEALTHY, corev3.HealthStatus_DRAINING:
+				convertedEndpoint.HealthStatus = lbEndpoint.GetHealthStatus().String()
+			default:
+				// The router has no notion of unhealthy hosts besides draining.
+				convertedEndpoint.HealthStatus = corev3.HealthStatus_DRAINING.String()
+			}
+			convertedLocality.LbEndpoints = append(convertedLocality.LbEndpoints, convertedEndpoint)
+		}
+		converted.Endpoints = append(converted.Endpoints, convertedLocality)
+	}
+	return converted, nil
+}
+
+// convertListener turns a listener into config, taking route configs named
+// over RDS from routes. It reports ok false while a route config it needs has
+// not arrived yet, as Envoy keeps such a listener warming.
+func convertListener(l *listenerv3.Listener, routes map[string]*routev3.RouteConfiguration) (converted config.Listener, ok bool, err error) {
+	converted.Name = l.GetName()
+	socketAddress := l.GetAddress().GetSocketAddress()
+	if socketAddress == nil {
+		return converted, false, fmt.Errorf("listener %q: only socket addresses are supported", l.GetName())
+	}
+	converted.Address.SocketAddress = config.SocketAddress{Address: socketAddress.GetAddress(), PortValue: int(socketAddress.GetPortValue())}
+	if socketAddress.GetProtocol() == corev3.SocketAddress_UDP {
+		converted.Address.SocketAddress.Protocol = "UDP"
+	}
+	if udpConfig := l.GetUdpListenerConfig(); udpConfig != nil {
+		if converted.UdpListenerConfig, err = convertUdpListenerConfig(udpConfig); err != nil {
+			return converted, false, fmt.Errorf("listener %q: %v", l.GetName(), err)
+		}
+	}
+
+	for _, listenerFilter := range l.GetListenerFilters() {
+		convertedListenerFilter := config.ListenerFilter{Name: listenerFilter.GetName()}
+		switch listenerFilter.GetName() {
+		case config.TLSInspectorFilter:
+			convertedListenerFilter.TypedConfig.Type = listenerFilter.GetTypedConfig().GetTypeUrl()
+		case config.UdpProxyFilter:
+			udpProxy, err := convertUdpProxy(listenerFilter.GetTypedConfig())
+			if err != nil {
+				return converted, false, fmt.Errorf("listener %q: listener filter %q: %v", l.GetName(), listenerFilter.GetName(), err)
+			}
+			convertedListenerFilter.UdpProxy = udpProxy
+		default:
+			return converted, false, fmt.Errorf("listener %q: unsupported listener filter %q", l.GetName(), listenerFilter.GetName())
+		}
+		converted.ListenerFilters = append(converted.ListenerFilters, convertedListenerFilter)
+	}
+	if timeout := l.GetListenerFiltersTimeout(); timeout != nil {
+		converted.ListenerFiltersTimeout = timeout.AsDuration().String()
+	}
+
+	for _, filterChain := range l.GetFilterChains() {
+		var convertedChain config.FilterChain
+		if match := filterChain.GetFilterChainMatch(); match != nil {
+			supported := &listenerv3.FilterChainMatch{ServerNames: match.GetServerNames(), TransportProtocol: match.GetTransportProtocol()}
+			if !proto.Equal(match, supported) {
+				return converted, false, fmt.Errorf("listener %q: filter_chain_match supports only server_names and transport_protocol", l.GetName())
+			}
+			convertedChain.FilterChainMatch = config.FilterChainMatch{
+				ServerNames:       match.GetServerNames(),
+				TransportProtocol: match.GetTransportProtocol(),
+			}
+		}
+		if transportSocket := filterChain.GetTransportSocket(); transportSocket != nil {
+			if convertedChain.TransportSocket, err = convertDownstreamTransportSocket(transportSocket); err != nil {
+				return converted, false, fmt.Errorf("listener %q: transport_socket: %v", l.GetName(), err)
+			}
+		}
+		for _, filter := range filterChain.GetFilters() {
+			if filter.GetName() != config.HttpConnectionManagerFilter {
+				convertedFilter, err := convertNetworkFilter(filter)
+				if err != nil {
+					return converted, false, fmt.Errorf("listener %q: network filter %q: %v", l.GetName(), filter.GetName(), err)
+				}
+				convertedChain.Filters = append(convertedChain.Filters, convertedFilter)
+				continue
+			}
+			var hcm hcmv3.HttpConnectionManager
+			if err := filter.GetTypedConfig().UnmarshalTo(&hcm); err != nil {
+				return converted, false, fmt.Errorf("listener %q: %v", l.GetName(), err)
+			}
+
+			routeConfig := hcm.GetRouteConfig()
+			if rds := hcm.GetRds(); rds != nil {
+				if rds.GetConfigSource().GetAds() == nil {
+					return converted, false, fmt.Errorf("listener %q: only ads rds config sources are supported", l.GetName())
+				}
+				if routeConfig = routes[rds.GetRouteConfigName()]; routeConfig == nil {
+					return converted, false, nil
+				}
+			}
+			convertedRouteConfig, err := convertRouteConfig(routeConfig)
+			if err != nil {
+				return converted, false, fmt.Errorf("listener %q: %v", l.GetName(), err)
+			}
+
+			convertedFilter := config.Filter{Name: filter.GetName()}
+			convertedFilter.TypedConfig = config.HttpConnectionManager{
+				Type:        filter.GetTypedConfig().GetTypeUrl(),
+				StatPrefix:  hcm.GetStatPrefix(),
+				CodecType:   hcm.GetCodecType().String(),
+				RouteConfig: convertedRouteConfig,
+			}
+			if hcm.GetForwardClientCertDetails() != hcmv3.HttpConnectionManager_SANITIZE {
+				convertedFilter.TypedConfig.ForwardClientCertDetails = hcm.GetForwardClientCertDetails().String()
+			}
+			if options := hcm.GetHttp2ProtocolOptions(); options != nil {
+				if convertedFilter.TypedConfig.Http2ProtocolOptions, err = convertHttp2ProtocolOptions(options); err != nil {
+					return converted, false, fmt.Errorf("listener %q: %v", l.GetName(), err)
+				}
+			}
+			if details := hcm.GetSetCurrentClientCertDetails(); details != nil {
+				convertedFilter.TypedConfig.SetCurrentClientCertDetails = config.SetCurrentClientCertDetails{
+					Subject: details.GetSubject().GetValue(),
+					Cert:    details.GetCert(),
+					Chain:   details.GetChain(),
+					DNS:     details.GetDns(),
+					URI:     details.GetUri(),
+				}
+			}
+			for _, httpFilter := range hcm.GetHttpFilters() {
+				convertedHTTPFilter := config.HttpFilter{Name: httpFilter.GetName()}
+				if convertedHTTPFilter.TypedConfig, err = convertTypedConfig(httpFilter.GetTypedConfig()); err != nil {
+					return converted, false, fmt.Errorf("listener %q: http filter %q: %v", l.GetName(), httpFilter.GetName(), err)
+				}
+				convertedFilter.TypedConfig.HTTPFilters = append(convertedFilter.TypedConfig.HTTPFilters, convertedHTTPFilter)
+			}
+			convertedChain.Filters = append(convertedChain.Filters, convertedFilter)
+		}
+		converted.FilterChains = append(converted.FilterChains, convertedChain)
+	}
+	return converted, true, nil
+}
+
+// convertUdpProxy turns a udp_proxy config into config. It supports a single
+// cluster, the idle timeout and source IP hashing.
+func convertUdpProxy(typedConfig *anypb.Any) (*config.UdpProxy, error) {
+	var udpProxy udpproxyv3.UdpProxyConfig
+	if err := typedConfig.UnmarshalTo(&udpProxy); err != nil {
+		return nil, err
+	}
+	supported := &udpproxyv3.UdpProxyConfig{
+		StatPrefix:     udpProxy.GetStatPrefix(),
+		RouteSpecifier: &udpproxyv3.UdpProxyConfig_Cluster{Cluster: udpProxy.GetCluster()},
+		IdleTimeout:    udpProxy.GetIdleTimeout(),
+	}
+	converted := &config.UdpProxy{
+		Type:       typedConfig.GetTypeUrl(),
+		StatPrefix: udpProxy.GetStatPrefix(),
+		Cluster:    udpProxy.GetCluster(),
+	}
+	if udpProxy.GetIdleTimeout() != nil {
+		converted.IdleTimeout = udpProxy.GetIdleTimeout().AsDuration().String()
+	}
+	for _, hashPolicy := range udpProxy.GetHashPolicies() {
+		supported.HashPolicies = append(supported.HashPolicies, &udpproxyv3.UdpProxyConfig_HashPolicy{
+			PolicySpecifier: &udpproxyv3.UdpProxyConfig_HashPolicy_SourceIp{SourceIp: hashPolicy.GetSourceIp()},
+		})
+		converted.HashPolicies = append(converted.HashPolicies, config.UdpHashPolicy{SourceIP: hashPolicy.GetSourceIp()})
+	}
+	if !proto.Equal(&udpProxy, supported) {
+		return nil, errors.New("udp_proxy supports only stat_prefix, cluster, idle_timeout and source_ip hash_policies")
+	}
+	return converted, nil
+}
+
+// routeConfigNames returns the RDS route configs the listener's HTTP
+// connection managers refer to.
+func routeConfigNames(l *listenerv3.Listener) []string {
+	var names []string
+	for _, filterChain := range l.GetFilterChains() {
+		for _, filter := range filterChain.GetFilters() {
+			var hcm hcmv3.HttpConnectionManager
+			if filter.GetTypedConfig().UnmarshalTo(&hcm) != nil {
+				continue
+			}
+			if rds := hcm.GetRds(); rds != nil {
+				names = append(names, rds.GetRouteConfigName())
+			}
+		}
+	}
+	return names
+}
+
+func convertRouteConfig(rc *routev3.RouteConfiguration) (config.RouteConfiguration, error) {
+	converted := config.RouteConfiguration{Name: rc.GetName()}
+	for _, virtualHost := range rc.GetVirtualHosts() {
+		convertedHost := config.VirtualHost{Name: virtualHost.GetName(), Domains: virtualHost.GetDomains()}
+		var err error
+		if convertedHost.TypedPerFilterConfig, err = convertTypedConfigs(virtualHost.GetTypedPerFilterConfig()); err != nil {
+			return converted, fmt.Errorf("virtual host %q: %v", virtualHost.GetName(), err)
+		}
+		for _, route := range virtualHost.GetRoutes() {
+			var convertedRoute config.Route
+			if convertedRoute.TypedPerFilterConfig, err = convertTypedConfigs(route.GetTypedPerFilterConfig()); err != nil {
+				return converted, fmt.Errorf("virtual host %q: %v", virtualHost.GetName(), err)
+			}
+			prefix, ok := route.GetMatch().GetPathSpecifier().(*routev3.RouteMatch_Prefix)
+			if !ok {
+				return converted, fmt.Errorf("virtual host %q: only prefix route matches are supported", virtualHost.GetName())
+			}
+			convertedRoute.Match.Prefix = prefix.Prefix
+			for _, header := range route.GetMatch().GetHeaders() {
+				convertedHeader, err := convertHeaderMatcher(header)
+				if err != nil {
+					return converted, fmt.Errorf("virtual host %q: %v", virtualHost.GetName(), err)
+				}
+				convertedRoute.Match.Headers = append(convertedRoute.Match.Headers, convertedHeader)
+			}
+			if route.GetRoute().GetCluster() == "" {
+				return converted, fmt.Errorf("virtual host %q: only routes to a single cluster are supported", virtualHost.GetName())
+			}
+			convertedRoute.Route.Cluster = route.GetRoute().GetCluster()
+			for _, upgrade := range route.GetRoute().GetUpgradeConfigs() {
+				if upgrade.GetConnectConfig() != nil {
+					return converted, fmt.Errorf("virtual host %q: CONNECT upgrades are not supported", virtualHost.GetName())
+				}
+				convertedUpgrade := config.UpgradeConfig{UpgradeType: upgrade.GetUpgradeType()}
+				if upgrade.GetEnabled() != nil {
+					enabled := upgrade.GetEnabled().GetValue()
+					convertedUpgrade.Enabled = &enabled
+				}
+				convertedRoute.Route.UpgradeConfigs = append(convertedRoute.Route.UpgradeConfigs, convertedUpgrade)
+			}
+			if route.GetRoute().GetIdleTimeout() != nil {
+				convertedRoute.Route.IdleTimeout = route.GetRoute().GetIdleTimeout().AsDuration().String()
+			}
+			convertedHost.Routes = append(convertedHost.Routes, convertedRoute)
+		}
+		converted.VirtualHosts = append(converted.VirtualHosts, convertedHost)
+	}
+	return converted, nil
+}
+
+// convertTypedConfig turns a filter config into its YAML form, with field
+// names as they are written in config files.
+// convertNetworkFilter turns a network filter other than the HTTP connection
+// manager into config through its JSON form, so fields the config types have
+// no room for are rejected as they would be in a config file.
+func convertNetworkFilter(filter *listenerv3.Filter) (config.Filter, error) {
+	converted := config.Filter{Name: filter.GetName()}
+	switch filter.GetName() {
+	case config.TcpProxyFilter, config.RBACFilter:
+	case config.ConnectionLimitFilter:
+		// protojson writes 64-bit integers such as max_connections as
+		// strings, which do not decode into ints.
+		var connectionLimit connectionlimitv3.ConnectionLimit
+		if err := filter.GetTypedConfig().UnmarshalTo(&connectionLimit); err != nil {
+			return converted, err
+		}
+		converted.ConnectionLimit = &config.ConnectionLimit{
+			Type:           filter.GetTypedConfig().GetTypeUrl(),
+			StatPrefix:     connectionLimit.GetStatPrefix(),
+			MaxConnections: int(connectionLimit.GetMaxConnections().GetValue()),
+		}
+		if connectionLimit.GetDelay() != nil {
+			converted.ConnectionLimit.Delay = connectionLimit.GetDelay().AsDuration().String()
+		}
+		return converted, nil
+	default:
+		return converted, errors.New("unsupported network filter")
+	}
+
+	data, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(filter.GetTypedConfig())
+	if err != nil {
+		return converted, err
+	}
+	var typedConfig yaml.Node
+	if err := yaml.Unmarshal(data, &typedConfig); err != nil {
+		return converted, err
+	}
+	node := &yaml.Node{Kind: yaml.MappingNode, Content: []*yaml.Node{
+		{Kind: yaml.ScalarNode, Value: "name"},
+		{Kind: yaml.ScalarNode, Value: filter.GetName()},
+		{Kind: yaml.ScalarNode, Value: "typed_config"},
+		typedConfig.Content[0],
+	}}
+	err = node.Decode(&converted)
+	return converted, err
+}
+
+func convertTypedConfig(a *anypb.Any) (config.TypedConfig, error) {
+	var typedConfig config.TypedConfig
+	if a == nil {
+		return typedConfig, nil
+	}
+	data, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(a)
+	if err != nil {
+		return typedConfig, err
+	}
+	// JSON is YAML, so it decodes as it would from a config file.
+	err = yaml.Unmarshal(data, &typedConfig)
+	return typedConfig, err
+}
+
+func convertTypedConfigs(configs map[string]*anypb.Any) (map[string]config.TypedConfig, error) {
+	if len(configs) == 0 {
+		return nil, nil
+	}
+	converted := make(map[string]config.TypedConfig, len(configs))
+	for name, a := range configs {
+		typedConfig, err := convertTypedConfig(a)
+		if err != nil {
+			return nil, fmt.Errorf("typed_per_filter_config %q: %v", name, err)
+		}
+		converted[name] = typedConfig
+	}
+	return converted, nil
+}
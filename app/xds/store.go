@@ -0,0 +1,156 @@
+package xds
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	resourcev3 "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"google.golang.org/protobuf/proto"
+)
+
+// Store holds the dynamic resources from every source: the ADS stream and
+// each watched file. Every update is converted together with the rest and
+// handed to apply; an update that fails either step is dropped and the
+// resources from before it stay in place.
+type Store struct {
+	ctx   context.Context
+	apply func(Resources) error
+
+	mu sync.Mutex
+	// sources holds the accepted resources by source, type URL and name.
+	sources map[string]map[string]map[string]proto.Message
+	// edsFiles cancels the watch on each EDS file in use.
+	edsFiles map[string]context.CancelFunc
+	// staticEdsFiles are the EDS files of the EDS clusters in static_resources.
+	staticEdsFiles []string
+}
+
+// NewStore returns a store that applies updates with apply. Files are watched
+// until ctx is cancelled.
+func NewStore(ctx context.Context, apply func(Resources) error, staticEdsFiles []string) *Store {
+	return &Store{
+		ctx:            ctx,
+		apply:          apply,
+		sources:        make(map[string]map[string]map[string]proto.Message),
+		edsFiles:       make(map[string]context.CancelFunc),
+		staticEdsFiles: staticEdsFiles,
+	}
+}
+
+// Start watches the EDS files of the static clusters.
+func (s *Store) Start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.watchEdsFiles(nil)
+}
+
+// Update replaces the resources of typeURL that came from source.
+func (s *Store) Update(source, typeURL string, resources map[string]proto.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.update(source, typeURL, resources)
+}
+
+// updateFile is Update for a watched file. Once ctx is cancelled the file is
+// no longer used and late updates from it are dropped.
+func (s *Store) updateFile(ctx context.Context, path, typeURL string, resources map[string]proto.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ctx.Err() != nil {
+		return nil
+	}
+	return s.update(path, typeURL, resources)
+}
+
+func (s *Store) update(source, typeURL string, resources map[string]proto.Message) error {
+	candidate := make(map[string]map[string]map[string]proto.Message, len(s.sources)+1)
+	for name, byType := range s.sources {
+		candidate[name] = byType
+	}
+	byType := make(map[string]map[string]proto.Message, len(candidate[source])+1)
+	for t, r := range candidate[source] {
+		byType[t] = r
+	}
+	byType[typeURL] = resources
+	candidate[source] = byType
+
+	merged, err := mergeSources(candidate)
+	if err != nil {
+		return err
+	}
+	built, err := build(merged)
+	if err != nil {
+		return err
+	}
+	if err := s.apply(built); err != nil {
+		return err
+	}
+	s.sources = candidate
+	s.watchEdsFiles(merged[resourcev3.ClusterType])
+	return nil
+}
+
+// Resources returns the accepted resources of typeURL from every source.
+func (s *Store) Resources(typeURL string) map[string]proto.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	merged, _ := mergeSources(s.sources)
+	return merged[typeURL]
+}
+
+// mergeSources combines the resources of every source. A name may only come
+// from one source.
+func mergeSources(sources map[string]map[string]map[string]proto.Message) (map[string]map[string]proto.Message, error) {
+	merged := make(map[string]map[string]proto.Message)
+	from := make(map[string]string)
+	for _, source := range sortedKeys(sources) {
+		for typeURL, resources := range sources[source] {
+			if merged[typeURL] == nil {
+				merged[typeURL] = make(map[string]proto.Message)
+			}
+			for name, resource := range resources {
+				key := typeURL + "/" + name
+				if other, ok := from[key]; ok {
+					return nil, fmt.Errorf("%s %q comes from both %s and %s", typeURL, name, other, source)
+				}
+				from[key] = source
+				merged[typeURL][name] = resource
+			}
+		}
+	}
+	return merged, nil
+}
+
+// watchEdsFiles starts watching the EDS file of every cluster that has one and
+// stops watching files no cluster uses any more. It is called with mu held.
+func (s *Store) watchEdsFiles(clusters map[string]proto.Message) {
+	wanted := make(map[string]bool)
+	for _, path := range s.staticEdsFiles {
+		wanted[path] = true
+	}
+	for _, m := range clusters {
+		if path := m.(*clusterv3.Cluster).GetEdsClusterConfig().GetEdsConfig().GetPathConfigSource().GetPath(); path != "" {
+			wanted[path] = true
+		}
+	}
+
+	for path, cancel := range s.edsFiles {
+		if !wanted[path] {
+			cancel()
+			delete(s.edsFiles, path)
+			// The endpoints stay in the applied resources until the next
+			// update, but no cluster uses them any more.
+			delete(s.sources, path)
+		}
+	}
+	for path := range wanted {
+		if _, ok := s.edsFiles[path]; !ok {
+			ctx, cancel := context.WithCancel(s.ctx)
+			s.edsFiles[path] = cancel
+			go s.WatchFile(ctx, path, resourcev3.EndpointType)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package xds
+
+import (
+	"errors"
+	"fmt"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	tlsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"seateam/config"
+)
+
+// convertDownstreamTransportSocket turns the transport socket of a filter
+// chain into config. Only TLS, or QUIC with TLS, with certificates given as
+// files or inline, and client certificates verified against a CA and by
+// subject alternative name, is supported.
+func convertDownstreamTransportSocket(transportSocket *corev3.TransportSocket) (*config.DownstreamTransportSocket, error) {
+	switch transportSocket.GetName() {
+	case config.TLSTransportSocket:
+	case config.QuicTransportSocket:
+		return convertQuicTransportSocket(transportSocket)
+	default:
+		return nil, fmt.Errorf("unsupported transport socket %q", transportSocket.GetName())
+	}
+	var tlsContext tlsv3.DownstreamTlsContext
+	if err := transportSocket.GetTypedConfig().UnmarshalTo(&tlsContext); err != nil {
+		return nil, err
+	}
+	converted := &config.DownstreamTransportSocket{Name: transportSocket.GetName()}
+	var err error
+	if converted.TypedConfig, err = convertDownstreamTlsContext(&tlsContext); err != nil {
+		return nil, err
+	}
+	converted.TypedConfig.Type = transportSocket.GetTypedConfig().GetTypeUrl()
+	return converted, nil
+}
+
+func convertDownstreamTlsContext(tlsContext *tlsv3.DownstreamTlsContext) (config.DownstreamTlsContext, error) {
+	var converted config.DownstreamTlsContext
+	supported := &tlsv3.DownstreamTlsContext{CommonTlsContext: tlsContext.GetCommonTlsContext()}
+	if tlsContext.GetRequireClientCertificate() != nil {
+		supported.RequireClientCertificate = wrapperspb.Bool(tlsContext.GetRequireClientCertificate().GetValue())
+	}
+	if !proto.Equal(tlsContext, supported) {
+		return converted, errors.New("DownstreamTlsContext supports only common_tls_context and require_client_certificate")
+	}
+	common, err := convertCommonTlsContext(tlsContext.GetCommonTlsContext())
+	if err != nil {
+		return converted, err
+	}
+	converted.CommonTlsContext = common
+	converted.RequireClientCertificate = tlsContext.GetRequireClientCertificate().GetValue()
+	return converted, nil
+}
+
+// convertUpstreamTransportSocket turns the transport socket of a cluster into
+// config. Only TLS with common_tls_context and sni is supported.
+func convertUpstreamTransportSocket(transportSocket *corev3.TransportSocket) (*config.UpstreamTransportSocket, error) {
+	if transportSocket.GetName() != config.TLSTransportSocket {
+		return nil, fmt.Errorf("unsupported transport socket %q", transportSocket.GetName())
+	}
+	var tlsContext tlsv3.UpstreamTlsContext
+	if err := transportSocket.GetTypedConfig().UnmarshalTo(&tlsContext); err != nil {
+		return nil, err
+	}
+	if !proto.Equal(&tlsContext, &tlsv3.UpstreamTlsContext{CommonTlsContext: tlsContext.GetCommonTlsContext(), Sni: tlsContext.GetSni()}) {
+		return nil, errors.New("UpstreamTlsContext supports only common_tls_context and sni")
+	}
+	common, err := convertCommonTlsContext(tlsContext.GetCommonTlsContext())
+	if err != nil {
+		return nil, err
+	}
+	converted := &config.UpstreamTransportSocket{Name: transportSocket.GetName()}
+	converted.TypedConfig.Type = transportSocket.GetTypedConfig().GetTypeUrl()
+	converted.TypedConfig.CommonTlsContext = common
+	converted.TypedConfig.Sni = tlsContext.GetSni()
+	return converted, nil
+}
+
+func convertCommonTlsContext(common *tlsv3.CommonTlsContext) (config.CommonTlsContext, error) {
+	var converted config.CommonTlsContext
+	supported := &tlsv3.CommonTlsContext{AlpnProtocols: common.GetAlpnProtocols()}
+	if params := common.GetTlsParams(); params != nil {
+		supported.TlsParams = &tlsv3.TlsParameters{
+			TlsMinimumProtocolVersion: params.GetTlsMinimumProtocolVersion(),
+			TlsMaximumProtocolVersion: params.GetTlsMaximumProtocolVersion(),
+			CipherSuites:              params.GetCipherSuites(),
+		}
+		converted.TlsParams = config.TlsParams{
+			TlsMinimumProtocolVersion: tlsVersion(params.GetTlsMinimumProtocolVersion()),
+			TlsMaximumProtocolVersion: tlsVersion(params.GetTlsMaximumProtocolVersion()),
+			CipherSuites:              params.GetCipherSuites(),
+		}
+	}
+	for _, certificate := range common.GetTlsCertificates() {
+		supported.TlsCertificates = append(supported.TlsCertificates, &tlsv3.TlsCertificate{
+			CertificateChain: certificate.GetCertificateChain(),
+			PrivateKey:       certificate.GetPrivateKey(),
+		})
+		certificateChain, err := convertDataSource(certificate.GetCertificateChain())
+		if err != nil {
+			return converted, fmt.Errorf("certificate_chain: %v", err)
+		}
+		privateKey, err := convertDataSource(certificate.GetPrivateKey())
+		if err != nil {
+			return converted, fmt.Errorf("private_key: %v", err)
+		}
+		converted.TlsCertificates = append(converted.TlsCertificates, config.TlsCertificate{CertificateChain: certificateChain, PrivateKey: privateKey})
+	}
+	if validationContext := common.GetValidationContext(); validationContext != nil {
+		supported.ValidationContextType = &tlsv3.CommonTlsContext_ValidationContext{ValidationContext: &tlsv3.CertificateValidationContext{
+			TrustedCa:                 validationContext.GetTrustedCa(),
+			MatchTypedSubjectAltNames: validationContext.GetMatchTypedSubjectAltNames(),
+		}}
+		trustedCa, err := convertDataSource(validationContext.GetTrustedCa())
+		if err != nil {
+			return converted, fmt.Errorf("trusted_ca: %v", err)
+		}
+		converted.ValidationContext = &config.CertificateValidationContext{TrustedCa: trustedCa}
+		for _, matcher := range validationContext.GetMatchTypedSubjectAltNames() {
+			convertedMatcher, err := convertSubjectAltNameMatcher(matcher)
+			if err != nil {
+				return converted, fmt.Errorf("match_typed_subject_alt_names: %v", err)
+			}
+			converted.ValidationContext.MatchTypedSubjectAltNames = append(converted.ValidationContext.MatchTypedSubjectAltNames, convertedMatcher)
+		}
+	}
+	converted.AlpnProtocols = common.GetAlpnProtocols()
+	if !proto.Equal(common, supported) {
+		return converted, errors.New("common_tls_context supports only tls_params, tls_certificates, validation_context and alpn_protocols")
+	}
+	return converted, nil
+}
+
+// tlsVersion returns Envoy's name for version, or "" for TLS_AUTO.
+func tlsVersion(version tlsv3.TlsParameters_TlsProtocol) string {
+	if version == tlsv3.TlsParameters_TLS_AUTO {
+		return ""
+	}
+	return version.String()
+}
+
+func convertDataSource(source *corev3.DataSource) (config.DataSource, error) {
+	switch specifier := source.GetSpecifier().(type) {
+	case *corev3.DataSource_Filename:
+		return config.DataSource{Filename: specifier.Filename}, nil
+	case *corev3.DataSource_InlineString:
+		return config.DataSource{InlineString: specifier.InlineString}, nil
+	case *corev3.DataSource_InlineBytes:
+		return config.DataSource{InlineString: string(specifier.InlineBytes)}, nil
+	}
+	return config.DataSource{}, errors.New("only filename, inline_string and inline_bytes are supported")
+}